@@ -0,0 +1,240 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// checkpointConfigMapKey is the key of the resourceVersion in the ConfigMap
+const checkpointConfigMapKey = "resourceVersion"
+
+// CheckpointStore persists the checkpoint of the Checkpointer
+type CheckpointStore interface {
+	// Load returns the saved resourceVersion, "" if none
+	Load() (string, error)
+	Save(resourceVersion string) error
+}
+
+// fileCheckpointStore keeps the checkpoint in a file, e.g. on a persistent
+// volume
+type fileCheckpointStore struct {
+	path string
+}
+
+func (s fileCheckpointStore) Load() (string, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+func (s fileCheckpointStore) Save(resourceVersion string) error {
+	// Write atomically, a torn checkpoint would replay everything
+	tmp := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tmp, []byte(resourceVersion+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// configMapCheckpointStore keeps the checkpoint in a ConfigMap, created on
+// the first save
+type configMapCheckpointStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s configMapCheckpointStore) Load() (string, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return cm.Data[checkpointConfigMapKey], nil
+}
+
+func (s configMapCheckpointStore) Save(resourceVersion string) error {
+	cms := s.client.CoreV1().ConfigMaps(s.namespace)
+	cm, err := cms.Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = cms.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name},
+			Data:       map[string]string{checkpointConfigMapKey: resourceVersion},
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 1)
+	}
+	cm.Data[checkpointConfigMapKey] = resourceVersion
+	_, err = cms.Update(cm)
+	return err
+}
+
+/*
+Checkpointer keeps track of the resourceVersion of the last event handed to
+the sinks, and saves it periodically, so that after a restart the events the
+informer lists again are only forwarded when they are newer than the
+checkpoint: restarts don't replay the events to the sinks, and the events
+emitted while eventrouter was down are still forwarded, as long as they
+haven't expired.
+
+The resourceVersions are compared as the etcd revisions they are, events
+with a non numeric resourceVersion are always forwarded.
+
+The checkpoint moves when the events are handed to the sinks. On shutdown,
+it is saved for the last time once the sinks sent the events they hold, see
+sinks.Shutdown, and not at all if they don't within shutdown-timeout, the
+events handed since the last save being forwarded again. On a crash, the
+events still held in the sink queues, batches or the dedup window are not
+forwarded again, unless the disk queue holds them.
+*/
+type Checkpointer struct {
+	store    CheckpointStore
+	interval time.Duration
+
+	// resumeFrom is the checkpoint loaded on start
+	resumeFrom uint64
+
+	mu    sync.Mutex
+	last  uint64
+	saved uint64
+}
+
+// newCheckpointer creates the Checkpointer configured by viper, nil if
+// checkpointing is disabled. checkpoint-file or checkpoint-configmap, as
+// namespace/name, is the store, suffixed with the id of the event router,
+// its cluster and shard, when set.
+func newCheckpointer(kubeClient kubernetes.Interface, id string) *Checkpointer {
+	var store CheckpointStore
+	if path := viper.GetString("checkpoint-file"); path != "" {
+		if id != "" {
+			path += "." + id
+		}
+		store = fileCheckpointStore{path: path}
+	} else if ref := viper.GetString("checkpoint-configmap"); ref != "" {
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			panic("checkpoint-configmap must be namespace/name")
+		}
+		name := parts[1]
+		if id != "" {
+			name += "-" + id
+		}
+		store = configMapCheckpointStore{client: kubeClient, namespace: parts[0], name: name}
+	} else {
+		return nil
+	}
+
+	c, err := NewCheckpointer(store, viper.GetDuration("checkpoint-interval"))
+	if err != nil {
+		panic(err.Error())
+	}
+	return c
+}
+
+// NewCheckpointer creates a Checkpointer resuming from the checkpoint of the
+// store
+func NewCheckpointer(store CheckpointStore, interval time.Duration) (*Checkpointer, error) {
+	rv, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpointer{store: store, interval: interval}
+	if rv != "" {
+		if c.resumeFrom, err = strconv.ParseUint(rv, 10, 64); err != nil {
+			glog.Warningf("Ignoring invalid checkpoint %q: %v", rv, err)
+			c.resumeFrom = 0
+		}
+		glog.Infof("Resuming from resourceVersion %d", c.resumeFrom)
+	}
+	c.last, c.saved = c.resumeFrom, c.resumeFrom
+	return c, nil
+}
+
+// seen returns true if the event was handed to the sinks before the
+// restart, and records it as handed otherwise
+func (c *Checkpointer) seen(e *v1.Event) bool {
+	rv, err := strconv.ParseUint(e.ResourceVersion, 10, 64)
+	if err != nil {
+		return false
+	}
+	if rv <= c.resumeFrom {
+		return true
+	}
+
+	c.mu.Lock()
+	if rv > c.last {
+		c.last = rv
+	}
+	c.mu.Unlock()
+	return false
+}
+
+// Run saves the checkpoint every interval, until stopCh is closed. The last
+// save is left to the caller, once the sinks sent the events handed to them.
+func (c *Checkpointer) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.save()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// save saves the last resourceVersion, if it changed
+func (c *Checkpointer) save() {
+	c.mu.Lock()
+	last := c.last
+	c.mu.Unlock()
+	if last == c.saved {
+		return
+	}
+	if err := c.store.Save(strconv.FormatUint(last, 10)); err != nil {
+		glog.Errorf("Failed to save the checkpoint: %v", err)
+		return
+	}
+	c.saved = last
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// memoryCheckpointStore keeps the checkpoint in memory, counting the saves
+type memoryCheckpointStore struct {
+	resourceVersion string
+	saves           int
+}
+
+func (s *memoryCheckpointStore) Load() (string, error) {
+	return s.resourceVersion, nil
+}
+
+func (s *memoryCheckpointStore) Save(resourceVersion string) error {
+	s.resourceVersion = resourceVersion
+	s.saves++
+	return nil
+}
+
+func eventWithVersion(resourceVersion string) *v1.Event {
+	return &v1.Event{ObjectMeta: metav1.ObjectMeta{Name: "test", ResourceVersion: resourceVersion}}
+}
+
+func TestCheckpointerSeen(t *testing.T) {
+	c, err := NewCheckpointer(&memoryCheckpointStore{resourceVersion: "100"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		resourceVersion string
+		seen            bool
+	}{
+		{"99", true},
+		{"100", true},
+		{"101", false},
+		// The events listed again after the restart are compared to the
+		// checkpoint loaded, not to the last one handed
+		{"50", true},
+		{"abc", false},
+		{"", false},
+	} {
+		if seen := c.seen(eventWithVersion(tc.resourceVersion)); seen != tc.seen {
+			t.Errorf("Got seen %v for resourceVersion %q, want %v", seen, tc.resourceVersion, tc.seen)
+		}
+	}
+	if c.last != 101 {
+		t.Errorf("Got last resourceVersion %d, want 101", c.last)
+	}
+}
+
+func TestCheckpointerSave(t *testing.T) {
+	store := &memoryCheckpointStore{resourceVersion: "100"}
+	c, err := NewCheckpointer(store, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing new to save
+	c.save()
+	if store.saves != 0 {
+		t.Errorf("Got %d saves without new events, want none", store.saves)
+	}
+
+	c.seen(eventWithVersion("105"))
+	c.seen(eventWithVersion("103"))
+	c.save()
+	if store.resourceVersion != "105" || store.saves != 1 {
+		t.Errorf("Got checkpoint %q after %d saves, want 105 after 1", store.resourceVersion, store.saves)
+	}
+	c.save()
+	if store.saves != 1 {
+		t.Errorf("Got %d saves without new events, want 1", store.saves)
+	}
+}
+
+func TestCheckpointerInvalidCheckpoint(t *testing.T) {
+	c, err := NewCheckpointer(&memoryCheckpointStore{resourceVersion: "abc"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.seen(eventWithVersion("1")) {
+		t.Errorf("Got an event seen with an invalid checkpoint, want all of them forwarded")
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := fileCheckpointStore{path: filepath.Join(dir, "state", "checkpoint")}
+
+	if rv, err := store.Load(); err != nil || rv != "" {
+		t.Fatalf("Got checkpoint %q, %v without a file, want none", rv, err)
+	}
+	if err := store.Save("42"); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if rv, err := store.Load(); err != nil || rv != "42" {
+		t.Errorf("Got checkpoint %q, %v, want 42", rv, err)
+	}
+	if _, err := os.Stat(store.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Got the temporary file left after the save")
+	}
+}
+
+func TestEventRouterStoppedDoesNotCheckpoint(t *testing.T) {
+	c, err := NewCheckpointer(&memoryCheckpointStore{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once stopped, the events are neither handed to the sinks, there are
+	// none, nor recorded by the checkpoint saved after the sinks shut down
+	er := &EventRouter{checkpoint: c}
+	er.stopHandling()
+	er.addEvent(eventWithVersion("5"))
+	er.updateEvent(eventWithVersion("5"), eventWithVersion("6"))
+	if c.last != 0 {
+		t.Errorf("Got last resourceVersion %d after the stop, want none", c.last)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+// clusterConfig is a cluster to watch: the kubeconfig and context default
+// to the kubeconfig setting and its current context, else the in-cluster
+// config
+type clusterConfig struct {
+	Name       string `mapstructure:"name"`
+	Kubeconfig string `mapstructure:"kubeconfig"`
+	Context    string `mapstructure:"context"`
+}
+
+// clusterConfigs returns the clusters of the clusters setting, e.g.
+// [{"name": "prod-eu", "context": "prod-eu"}], their events tagged with the
+// cluster name; by default the single cluster, untagged
+func clusterConfigs() []clusterConfig {
+	var clusters []clusterConfig
+	if err := viper.UnmarshalKey("clusters", &clusters); err != nil {
+		panic(fmt.Sprintf("invalid clusters: %v", err))
+	}
+	if len(clusters) == 0 {
+		return []clusterConfig{{}}
+	}
+
+	names := make(map[string]bool, len(clusters))
+	for _, c := range clusters {
+		if c.Name == "" {
+			panic("clusters must have a name")
+		}
+		if names[c.Name] {
+			panic(fmt.Sprintf("duplicate cluster %s", c.Name))
+		}
+		names[c.Name] = true
+	}
+	return clusters
+}
+
+// staticLabelName is the syntax of the static label names, valid as both
+// Kubernetes and Prometheus label names
+var staticLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// staticLabels returns the labels of the static-labels setting, e.g.
+// {"cluster": "prod-eu", "environment": "prod", "region": "eu-west-1"}, set
+// on every event and on the event counters, so the events of the clusters
+// can be told apart downstream. The static labels override the labels of the
+// same name of the events; the names are lower-cased by the configuration.
+func staticLabels() map[string]string {
+	labels := viper.GetStringMapString("static-labels")
+	for name := range labels {
+		if !staticLabelName.MatchString(name) {
+			panic(fmt.Sprintf("invalid static label name %q", name))
+		}
+		for _, l := range eventMetricLabels {
+			if name == l {
+				panic(fmt.Sprintf("static label %s conflicts with the label of the event counters", name))
+			}
+		}
+	}
+	return labels
+}
@@ -18,6 +18,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -27,9 +29,7 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
-	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -38,122 +38,245 @@ var kubernetesNormalEventCounterVec *prometheus.CounterVec
 var kubernetesInfoEventCounterVec *prometheus.CounterVec
 var kubernetesUnknownEventCounterVec *prometheus.CounterVec
 
+// skippedObjectsCounterVec counts the objects the handlers skipped as they
+// aren't events, by handler
+var skippedObjectsCounterVec *prometheus.CounterVec
+
 // EventRouter is responsible for maintaining a stream of kubernetes
 // system Events and pushing them to another channel for storage
 type EventRouter struct {
 	// kubeclient is the main kubernetes interface
 	kubeClient kubernetes.Interface
 
-	// store of events populated by the shared informer
-	eLister corelisters.EventLister
-
-	// returns true if the event store has been synced
-	eListerSynched cache.InformerSynced
+	// return true once the event stores have been synced
+	eListerSynched []cache.InformerSynced
 
-	// event sink
-	// TODO: Determine if we want to support multiple sinks.
+	// event sink, a sinks.MultiSink fanning the events out when several
+	// sinks are configured
 	eSink sinks.EventSinkInterface
 
-	// Keeps track of the last time the SharedInformer executed a re-sync
+	// checkpoint, when set, skips the events handed to the sinks before a
+	// restart
+	checkpoint *Checkpointer
+
+	// shard, when set, skips the events of the other shards
+	shard *shardFilter
+
+	// owners, when set, resolves the top owners of the involved objects
+	owners *ownerResolver
+
+	// nodes, when set, resolves the node metadata of the involved objects
+	nodes *nodeResolver
+
+	// cluster, when set, is the name of the cluster, set as the clusterName
+	// of the events
+	cluster string
+
+	// labels are the static labels set on the events
+	labels map[string]string
+
+	// handling is read-locked by the handlers while they hand an event to
+	// the sinks, and stopped set once Run returns: the events the
+	// checkpoint records were all handed to the sinks by then
+	handling sync.RWMutex
+	stopped  bool
+
+	// Keeps track of the last time the SharedInformer executed a re-sync,
+	// guarded by resetMu as the informers of the namespaces run concurrently
+	resetMu   sync.Mutex
 	lastReset time.Time
 }
 
-// NewEventRouter will create a new event router using the input params
-func NewEventRouter(kubeClient kubernetes.Interface, eventsInformer coreinformers.EventInformer) *EventRouter {
+// NewEventRouter will create a new event router using the input params. The
+// informers watch either core/v1 or events.k8s.io events, see toCoreEvent,
+// of all the namespaces or one each.
+func NewEventRouter(kubeClient kubernetes.Interface, eventsInformers []cache.SharedIndexInformer, eSink sinks.EventSinkInterface, cluster string) *EventRouter {
+	er := &EventRouter{
+		kubeClient: kubeClient,
+		eSink:      eSink,
+		shard:      newShardFilter(),
+		cluster:    cluster,
+		labels:     staticLabels(),
+	}
+	if viper.GetBool("enrich-owners") {
+		er.owners = newOwnerResolver(kubeClient, viper.GetDuration("enrich-owners-ttl"))
+	}
+	if viper.GetBool("enrich-nodes") {
+		er.nodes = newNodeResolver(kubeClient, viper.GetDuration("enrich-nodes-ttl"), viper.GetStringSlice("enrich-node-pool-labels"))
+	}
+	// The shards keep a checkpoint each
+	id := cluster
+	if er.shard != nil {
+		id = strings.TrimPrefix(fmt.Sprintf("%s-shard-%d", cluster, er.shard.index), "-")
+	}
+	er.checkpoint = newCheckpointer(kubeClient, id)
+	for _, eventsInformer := range eventsInformers {
+		addFunc := er.addEvent
+		if viper.GetBool("skip-initial-list") {
+			addFunc = er.skipInitialList(eventsInformer.HasSynced)
+		}
+		eventsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    addFunc,
+			UpdateFunc: er.updateEvent,
+			DeleteFunc: er.deleteEvent,
+		})
+		er.eListerSynched = append(er.eListerSynched, eventsInformer.HasSynced)
+	}
+	return er
+}
+
+// eventMetricLabels are the labels of the event counters, besides the static
+// labels
+var eventMetricLabels = []string{
+	"involved_object_kind",
+	"involved_object_name",
+	"involved_object_namespace",
+	"reason",
+	"source",
+}
+
+// registerEventMetrics creates the event counters, registered with
+// enable-prometheus. It is called once, the counters are shared by the
+// event routers of the clusters.
+func registerEventMetrics() {
+	labels := prometheus.Labels(staticLabels())
 	kubernetesWarningEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%s_eventrouter_warnings_total", viper.GetString("metric-prefix")),
-		Help: "Total number of warning events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
+		Name:        fmt.Sprintf("%s_eventrouter_warnings_total", viper.GetString("metric-prefix")),
+		Help:        "Total number of warning events in the kubernetes cluster",
+		ConstLabels: labels,
+	}, eventMetricLabels)
 	kubernetesNormalEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%s_eventrouter_normal_total", viper.GetString("metric-prefix")),
-		Help: "Total number of normal events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
+		Name:        fmt.Sprintf("%s_eventrouter_normal_total", viper.GetString("metric-prefix")),
+		Help:        "Total number of normal events in the kubernetes cluster",
+		ConstLabels: labels,
+	}, eventMetricLabels)
 	kubernetesInfoEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%s_eventrouter_info_total", viper.GetString("metric_prefix")),
-		Help: "Total number of info events in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
+		Name:        fmt.Sprintf("%s_eventrouter_info_total", viper.GetString("metric_prefix")),
+		Help:        "Total number of info events in the kubernetes cluster",
+		ConstLabels: labels,
+	}, eventMetricLabels)
 	kubernetesUnknownEventCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%s_eventrouter_unknown_total", viper.GetString("metric-prefix")),
-		Help: "Total number of events of unknown type in the kubernetes cluster",
-	}, []string{
-		"involved_object_kind",
-		"involved_object_name",
-		"involved_object_namespace",
-		"reason",
-		"source",
-	})
+		Name:        fmt.Sprintf("%s_eventrouter_unknown_total", viper.GetString("metric-prefix")),
+		Help:        "Total number of events of unknown type in the kubernetes cluster",
+		ConstLabels: labels,
+	}, eventMetricLabels)
+	skippedObjectsCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        fmt.Sprintf("%s_eventrouter_skipped_objects_total", viper.GetString("metric-prefix")),
+		Help:        "Total number of objects handed to the event handlers that are not events",
+		ConstLabels: labels,
+	}, []string{"handler"})
 
 	if viper.GetBool("enable-prometheus") {
+		prometheus.MustRegister(skippedObjectsCounterVec)
 		prometheus.MustRegister(kubernetesWarningEventCounterVec)
 		prometheus.MustRegister(kubernetesNormalEventCounterVec)
 		prometheus.MustRegister(kubernetesInfoEventCounterVec)
 		prometheus.MustRegister(kubernetesUnknownEventCounterVec)
 	}
-
-	er := &EventRouter{
-		kubeClient: kubeClient,
-		eSink:      sinks.ManufactureSink(),
-	}
-	eventsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    er.addEvent,
-		UpdateFunc: er.updateEvent,
-		DeleteFunc: er.deleteEvent,
-	})
-	er.eLister = eventsInformer.Lister()
-	er.eListerSynched = eventsInformer.Informer().HasSynced
-	return er
 }
 
-// Run starts the EventRouter/Controller.
+// Run starts the EventRouter/Controller. The events handed afterwards are
+// dropped, and the checkpoint is saved periodically but not on stop, see
+// saveCheckpoint.
 func (er *EventRouter) Run(stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer glog.Infof("Shutting down EventRouter")
+	defer er.stopHandling()
 
 	glog.Infof("Starting EventRouter")
 
 	// here is where we kick the caches into gear
-	if !cache.WaitForCacheSync(stopCh, er.eListerSynched) {
+	if !cache.WaitForCacheSync(stopCh, er.eListerSynched...) {
 		utilruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 		return
 	}
-	<-stopCh
+	if er.checkpoint != nil {
+		er.checkpoint.Run(stopCh)
+	} else {
+		<-stopCh
+	}
+}
+
+// handle read-locks er.handling for a handler, returning false, unlocked,
+// once the EventRouter stopped
+func (er *EventRouter) handle() bool {
+	er.handling.RLock()
+	if er.stopped {
+		er.handling.RUnlock()
+		return false
+	}
+	return true
+}
+
+// stopHandling waits for the handlers handing an event, and stops the
+// others
+func (er *EventRouter) stopHandling() {
+	er.handling.Lock()
+	er.stopped = true
+	er.handling.Unlock()
+}
+
+// saveCheckpoint saves the checkpoint for the last time, once the sinks sent
+// the events handed to them
+func (er *EventRouter) saveCheckpoint() {
+	if er.checkpoint != nil {
+		er.checkpoint.save()
+	}
 }
 
 // addEvent is called when an event is created, or during the initial list
 func (er *EventRouter) addEvent(obj interface{}) {
-	e := obj.(*v1.Event)
+	if !er.handle() {
+		return
+	}
+	defer er.handling.RUnlock()
+	e, ok := er.coreEvent("add", obj)
+	if !ok {
+		return
+	}
+	if er.shard != nil && !er.shard.owns(e) {
+		return
+	}
+	if er.checkpoint != nil && er.checkpoint.seen(e) {
+		return
+	}
+	e = er.enrich(e)
 	prometheusEvent(e)
 	er.eSink.UpdateEvents(e, nil)
 }
 
+// skipInitialList returns an addEvent treating the events of the initial list
+// of an informer as already known: they aren't forwarded until it has synced,
+// the events created afterwards are
+func (er *EventRouter) skipInitialList(hasSynced cache.InformerSynced) func(obj interface{}) {
+	return func(obj interface{}) {
+		if !hasSynced() {
+			glog.V(5).Info("Skipping event of the initial list")
+			return
+		}
+		er.addEvent(obj)
+	}
+}
+
 // updateEvent is called any time there is an update to an existing event
 func (er *EventRouter) updateEvent(objOld interface{}, objNew interface{}) {
-	eOld := objOld.(*v1.Event)
-	eNew := objNew.(*v1.Event)
+	if !er.handle() {
+		return
+	}
+	defer er.handling.RUnlock()
+	eOld, okOld := er.coreEvent("update", objOld)
+	eNew, okNew := er.coreEvent("update", objNew)
+	if !okOld || !okNew {
+		return
+	}
 
 	// Detect if the Informer is in resync
 	// In a re-sync previous events are re-submitted as updateEvents, which means  ResourceVersions will match between the eOld and eNew.
 	// Since there could be legitimate k8s reasons to re-emit an event, we also check to see if the last
 	// time vectors reset was at least X time ago as indicated by the resync interval.
 	if eOld.ResourceVersion == eNew.ResourceVersion {
+		er.resetMu.Lock()
+		defer er.resetMu.Unlock()
 		if er.lastReset.IsZero() || time.Since(er.lastReset) >= viper.GetDuration("resync-interval") {
 			glog.Info("Time since last reset: ", time.Since(er.lastReset))
 			er.lastReset = time.Now()
@@ -167,10 +290,63 @@ func (er *EventRouter) updateEvent(objOld interface{}, objNew interface{}) {
 		return
 	}
 
+	if er.shard != nil && !er.shard.owns(eNew) {
+		return
+	}
+	if er.checkpoint != nil && er.checkpoint.seen(eNew) {
+		return
+	}
+	eOld, eNew = er.enrich(eOld), er.enrich(eNew)
 	prometheusEvent(eNew)
 	er.eSink.UpdateEvents(eNew, eOld)
 }
 
+// enrich sets the cluster name, the static labels, the top owner and the node
+// metadata of the event, on a copy as the informer cache owns the event
+func (er *EventRouter) enrich(e *v1.Event) *v1.Event {
+	if er.cluster == "" && len(er.labels) == 0 && er.owners == nil && er.nodes == nil {
+		return e
+	}
+	e = e.DeepCopy()
+	e.ClusterName = er.cluster
+	if len(er.labels) > 0 {
+		if e.Labels == nil {
+			e.Labels = make(map[string]string, len(er.labels))
+		}
+		for k, v := range er.labels {
+			e.Labels[k] = v
+		}
+	}
+	if er.owners != nil && e.InvolvedObject.Name != "" {
+		top := er.owners.resolve(e.InvolvedObject)
+		if e.Annotations == nil {
+			e.Annotations = make(map[string]string, 2)
+		}
+		e.Annotations[ownerKindAnnotation] = top.kind
+		e.Annotations[ownerNameAnnotation] = top.name
+	}
+	if er.nodes != nil && e.InvolvedObject.Name != "" {
+		if node, ok := er.nodes.resolve(e.InvolvedObject); ok {
+			setAnnotation(e, nodeNameAnnotation, node.name)
+			setAnnotation(e, nodeZoneAnnotation, node.zone)
+			setAnnotation(e, nodeInstanceTypeAnnotation, node.instanceType)
+			setAnnotation(e, nodePoolAnnotation, node.pool)
+		}
+	}
+	return e
+}
+
+// setAnnotation sets the annotation of the event, unless the value is empty
+func setAnnotation(e *v1.Event, key, value string) {
+	if value == "" {
+		return
+	}
+	if e.Annotations == nil {
+		e.Annotations = make(map[string]string)
+	}
+	e.Annotations[key] = value
+}
+
 // prometheusEvent is called when an event is added or updated
 func prometheusEvent(event *v1.Event) {
 	if !viper.GetBool("enable-prometheus") {
@@ -224,8 +400,41 @@ func prometheusEvent(event *v1.Event) {
 
 // deleteEvent should only occur when the system garbage collects events via TTL expiration
 func (er *EventRouter) deleteEvent(obj interface{}) {
-	e := obj.(*v1.Event)
-	// NOTE: This should *only* happen on TTL expiration there
-	// is no reason to push this to a sink
-	glog.V(5).Infof("Event Deleted from the system:\n%v", e)
+	glog.V(5).Infof("Event Deleted from the system:\n%v", obj)
+
+	// The deletes are only forwarded to the sinks with <sink>ForwardDeletes,
+	// as DELETED tombstone records. The deletes the watch missed come as
+	// tombstones, with the last known state of the event.
+	if !sinks.ForwardDeletes() || !er.handle() {
+		return
+	}
+	defer er.handling.RUnlock()
+	e, ok := er.coreEvent("delete", obj)
+	if !ok {
+		return
+	}
+	if er.shard != nil && !er.shard.owns(e) {
+		return
+	}
+	// The tombstone records only keep the cluster of the enrichment
+	e = e.DeepCopy()
+	if er.cluster != "" {
+		e.ClusterName = er.cluster
+	}
+	if e.Annotations == nil {
+		e.Annotations = make(map[string]string, 1)
+	}
+	e.Annotations[sinks.DeletedAnnotation] = "true"
+	er.eSink.UpdateEvents(e, nil)
+}
+
+// coreEvent returns the object handed to a handler as a core/v1 event,
+// counting the objects that aren't events
+func (er *EventRouter) coreEvent(handler string, obj interface{}) (*v1.Event, bool) {
+	e, ok := toCoreEvent(obj)
+	if !ok {
+		glog.Warningf("Skipping unexpected object of type %T in the %s handler", obj, handler)
+		skippedObjectsCounterVec.WithLabelValues(handler).Inc()
+	}
+	return e, ok
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/heptiolabs/eventrouter/sinks"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// eventRoutesResource is the resource of the EventRoute custom resources, see
+// yaml/eventrouter-crds.yaml
+var eventRoutesResource = schema.GroupVersionResource{
+	Group:    "eventrouter.heptio.com",
+	Version:  "v1alpha1",
+	Resource: "eventroutes",
+}
+
+// eventRouteSpec is the spec of an EventRoute
+type eventRouteSpec struct {
+	// Sinks are the names of the EventSinks of the namespace of the
+	// EventRoute the events are routed to
+	Sinks []string `json:"sinks,omitempty"`
+	// ConfiguredSinks are the sink types of the configuration the events
+	// are routed to, only for the EventRoutes of the admin namespace
+	ConfiguredSinks []string `json:"configuredSinks,omitempty"`
+
+	// The events matching all the criteria are routed, of any namespace,
+	// type, reason and kind when not set
+	Namespaces []string `json:"namespaces,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	Reasons    []string `json:"reasons,omitempty"`
+	Kinds      []string `json:"kinds,omitempty"`
+	// Expression is a CEL expression the events must match as well
+	Expression string `json:"expression,omitempty"`
+}
+
+/*
+eventRouteController routes the events to the sinks by the EventRoute
+resources, so the routing can be declared along with the sinks, e.g. by the
+platform teams or the tenants of a cluster. The EventRoutes targeting a sink
+replace the routing rules of its configuration: the sink receives the events
+matching any of them.
+
+The EventRoutes outside of the admin namespace only route the events of their
+namespace, to the EventSinks of their namespace.
+*/
+type eventRouteController struct {
+	adminNamespace string
+
+	mu sync.Mutex
+	// generations are the generations of the applied EventRoutes, the
+	// EventRoutes failing to apply are left out to be retried on resync
+	generations map[string]int64
+}
+
+// runEventRouteController starts the controller of the EventRoutes of the
+// namespace, all of them for metav1.NamespaceAll, until stop is closed
+func runEventRouteController(cluster clusterConfig, namespace, adminNamespace string, stop <-chan struct{}) {
+	c := &eventRouteController{
+		adminNamespace: adminNamespace,
+		generations:    make(map[string]int64),
+	}
+	glog.Infof("Starting the EventRoute controller")
+	runResourceInformer(cluster, eventRoutesResource, namespace, c.apply, c.remove, stop)
+}
+
+// apply sets the rule of an EventRoute
+func (c *eventRouteController) apply(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		glog.Warningf("Skipping unexpected object of type %T in the EventRoute handler", obj)
+		return
+	}
+	name := u.GetNamespace() + "/" + u.GetName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation, ok := c.generations[name]; ok && generation == u.GetGeneration() {
+		return
+	}
+	delete(c.generations, name)
+
+	targets, rule, err := c.rule(u)
+	if err == nil {
+		err = sinks.SetEventRoute(name, targets, rule)
+	}
+	if err != nil {
+		glog.Errorf("Failed to apply EventRoute %s: %v", name, err)
+		return
+	}
+	c.generations[name] = u.GetGeneration()
+}
+
+// remove removes the rule of a deleted EventRoute
+func (c *eventRouteController) remove(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		glog.Warningf("Skipping unexpected object of type %T in the EventRoute handler", obj)
+		return
+	}
+	name := u.GetNamespace() + "/" + u.GetName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.generations, name)
+	sinks.RemoveEventRoute(name)
+}
+
+// rule returns the names of the sinks an EventRoute targets, and its rule
+func (c *eventRouteController) rule(u *unstructured.Unstructured) ([]string, sinks.EventRule, error) {
+	var spec eventRouteSpec
+	var rule sinks.EventRule
+	obj, _, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		return nil, rule, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &spec); err != nil {
+		return nil, rule, err
+	}
+
+	namespace := u.GetNamespace()
+	if namespace != c.adminNamespace {
+		if len(spec.ConfiguredSinks) > 0 {
+			return nil, rule, fmt.Errorf("only the EventRoutes of namespace %s route to the configured sinks", c.adminNamespace)
+		}
+		for _, ns := range spec.Namespaces {
+			if ns != namespace {
+				return nil, rule, fmt.Errorf("routes the events of namespace %s, only those of namespace %s are allowed", ns, namespace)
+			}
+		}
+		spec.Namespaces = []string{namespace}
+	}
+
+	// The sinks of the EventSinks are named after their namespace and name
+	targets := make([]string, 0, len(spec.Sinks)+len(spec.ConfiguredSinks))
+	for _, sink := range spec.Sinks {
+		targets = append(targets, namespace+"/"+sink)
+	}
+	targets = append(targets, spec.ConfiguredSinks...)
+	if len(targets) == 0 {
+		return nil, rule, fmt.Errorf("no sinks")
+	}
+
+	rule.Filter = sinks.EventFilter{
+		Types:      spec.Types,
+		Reasons:    spec.Reasons,
+		Namespaces: spec.Namespaces,
+		Kinds:      spec.Kinds,
+	}
+	if spec.Expression != "" {
+		f, err := sinks.NewCELFilter(spec.Expression)
+		if err != nil {
+			return nil, rule, err
+		}
+		rule.Expression = f
+	}
+	return targets, rule, nil
+}
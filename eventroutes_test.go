@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newTestResource(kind, namespace string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "eventrouter.heptio.com/v1alpha1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "test", "namespace": namespace},
+		"spec":       spec,
+	}}
+}
+
+func TestEventRouteTenantNamespace(t *testing.T) {
+	c := &eventRouteController{adminNamespace: "kube-system"}
+
+	// The EventRoutes of a tenant only route the events of its namespace
+	targets, rule, err := c.rule(newTestResource("EventRoute", "team-a", map[string]interface{}{
+		"sinks": []interface{}{"alerts"},
+		"types": []interface{}{"Warning"},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to get the rule: %v", err)
+	}
+	if !reflect.DeepEqual(targets, []string{"team-a/alerts"}) {
+		t.Errorf("Got sinks %v, want the EventSink of the namespace", targets)
+	}
+	if !reflect.DeepEqual(rule.Filter.Namespaces, []string{"team-a"}) {
+		t.Errorf("Got namespaces %v, want the namespace of the EventRoute", rule.Filter.Namespaces)
+	}
+
+	for name, spec := range map[string]map[string]interface{}{
+		"other namespace": {
+			"sinks":      []interface{}{"alerts"},
+			"namespaces": []interface{}{"team-b"},
+		},
+		"configured sinks": {
+			"configuredSinks": []interface{}{"kafka"},
+		},
+		"no sinks": {},
+	} {
+		if _, _, err := c.rule(newTestResource("EventRoute", "team-a", spec)); err == nil {
+			t.Errorf("Got no error for an EventRoute of a tenant with %s", name)
+		}
+	}
+}
+
+func TestEventRouteAdminNamespace(t *testing.T) {
+	c := &eventRouteController{adminNamespace: "kube-system"}
+
+	targets, rule, err := c.rule(newTestResource("EventRoute", "kube-system", map[string]interface{}{
+		"sinks":           []interface{}{"audit"},
+		"configuredSinks": []interface{}{"kafka"},
+		"namespaces":      []interface{}{"team-a", "team-b"},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to get the rule: %v", err)
+	}
+	if !reflect.DeepEqual(targets, []string{"kube-system/audit", "kafka"}) {
+		t.Errorf("Got sinks %v, want the EventSink and the configured sink", targets)
+	}
+	if !reflect.DeepEqual(rule.Filter.Namespaces, []string{"team-a", "team-b"}) {
+		t.Errorf("Got namespaces %v, want those of the EventRoute", rule.Filter.Namespaces)
+	}
+}
+
+func TestEventSinkTenantNamespace(t *testing.T) {
+	c := &eventSinkController{adminNamespace: "kube-system"}
+
+	// The route namespaces of a tenant sink are forced to its namespace,
+	// whatever their case
+	spec, settings, err := c.settings(newTestResource("EventSink", "team-a", map[string]interface{}{
+		"type": "http",
+		"settings": map[string]interface{}{
+			"httpSinkUrl":         "https://example.com",
+			"httpRouteNamespaces": []interface{}{"team-b"},
+			"HTTPROUTENAMESPACES": []interface{}{"team-c"},
+			"httpSinkBufferSize":  int64(100),
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to get the settings: %v", err)
+	}
+	if spec.Type != "http" {
+		t.Errorf("Got type %q, want http", spec.Type)
+	}
+	want := map[string]interface{}{
+		"httpSinkUrl":         "https://example.com",
+		"httpSinkBufferSize":  int64(100),
+		"httpRouteNamespaces": []string{"team-a"},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("Got settings %v, want %v", settings, want)
+	}
+
+	for name, s := range map[string]map[string]interface{}{
+		"setting of another sink type": {"kafkaBrokers": "kafka:9092"},
+		"filesystem path":              {"httpSinkTLSCAFile": "/var/run/secrets/token"},
+	} {
+		_, _, err := c.settings(newTestResource("EventSink", "team-a", map[string]interface{}{
+			"type":     "http",
+			"settings": s,
+		}))
+		if err == nil {
+			t.Errorf("Got no error for an EventSink of a tenant with a %s", name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1beta1 "k8s.io/api/events/v1beta1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// coreEventsAPI and eventsAPI are the values of events-api
+	coreEventsAPI = "core/v1"
+	eventsAPI     = "events.k8s.io/v1beta1"
+)
+
+// eventsInformer returns the informer of the events of the API, core/v1 or
+// events.k8s.io/v1beta1
+func eventsInformer(sharedInformers informers.SharedInformerFactory, api string) (cache.SharedIndexInformer, error) {
+	switch api {
+	case "", coreEventsAPI:
+		return sharedInformers.Core().V1().Events().Informer(), nil
+	case eventsAPI:
+		return sharedInformers.Events().V1beta1().Events().Informer(), nil
+	default:
+		return nil, fmt.Errorf("invalid events-api %q, must be %s or %s", api, coreEventsAPI, eventsAPI)
+	}
+}
+
+// toCoreEvent returns the event the informer watches as a core/v1 event, the
+// sinks only handle those, unwrapping the tombstones of the deletes the watch
+// missed. It returns false for the objects that aren't events.
+func toCoreEvent(obj interface{}) (*v1.Event, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	switch e := obj.(type) {
+	case *v1.Event:
+		return e, true
+	case *eventsv1beta1.Event:
+		return fromEventsAPI(e), true
+	default:
+		return nil, false
+	}
+}
+
+// fromEventsAPI maps an events.k8s.io event to a core/v1 event: the note is
+// the message, the regarding object the involved object, and the series and
+// reporting fields, which core/v1 has too, are kept. The count and
+// timestamps fall back from the series to the deprecated fields and the
+// event time.
+func fromEventsAPI(e *eventsv1beta1.Event) *v1.Event {
+	ce := &v1.Event{
+		ObjectMeta:     e.ObjectMeta,
+		InvolvedObject: e.Regarding,
+		Related:        e.Related,
+		Reason:         e.Reason,
+		Message:        e.Note,
+		Type:           e.Type,
+		Action:         e.Action,
+		Source:         e.DeprecatedSource,
+		EventTime:      e.EventTime,
+
+		ReportingController: e.ReportingController,
+		ReportingInstance:   e.ReportingInstance,
+
+		FirstTimestamp: e.DeprecatedFirstTimestamp,
+		LastTimestamp:  e.DeprecatedLastTimestamp,
+		Count:          e.DeprecatedCount,
+	}
+	if ce.Source.Component == "" {
+		ce.Source.Component = e.ReportingController
+	}
+
+	if e.Series != nil {
+		ce.Series = &v1.EventSeries{
+			Count:            e.Series.Count,
+			LastObservedTime: e.Series.LastObservedTime,
+			State:            v1.EventSeriesState(e.Series.State),
+		}
+		ce.Count = e.Series.Count
+		if ce.LastTimestamp.IsZero() {
+			ce.LastTimestamp.Time = e.Series.LastObservedTime.Time
+		}
+	}
+	if ce.Count == 0 {
+		ce.Count = 1
+	}
+	if ce.FirstTimestamp.IsZero() {
+		ce.FirstTimestamp.Time = e.EventTime.Time
+	}
+	if ce.LastTimestamp.IsZero() {
+		ce.LastTimestamp.Time = e.EventTime.Time
+	}
+	return ce
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/heptiolabs/eventrouter/sinks"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// eventSinksResource is the resource of the EventSink custom resources, see
+// yaml/eventrouter-crds.yaml
+var eventSinksResource = schema.GroupVersionResource{
+	Group:    "eventrouter.heptio.com",
+	Version:  "v1alpha1",
+	Resource: "eventsinks",
+}
+
+// eventSinksResync is the resync period of the EventSinks and EventRoutes,
+// retrying those that failed to apply, e.g. on a missing secret
+const eventSinksResync = time.Minute
+
+// eventSinkSpec is the spec of an EventSink
+type eventSinkSpec struct {
+	// Type is the sink type, e.g. http
+	Type string `json:"type"`
+	// Settings are the configuration keys of the sink, e.g. httpSinkUrl
+	Settings map[string]interface{} `json:"settings,omitempty"`
+	// SecretRefs set configuration keys from the secrets of the namespace
+	// of the EventSink
+	SecretRefs []eventSinkSecretRef `json:"secretRefs,omitempty"`
+}
+
+// eventSinkSecretRef sets the configuration key Setting to the Key of the
+// secret SecretName
+type eventSinkSecretRef struct {
+	Setting    string `json:"setting"`
+	SecretName string `json:"secretName"`
+	Key        string `json:"key"`
+}
+
+/*
+eventSinkController adds the sinks declared by the EventSink resources to the
+configured sinks, and removes them with their EventSink, so the sinks can be
+managed as cluster resources rather than in the mounted configuration. The
+sink of an EventSink is named after its namespace and name, e.g. for the
+sink metrics, and replaced when its spec changes. The referenced secrets are
+read when the sink is created, their changes apply on the next change of the
+EventSink.
+
+The sinks of the EventSinks outside of the admin namespace only receive the
+events of their namespace, for the tenants to declare their own sinks, and
+only take the settings of their sink type but the filesystem paths. They
+don't inherit the configuration of their sink type, e.g. its credentials.
+*/
+type eventSinkController struct {
+	client         kubernetes.Interface
+	adminNamespace string
+
+	mu sync.Mutex
+	// generations are the generations of the applied EventSinks, the
+	// EventSinks failing to apply are left out to be retried on resync
+	generations map[string]int64
+}
+
+// runEventSinkController starts the controller of the EventSinks of the
+// namespace, all of them for metav1.NamespaceAll, until stop is closed
+func runEventSinkController(cluster clusterConfig, namespace, adminNamespace string, stop <-chan struct{}) {
+	c := &eventSinkController{
+		client:         newClientset(cluster),
+		adminNamespace: adminNamespace,
+		generations:    make(map[string]int64),
+	}
+	glog.Infof("Starting the EventSink controller")
+	runResourceInformer(cluster, eventSinksResource, namespace, c.apply, c.remove, stop)
+}
+
+// runResourceInformer starts an informer of the custom resources of the
+// namespace, handing the added and updated resources to apply and the deleted
+// ones to remove, until stop is closed
+func runResourceInformer(cluster clusterConfig, resource schema.GroupVersionResource, namespace string, apply, remove func(obj interface{}), stop <-chan struct{}) {
+	dynamicClient, err := dynamic.NewForConfig(newClientConfig(cluster))
+	if err != nil {
+		panic(err.Error())
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, eventSinksResync, namespace, nil)
+	informer := factory.ForResource(resource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    apply,
+		UpdateFunc: func(_, obj interface{}) { apply(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			remove(obj)
+		},
+	})
+	factory.Start(stop)
+}
+
+// apply creates or replaces the sink of an EventSink
+func (c *eventSinkController) apply(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		glog.Warningf("Skipping unexpected object of type %T in the EventSink handler", obj)
+		return
+	}
+	name := u.GetNamespace() + "/" + u.GetName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation, ok := c.generations[name]; ok && generation == u.GetGeneration() {
+		return
+	}
+	delete(c.generations, name)
+
+	spec, settings, err := c.settings(u)
+	if err == nil {
+		if u.GetNamespace() != c.adminNamespace {
+			err = sinks.AddTenantSink(name, spec.Type, settings)
+		} else {
+			err = sinks.AddSink(name, spec.Type, settings)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Failed to apply EventSink %s: %v", name, err)
+		return
+	}
+	c.generations[name] = u.GetGeneration()
+}
+
+// remove removes the sink of a deleted EventSink
+func (c *eventSinkController) remove(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		glog.Warningf("Skipping unexpected object of type %T in the EventSink handler", obj)
+		return
+	}
+	name := u.GetNamespace() + "/" + u.GetName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.generations, name)
+	sinks.RemoveSink(name)
+}
+
+// settings returns the spec of an EventSink and the settings of its sink,
+// with the referenced secrets
+func (c *eventSinkController) settings(u *unstructured.Unstructured) (eventSinkSpec, map[string]interface{}, error) {
+	var spec eventSinkSpec
+	obj, _, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		return spec, nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &spec); err != nil {
+		return spec, nil, err
+	}
+	if spec.Type == "" {
+		return spec, nil, fmt.Errorf("no sink type")
+	}
+
+	settings := make(map[string]interface{}, len(spec.Settings)+len(spec.SecretRefs))
+	for k, v := range spec.Settings {
+		settings[k] = v
+	}
+	for _, ref := range spec.SecretRefs {
+		if ref.Setting == "" || ref.SecretName == "" || ref.Key == "" {
+			return spec, nil, fmt.Errorf("secret reference without setting, secret name or key")
+		}
+		secret, err := c.client.CoreV1().Secrets(u.GetNamespace()).Get(ref.SecretName, metav1.GetOptions{})
+		if err != nil {
+			return spec, nil, fmt.Errorf("failed to get secret %s: %v", ref.SecretName, err)
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return spec, nil, fmt.Errorf("secret %s has no key %s", ref.SecretName, ref.Key)
+		}
+		settings[ref.Setting] = string(value)
+	}
+	if u.GetNamespace() != c.adminNamespace {
+		for k, v := range settings {
+			if err := checkTenantSetting(spec.Type, k, v); err != nil {
+				return spec, nil, err
+			}
+		}
+		// The settings are case insensitive
+		key := spec.Type + "RouteNamespaces"
+		for k := range settings {
+			if strings.EqualFold(k, key) {
+				delete(settings, k)
+			}
+		}
+		settings[key] = []string{u.GetNamespace()}
+	}
+	return spec, settings, nil
+}
+
+// tenantPathSetting matches the settings of filesystem paths, e.g.
+// logfilePath or kafkaTLSCAFile
+var tenantPathSetting = regexp.MustCompile(`(?i)(file|path)$`)
+
+// checkTenantSetting fails on the settings the EventSinks outside of the
+// admin namespace may not set: those of the other sink types and of the
+// router, and the filesystem paths, which could point at e.g. the checkpoint
+// file, the disk queue or the service account token
+func checkTenantSetting(sinkType, key string, value interface{}) error {
+	if !strings.HasPrefix(strings.ToLower(key), strings.ToLower(sinkType)) {
+		return fmt.Errorf("setting %s is not a setting of sink type %s", key, sinkType)
+	}
+	if tenantPathSetting.MatchString(key) {
+		return fmt.Errorf("setting %s is a filesystem path", key)
+	}
+	// The unix sockets are filesystem paths too
+	if strings.EqualFold(key, "socketNetwork") && strings.HasPrefix(fmt.Sprint(value), "unix") {
+		return fmt.Errorf("setting %s is a unix socket", key)
+	}
+	return nil
+}
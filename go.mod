@@ -3,22 +3,40 @@ module github.com/heptiolabs/eventrouter
 go 1.12
 
 require (
+	cloud.google.com/go/bigquery v1.8.0
+	cloud.google.com/go/pubsub v1.4.0
+	cloud.google.com/go/storage v1.8.0
+	github.com/Azure/azure-amqp-common-go/v2 v2.1.0
 	github.com/Azure/azure-event-hubs-go/v2 v2.0.3
+	github.com/Azure/go-autorest v12.0.0+incompatible
 	github.com/Shopify/sarama v1.23.1
+	github.com/apache/pulsar-client-go v0.1.0
 	github.com/aws/aws-sdk-go v1.23.2
 	github.com/crewjam/rfc5424 v0.0.0-20180723152949-c25bdd3a0ba2
 	github.com/eapache/channels v1.1.0
+	github.com/eclipse/paho.golang v0.9.0
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/google/cel-go v0.4.2
 	github.com/google/uuid v1.1.1
 	github.com/imdario/mergo v0.3.7 // indirect
 	github.com/influxdata/influxdb v1.7.7
 	github.com/json-iterator/go v1.1.7
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/klauspost/compress v1.9.2
+	github.com/linkedin/goavro/v2 v2.9.7
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/nytlabs/gojsonexplode v0.0.0-20160201065013-0f3fe6bb573f
 	github.com/prometheus/client_golang v1.1.0
-	github.com/rockset/rockset-go-client v0.6.0
-	github.com/sethgrid/pester v0.0.0-20190127155807-68a33a018ad0
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/viper v1.4.0
+	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
+	google.golang.org/api v0.25.0
+	google.golang.org/genproto v0.0.0-20200528110217-3d3490e7e671
+	google.golang.org/protobuf v1.24.0
 	gopkg.in/jcmturner/goidentity.v3 v3.0.0 // indirect
 	k8s.io/api v0.0.0-20190814101207-0772a1bdf941
 	k8s.io/apimachinery v0.0.0-20190814100815-533d101be9a6
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1beta1 "k8s.io/api/events/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// lastAppliedAnnotation is the bulky annotation of kubectl apply
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// stripMetadata drops the managedFields and the last applied configuration
+// of the object, which the sinks don't need
+func stripMetadata(obj runtime.Object) {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	m.SetManagedFields(nil)
+	if annotations := m.GetAnnotations(); annotations[lastAppliedAnnotation] != "" {
+		delete(annotations, lastAppliedAnnotation)
+		m.SetAnnotations(annotations)
+	}
+}
+
+// transformListWatch applies the transform to the objects listed and watched,
+// before they reach the informer cache: client-go doesn't have the
+// TransformFunc of the informers yet
+func transformListWatch(lw cache.ListerWatcher, transform func(runtime.Object)) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list, err := lw.List(options)
+			if err != nil {
+				return nil, err
+			}
+			if err := meta.EachListItem(list, func(obj runtime.Object) error {
+				transform(obj)
+				return nil
+			}); err != nil {
+				glog.Warningf("Failed to transform the listed objects: %v", err)
+			}
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(options)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				if e.Type != watch.Error && e.Object != nil {
+					transform(e.Object)
+				}
+				return e, true
+			}), nil
+		},
+	}
+}
+
+// strippedEventsInformer returns the informer of the events of the API, as
+// eventsInformer does, with the metadata stripped before the events enter the
+// cache, to save memory in clusters with many events
+func strippedEventsInformer(sharedInformers informers.SharedInformerFactory, namespace string, tweakListOptions func(*metav1.ListOptions), api string) (cache.SharedIndexInformer, error) {
+	var obj runtime.Object
+	var newListWatch func(client kubernetes.Interface) cache.ListerWatcher
+	switch api {
+	case "", coreEventsAPI:
+		obj = &v1.Event{}
+		newListWatch = func(client kubernetes.Interface) cache.ListerWatcher {
+			return &cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					tweakListOptions(&options)
+					return client.CoreV1().Events(namespace).List(options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					tweakListOptions(&options)
+					return client.CoreV1().Events(namespace).Watch(options)
+				},
+			}
+		}
+	case eventsAPI:
+		obj = &eventsv1beta1.Event{}
+		newListWatch = func(client kubernetes.Interface) cache.ListerWatcher {
+			return &cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					tweakListOptions(&options)
+					return client.EventsV1beta1().Events(namespace).List(options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					tweakListOptions(&options)
+					return client.EventsV1beta1().Events(namespace).Watch(options)
+				},
+			}
+		}
+	default:
+		// eventsInformer reports the invalid API
+		return eventsInformer(sharedInformers, api)
+	}
+
+	// The factory keeps this informer as the informer of the events
+	return sharedInformers.InformerFor(obj, func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		return cache.NewSharedIndexInformer(
+			transformListWatch(newListWatch(client), stripMetadata),
+			obj,
+			resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	}), nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runLeaderElected runs the event routers while this replica holds the
+// leader-elect-lease Lease, namespace/name, so that of several replicas only
+// the leader forwards events. It returns once stopped or the lease is lost,
+// the event routers being stopped: the replica exits and runs for the lease
+// again after its restart. With a checkpoint-configmap, the new leader
+// resumes from the checkpoint of the previous one.
+func runLeaderElected(kubeClient kubernetes.Interface, stop <-chan struct{}, run func(stop <-chan struct{})) {
+	ref := viper.GetString("leader-elect-lease")
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		panic("leader-elect-lease must be namespace/name")
+	}
+	id, err := os.Hostname()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{Namespace: parts[0], Name: parts[1]},
+		Client:    kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+	glog.Infof("Running for the lease %s as %s", ref, id)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   viper.GetDuration("leader-elect-lease-duration"),
+		RenewDeadline:   viper.GetDuration("leader-elect-renew-deadline"),
+		RetryPeriod:     viper.GetDuration("leader-elect-retry-period"),
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				glog.Infof("Leading, starting the event routers")
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				glog.Warningf("Not leading anymore, stopping the event routers")
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					glog.Infof("The leader is %s", identity)
+				}
+			},
+		},
+		Name: fmt.Sprintf("eventrouter %s", ref),
+	})
+}
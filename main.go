@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,19 +28,25 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/heptiolabs/eventrouter/sinks"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 // addr tells us what address to have the Prometheus metrics listen on.
 var addr = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
 var configFormat = flag.String("config-format", "json", "The configuration file format.")
+var dryRun = flag.Bool("dry-run", false, "Log the events the sinks would send instead of sending them.")
 
 // setup a signal hander to gracefully exit
 func sigHandler() <-chan struct{} {
@@ -60,11 +67,8 @@ func sigHandler() <-chan struct{} {
 	return stop
 }
 
-// loadConfig will parse input + config file and return a clientset
-func loadConfig() kubernetes.Interface {
-	var config *rest.Config
-	var err error
-
+// loadConfig will parse input + config file
+func loadConfig() {
 	flag.Parse()
 
 	if cfgFormat := os.Getenv("EVENTROUTER_CONFIG_FORMAT"); cfgFormat != "" {
@@ -81,11 +85,47 @@ func loadConfig() kubernetes.Interface {
 	viper.AddConfigPath("/etc/eventrouter/")
 	viper.AddConfigPath(".")
 	viper.SetDefault("kubeconfig", "")
+	viper.SetDefault("kube-api-protobuf", false)
+	viper.SetDefault("kube-api-qps", 0)
+	viper.SetDefault("kube-api-burst", 0)
+	viper.SetDefault("kube-api-timeout", time.Duration(0))
+	viper.SetDefault("kube-api-user-agent", "")
 	viper.SetDefault("sink", "glog")
 	viper.SetDefault("resync-interval", time.Minute*30)
 	viper.SetDefault("enable-prometheus", true)
 	viper.SetDefault("metric-prefix", "heptio")
-	if err = viper.ReadInConfig(); err != nil {
+	viper.SetDefault("field-selector", "")
+	viper.SetDefault("watch-bookmarks", false)
+	viper.SetDefault("list-page-size", 0)
+	viper.SetDefault("events-api", coreEventsAPI)
+	viper.SetDefault("checkpoint-file", "")
+	viper.SetDefault("checkpoint-configmap", "")
+	viper.SetDefault("checkpoint-interval", time.Second*10)
+	viper.SetDefault("shutdown-timeout", time.Second*25)
+	viper.SetDefault("clusters", []interface{}{})
+	viper.SetDefault("namespaces", []string{})
+	viper.SetDefault("static-labels", map[string]string{})
+	viper.SetDefault("dry-run", false)
+	viper.SetDefault("skip-initial-list", false)
+	viper.SetDefault("strip-managed-fields", false)
+	viper.SetDefault("sink-crds", false)
+	viper.SetDefault("sink-crds-namespace", metav1.NamespaceAll)
+	viper.SetDefault("route-crds", false)
+	viper.SetDefault("crd-admin-namespace", "kube-system")
+	viper.SetDefault("enrich-owners", false)
+	viper.SetDefault("enrich-owners-ttl", time.Minute*5)
+	viper.SetDefault("enrich-nodes", false)
+	viper.SetDefault("enrich-nodes-ttl", time.Minute*5)
+	viper.SetDefault("enrich-node-pool-labels", []string{})
+	viper.SetDefault("leader-elect", false)
+	viper.SetDefault("leader-elect-lease", "kube-system/eventrouter")
+	viper.SetDefault("leader-elect-lease-duration", time.Second*15)
+	viper.SetDefault("leader-elect-renew-deadline", time.Second*10)
+	viper.SetDefault("leader-elect-retry-period", time.Second*2)
+	viper.SetDefault("shard-count", 1)
+	viper.SetDefault("shard-index", -1)
+	viper.SetDefault("shard-key", shardByUID)
+	if err := viper.ReadInConfig(); err != nil {
 		panic(err.Error())
 	}
 
@@ -96,13 +136,45 @@ func loadConfig() kubernetes.Interface {
 		viper.SetConfigFile(forceCfg)
 	}
 
+	// The dry-run mode doesn't take the lease or write checkpoints either,
+	// leaving them to the deployment it validates the configuration of
+	if *dryRun {
+		viper.Set("dry-run", true)
+	}
+	if viper.GetBool("dry-run") {
+		glog.Warningf("Dry-run mode, the events are logged rather than sent")
+		viper.Set("leader-elect", false)
+		viper.Set("checkpoint-file", "")
+		viper.Set("checkpoint-configmap", "")
+	}
+}
+
+// newClientset returns a clientset for the cluster
+func newClientset(cluster clusterConfig) kubernetes.Interface {
+	// creates the clientset from kubeconfig
+	clientset, err := kubernetes.NewForConfig(newClientConfig(cluster))
+	if err != nil {
+		panic(err.Error())
+	}
+	return clientset
+}
+
+// newClientConfig returns the client config of the cluster, from its
+// kubeconfig and context, else the kubeconfig setting, else the in-cluster
+// config
+func newClientConfig(cluster clusterConfig) *rest.Config {
+	var config *rest.Config
+	var err error
+
 	kubeconfig := viper.GetString("kubeconfig")
-	if len(kubeconfig) > 0 {
+	if len(kubeconfig) > 0 || len(cluster.Kubeconfig) > 0 || len(cluster.Context) > 0 {
 
 		//config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = cluster.Kubeconfig
 		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-			clientcmd.NewDefaultClientConfigLoadingRules(),
-			&clientcmd.ConfigOverrides{},
+			rules,
+			&clientcmd.ConfigOverrides{CurrentContext: cluster.Context},
 		)
 
 		config, err = kubeConfig.ClientConfig()
@@ -114,24 +186,76 @@ func loadConfig() kubernetes.Interface {
 		panic(err.Error())
 	}
 
-	// creates the clientset from kubeconfig
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
+	// With kube-api-protobuf, the lists and watches are requested in the
+	// protobuf encoding, cheaper to decode than JSON for the API server and
+	// the router, falling back to JSON for the types without protobuf
+	if viper.GetBool("kube-api-protobuf") {
+		config.AcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+		config.ContentType = runtime.ContentTypeProtobuf
 	}
-	return clientset
+
+	// The client-go rate limiter defaults to 5 QPS with bursts of 10, which
+	// throttles the relists of large clusters. kube-api-timeout bounds the
+	// requests but the watches, 0 for no timeout.
+	if qps := viper.GetFloat64("kube-api-qps"); qps > 0 {
+		config.QPS = float32(qps)
+	}
+	if burst := viper.GetInt("kube-api-burst"); burst > 0 {
+		config.Burst = burst
+	}
+	if timeout := viper.GetDuration("kube-api-timeout"); timeout > 0 {
+		wrap := config.WrapTransport
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			if wrap != nil {
+				rt = wrap(rt)
+			}
+			return &timeoutRoundTripper{rt: rt, timeout: timeout}
+		}
+	}
+	if userAgent := viper.GetString("kube-api-user-agent"); userAgent != "" {
+		config.UserAgent = userAgent
+	}
+	return config
 }
 
 // main entry point of the program
 func main() {
-	var wg sync.WaitGroup
+	var routers eventRouters
 
-	clientset := loadConfig()
-	sharedInformers := informers.NewSharedInformerFactory(clientset, viper.GetDuration("resync-interval"))
-	eventsInformer := sharedInformers.Core().V1().Events()
+	loadConfig()
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "replay" {
+		runReplay(args[1:])
+		return
+	}
+
+	// The field selector (e.g. type!=Normal or involvedObject.kind=Pod) is
+	// applied by the API server, the filtered out events are never received
+	fieldSelector := viper.GetString("field-selector")
+	if _, err := fields.ParseSelector(fieldSelector); err != nil {
+		panic(err.Error())
+	}
+	// The informer relists every resync-interval, 0 to never relist. With
+	// watch-bookmarks, the API server sends bookmarks on the watches, so a
+	// restarted watch resumes from a recent resourceVersion rather than
+	// relisting. With a positive list-page-size, the lists are read from etcd
+	// in chunks of events, rather than from the watch cache at once.
+	watchBookmarks := viper.GetBool("watch-bookmarks")
+	listPageSize := viper.GetInt64("list-page-size")
+	tweakListOptions := func(options *metav1.ListOptions) {
+		options.FieldSelector = fieldSelector
+		// Only the watches of the reflector have a timeout
+		if options.TimeoutSeconds != nil {
+			options.AllowWatchBookmarks = watchBookmarks
+		} else if listPageSize > 0 {
+			options.ResourceVersion = ""
+			options.Limit = listPageSize
+		}
+	}
 
-	// TODO: Support locking for HA https://github.com/kubernetes/kubernetes/pull/42666
-	eventRouter := NewEventRouter(clientset, eventsInformer)
+	// The clusters share the metrics and the sinks
+	registerEventMetrics()
+	eSink := sinks.ManufactureSink()
 	stop := sigHandler()
 
 	// Startup the http listener for Prometheus Metrics endpoint.
@@ -143,16 +267,134 @@ func main() {
 		}()
 	}
 
-	// Startup the EventRouter
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		eventRouter.Run(stop)
-	}()
-	// Startup the Informer(s)
-	glog.Infof("Starting shared Informer(s)")
-	sharedInformers.Start(stop)
-	wg.Wait()
+	// With sink-crds, the sinks declared by the EventSink resources of
+	// sink-crds-namespace, of all the namespaces by default, are added to the
+	// configured sinks, and removed with their EventSink. With route-crds,
+	// the EventRoute resources of the namespace route the events to the
+	// sinks. The resources outside of crd-admin-namespace only get the
+	// events of their namespace.
+	crdNamespace, adminNamespace := viper.GetString("sink-crds-namespace"), viper.GetString("crd-admin-namespace")
+	if viper.GetBool("sink-crds") {
+		runEventSinkController(clusterConfig{}, crdNamespace, adminNamespace, stop)
+	}
+	if viper.GetBool("route-crds") {
+		runEventRouteController(clusterConfig{}, crdNamespace, adminNamespace, stop)
+	}
+
+	namespaces := watchedNamespaces()
+
+	if viper.GetBool("leader-elect") {
+		runLeaderElected(newClientset(clusterConfig{}), stop, func(stop <-chan struct{}) {
+			startEventRouters(&routers, eSink, namespaces, tweakListOptions, stop)
+		})
+	} else {
+		startEventRouters(&routers, eSink, namespaces, tweakListOptions, stop)
+	}
+	routers.Wait()
+
+	// The checkpoints are saved once the sinks sent the events they hold,
+	// within shutdown-timeout, so that the restart doesn't skip them
+	if sinks.Shutdown(viper.GetDuration("shutdown-timeout")) {
+		routers.saveCheckpoints()
+	}
 	glog.Warningf("Exiting main()")
 	os.Exit(1)
 }
+
+// watchedNamespaces returns the namespaces of the namespaces setting: only
+// their events are watched, with an informer per namespace, so that a Role in
+// each namespace is enough; by default the events of all the namespaces. The
+// namespaces listed twice or empty would have their events forwarded twice.
+func watchedNamespaces() []string {
+	namespaces := viper.GetStringSlice("namespaces")
+	if len(namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	seen := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		if namespace == "" {
+			panic("namespaces must not be empty")
+		}
+		if seen[namespace] {
+			panic(fmt.Sprintf("duplicate namespace %s", namespace))
+		}
+		seen[namespace] = true
+	}
+	return namespaces
+}
+
+// eventRouters are the EventRouters started, Wait waiting for them to stop
+type eventRouters struct {
+	sync.WaitGroup
+
+	mu      sync.Mutex
+	routers []*EventRouter
+}
+
+// run runs the EventRouter until stop is closed
+func (r *eventRouters) run(er *EventRouter, stop <-chan struct{}) {
+	r.mu.Lock()
+	r.routers = append(r.routers, er)
+	r.mu.Unlock()
+
+	r.Add(1)
+	go func() {
+		defer r.Done()
+		er.Run(stop)
+	}()
+}
+
+// saveCheckpoints saves the checkpoints of the EventRouters stopped
+func (r *eventRouters) saveCheckpoints() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, er := range r.routers {
+		er.saveCheckpoint()
+	}
+}
+
+// startEventRouters starts the informers and event routers of the clusters,
+// running until stop is closed
+func startEventRouters(routers *eventRouters, eSink sinks.EventSinkInterface, namespaces []string, tweakListOptions func(*metav1.ListOptions), stop <-chan struct{}) {
+	for _, cluster := range clusterConfigs() {
+		clientset := newClientset(cluster)
+		var factories []informers.SharedInformerFactory
+		var eventsInformers []cache.SharedIndexInformer
+		for _, namespace := range namespaces {
+			sharedInformers := informers.NewSharedInformerFactoryWithOptions(clientset, viper.GetDuration("resync-interval"),
+				informers.WithNamespace(namespace),
+				informers.WithTweakListOptions(tweakListOptions))
+			// With events-api events.k8s.io/v1beta1, the events are watched
+			// through the events API, carrying the series and reporting
+			// fields, and mapped to core/v1 events for the sinks. With
+			// strip-managed-fields, the managedFields and the last applied
+			// configuration are dropped before the events enter the cache.
+			var informer cache.SharedIndexInformer
+			var err error
+			if viper.GetBool("strip-managed-fields") {
+				informer, err = strippedEventsInformer(sharedInformers, namespace, tweakListOptions, viper.GetString("events-api"))
+			} else {
+				informer, err = eventsInformer(sharedInformers, viper.GetString("events-api"))
+			}
+			if err != nil {
+				panic(err.Error())
+			}
+			factories = append(factories, sharedInformers)
+			eventsInformers = append(eventsInformers, informer)
+		}
+
+		eventRouter := NewEventRouter(clientset, eventsInformers, eSink, cluster.Name)
+
+		// Startup the EventRouter
+		routers.run(eventRouter, stop)
+		// Startup the Informer(s)
+		if cluster.Name != "" {
+			glog.Infof("Starting shared Informer(s) of cluster %s", cluster.Name)
+		} else {
+			glog.Infof("Starting shared Informer(s)")
+		}
+		for _, sharedInformers := range factories {
+			sharedInformers.Start(stop)
+		}
+	}
+}
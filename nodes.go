@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// The node metadata annotations of the enriched events
+	nodeNameAnnotation         = "eventrouter.heptio.com/node"
+	nodeZoneAnnotation         = "eventrouter.heptio.com/node-zone"
+	nodeInstanceTypeAnnotation = "eventrouter.heptio.com/node-instance-type"
+	nodePoolAnnotation         = "eventrouter.heptio.com/node-pool"
+)
+
+// The well-known node labels of the zone and instance type, the GA label first
+var (
+	nodeZoneLabels         = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+	nodeInstanceTypeLabels = []string{"node.kubernetes.io/instance-type", "beta.kubernetes.io/instance-type"}
+)
+
+// defaultNodePoolLabels are the node pool labels of the managed clusters
+var defaultNodePoolLabels = []string{
+	"cloud.google.com/gke-nodepool",
+	"eks.amazonaws.com/nodegroup",
+	"kubernetes.azure.com/agentpool",
+	"agentpool",
+}
+
+// nodeMetadata is the metadata of a node attached to the events
+type nodeMetadata struct {
+	name         string
+	zone         string
+	instanceType string
+	pool         string
+}
+
+// nodeCacheEntry is a looked up value and its expiry
+type nodeCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+/*
+nodeResolver resolves the node metadata of the events involving Pods and
+Nodes: the zone, the instance type and the node pool, from the well-known
+node labels, and the first of poolLabels set. The node of a Pod is the node
+it's scheduled on; a Pod not scheduled yet has no node metadata. The Pods and
+Nodes are cached for a TTL, the events of an object coming in bursts; the
+RBAC must allow getting them.
+*/
+type nodeResolver struct {
+	client     kubernetes.Interface
+	ttl        time.Duration
+	poolLabels []string
+
+	mu    sync.Mutex
+	cache map[string]nodeCacheEntry
+}
+
+// newNodeResolver creates a nodeResolver
+func newNodeResolver(client kubernetes.Interface, ttl time.Duration, poolLabels []string) *nodeResolver {
+	if len(poolLabels) == 0 {
+		poolLabels = defaultNodePoolLabels
+	}
+	return &nodeResolver{
+		client:     client,
+		ttl:        ttl,
+		poolLabels: poolLabels,
+		cache:      make(map[string]nodeCacheEntry),
+	}
+}
+
+// resolve returns the node metadata of the object, false if it isn't a Pod
+// or Node or its node is unknown
+func (r *nodeResolver) resolve(ref v1.ObjectReference) (nodeMetadata, bool) {
+	nodeName := ref.Name
+	switch ref.Kind {
+	case "Node":
+	case "Pod":
+		v, ok := r.lookup("Pod/"+ref.Namespace+"/"+ref.Name, func() (interface{}, error) {
+			pod, err := r.client.CoreV1().Pods(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return pod.Spec.NodeName, nil
+		})
+		if !ok || v.(string) == "" {
+			return nodeMetadata{}, false
+		}
+		nodeName = v.(string)
+	default:
+		return nodeMetadata{}, false
+	}
+
+	v, ok := r.lookup("Node/"+nodeName, func() (interface{}, error) {
+		node, err := r.client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return nodeMetadata{
+			name:         node.Name,
+			zone:         firstLabel(node.Labels, nodeZoneLabels),
+			instanceType: firstLabel(node.Labels, nodeInstanceTypeLabels),
+			pool:         firstLabel(node.Labels, r.poolLabels),
+		}, nil
+	})
+	if !ok {
+		return nodeMetadata{}, false
+	}
+	return v.(nodeMetadata), true
+}
+
+// lookup returns the cached value of the key, getting it on a miss. The
+// failed lookups are cached too, as the object won't appear by retrying.
+func (r *nodeResolver) lookup(key string, get func() (interface{}, error)) (interface{}, bool) {
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, entry.value != nil
+	}
+
+	value, err := get()
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.V(2).Infof("Failed to get %s: %v", key, err)
+		}
+		value = nil
+	}
+
+	r.mu.Lock()
+	// Expired entries are swept when the cache grows
+	if len(r.cache) > 10000 {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	r.cache[key] = nodeCacheEntry{value: value, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+	return value, value != nil
+}
+
+// firstLabel returns the value of the first of the labels set, or ""
+func firstLabel(labels map[string]string, keys []string) string {
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ownerKindAnnotation and ownerNameAnnotation hold the top owner of the
+	// involved object on the enriched events
+	ownerKindAnnotation = "eventrouter.heptio.com/owner-kind"
+	ownerNameAnnotation = "eventrouter.heptio.com/owner-name"
+
+	// ownerMaxDepth bounds the owner chains followed
+	ownerMaxDepth = 5
+)
+
+// owner is the top owner of an object
+type owner struct {
+	kind string
+	name string
+}
+
+// ownerCacheEntry is a resolved owner and its expiry
+type ownerCacheEntry struct {
+	owner   owner
+	expires time.Time
+}
+
+/*
+ownerResolver resolves the top-level controller of the involved objects, by
+following the controller owner references, e.g. Pod to ReplicaSet to
+Deployment, or Pod to Job to CronJob, so the events can be grouped by
+workload. The owners are cached for a TTL, the events of an object coming in
+bursts. The owners of Pods, ReplicaSets, Jobs, StatefulSets and DaemonSets
+are looked up, which the RBAC must allow; an object without controller is
+its own top owner.
+*/
+type ownerResolver struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]ownerCacheEntry
+}
+
+// newOwnerResolver creates an ownerResolver
+func newOwnerResolver(client kubernetes.Interface, ttl time.Duration) *ownerResolver {
+	return &ownerResolver{
+		client: client,
+		ttl:    ttl,
+		cache:  make(map[string]ownerCacheEntry),
+	}
+}
+
+// resolve returns the top owner of the object
+func (r *ownerResolver) resolve(ref v1.ObjectReference) owner {
+	key := ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+	now := time.Now()
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.owner
+	}
+
+	top := owner{kind: ref.Kind, name: ref.Name}
+	for depth := 0; depth < ownerMaxDepth; depth++ {
+		controller, err := r.controller(top.kind, ref.Namespace, top.name)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				glog.V(2).Infof("Failed to get the owner of %s %s/%s: %v", top.kind, ref.Namespace, top.name, err)
+			}
+			break
+		}
+		if controller == nil {
+			break
+		}
+		top = owner{kind: controller.Kind, name: controller.Name}
+	}
+
+	r.mu.Lock()
+	// Expired entries are swept when the cache grows
+	if len(r.cache) > 10000 {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	r.cache[key] = ownerCacheEntry{owner: top, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+	return top
+}
+
+// controller returns the controller owner reference of the object, nil if
+// it has none or its kind isn't looked up
+func (r *ownerResolver) controller(kind, namespace, name string) (*metav1.OwnerReference, error) {
+	var meta metav1.Object
+	var err error
+	switch kind {
+	case "Pod":
+		meta, err = r.client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+	case "ReplicaSet":
+		meta, err = r.client.AppsV1().ReplicaSets(namespace).Get(name, metav1.GetOptions{})
+	case "Job":
+		meta, err = r.client.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+	case "StatefulSet":
+		meta, err = r.client.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+	case "DaemonSet":
+		meta, err = r.client.AppsV1().DaemonSets(namespace).Get(name, metav1.GetOptions{})
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metav1.GetControllerOf(meta), nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// shardByNamespace and shardByUID are the values of shard-key
+	shardByNamespace = "namespace"
+	shardByUID       = "uid"
+)
+
+/*
+shardFilter selects the events of a shard, so that N replicas each forward a
+distinct subset of the events: the hash of the namespace or of the involved
+object UID of an event, modulo the shard count, is the shard forwarding it.
+All the updates of an event are thus handled by the same replica.
+*/
+type shardFilter struct {
+	index uint32
+	count uint32
+	key   string
+}
+
+// newShardFilter creates the shardFilter configured by viper, nil with a
+// single shard. shard-index defaults to the ordinal of the StatefulSet pod,
+// the number ending the hostname.
+func newShardFilter() *shardFilter {
+	count := viper.GetInt("shard-count")
+	if count <= 1 {
+		return nil
+	}
+	index := viper.GetInt("shard-index")
+	if index < 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			panic(err.Error())
+		}
+		ordinal := hostname[strings.LastIndex(hostname, "-")+1:]
+		if index, err = strconv.Atoi(ordinal); err != nil {
+			panic(fmt.Sprintf("shard-index not set and hostname %s has no ordinal", hostname))
+		}
+	}
+	if index >= count {
+		panic(fmt.Sprintf("shard-index %d out of the %d shards", index, count))
+	}
+
+	key := viper.GetString("shard-key")
+	switch key {
+	case shardByNamespace, shardByUID:
+	default:
+		panic(fmt.Sprintf("invalid shard-key %q, must be %s or %s", key, shardByNamespace, shardByUID))
+	}
+	return &shardFilter{index: uint32(index), count: uint32(count), key: key}
+}
+
+// owns returns true if the event belongs to the shard
+func (s *shardFilter) owns(e *v1.Event) bool {
+	h := fnv.New32a()
+	if s.key == shardByUID {
+		h.Write([]byte(e.InvolvedObject.UID))
+	} else {
+		h.Write([]byte(e.Namespace))
+	}
+	return h.Sum32()%s.count == s.index
+}
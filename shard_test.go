@@ -0,0 +1,90 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func shardTestEvent(i int) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: fmt.Sprintf("ns-%d", i), Name: "test"},
+		InvolvedObject: v1.ObjectReference{
+			Namespace: fmt.Sprintf("ns-%d", i),
+			UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+		},
+	}
+}
+
+func TestShardFilterOwnsEachEventOnce(t *testing.T) {
+	const count, events = 4, 1000
+	for _, key := range []string{shardByNamespace, shardByUID} {
+		shards := make([]*shardFilter, count)
+		for i := range shards {
+			shards[i] = &shardFilter{index: uint32(i), count: count, key: key}
+		}
+
+		owned := make([]int, count)
+		for i := 0; i < events; i++ {
+			e := shardTestEvent(i)
+			owners := 0
+			for j, s := range shards {
+				if s.owns(e) {
+					owners++
+					owned[j]++
+				}
+			}
+			if owners != 1 {
+				t.Fatalf("Got event %d owned by %d shards by %s, want 1", i, owners, key)
+			}
+		}
+
+		// The hash spreads the events evenly enough
+		for j, n := range owned {
+			if n < events/count/2 || n > events/count*2 {
+				t.Errorf("Got %d of %d events in shard %d by %s, want about %d", n, events, j, key, events/count)
+			}
+		}
+	}
+}
+
+func TestShardFilterKeepsTheUpdatesTogether(t *testing.T) {
+	// The events of one object, and of one namespace, belong to one shard
+	byUID := &shardFilter{index: 0, count: 3, key: shardByUID}
+	byNamespace := &shardFilter{index: 0, count: 3, key: shardByNamespace}
+	for i := 0; i < 100; i++ {
+		e := shardTestEvent(i)
+		other := shardTestEvent(i)
+		other.Name = "other"
+		other.Namespace = "elsewhere"
+		if byUID.owns(e) != byUID.owns(other) {
+			t.Errorf("Got the events of object %s in distinct shards", e.InvolvedObject.UID)
+		}
+
+		other = shardTestEvent(i)
+		other.Name = "other"
+		other.InvolvedObject.UID = "another"
+		if byNamespace.owns(e) != byNamespace.owns(other) {
+			t.Errorf("Got the events of namespace %s in distinct shards", e.Namespace)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// AlertmanagerConfig holds the settings of the AlertmanagerSink
+type AlertmanagerConfig struct {
+	// URLs are the base URLs of the Alertmanager replicas, alerts are posted
+	// to all of them like Prometheus does
+	URLs []string
+
+	// Username and Password enable basic auth, Token bearer auth
+	Username string
+	Password string
+	Token    string
+
+	// Labels are added to every alert, e.g. cluster=prod
+	Labels map[string]string
+
+	// Severity is the value of the severity label of warning events, other
+	// events get "info", unless the severity mapping sets it
+	Severity string
+
+	// ResolveTimeout is how long an alert stays firing after the last event
+	ResolveTimeout time.Duration
+
+	Filter EventFilter
+}
+
+/*
+AlertmanagerSink posts the events matching its filter to the Alertmanager v2
+API as alerts, so the existing Alertmanager routing, grouping, inhibition and
+silences apply to Kubernetes events.
+
+The alert labels are alertname (the event reason), namespace, kind, name and
+severity, plus the configured static labels; the event message goes to the
+summary and description annotations. As events don't resolve, alerts get an
+endsAt ResolveTimeout in the future: an alert keeps firing while its event
+keeps being updated, and resolves on its own afterwards.
+*/
+type AlertmanagerSink struct {
+	cfg        AlertmanagerConfig
+	httpClient *retryClient
+	eventCh    channels.Channel
+}
+
+// alertmanagerAlert is one element of the postable alerts of the v2 API
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    string            `json:"startsAt,omitempty"`
+	EndsAt      string            `json:"endsAt"`
+}
+
+// NewAlertmanagerSink constructs a new AlertmanagerSink given its config
+func NewAlertmanagerSink(cfg AlertmanagerConfig, overflow bool, bufferSize int) *AlertmanagerSink {
+	a := &AlertmanagerSink{
+		cfg: cfg,
+	}
+
+	a.httpClient = retryPolicy.forSink().httpClient()
+
+	if overflow {
+		a.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		a.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return a
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (a *AlertmanagerSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !a.cfg.Filter.Matches(eNew) {
+		return
+	}
+	a.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through a.eventCh, and
+// posting them to Alertmanager. If multiple events have happened between loop
+// iterations, they are posted in one request.
+func (a *AlertmanagerSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-a.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := a.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-a.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			a.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(a.eventCh); len(arr) > 0 {
+				a.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+}
+
+// alert converts an event to an alert
+func (a *AlertmanagerSink) alert(e *v1.Event, now time.Time) alertmanagerAlert {
+	severity := "info"
+	if severities != nil {
+		severity = eventSeverity(e).String()
+	} else if e.Type == v1.EventTypeWarning {
+		severity = a.cfg.Severity
+	}
+
+	labels := make(map[string]string, len(a.cfg.Labels)+5)
+	for k, v := range a.cfg.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = e.Reason
+	labels["namespace"] = e.InvolvedObject.Namespace
+	labels["kind"] = e.InvolvedObject.Kind
+	labels["name"] = e.InvolvedObject.Name
+	labels["severity"] = severity
+
+	alert := alertmanagerAlert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary":     fmt.Sprintf("%s on %s", e.Reason, describeObject(e)),
+			"description": e.Message,
+			"count":       fmt.Sprintf("%d", e.Count),
+			"source":      e.Source.Component,
+		},
+		EndsAt: now.Add(a.cfg.ResolveTimeout).UTC().Format(time.RFC3339),
+	}
+	if !e.FirstTimestamp.IsZero() {
+		alert.StartsAt = e.FirstTimestamp.UTC().Format(time.RFC3339)
+	}
+	return alert
+}
+
+// drainEvents posts the alerts of the events to every Alertmanager, the
+// events being dead-lettered when none of them got the alerts
+func (a *AlertmanagerSink) drainEvents(events []EventData) {
+	now := time.Now()
+	alerts := make([]alertmanagerAlert, 0, len(events))
+	for _, evt := range events {
+		alerts = append(alerts, a.alert(evt.Event, now))
+	}
+
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		glog.Warningf("Failed to json serialize alerts: %v", err)
+		return
+	}
+
+	var lastErr error
+	delivered := false
+	for _, u := range a.cfg.URLs {
+		if err := a.post(strings.TrimSuffix(u, "/")+"/api/v2/alerts", body); err != nil {
+			glog.Errorf("Failed to post %d alerts to %s: %v", len(alerts), u, err)
+			lastErr = err
+		} else {
+			delivered = true
+		}
+	}
+	if !delivered && lastErr != nil {
+		deadLetterEvents("alertmanager", events, lastErr)
+	}
+}
+
+// post sends the alerts to one Alertmanager
+func (a *AlertmanagerSink) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.cfg.Token)
+	} else if a.cfg.Username != "" {
+		req.SetBasicAuth(a.cfg.Username, a.cfg.Password)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
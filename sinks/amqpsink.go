@@ -0,0 +1,272 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"github.com/streadway/amqp"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// amqpConfirmTimeout is how long we wait for the broker to confirm a batch
+	amqpConfirmTimeout = 30 * time.Second
+	// amqpMaxUnconfirmed is the number of messages published before waiting
+	// for their confirmations, it is also the size of the confirmation buffer
+	amqpMaxUnconfirmed = 256
+)
+
+/*
+AMQPSink publishes events to an AMQP 0-9-1 exchange (e.g. RabbitMQ). The routing
+key of every message is built from a template such as
+"events.{namespace}.{type}.{reason}", so consumers can bind queues to the subset
+of events they care about.
+
+The channel is put in confirm mode: a batch of events is only considered sent
+once the broker acknowledged every message in it. The events that are nacked,
+or not confirmed in time, are published again with the retry policy of the
+sinks, reconnecting when the connection is lost, and dead-lettered when the
+retries are exhausted.
+*/
+type AMQPSink struct {
+	eventOutput
+
+	url        string
+	exchange   string
+	routingKey string
+
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	// tag is the delivery tag of the last message published on the channel
+	tag uint64
+
+	retry RetryPolicy
+
+	eventCh channels.Channel
+}
+
+// NewAMQPSink constructs a new AMQPSink and connects it to the broker at url.
+func NewAMQPSink(url, exchange, routingKey string, overflow bool, bufferSize int) (*AMQPSink, error) {
+	a := &AMQPSink{
+		url:        url,
+		exchange:   exchange,
+		routingKey: routingKey,
+		retry:      retryPolicy.forSink(),
+	}
+
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+
+	if overflow {
+		a.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		a.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return a, nil
+}
+
+// connect dials the broker and opens a channel in confirm mode
+func (a *AMQPSink) connect() error {
+	conn, err := amqp.Dial(a.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	a.conn = conn
+	a.channel = ch
+	a.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, amqpMaxUnconfirmed))
+	a.tag = 0
+	return nil
+}
+
+// close tears down the connection so the next batch reconnects
+func (a *AMQPSink) close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn = nil
+	a.channel = nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (a *AMQPSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	a.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through a.eventCh, and
+// publishing them to the exchange. If multiple events have happened between
+// loop iterations, they are published and confirmed as one batch.
+func (a *AMQPSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-a.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := a.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-a.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			a.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(a.eventCh); len(arr) > 0 {
+				a.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+	a.close()
+}
+
+// drainEvents publishes the events and waits for the broker confirmations.
+func (a *AMQPSink) drainEvents(events []EventData) {
+	for len(events) > 0 {
+		n := len(events)
+		if n > amqpMaxUnconfirmed {
+			n = amqpMaxUnconfirmed
+		}
+		batch := events[:n]
+		err := a.retry.Do(func() error {
+			failed, err := a.publishBatch(batch)
+			batch = failed
+			return err
+		})
+		if err != nil {
+			glog.Errorf("Failed to publish %d events to exchange(%s), dropping %d more: %v", len(batch), a.exchange, len(events)-n, err)
+			deadLetterEvents("amqp", batch, err)
+			return
+		}
+		events = events[n:]
+	}
+}
+
+// publishBatch publishes up to amqpMaxUnconfirmed events and waits for their
+// confirmations. It returns the events to publish again, with the error,
+// dropping the connection when it failed.
+func (a *AMQPSink) publishBatch(events []EventData) ([]EventData, error) {
+	if a.channel == nil {
+		if err := a.connect(); err != nil {
+			return events, fmt.Errorf("failed to connect to AMQP broker: %v", err)
+		}
+	}
+
+	// The events by delivery tag, until confirmed
+	unconfirmed := make(map[uint64]EventData, len(events))
+	for i, evt := range events {
+		eJSONBytes, err := a.encode(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		msg := amqp.Publishing{
+			ContentType:  a.contentType(),
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    eventTimestamp(evt.Event),
+			MessageId:    string(evt.Event.UID),
+			Type:         evt.Verb,
+			Body:         eJSONBytes,
+		}
+		key := expandEventTemplate(a.routingKey, evt.Event)
+		if err := a.channel.Publish(a.exchange, key, false, false, msg); err != nil {
+			a.close()
+			return append(amqpEvents(unconfirmed), events[i:]...), fmt.Errorf("failed to publish: %v", err)
+		}
+		a.tag++
+		unconfirmed[a.tag] = evt
+	}
+
+	timeout := time.After(amqpConfirmTimeout)
+	var nacked []EventData
+	for len(unconfirmed) > 0 {
+		select {
+		case c, ok := <-a.confirms:
+			if !ok {
+				a.close()
+				return append(nacked, amqpEvents(unconfirmed)...), fmt.Errorf("AMQP channel closed with %d unconfirmed events", len(unconfirmed))
+			}
+			if evt, ok := unconfirmed[c.DeliveryTag]; ok {
+				delete(unconfirmed, c.DeliveryTag)
+				if !c.Ack {
+					nacked = append(nacked, evt)
+				}
+			}
+		case <-timeout:
+			a.close()
+			return append(nacked, amqpEvents(unconfirmed)...), fmt.Errorf("timed out waiting for confirmation of %d events", len(unconfirmed))
+		}
+	}
+
+	if len(nacked) > 0 {
+		return nacked, fmt.Errorf("broker rejected %d of %d events", len(nacked), len(events))
+	}
+	return nil, nil
+}
+
+// amqpEvents returns the unconfirmed events, in the order of their delivery
+// tags
+func amqpEvents(unconfirmed map[uint64]EventData) []EventData {
+	tags := make([]uint64, 0, len(unconfirmed))
+	for tag := range unconfirmed {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	events := make([]EventData, len(tags))
+	for i, tag := range tags {
+		events[i] = unconfirmed[tag]
+	}
+	return events
+}
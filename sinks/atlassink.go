@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/*
+AtlasSink posts events to the MongoDB Atlas Data API over HTTPS. It is meant
+for clusters that cannot open a driver connection to Atlas (e.g. because of
+egress network policy) but can reach the Data API endpoint.
+
+Events are buffered in a channel and flushed with the insertMany action, up to
+batchSize documents per request:
+
+POST <endpoint>/action/insertMany
+{"dataSource": "...", "database": "...", "collection": "...", "documents": [...]}
+
+Failed requests are retried with exponential backoff.
+*/
+type AtlasSink struct {
+	// endpoint is the Data API base URL, e.g.
+	// https://data.mongodb-api.com/app/<app-id>/endpoint/data/v1
+	endpoint string
+
+	// apiKey is the Data API key sent in the api-key header
+	apiKey string
+
+	dataSource string
+	database   string
+	collection string
+
+	// batchSize is the maximum number of documents sent in one insertMany
+	batchSize int
+
+	eventCh    channels.Channel
+	httpClient *retryClient
+	bodyBuf    *bytes.Buffer
+}
+
+// atlasInsertMany is the request body of the Data API insertMany action
+type atlasInsertMany struct {
+	DataSource string            `json:"dataSource"`
+	Database   string            `json:"database"`
+	Collection string            `json:"collection"`
+	Documents  []json.RawMessage `json:"documents"`
+}
+
+// NewAtlasSink constructs a new AtlasSink given the Data API endpoint, key,
+// target namespace and buffering options.
+func NewAtlasSink(endpoint, apiKey, dataSource, database, collection string, batchSize, maxRetries int, overflow bool, bufferSize int) *AtlasSink {
+	a := &AtlasSink{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		apiKey:     apiKey,
+		dataSource: dataSource,
+		database:   database,
+		collection: collection,
+		batchSize:  batchSize,
+		bodyBuf:    bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+
+	if overflow {
+		a.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		a.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	a.httpClient = retryPolicy.forSink().withRetries(maxRetries).httpClient()
+
+	return a
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (a *AtlasSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	a.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through a.eventCh, and
+// forwarding them to the Data API. Events buffered between loop iterations are
+// sent together, batchSize documents at a time.
+func (a *AtlasSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-a.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := a.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-a.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, a.batchSize, a.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(a.eventCh), a.batchSize, a.drainEvents)
+			break loop
+		}
+	}
+}
+
+// drainEvents sends a single insertMany request containing the given events.
+// This function is *NOT* re-entrant: it re-uses the same body buffer for each
+// call.
+func (a *AtlasSink) drainEvents(events []EventData) {
+	req := atlasInsertMany{
+		DataSource: a.dataSource,
+		Database:   a.database,
+		Collection: a.collection,
+		Documents:  make([]json.RawMessage, 0, len(events)),
+	}
+	for _, evt := range events {
+		eJSONBytes, err := json.Marshal(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		req.Documents = append(req.Documents, eJSONBytes)
+	}
+
+	a.bodyBuf.Truncate(0)
+	if err := json.NewEncoder(a.bodyBuf).Encode(req); err != nil {
+		glog.Warningf("Failed to json serialize insertMany request: %v", err)
+		return
+	}
+
+	httpReq, err := http.NewRequest("POST", a.endpoint+"/action/insertMany", a.bodyBuf)
+	if err != nil {
+		glog.Warningf(err.Error())
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("api-key", a.apiKey)
+
+	resp, err := a.httpClient.Do(httpReq)
+	if err != nil {
+		glog.Errorf("Failed to insert %d events into Atlas: %v", len(req.Documents), err)
+		deadLetterEvents("atlas", events, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		glog.Warningf("Got HTTP code %v from Atlas Data API", resp.StatusCode)
+		deadLetterEvents("atlas", events, fmt.Errorf("got HTTP code %v", resp.StatusCode))
+	}
+}
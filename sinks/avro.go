@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// eventAvroSchema is the Avro schema of the event records. The key fields
+// are top level fields, the complete events are kept as JSON strings so that
+// the schema doesn't depend on the Kubernetes API version.
+const eventAvroSchema = `{
+  "type": "record",
+  "name": "KubernetesEvent",
+  "namespace": "com.heptio.eventrouter",
+  "fields": [
+    {"name": "verb", "type": "string"},
+    {"name": "type", "type": "string"},
+    {"name": "reason", "type": "string"},
+    {"name": "message", "type": "string"},
+    {"name": "count", "type": "long"},
+    {"name": "namespace", "type": "string"},
+    {"name": "kind", "type": "string"},
+    {"name": "name", "type": "string"},
+    {"name": "uid", "type": "string"},
+    {"name": "object_uid", "type": "string"},
+    {"name": "source_component", "type": "string"},
+    {"name": "source_host", "type": "string"},
+    {"name": "first_timestamp", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+    {"name": "last_timestamp", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+    {"name": "event_time", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+    {"name": "event", "type": "string"},
+    {"name": "old_event", "type": ["null", "string"], "default": null}
+  ]
+}`
+
+// avroTimestamp returns the union value of a nullable timestamp-millis field
+func avroTimestamp(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return goavro.Union("long.timestamp-millis", t.UTC())
+}
+
+// eventAvroRecord converts an event to a record of eventAvroSchema
+func eventAvroRecord(evt EventData) (map[string]interface{}, error) {
+	e := evt.Event
+	eventJSON, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var oldEvent interface{}
+	if evt.OldEvent != nil {
+		oldJSON, err := json.Marshal(evt.OldEvent)
+		if err != nil {
+			return nil, err
+		}
+		oldEvent = goavro.Union("string", string(oldJSON))
+	}
+
+	return map[string]interface{}{
+		"verb":             evt.Verb,
+		"type":             e.Type,
+		"reason":           e.Reason,
+		"message":          e.Message,
+		"count":            int64(e.Count),
+		"namespace":        e.InvolvedObject.Namespace,
+		"kind":             e.InvolvedObject.Kind,
+		"name":             e.InvolvedObject.Name,
+		"uid":              string(e.UID),
+		"object_uid":       string(e.InvolvedObject.UID),
+		"source_component": e.Source.Component,
+		"source_host":      e.Source.Host,
+		"first_timestamp":  avroTimestamp(e.FirstTimestamp.Time),
+		"last_timestamp":   avroTimestamp(e.LastTimestamp.Time),
+		"event_time":       avroTimestamp(e.EventTime.Time),
+		"event":            string(eventJSON),
+		"old_event":        oldEvent,
+	}, nil
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// azureMonitorResourceURI is the AAD resource Logs Ingestion tokens are issued for
+	azureMonitorResourceURI = "https://monitor.azure.com"
+	// azureMonitorAPIVersion is the Logs Ingestion API version used
+	azureMonitorAPIVersion = "2023-01-01"
+	// azureMonitorMaxRequestSize is the maximum payload of one upload call
+	azureMonitorMaxRequestSize = 1000 * 1000
+)
+
+/*
+AzureMonitorSink sends events to a Log Analytics custom table through the Azure
+Monitor Logs Ingestion API, using a Data Collection Endpoint (DCE) and a Data
+Collection Rule (DCR):
+
+POST <endpoint>/dataCollectionRules/<dcr immutable id>/streams/<stream>?api-version=2023-01-01
+
+Each event is sent as one record with the columns below, the DCR transformation
+can then project them onto the columns of the destination table. Requests are
+authenticated with an AAD service principal or the managed identity of the
+node, which is the common setup for AKS clusters.
+*/
+type AzureMonitorSink struct {
+	url   string
+	token *adal.ServicePrincipalToken
+
+	eventCh    channels.Channel
+	httpClient *retryClient
+	bodyBuf    *bytes.Buffer
+}
+
+// azureMonitorRecord is the shape of a record sent to the DCR stream
+type azureMonitorRecord struct {
+	TimeGenerated   time.Time `json:"TimeGenerated"`
+	Verb            string    `json:"Verb"`
+	Type            string    `json:"Type"`
+	Reason          string    `json:"Reason"`
+	Message         string    `json:"Message"`
+	Count           int32     `json:"Count"`
+	Namespace       string    `json:"Namespace"`
+	Kind            string    `json:"Kind"`
+	Name            string    `json:"Name"`
+	SourceComponent string    `json:"SourceComponent"`
+	SourceHost      string    `json:"SourceHost"`
+	Event           EventData `json:"Event"`
+}
+
+// AzureMonitorConfig holds the settings of the AzureMonitorSink
+type AzureMonitorConfig struct {
+	// Endpoint is the logs ingestion URL of the Data Collection Endpoint
+	Endpoint string
+	// RuleID is the immutable ID of the Data Collection Rule
+	RuleID string
+	// Stream is the name of the DCR stream, e.g. Custom-KubeEvents_CL
+	Stream string
+	// Environment is the Azure cloud name, e.g. AzurePublicCloud
+	Environment string
+	// TenantID, ClientID and ClientSecret identify a service principal. If
+	// ClientSecret is empty a managed identity is used instead, ClientID then
+	// optionally selects a user assigned identity.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+// NewAzureMonitorSink constructs a new AzureMonitorSink given its config and
+// buffering options.
+func NewAzureMonitorSink(cfg AzureMonitorConfig, overflow bool, bufferSize int) (*AzureMonitorSink, error) {
+	env, err := azure.EnvironmentFromName(cfg.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newAADToken(env, cfg.TenantID, cfg.ClientID, cfg.ClientSecret, azureMonitorResourceURI)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AzureMonitorSink{
+		url: fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s",
+			strings.TrimSuffix(cfg.Endpoint, "/"), cfg.RuleID, cfg.Stream, azureMonitorAPIVersion),
+		token:   token,
+		bodyBuf: bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+
+	if overflow {
+		a.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		a.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	a.httpClient = retryPolicy.forSink().httpClient()
+
+	return a, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (a *AzureMonitorSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	a.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through a.eventCh, and
+// forwarding them to Azure Monitor. If multiple events have happened between
+// loop iterations, they are uploaded together.
+func (a *AzureMonitorSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-a.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := a.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-a.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			a.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(a.eventCh); len(arr) > 0 {
+				a.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvents converts the events to records and uploads them, splitting the
+// records over several requests when they exceed the API payload limit.
+func (a *AzureMonitorSink) drainEvents(events []EventData) {
+	var batch []json.RawMessage
+	var batchEvents []EventData
+	var batchSize int
+	for _, evt := range events {
+		e := evt.Event
+		record := azureMonitorRecord{
+			TimeGenerated:   eventTimestamp(e),
+			Verb:            evt.Verb,
+			Type:            e.Type,
+			Reason:          e.Reason,
+			Message:         e.Message,
+			Count:           e.Count,
+			Namespace:       e.InvolvedObject.Namespace,
+			Kind:            e.InvolvedObject.Kind,
+			Name:            e.InvolvedObject.Name,
+			SourceComponent: e.Source.Component,
+			SourceHost:      e.Source.Host,
+			Event:           evt,
+		}
+		if record.TimeGenerated.IsZero() {
+			record.TimeGenerated = time.Now().UTC()
+		}
+
+		rJSONBytes, err := json.Marshal(record)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		if len(batch) > 0 && batchSize+len(rJSONBytes) > azureMonitorMaxRequestSize {
+			a.upload(batch, batchEvents)
+			batch, batchEvents = nil, nil
+			batchSize = 0
+		}
+		batch = append(batch, rJSONBytes)
+		batchEvents = append(batchEvents, evt)
+		batchSize += len(rJSONBytes) + 1
+	}
+
+	if len(batch) > 0 {
+		a.upload(batch, batchEvents)
+	}
+}
+
+// upload sends the records of the events as a JSON array, dead-lettering the
+// events on failure. This function is *NOT* re-entrant: it re-uses the same
+// body buffer for each call.
+func (a *AzureMonitorSink) upload(records []json.RawMessage, events []EventData) {
+	if err := a.token.EnsureFresh(); err != nil {
+		glog.Errorf("Failed to refresh Azure Monitor token: %v", err)
+		deadLetterEvents("azuremonitor", events, err)
+		return
+	}
+
+	a.bodyBuf.Truncate(0)
+	if err := json.NewEncoder(a.bodyBuf).Encode(records); err != nil {
+		glog.Warningf("Failed to json serialize records: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", a.url, a.bodyBuf)
+	if err != nil {
+		glog.Warningf(err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.token.OAuthToken())
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		glog.Errorf("Failed to upload %d records to Azure Monitor: %v", len(records), err)
+		deadLetterEvents("azuremonitor", events, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		glog.Warningf("Got HTTP code %v from Azure Monitor", resp.StatusCode)
+		deadLetterEvents("azuremonitor", events, fmt.Errorf("got HTTP code %v", resp.StatusCode))
+	}
+}
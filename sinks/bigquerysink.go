@@ -0,0 +1,280 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// bigQueryMaxRows is the number of rows sent per streaming insert request
+const bigQueryMaxRows = 500
+
+// bigQuerySchema is the schema of the events table: the key event fields in
+// their own columns and the full event JSON in data
+var bigQuerySchema = bigquery.Schema{
+	{Name: "event_time", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "cluster", Type: bigquery.StringFieldType},
+	{Name: "uid", Type: bigquery.StringFieldType},
+	{Name: "resource_version", Type: bigquery.StringFieldType},
+	{Name: "verb", Type: bigquery.StringFieldType},
+	{Name: "type", Type: bigquery.StringFieldType},
+	{Name: "reason", Type: bigquery.StringFieldType},
+	{Name: "message", Type: bigquery.StringFieldType},
+	{Name: "count", Type: bigquery.IntegerFieldType},
+	{Name: "namespace", Type: bigquery.StringFieldType},
+	{Name: "kind", Type: bigquery.StringFieldType},
+	{Name: "name", Type: bigquery.StringFieldType},
+	{Name: "source_component", Type: bigquery.StringFieldType},
+	{Name: "source_host", Type: bigquery.StringFieldType},
+	{Name: "first_timestamp", Type: bigquery.TimestampFieldType},
+	{Name: "last_timestamp", Type: bigquery.TimestampFieldType},
+	{Name: "data", Type: bigquery.StringFieldType},
+}
+
+/*
+BigQuerySink streams events into a BigQuery table with the streaming insert
+API. The table is created at startup when missing, partitioned by day on
+event_time and clustered on namespace, kind and reason; columns missing from
+an existing table are added, so the schema is managed by the sink.
+
+Rows carry an insert ID made of the event UID and resourceVersion, which lets
+BigQuery drop the duplicates of retried inserts on a best effort basis.
+
+Without a credentials file the Application Default Credentials are used, which
+includes GKE Workload Identity.
+*/
+type BigQuerySink struct {
+	client   *bigquery.Client
+	cluster  string
+	table    *bigquery.Table
+	inserter *bigquery.Inserter
+	retry    RetryPolicy
+	eventCh  channels.Channel
+}
+
+// bigQueryRow is one row of the events table
+type bigQueryRow struct {
+	cluster string
+	evt     EventData
+}
+
+// Save implements the bigquery.ValueSaver interface
+func (r bigQueryRow) Save() (map[string]bigquery.Value, string, error) {
+	eJSONBytes, err := json.Marshal(r.evt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	e := r.evt.Event
+	eventTime := eventTimestamp(e)
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+
+	row := map[string]bigquery.Value{
+		"event_time":       eventTime,
+		"cluster":          r.cluster,
+		"uid":              string(e.UID),
+		"resource_version": e.ResourceVersion,
+		"verb":             r.evt.Verb,
+		"type":             e.Type,
+		"reason":           e.Reason,
+		"message":          e.Message,
+		"count":            e.Count,
+		"namespace":        e.InvolvedObject.Namespace,
+		"kind":             e.InvolvedObject.Kind,
+		"name":             e.InvolvedObject.Name,
+		"source_component": e.Source.Component,
+		"source_host":      e.Source.Host,
+		"data":             string(eJSONBytes),
+	}
+	if !e.FirstTimestamp.IsZero() {
+		row["first_timestamp"] = e.FirstTimestamp.Time
+	}
+	if !e.LastTimestamp.IsZero() {
+		row["last_timestamp"] = e.LastTimestamp.Time
+	}
+	return row, string(e.UID) + "-" + e.ResourceVersion, nil
+}
+
+// NewBigQuerySink constructs a new BigQuerySink, creating or updating the
+// table if needed. cluster is stored in every row, to tell apart the events
+// of several clusters streaming into one table.
+func NewBigQuerySink(project, dataset, table, cluster, credentialsFile string, overflow bool, bufferSize int) (*BigQuerySink, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, project, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BigQuerySink{
+		client:  client,
+		cluster: cluster,
+		table:   client.Dataset(dataset).Table(table),
+		retry:   retryPolicy.forSink(),
+	}
+	if err := b.ensureTable(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	b.inserter = b.table.Inserter()
+
+	if overflow {
+		b.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		b.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return b, nil
+}
+
+// ensureTable creates the table, or adds the columns it is missing
+func (b *BigQuerySink) ensureTable(ctx context.Context) error {
+	md, err := b.table.Metadata(ctx)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		err = b.table.Create(ctx, &bigquery.TableMetadata{
+			Schema: bigQuerySchema,
+			TimePartitioning: &bigquery.TimePartitioning{
+				Field: "event_time",
+			},
+			Clustering: &bigquery.Clustering{
+				Fields: []string{"namespace", "kind", "reason"},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create bigquery table %s: %v", b.table.FullyQualifiedName(), err)
+		}
+		glog.Infof("Created bigquery table %s", b.table.FullyQualifiedName())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get bigquery table %s: %v", b.table.FullyQualifiedName(), err)
+	}
+
+	existing := map[string]bool{}
+	for _, f := range md.Schema {
+		existing[f.Name] = true
+	}
+	schema := md.Schema
+	for _, f := range bigQuerySchema {
+		if !existing[f.Name] {
+			// new columns of an existing table can't be required
+			added := *f
+			added.Required = false
+			schema = append(schema, &added)
+		}
+	}
+	if len(schema) == len(md.Schema) {
+		return nil
+	}
+
+	if _, err := b.table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, md.ETag); err != nil {
+		return fmt.Errorf("failed to update bigquery table %s schema: %v", b.table.FullyQualifiedName(), err)
+	}
+	glog.Infof("Added %d columns to bigquery table %s", len(schema)-len(md.Schema), b.table.FullyQualifiedName())
+	return nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (b *BigQuerySink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	b.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through b.eventCh, and
+// streaming them into BigQuery. If multiple events have happened between loop
+// iterations, they are inserted bigQueryMaxRows rows at a time.
+func (b *BigQuerySink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-b.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := b.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-b.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, bigQueryMaxRows, b.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(b.eventCh), bigQueryMaxRows, b.drainEvents)
+			break loop
+		}
+	}
+	b.client.Close()
+}
+
+// drainEvents inserts the events with one streaming insert request
+func (b *BigQuerySink) drainEvents(events []EventData) {
+	rows := make([]bigQueryRow, 0, len(events))
+	for _, evt := range events {
+		rows = append(rows, bigQueryRow{cluster: b.cluster, evt: evt})
+	}
+
+	err := b.retry.Do(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		err := b.inserter.Put(ctx, rows)
+		if _, ok := err.(bigquery.PutMultiError); ok {
+			// Rows rejected, retrying wouldn't help
+			return permanent(err)
+		}
+		return err
+	})
+	if multiErr, ok := err.(bigquery.PutMultiError); ok {
+		glog.Errorf("Failed to insert %d of %d events into bigquery, first error: %v", len(multiErr), len(rows), multiErr[0])
+	} else if err != nil {
+		glog.Errorf("Failed to insert %d events into bigquery: %v", len(rows), err)
+		deadLetterEvents("bigquery", events, err)
+	}
+}
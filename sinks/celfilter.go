@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/*
+CELFilter selects events with a CEL expression, e.g.
+
+	event.type == 'Warning' && event.involvedObject.kind == 'Pod' && event.reason.startsWith('Failed')
+
+The expression sees the variables verb (ADDED, UPDATED, REPEATED or
+DELETED), event and oldEvent (null for the added and deleted events), the
+events having the field names of their JSON form. Integral numbers are ints, e.g. event.count > 5.
+*/
+type CELFilter struct {
+	expression string
+	program    cel.Program
+}
+
+// NewCELFilter compiles the expression, which must evaluate to a bool
+func NewCELFilter(expression string) (*CELFilter, error) {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewIdent("verb", decls.String, nil),
+		decls.NewIdent("event", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("oldEvent", decls.Dyn, nil),
+	))
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expression)
+	if iss != nil && iss.Err() != nil {
+		return nil, fmt.Errorf("invalid cel expression %q: %v", expression, iss.Err())
+	}
+	// Expressions on the fields of the events are dyn, checked at evaluation
+	if t := ast.ResultType(); t.GetPrimitive() != exprpb.Type_BOOL && t.GetDyn() == nil {
+		return nil, fmt.Errorf("cel expression %q doesn't evaluate to a bool", expression)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &CELFilter{expression: expression, program: program}, nil
+}
+
+// Matches returns true if the expression evaluates to true for the event
+// update. Evaluation errors, e.g. on missing fields, are logged and don't
+// match.
+func (f *CELFilter) Matches(eNew *v1.Event, eOld *v1.Event) bool {
+	vars := map[string]interface{}{
+		"verb":     NewEventData(eNew, eOld).Verb,
+		"oldEvent": nil,
+	}
+	var err error
+	if vars["event"], err = celValue(eNew); err != nil {
+		glog.Warningf("Failed to convert event for cel expression: %v", err)
+		return false
+	}
+	if eOld != nil {
+		if vars["oldEvent"], err = celValue(eOld); err != nil {
+			glog.Warningf("Failed to convert event for cel expression: %v", err)
+			return false
+		}
+	}
+
+	out, _, err := f.program.Eval(vars)
+	if err != nil {
+		glog.V(4).Infof("Failed to evaluate cel expression %q: %v", f.expression, err)
+		return false
+	}
+	return out == types.True
+}
+
+// celValue converts an event to the generic maps and lists of its JSON form,
+// with the integral numbers as int64
+func celValue(e *v1.Event) (interface{}, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return celNumbers(v), nil
+}
+
+// celNumbers replaces the json.Number values
+func celNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			t[k] = celNumbers(vv)
+		}
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = celNumbers(vv)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+)
+
+func TestCELFilterMatches(t *testing.T) {
+	failed := newRoutedTestEvent("team-a", "Warning")
+	failed.Reason = "FailedMount"
+	failed.Count = 7
+	pulled := newRoutedTestEvent("team-b", "Normal")
+	pulled.Reason = "Pulled"
+	pulled.Count = 1
+
+	for _, test := range []struct {
+		expression string
+		eNew, eOld bool
+		want       bool
+	}{
+		{expression: "event.type == 'Warning' && event.involvedObject.kind == 'Pod' && event.reason.startsWith('Failed')", want: true},
+		{expression: "event.type == 'Warning' && event.reason.startsWith('Back')", want: false},
+		{expression: "event.count > 5", want: true},
+		{expression: "event.involvedObject.namespace in ['team-a', 'team-c']", want: true},
+		{expression: "verb == 'ADDED' && oldEvent == null", want: true},
+		{expression: "verb == 'UPDATED' && oldEvent.reason == 'Pulled'", eOld: true, want: true},
+		{expression: "event.count - oldEvent.count == 6", eOld: true, want: true},
+		// Evaluation errors don't match
+		{expression: "event.missing == 'x'", want: false},
+		{expression: "oldEvent.reason == 'Pulled'", want: false},
+		{expression: "event.message > 5", want: false},
+	} {
+		f, err := NewCELFilter(test.expression)
+		if err != nil {
+			t.Errorf("Failed to compile %q: %v", test.expression, err)
+			continue
+		}
+		eOld := pulled
+		if !test.eOld {
+			eOld = nil
+		}
+		if got := f.Matches(failed, eOld); got != test.want {
+			t.Errorf("Got %v for %q, want %v", got, test.expression, test.want)
+		}
+	}
+}
+
+func TestNewCELFilterErrors(t *testing.T) {
+	for name, expression := range map[string]string{
+		"syntax error":       "event.type ==",
+		"undeclared":         "events.type == 'Warning'",
+		"not a bool":         "verb + 'x'",
+		"not a bool literal": "42",
+	} {
+		if _, err := NewCELFilter(expression); err == nil {
+			t.Errorf("Got no error for the %s %q", name, expression)
+		}
+	}
+}
+
+func TestMultiSinkRouteExpression(t *testing.T) {
+	f, err := NewCELFilter("event.reason.startsWith('Failed')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMultiSink([]MultiSinkRoute{
+		{Name: "failures", Sink: &recordingSink{}, Expression: f},
+		{Name: "warnings", Sink: &recordingSink{}, Filter: EventFilter{Types: []string{"Warning"}}, Expression: f},
+	}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range [][2]string{{"Normal", "FailedCreate"}, {"Warning", "FailedMount"}, {"Warning", "BackOff"}} {
+		event := newRoutedTestEvent("team-a", e[0])
+		event.Reason = e[1]
+		m.UpdateEvents(event, nil)
+	}
+	if n := queued(t, m, "failures"); n != 2 {
+		t.Errorf("Got %d updates for the sink with an expression, want 2", n)
+	}
+	if n := queued(t, m, "warnings"); n != 1 {
+		t.Errorf("Got %d updates for the sink with a filter and an expression, want 1", n)
+	}
+}
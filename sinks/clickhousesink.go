@@ -0,0 +1,298 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// clickhouseTimeFormat is the default DateTime input format of ClickHouse
+const clickhouseTimeFormat = "2006-01-02 15:04:05"
+
+// clickhouseTableNameRe restricts table names, they are part of the query text
+var clickhouseTableNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)?$`)
+
+/*
+ClickHouseSink writes events to a ClickHouse table over the HTTP interface,
+using the JSONEachRow input format:
+
+POST <url>/?query=INSERT INTO <table> FORMAT JSONEachRow
+
+Events buffered between two loop iterations are sent in one request of up to
+batchSize rows. When async is set the inserts use the server side asynchronous
+insert mode (async_insert=1), so ClickHouse coalesces the small inserts coming
+from several eventrouters into larger parts instead of creating one part per
+request.
+
+clickhouseUrl is the base URL of the HTTP interface, e.g.
+http://clickhouse:8123. clickhouseUser and clickhousePassword are sent as the
+X-ClickHouse-User and X-ClickHouse-Key headers. clickhouseTable is the table,
+"events" by default, optionally as database.table. clickhouseAsyncInsert
+(true by default) and clickhouseBatchSize (1000 by default) set async and
+batchSize. clickhouseCreateTable creates the table at startup if it does not
+exist, a MergeTree partitioned by day and ordered by namespace, kind and
+event time.
+
+Each row holds the event time in UTC as a DateTime (YYYY-MM-DD hh:mm:ss),
+the uid, resource_version and verb of the update, the type, reason, message
+and count of the event, the namespace, kind and name of the involved object,
+the source component and host, and data, the EventData serialized as JSON for
+the fields without a column of their own.
+*/
+type ClickHouseSink struct {
+	url       string
+	user      string
+	password  string
+	table     string
+	batchSize int
+
+	eventCh    channels.Channel
+	httpClient *retryClient
+	bodyBuf    *bytes.Buffer
+}
+
+// clickhouseRow is one row of the events table in JSONEachRow format
+type clickhouseRow struct {
+	EventTime       string `json:"event_time"`
+	UID             string `json:"uid"`
+	ResourceVersion string `json:"resource_version"`
+	Verb            string `json:"verb"`
+	Type            string `json:"type"`
+	Reason          string `json:"reason"`
+	Message         string `json:"message"`
+	Count           int32  `json:"count"`
+	Namespace       string `json:"namespace"`
+	Kind            string `json:"kind"`
+	Name            string `json:"name"`
+	SourceComponent string `json:"source_component"`
+	SourceHost      string `json:"source_host"`
+	Data            string `json:"data"`
+}
+
+// NewClickHouseSink constructs a new ClickHouseSink. When createTable is set,
+// a MergeTree table is created if it does not exist.
+func NewClickHouseSink(endpoint, user, password, table string, async, createTable bool, batchSize int, overflow bool, bufferSize int) (*ClickHouseSink, error) {
+	if !clickhouseTableNameRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid clickhouse table name %q", table)
+	}
+
+	params := url.Values{}
+	params.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+	if async {
+		params.Set("async_insert", "1")
+		params.Set("wait_for_async_insert", "0")
+	}
+
+	c := &ClickHouseSink{
+		url:       strings.TrimSuffix(endpoint, "/") + "/?" + params.Encode(),
+		user:      user,
+		password:  password,
+		table:     table,
+		batchSize: batchSize,
+		bodyBuf:   bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+
+	c.httpClient = retryPolicy.forSink().httpClient()
+
+	if createTable {
+		if err := c.createTable(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	if overflow {
+		c.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		c.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return c, nil
+}
+
+// createTable creates the events table if it doesn't exist yet
+func (c *ClickHouseSink) createTable(endpoint string) error {
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	event_time DateTime,
+	uid String,
+	resource_version String,
+	verb LowCardinality(String),
+	type LowCardinality(String),
+	reason LowCardinality(String),
+	message String,
+	count UInt32,
+	namespace LowCardinality(String),
+	kind LowCardinality(String),
+	name String,
+	source_component LowCardinality(String),
+	source_host String,
+	data String
+) ENGINE = MergeTree
+PARTITION BY toYYYYMMDD(event_time)
+ORDER BY (namespace, kind, event_time)`, c.table)
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", strings.NewReader(query))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to create clickhouse table %s: %v", c.table, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends the request with the ClickHouse credentials and turns non 2xx
+// responses into errors
+func (c *ClickHouseSink) do(req *http.Request) (*http.Response, error) {
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("got HTTP code %v from clickhouse: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (c *ClickHouseSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	c.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through c.eventCh, and
+// inserting them into ClickHouse. If multiple events have happened between
+// loop iterations, they are inserted batchSize rows at a time.
+func (c *ClickHouseSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-c.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := c.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-c.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, c.batchSize, c.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(c.eventCh), c.batchSize, c.drainEvents)
+			break loop
+		}
+	}
+}
+
+// drainEvents inserts the events with one request, dead-lettering them on
+// failure. This function is *NOT* re-entrant: it re-uses the same body buffer
+// for each call.
+func (c *ClickHouseSink) drainEvents(events []EventData) {
+	c.bodyBuf.Truncate(0)
+	enc := json.NewEncoder(c.bodyBuf)
+
+	rows := 0
+	for _, evt := range events {
+		eJSONBytes, err := json.Marshal(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		e := evt.Event
+		eventTime := eventTimestamp(e)
+		if eventTime.IsZero() {
+			eventTime = time.Now()
+		}
+		row := clickhouseRow{
+			EventTime:       eventTime.UTC().Format(clickhouseTimeFormat),
+			UID:             string(e.UID),
+			ResourceVersion: e.ResourceVersion,
+			Verb:            evt.Verb,
+			Type:            e.Type,
+			Reason:          e.Reason,
+			Message:         e.Message,
+			Count:           e.Count,
+			Namespace:       e.InvolvedObject.Namespace,
+			Kind:            e.InvolvedObject.Kind,
+			Name:            e.InvolvedObject.Name,
+			SourceComponent: e.Source.Component,
+			SourceHost:      e.Source.Host,
+			Data:            string(eJSONBytes),
+		}
+		// Encode writes one JSON object per line, as JSONEachRow expects
+		if err := enc.Encode(row); err != nil {
+			glog.Warningf("Failed to json serialize row: %v", err)
+			continue
+		}
+		rows++
+	}
+	if rows == 0 {
+		return
+	}
+
+	req, err := http.NewRequest("POST", c.url, c.bodyBuf)
+	if err != nil {
+		glog.Warningf(err.Error())
+		return
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		glog.Errorf("Failed to insert %d events into clickhouse table %s: %v", rows, c.table, err)
+		deadLetterEvents("clickhouse", events, err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// CloudEventsConfig holds the settings of the CloudEvents envelope
+type CloudEventsConfig struct {
+	// Source prefixes the source attribute, which ends with the component
+	// that reported the event, e.g. /eventrouter/kubelet
+	Source string
+
+	// TypePrefix prefixes the type attribute, which ends with the lower case
+	// event type, e.g. io.k8s.event.warning
+	TypePrefix string
+}
+
+// cloudEvents, when set, makes the sinks writing the EventData as JSON wrap it
+// in a CloudEvents envelope. It is set by ManufactureSink.
+var cloudEvents *CloudEventsConfig
+
+// cloudEvent is a CloudEvents 1.0 event in the JSON structured mode
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time,omitempty"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// newCloudEvent wraps the event data, serialized as data, in a CloudEvents
+// envelope. The id is the event UID and resource version, so each update of
+// an event is a distinct occurrence, and the subject the involved object, e.g.
+// Pod/default/web-0.
+func newCloudEvent(cfg *CloudEventsConfig, evt EventData, data interface{}) cloudEvent {
+	e := evt.Event
+
+	id := string(e.UID)
+	if e.ResourceVersion != "" {
+		id += "/" + e.ResourceVersion
+	}
+	component := e.Source.Component
+	if component == "" {
+		component = "unknown"
+	}
+	eventType := strings.ToLower(e.Type)
+	if eventType == "" {
+		eventType = "unknown"
+	}
+	subject := e.InvolvedObject.Kind + "/" + e.InvolvedObject.Name
+	if e.InvolvedObject.Namespace != "" {
+		subject = e.InvolvedObject.Kind + "/" + e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name
+	}
+	ts := eventTimestamp(e)
+	var t string
+	if !ts.IsZero() {
+		t = ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          strings.TrimSuffix(cfg.Source, "/") + "/" + component,
+		Type:            cfg.TypePrefix + "." + eventType,
+		Subject:         subject,
+		Time:            t,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// eventDataJSON returns the value to serialize for the event data: the
+// event data itself, or its CloudEvents envelope, transformed
+func eventDataJSON(evt EventData) interface{} {
+	data := transformEventData(evt)
+	if cloudEvents == nil {
+		return data
+	}
+	return newCloudEvent(cloudEvents, evt, data)
+}
+
+// marshalEventData serializes the event data as JSON, in a CloudEvents
+// envelope when enabled
+func marshalEventData(evt EventData) ([]byte, error) {
+	return json.Marshal(eventDataJSON(evt))
+}
+
+// eventDataContentType is the content type of the marshalEventData output
+func eventDataContentType() string {
+	if cloudEvents == nil {
+		return "application/json"
+	}
+	return "application/cloudevents+json"
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// deadLetterSinkAnnotation and deadLetterErrorAnnotation hold the failure
+	// metadata on the events forwarded to the dead-letter sink
+	deadLetterSinkAnnotation  = "eventrouter.heptio.com/dead-letter-sink"
+	deadLetterErrorAnnotation = "eventrouter.heptio.com/dead-letter-error"
+)
+
+// deadLetterCounterVec counts the dead-lettered events by sink. It is nil
+// unless registerDeadLetterMetrics was called.
+var deadLetterCounterVec *prometheus.CounterVec
+
+// registerDeadLetterMetrics creates and registers the dead-letter metrics
+func registerDeadLetterMetrics(prefix string) {
+	deadLetterCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_eventrouter_dead_lettered_events_total", prefix),
+		Help: "Total number of events a sink failed to deliver, written to the dead letter",
+	}, []string{"sink"})
+	prometheus.MustRegister(deadLetterCounterVec)
+}
+
+// deadLetters, when set, receives the events the sinks failed to deliver. It
+// is set by ManufactureSink.
+var deadLetters *DeadLetter
+
+// DeadLetterConfig holds the settings of the DeadLetter
+type DeadLetterConfig struct {
+	// File is the file the events are appended to, one JSON object per line
+	File string
+
+	// Sink, when set, receives the events, SinkName being its sink type
+	Sink     EventSinkInterface
+	SinkName string
+}
+
+// deadLetterRecord is a line of the dead-letter file
+type deadLetterRecord struct {
+	Sink     string    `json:"sink"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	EventData
+}
+
+/*
+DeadLetter keeps the events a sink gave up on, after exhausting its retries,
+rather than losing them: they are written with the failure metadata (the sink,
+the error and the time) to a file, and/or forwarded to another sink, e.g.
+s3sink, with the sink and error as annotations of the events.
+*/
+type DeadLetter struct {
+	cfg DeadLetterConfig
+
+	mu sync.Mutex
+}
+
+// NewDeadLetter creates a DeadLetter
+func NewDeadLetter(cfg DeadLetterConfig) *DeadLetter {
+	return &DeadLetter{cfg: cfg}
+}
+
+// deadLetterEvents hands the events the sink failed to deliver to the
+// dead letter, when configured
+func deadLetterEvents(sink string, events []EventData, err error) {
+	if deadLetters == nil || len(events) == 0 {
+		return
+	}
+	deadLetters.add(sink, events, err)
+}
+
+// add writes the events to the file and forwards them to the sink
+func (d *DeadLetter) add(sink string, events []EventData, cause error) {
+	if d.cfg.File != "" {
+		if err := d.write(sink, events, cause); err != nil {
+			glog.Errorf("Failed to write %d events to the dead-letter file %s: %v", len(events), d.cfg.File, err)
+		}
+	}
+	if d.cfg.Sink != nil {
+		for _, evt := range events {
+			// The sinks report their sink type, which the dead-letter sink
+			// may share with others: its own failures are told apart by
+			// the annotations of the events it gets, not to loop
+			if _, ok := evt.Event.Annotations[deadLetterSinkAnnotation]; ok {
+				glog.Warningf("Dead-letter sink %s failed to deliver event %s/%s: %v", d.cfg.SinkName, evt.Event.Namespace, evt.Event.Name, cause)
+				continue
+			}
+			e := evt.Event.DeepCopy()
+			if e.Annotations == nil {
+				e.Annotations = make(map[string]string, 2)
+			}
+			e.Annotations[deadLetterSinkAnnotation] = sink
+			e.Annotations[deadLetterErrorAnnotation] = cause.Error()
+			d.cfg.Sink.UpdateEvents(e, evt.OldEvent)
+		}
+	}
+	if deadLetterCounterVec != nil {
+		deadLetterCounterVec.WithLabelValues(sink).Add(float64(len(events)))
+	}
+}
+
+// write appends the events to the dead-letter file
+func (d *DeadLetter) write(sink string, events []EventData, cause error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, err := os.OpenFile(d.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	now := time.Now().UTC()
+	for _, evt := range events {
+		record := deadLetterRecord{
+			Sink:      sink,
+			Error:     cause.Error(),
+			FailedAt:  now,
+			EventData: evt,
+		}
+		if err := enc.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
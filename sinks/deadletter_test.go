@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureDeadLetters sets a dead letter forwarding to the returned sink,
+// until the returned function restores the previous one
+func captureDeadLetters(sinkName string) (*recordingSink, func()) {
+	sink := &recordingSink{}
+	previous := deadLetters
+	deadLetters = NewDeadLetter(DeadLetterConfig{Sink: sink, SinkName: sinkName})
+	return sink, func() { deadLetters = previous }
+}
+
+func TestDeadLetterSinkOfTheSameType(t *testing.T) {
+	sink, restore := captureDeadLetters("s3")
+	defer restore()
+
+	// The failures of another sink of the type of the dead-letter sink are
+	// forwarded to it
+	failed := NewEventData(newTestEvent("a"), nil)
+	deadLetterEvents("s3", []EventData{failed}, errors.New("upload failed"))
+	checkNames(t, sink.names(), "a")
+	e := sink.updates[0]
+	if e.Annotations[deadLetterSinkAnnotation] != "s3" || e.Annotations[deadLetterErrorAnnotation] != "upload failed" {
+		t.Errorf("Got annotations %v, want the failed sink and error", e.Annotations)
+	}
+	if failed.Event.Annotations != nil {
+		t.Errorf("Got the annotations set on the failed event")
+	}
+
+	// The failures of the dead-letter sink are not forwarded again
+	deadLetterEvents("s3", []EventData{NewEventData(e, nil)}, errors.New("upload failed"))
+	checkNames(t, sink.names(), "a")
+}
+
+func TestSinkFailuresAreDeadLettered(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	clickhouse, err := NewClickHouseSink(srv.URL, "", "", "events", false, false, 0, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alertmanager := NewAlertmanagerSink(AlertmanagerConfig{URLs: []string{srv.URL, srv.URL}}, true, 10)
+
+	for name, drain := range map[string]func([]EventData){
+		"clickhouse":   clickhouse.drainEvents,
+		"alertmanager": alertmanager.drainEvents,
+	} {
+		sink, restore := captureDeadLetters("file")
+		drain([]EventData{NewEventData(newTestEvent("a"), nil), NewEventData(newTestEvent("b"), nil)})
+		restore()
+		if got := sink.names(); len(got) != 2 {
+			t.Errorf("Got events %v dead-lettered by the %s sink, want [a b]", got, name)
+		}
+	}
+}
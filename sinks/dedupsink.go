@@ -0,0 +1,168 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// dedupKey identifies the repetitions of an event
+type dedupKey struct {
+	object      string
+	reason      string
+	messageHash uint64
+}
+
+// dedupEntry aggregates the updates of a key during the window
+type dedupEntry struct {
+	first time.Time
+	eNew  *v1.Event
+	eOld  *v1.Event
+
+	// counts holds the last count of each of the events with the key
+	counts map[types.UID]int32
+}
+
+/*
+DedupSink holds back the updates of the events for a window, and forwards the
+repetitions of an event once: the events with the same involved object, reason
+and message are aggregated, so an event updated 50 times in a minute reaches
+the sink once with its last count.
+
+The forwarded event is the last update, with the count summed over the
+distinct events aggregated, and the old event of the first update. Events are
+delayed by up to the window.
+*/
+type DedupSink struct {
+	sink   EventSinkInterface
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[dedupKey]*dedupEntry
+}
+
+// NewDedupSink creates a DedupSink in front of sink
+func NewDedupSink(sink EventSinkInterface, window time.Duration) *DedupSink {
+	return &DedupSink{
+		sink:    sink,
+		window:  window,
+		pending: make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// newDedupKey returns the key of an event
+func newDedupKey(e *v1.Event) dedupKey {
+	h := fnv.New64a()
+	h.Write([]byte(e.Message))
+	return dedupKey{
+		object:      involvedObjectKey(e),
+		reason:      e.Reason,
+		messageHash: h.Sum64(),
+	}
+}
+
+// UpdateEvents implements the EventSinkInterface. The update is aggregated
+// with the pending ones of the same key. The deletes are forwarded at once,
+// after the pending update of their key.
+func (d *DedupSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	key := newDedupKey(eNew)
+	if isDeleted(eNew) {
+		d.mu.Lock()
+		entry, ok := d.pending[key]
+		delete(d.pending, key)
+		d.mu.Unlock()
+		if ok {
+			d.forward(entry)
+		}
+		d.sink.UpdateEvents(eNew, eOld)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.pending[key]
+	if !ok {
+		entry = &dedupEntry{
+			first:  time.Now(),
+			eOld:   eOld,
+			counts: make(map[types.UID]int32),
+		}
+		d.pending[key] = entry
+	}
+	entry.eNew = eNew
+	entry.counts[eNew.UID] = eNew.Count
+}
+
+// Run sits in a loop, forwarding the entries whose window has elapsed, until
+// stopCh is closed. The pending entries are forwarded on stop.
+func (d *DedupSink) Run(stopCh <-chan bool) {
+	tick := time.Second
+	if d.window < tick {
+		tick = d.window
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			d.flush(now.Add(-d.window))
+		case <-stopCh:
+			break loop
+		}
+	}
+	d.flush(time.Now())
+}
+
+// flush forwards the entries first seen before the deadline
+func (d *DedupSink) flush(deadline time.Time) {
+	var ready []*dedupEntry
+
+	d.mu.Lock()
+	for key, entry := range d.pending {
+		if !entry.first.After(deadline) {
+			ready = append(ready, entry)
+			delete(d.pending, key)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, entry := range ready {
+		d.forward(entry)
+	}
+}
+
+// forward forwards an entry, with the aggregated count
+func (d *DedupSink) forward(entry *dedupEntry) {
+	eNew := entry.eNew
+	if len(entry.counts) > 1 {
+		var count int32
+		for _, c := range entry.counts {
+			count += c
+		}
+		eNew = eNew.DeepCopy()
+		eNew.Count = count
+	}
+	d.sink.UpdateEvents(eNew, entry.eOld)
+}
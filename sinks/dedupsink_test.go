@@ -0,0 +1,127 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newDedupTestEvent returns an event of the test pod, with the given UID and
+// count
+func newDedupTestEvent(uid string, count int32) *v1.Event {
+	e := newTestEvent("web-0." + uid)
+	e.UID = types.UID(uid)
+	e.Count = count
+	e.Reason = "BackOff"
+	e.Message = "Back-off restarting failed container"
+	e.InvolvedObject = v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-0", UID: "pod"}
+	return e
+}
+
+func TestDedupAggregatesCounts(t *testing.T) {
+	sink := &recordingSink{}
+	d := NewDedupSink(sink, time.Minute)
+
+	// The updates of one event keep its last count
+	d.UpdateEvents(newDedupTestEvent("a", 1), nil)
+	d.UpdateEvents(newDedupTestEvent("a", 2), nil)
+	d.UpdateEvents(newDedupTestEvent("a", 3), nil)
+	// The distinct events of the key add up
+	d.UpdateEvents(newDedupTestEvent("b", 4), nil)
+	// Another message is another key
+	other := newDedupTestEvent("c", 5)
+	other.Message = "Liveness probe failed"
+	d.UpdateEvents(other, nil)
+
+	if len(sink.updates) != 0 {
+		t.Fatalf("Got %d updates forwarded during the window, want none", len(sink.updates))
+	}
+	d.flush(time.Now())
+
+	if len(sink.updates) != 2 {
+		t.Fatalf("Got %d updates forwarded, want 2", len(sink.updates))
+	}
+	counts := map[string]int32{}
+	for _, e := range sink.updates {
+		counts[e.Message] = e.Count
+	}
+	if c := counts["Back-off restarting failed container"]; c != 7 {
+		t.Errorf("Got count %d for the aggregated events, want 7", c)
+	}
+	if c := counts["Liveness probe failed"]; c != 5 {
+		t.Errorf("Got count %d for the single event, want 5", c)
+	}
+}
+
+func TestDedupKeepsTheUpdatesOfOneEvent(t *testing.T) {
+	sink := &recordingSink{}
+	d := NewDedupSink(sink, time.Minute)
+
+	first := newDedupTestEvent("a", 1)
+	last := newDedupTestEvent("a", 3)
+	d.UpdateEvents(first, nil)
+	d.UpdateEvents(last, first)
+	d.flush(time.Now())
+
+	if len(sink.updates) != 1 {
+		t.Fatalf("Got %d updates forwarded, want 1", len(sink.updates))
+	}
+	// A single event is forwarded as is, not copied
+	if sink.updates[0] != last {
+		t.Errorf("Got %v forwarded, want the last update", sink.updates[0])
+	}
+}
+
+func TestDedupFlushesBeforeDelete(t *testing.T) {
+	sink := &recordingSink{}
+	d := NewDedupSink(sink, time.Minute)
+
+	d.UpdateEvents(newDedupTestEvent("a", 2), nil)
+	deleted := newDedupTestEvent("a", 2)
+	deleted.Annotations = map[string]string{DeletedAnnotation: "true"}
+	d.UpdateEvents(deleted, nil)
+
+	if len(sink.updates) != 2 {
+		t.Fatalf("Got %d updates forwarded, want the pending update and the delete", len(sink.updates))
+	}
+	if isDeleted(sink.updates[0]) || !isDeleted(sink.updates[1]) {
+		t.Errorf("Got the delete forwarded before the pending update")
+	}
+	if len(d.pending) != 0 {
+		t.Errorf("Got %d pending entries after the delete, want none", len(d.pending))
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	sink := &recordingSink{}
+	d := NewDedupSink(sink, time.Minute)
+
+	d.UpdateEvents(newDedupTestEvent("a", 1), nil)
+	// The entries first seen after the deadline are held back
+	d.flush(time.Now().Add(-time.Minute))
+	if len(sink.updates) != 0 {
+		t.Fatalf("Got %d updates forwarded before the window elapsed, want none", len(sink.updates))
+	}
+	d.flush(time.Now())
+	if len(sink.updates) != 1 {
+		t.Fatalf("Got %d updates forwarded after the window, want 1", len(sink.updates))
+	}
+}
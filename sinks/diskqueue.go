@@ -0,0 +1,437 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// diskQueueSegmentExt is the extension of the segment files
+	diskQueueSegmentExt = ".log"
+	// diskQueueCursorFile holds the segment and offset of the next record
+	diskQueueCursorFile = "cursor"
+	// diskQueueSyncInterval is the interval of the segment and cursor syncs
+	diskQueueSyncInterval = time.Second
+)
+
+// DiskQueueConfig holds the settings of the DiskQueueSink
+type DiskQueueConfig struct {
+	// Dir holds the segments, e.g. on a persistent volume
+	Dir string
+
+	// SegmentSize is the size from which a new segment is started, MaxSize
+	// the total size from which the oldest segments are dropped (0 for no
+	// limit)
+	SegmentSize int64
+	MaxSize     int64
+}
+
+// diskQueueRecord is a queued update, one JSON line of a segment
+type diskQueueRecord struct {
+	Event    *v1.Event `json:"event"`
+	OldEvent *v1.Event `json:"old_event,omitempty"`
+}
+
+/*
+DiskQueueSink is a write-ahead log between the informer and the sinks: the
+updates are appended to segment files, and forwarded from them in order, so
+the updates not yet forwarded survive eventrouter restarts.
+
+The position of the next update to forward is kept in the cursor file, saved
+every second once the sink was handed the updates before it, when the sink is
+a flusher, e.g. a MultiSink, and the forwarded segments are deleted after the
+cursor moved past them; an update may be forwarded twice after a crash. The
+forwarding blocks when the sink blocks, e.g. a sink not discarding messages
+during an outage, the updates then pile up on disk rather than in memory, up
+to MaxSize.
+*/
+type DiskQueueSink struct {
+	sink EventSinkInterface
+	cfg  DiskQueueConfig
+
+	// mu guards the segment being written
+	mu       sync.Mutex
+	writeSeq uint64
+	w        *os.File
+	wSize    int64
+
+	// notify wakes up the reader on new records
+	notify chan struct{}
+
+	readSeq    uint64
+	readOffset int64
+	// forwarded are the segments read to the end, deleted once the cursor
+	// is saved past them
+	forwarded []uint64
+}
+
+// flusher is a sink handing the updates it buffers to the sinks it wraps on
+// Flush, e.g. a MultiSink
+type flusher interface {
+	Flush()
+}
+
+// NewDiskQueueSink creates a DiskQueueSink in front of sink, resuming from
+// the segments and cursor in the directory
+func NewDiskQueueSink(sink EventSinkInterface, cfg DiskQueueConfig) (*DiskQueueSink, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &DiskQueueSink{
+		sink:   sink,
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+	}
+
+	segments, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		q.writeSeq = segments[len(segments)-1]
+		q.readSeq = segments[0]
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(cfg.Dir, diskQueueCursorFile)); err == nil {
+		var seq uint64
+		var offset int64
+		if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &offset); err != nil {
+			return nil, fmt.Errorf("invalid disk queue cursor: %v", err)
+		}
+		if seq >= q.readSeq {
+			q.readSeq, q.readOffset = seq, offset
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The segments before the cursor were forwarded before a crash
+	for _, seq := range segments {
+		if seq < q.readSeq {
+			q.forwarded = append(q.forwarded, seq)
+		}
+	}
+
+	// The records appended after a crash would follow its torn line
+	if len(segments) > 0 {
+		if err := q.truncateTornLine(q.writeSeq); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.openSegment(q.writeSeq); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// truncateTornLine truncates the segment after its last complete line,
+// dropping the partial record of a crash
+func (q *DiskQueueSink) truncateTornLine(seq uint64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Look for the last newline from the end, a chunk at a time
+	size := info.Size()
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return nil
+	}
+	glog.Warningf("Dropping the torn record at the end of disk queue segment %d", seq)
+	return f.Truncate(end)
+}
+
+// segmentPath returns the path of a segment
+func (q *DiskQueueSink) segmentPath(seq uint64) string {
+	return filepath.Join(q.cfg.Dir, fmt.Sprintf("%020d%s", seq, diskQueueSegmentExt))
+}
+
+// segments returns the sequence numbers of the segments, in order
+func (q *DiskQueueSink) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), diskQueueSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), diskQueueSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// openSegment opens the segment to write, q.mu held
+func (q *DiskQueueSink) openSegment(seq uint64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.writeSeq, q.w, q.wSize = seq, f, info.Size()
+	return nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It appends the update to
+// the segment being written.
+func (q *DiskQueueSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	line, err := json.Marshal(diskQueueRecord{Event: eNew, OldEvent: eOld})
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	if q.wSize >= q.cfg.SegmentSize && q.wSize > 0 {
+		if err := q.rotate(); err != nil {
+			glog.Errorf("Failed to start a disk queue segment: %v", err)
+		}
+	}
+	n, err := q.w.Write(line)
+	q.wSize += int64(n)
+	q.mu.Unlock()
+	if err != nil {
+		glog.Errorf("Failed to write event %s/%s to the disk queue: %v", eNew.Namespace, eNew.Name, err)
+		return
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// rotate starts the next segment and drops the oldest ones over MaxSize,
+// q.mu held
+func (q *DiskQueueSink) rotate() error {
+	if err := q.w.Close(); err != nil {
+		glog.Warningf("Failed to close disk queue segment: %v", err)
+	}
+	if err := q.openSegment(q.writeSeq + 1); err != nil {
+		return err
+	}
+	if q.cfg.MaxSize <= 0 {
+		return nil
+	}
+
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+	var total int64
+	sizes := make([]int64, len(segments))
+	for i, seq := range segments {
+		if info, err := os.Stat(q.segmentPath(seq)); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, seq := range segments {
+		if total <= q.cfg.MaxSize || seq == q.writeSeq {
+			break
+		}
+		glog.Warningf("Disk queue over %d bytes, dropping segment %d", q.cfg.MaxSize, seq)
+		if err := os.Remove(q.segmentPath(seq)); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// Run sits in a loop, forwarding the queued updates to the sink, until stopCh
+// is closed
+func (q *DiskQueueSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(diskQueueSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.forward(stopCh); err != nil {
+			glog.Errorf("Failed to read the disk queue: %v", err)
+		}
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+			q.sync()
+		case <-stopCh:
+			q.sync()
+			return
+		}
+	}
+}
+
+// forward forwards the records from the cursor to the end of the queue
+func (q *DiskQueueSink) forward(stopCh <-chan bool) error {
+	lastSync := time.Now()
+	for {
+		// Segments are only appended to while being written, a segment not
+		// being written before it is read is complete
+		q.mu.Lock()
+		writing := q.readSeq == q.writeSeq
+		q.mu.Unlock()
+
+		f, err := os.Open(q.segmentPath(q.readSeq))
+		if os.IsNotExist(err) {
+			// Dropped over MaxSize, or not created yet
+			if next, ok := q.nextSegment(); ok {
+				q.readSeq, q.readOffset = next, 0
+				continue
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Seek(q.readOffset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				// A partial line is being written, read it on the next pass
+				break
+			}
+			q.readOffset += int64(len(line))
+
+			var record diskQueueRecord
+			if err := json.Unmarshal(line, &record); err != nil || record.Event == nil {
+				glog.Warningf("Skipping invalid disk queue record at %d:%d", q.readSeq, q.readOffset)
+				continue
+			}
+			q.sink.UpdateEvents(record.Event, record.OldEvent)
+
+			if time.Since(lastSync) >= diskQueueSyncInterval {
+				q.sync()
+				lastSync = time.Now()
+			}
+			select {
+			case <-stopCh:
+				f.Close()
+				return nil
+			default:
+			}
+		}
+		f.Close()
+
+		// Move to the next segment once this one is complete
+		next, ok := q.nextSegment()
+		if writing || !ok {
+			return nil
+		}
+		q.forwarded = append(q.forwarded, q.readSeq)
+		q.readSeq, q.readOffset = next, 0
+	}
+}
+
+// nextSegment returns the first segment after the one being read
+func (q *DiskQueueSink) nextSegment() (uint64, bool) {
+	segments, err := q.segments()
+	if err != nil {
+		glog.Warningf("Failed to list disk queue segments: %v", err)
+		return 0, false
+	}
+	for _, seq := range segments {
+		if seq > q.readSeq {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+// sync flushes the segment being written, and saves the cursor once the sink
+// was handed the updates before it, deleting the forwarded segments
+func (q *DiskQueueSink) sync() {
+	q.mu.Lock()
+	if err := q.w.Sync(); err != nil {
+		glog.Warningf("Failed to sync disk queue segment: %v", err)
+	}
+	q.mu.Unlock()
+
+	// The updates still queued in the sink would be lost on a crash
+	if f, ok := q.sink.(flusher); ok {
+		f.Flush()
+	}
+
+	// Write the cursor atomically, a torn cursor would lose the position
+	path := filepath.Join(q.cfg.Dir, diskQueueCursorFile)
+	cursor := fmt.Sprintf("%d %d\n", q.readSeq, q.readOffset)
+	if err := ioutil.WriteFile(path+".tmp", []byte(cursor), 0644); err != nil {
+		glog.Warningf("Failed to save disk queue cursor: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		glog.Warningf("Failed to save disk queue cursor: %v", err)
+		return
+	}
+
+	for _, seq := range q.forwarded {
+		if err := os.Remove(q.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Failed to delete disk queue segment %d: %v", seq, err)
+		}
+	}
+	q.forwarded = nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordingSink records the updates it is handed, and their old events
+type recordingSink struct {
+	mu      sync.Mutex
+	updates []*v1.Event
+	olds    []*v1.Event
+}
+
+func (r *recordingSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates = append(r.updates, eNew)
+	r.olds = append(r.olds, eOld)
+}
+
+// names returns the names of the recorded events, in order
+func (r *recordingSink) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, len(r.updates))
+	for i, e := range r.updates {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func newTestEvent(name string) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Reason:     "Test",
+		Message:    "test event " + name,
+	}
+}
+
+func newTestDiskQueue(t *testing.T, dir string, sink EventSinkInterface, cfg DiskQueueConfig) *DiskQueueSink {
+	cfg.Dir = dir
+	if cfg.SegmentSize == 0 {
+		cfg.SegmentSize = 1 << 20
+	}
+	q, err := NewDiskQueueSink(sink, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create disk queue: %v", err)
+	}
+	return q
+}
+
+func checkNames(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Got events %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDiskQueueResumesFromCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopCh := make(chan bool)
+
+	sink := &recordingSink{}
+	q := newTestDiskQueue(t, dir, sink, DiskQueueConfig{})
+	q.UpdateEvents(newTestEvent("a"), nil)
+	q.UpdateEvents(newTestEvent("b"), nil)
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	q.sync()
+	// Queued after the cursor was saved, lost by the sink on the restart
+	q.UpdateEvents(newTestEvent("c"), nil)
+	q.w.Close()
+	checkNames(t, sink.names(), "a", "b")
+
+	// The restarted queue forwards what is after the cursor only
+	sink = &recordingSink{}
+	q = newTestDiskQueue(t, dir, sink, DiskQueueConfig{})
+	defer q.w.Close()
+	q.UpdateEvents(newTestEvent("d"), nil)
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	checkNames(t, sink.names(), "c", "d")
+}
+
+func TestDiskQueueRotationAndMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopCh := make(chan bool)
+
+	// One record per segment, and room for one complete segment besides the
+	// one being written
+	sink := &recordingSink{}
+	q := newTestDiskQueue(t, dir, sink, DiskQueueConfig{SegmentSize: 1})
+	defer q.w.Close()
+	q.UpdateEvents(newTestEvent("a"), nil)
+	q.cfg.MaxSize = q.wSize
+
+	for _, name := range []string{"b", "c", "d"} {
+		q.UpdateEvents(newTestEvent(name), nil)
+	}
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("Got %d segments, want 2 under MaxSize", len(segments))
+	}
+	if segments[len(segments)-1] != q.writeSeq {
+		t.Errorf("Got last segment %d, want the segment being written %d", segments[len(segments)-1], q.writeSeq)
+	}
+
+	// The dropped segments are skipped
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	checkNames(t, sink.names(), "c", "d")
+
+	// The forwarded segments are deleted once the cursor is past them
+	q.sync()
+	segments, err = q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0] != q.writeSeq {
+		t.Errorf("Got segments %v after the sync, want [%d]", segments, q.writeSeq)
+	}
+}
+
+func TestDiskQueueTornLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopCh := make(chan bool)
+
+	sink := &recordingSink{}
+	q := newTestDiskQueue(t, dir, sink, DiskQueueConfig{})
+	defer q.w.Close()
+	q.UpdateEvents(newTestEvent("a"), nil)
+
+	// A record being written is not read until its line is complete
+	if _, err := q.w.Write([]byte(`{"event":{"metadata":{"name":"b"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	checkNames(t, sink.names(), "a")
+	offset := q.readOffset
+
+	if _, err := q.w.Write([]byte("}}}\n")); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupted record is skipped
+	if _, err := q.w.Write([]byte("not json\n")); err != nil {
+		t.Fatal(err)
+	}
+	q.UpdateEvents(newTestEvent("c"), nil)
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	checkNames(t, sink.names(), "a", "b", "c")
+	if q.readOffset <= offset {
+		t.Errorf("Got read offset %d, want past %d", q.readOffset, offset)
+	}
+}
+
+func TestDiskQueueRestartAfterTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopCh := make(chan bool)
+
+	// Crashed while writing a record
+	q := newTestDiskQueue(t, dir, &recordingSink{}, DiskQueueConfig{})
+	q.UpdateEvents(newTestEvent("a"), nil)
+	size := q.wSize
+	if _, err := q.w.Write([]byte(`{"event":{"metadata":{"name":"b"`)); err != nil {
+		t.Fatal(err)
+	}
+	q.w.Close()
+
+	// The torn record is dropped rather than prefixing the next one
+	sink := &recordingSink{}
+	q = newTestDiskQueue(t, dir, sink, DiskQueueConfig{})
+	defer q.w.Close()
+	if q.wSize != size {
+		t.Errorf("Got segment size %d after the restart, want %d", q.wSize, size)
+	}
+	q.UpdateEvents(newTestEvent("c"), nil)
+	if err := q.forward(stopCh); err != nil {
+		t.Fatalf("Failed to forward: %v", err)
+	}
+	checkNames(t, sink.names(), "a", "c")
+}
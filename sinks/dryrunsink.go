@@ -0,0 +1,56 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+/*
+DryRunSink stands in for a sink in dry-run mode: it logs the events that
+would be sent to the sink, serialized as the JSON sinks do, instead of
+sending them. The routing, filters, rate limits and sampling in front of the
+sinks still apply, the sink itself is not created.
+*/
+type DryRunSink struct {
+	eventOutput
+
+	name string
+}
+
+// NewDryRunSink creates a DryRunSink standing in for the named sink
+func NewDryRunSink(name string) EventSinkInterface {
+	return &DryRunSink{name: name}
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (d *DryRunSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eData := NewEventData(eNew, eOld)
+	b, err := d.encode(eData)
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return
+	}
+	if d.format != nil && d.format.protobuf {
+		// The binary records are logged as the JSON of the event data
+		doc, _ := marshalEventData(eData)
+		glog.Infof("[dry-run] Would send to sink %s a %d bytes protobuf record: %s", d.name, len(b), doc)
+		return
+	}
+	glog.Infof("[dry-run] Would send to sink %s: %s", d.name, b)
+}
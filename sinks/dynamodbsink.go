@@ -0,0 +1,289 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// dynamoDBMaxItems is the maximum number of items in one BatchWriteItem call
+	dynamoDBMaxItems = 25
+	// dynamoDBClusterScope is the partition key of events about cluster
+	// scoped objects, which have no namespace
+	dynamoDBClusterScope = "_cluster"
+)
+
+// DynamoDBConfig holds the settings of the DynamoDBSink
+type DynamoDBConfig struct {
+	Region string
+	Table  string
+
+	// Static credentials are optional, the default AWS credential chain (env,
+	// shared config, IRSA, instance role) is used when AccessKeyID is empty
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PartitionKey and SortKey are the names of the key attributes of the table
+	PartitionKey string
+	SortKey      string
+
+	// TTLAttribute, when set, is given the epoch time in seconds after which
+	// DynamoDB may expire the item, TTL after it was written
+	TTLAttribute string
+	TTL          time.Duration
+
+	// MaxRetries is the number of times unprocessed items are retried
+	MaxRetries int
+}
+
+/*
+DynamoDBSink writes events to a DynamoDB table, one item per event version,
+with BatchWriteItem calls of up to 25 items.
+
+The partition key is the namespace of the involved object (_cluster for
+cluster scoped objects) and the sort key is <timestamp>#<uid>, the timestamp
+being the RFC3339 UTC time of the last occurrence of the event, so a namespace
+can be queried by time range. The key event fields are stored as top level
+attributes and the whole event as JSON in the data attribute.
+
+Items DynamoDB leaves unprocessed because of throttling are retried with the
+retry policy of the sinks, up to MaxRetries times.
+*/
+type DynamoDBSink struct {
+	cfg     DynamoDBConfig
+	client  *dynamodb.DynamoDB
+	retry   RetryPolicy
+	eventCh channels.Channel
+}
+
+// NewDynamoDBSink constructs a new DynamoDBSink given its config
+func NewDynamoDBSink(cfg DynamoDBConfig, overflow bool, bufferSize int) (*DynamoDBSink, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(cfg.Region),
+	}
+	if cfg.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+
+	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DynamoDBSink{
+		cfg:    cfg,
+		client: dynamodb.New(sess),
+		retry:  retryPolicy.forSink().withRetries(cfg.MaxRetries),
+	}
+
+	if overflow {
+		d.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		d.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return d, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (d *DynamoDBSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	d.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through d.eventCh, and
+// writing them to DynamoDB. If multiple events have happened between loop
+// iterations, they are written in as few BatchWriteItem calls as possible.
+func (d *DynamoDBSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-d.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := d.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-d.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			d.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(d.eventCh); len(arr) > 0 {
+				d.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvents converts the events to items and writes them in batches
+func (d *DynamoDBSink) drainEvents(events []EventData) {
+	now := time.Now()
+
+	// A batch can't hold two items with the same key, keep the last one
+	batch := make([]*dynamodb.WriteRequest, 0, dynamoDBMaxItems)
+	batchEvents := make([]EventData, 0, dynamoDBMaxItems)
+	keys := map[string]int{}
+	for _, evt := range events {
+		item, err := d.item(evt, now)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		key := d.itemKey(item)
+		req := &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}}
+		if i, ok := keys[key]; ok {
+			batch[i], batchEvents[i] = req, evt
+			continue
+		}
+		if len(batch) == dynamoDBMaxItems {
+			d.batchWrite(batch, batchEvents)
+			batch = make([]*dynamodb.WriteRequest, 0, dynamoDBMaxItems)
+			batchEvents = make([]EventData, 0, dynamoDBMaxItems)
+			keys = map[string]int{}
+		}
+		keys[key] = len(batch)
+		batch = append(batch, req)
+		batchEvents = append(batchEvents, evt)
+	}
+
+	if len(batch) > 0 {
+		d.batchWrite(batch, batchEvents)
+	}
+}
+
+// itemKey returns the primary key of an item
+func (d *DynamoDBSink) itemKey(item map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(item[d.cfg.PartitionKey].S) + "\x00" + aws.StringValue(item[d.cfg.SortKey].S)
+}
+
+// item converts an event to a DynamoDB item
+func (d *DynamoDBSink) item(evt EventData, now time.Time) (map[string]*dynamodb.AttributeValue, error) {
+	eJSONBytes, err := json.Marshal(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	e := evt.Event
+	namespace := e.InvolvedObject.Namespace
+	if namespace == "" {
+		namespace = dynamoDBClusterScope
+	}
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = now
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		d.cfg.PartitionKey: {S: aws.String(namespace)},
+		d.cfg.SortKey:      {S: aws.String(ts.UTC().Format(time.RFC3339Nano) + "#" + string(e.UID))},
+		"verb":             {S: aws.String(evt.Verb)},
+		"count":            {N: aws.String(strconv.FormatInt(int64(e.Count), 10))},
+		"data":             {S: aws.String(string(eJSONBytes))},
+	}
+	// DynamoDB rejects empty string attributes
+	for name, value := range map[string]string{
+		"uid":             string(e.UID),
+		"resourceVersion": e.ResourceVersion,
+		"type":            e.Type,
+		"reason":          e.Reason,
+		"message":         e.Message,
+		"kind":            e.InvolvedObject.Kind,
+		"name":            e.InvolvedObject.Name,
+		"sourceComponent": e.Source.Component,
+		"sourceHost":      e.Source.Host,
+	} {
+		if value != "" {
+			item[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+	}
+	if d.cfg.TTLAttribute != "" {
+		expiry := now.Add(d.cfg.TTL).Unix()
+		item[d.cfg.TTLAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiry, 10))}
+	}
+	return item, nil
+}
+
+// batchWrite writes the items of the events, retrying the ones that DynamoDB
+// left unprocessed.
+func (d *DynamoDBSink) batchWrite(requests []*dynamodb.WriteRequest, events []EventData) {
+	byKey := make(map[string]EventData, len(events))
+	for i, req := range requests {
+		byKey[d.itemKey(req.PutRequest.Item)] = events[i]
+	}
+
+	err := d.retry.Do(func() error {
+		out, err := d.client.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				d.cfg.Table: requests,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		requests = out.UnprocessedItems[d.cfg.Table]
+		if len(requests) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%d items unprocessed", len(requests))
+	})
+	if err != nil {
+		glog.Errorf("Failed to write %d items to table(%s): %v", len(requests), d.cfg.Table, err)
+		failed := make([]EventData, 0, len(requests))
+		for _, req := range requests {
+			if req.PutRequest == nil {
+				continue
+			}
+			if evt, ok := byKey[d.itemKey(req.PutRequest.Item)]; ok {
+				failed = append(failed, evt)
+			}
+		}
+		deadLetterEvents("dynamodb", failed, err)
+	}
+}
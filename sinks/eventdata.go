@@ -20,32 +20,104 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
 
 	"github.com/crewjam/rfc5424"
 	"github.com/json-iterator/go"
 	"github.com/json-iterator/go/extra"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/nytlabs/gojsonexplode"
 )
 
 // EventData encodes an eventrouter event and previous event, with a verb for
-// whether the event is created or updated.
+// whether the event is created, updated or deleted.
 type EventData struct {
 	Verb     string    `json:"verb"`
 	Event    *v1.Event `json:"event"`
 	OldEvent *v1.Event `json:"old_event,omitempty"`
+
+	// Repeated is the count increment of the REPEATED updates
+	Repeated int32 `json:"repeated,omitempty"`
+
+	// DeliveryKey identifies the update, see deliveryKeys
+	DeliveryKey string `json:"delivery_key,omitempty"`
+
+	// Severity is the severity level of the event, with severities
+	Severity string `json:"severity,omitempty"`
+}
+
+// DeletedAnnotation marks the events forwarded on their delete, for which
+// NewEventData writes a DELETED tombstone record. Only the sinks with
+// <sink>ForwardDeletes receive them.
+const DeletedAnnotation = "eventrouter.heptio.com/deleted"
+
+// isDeleted returns true if the event is forwarded on its delete
+func isDeleted(e *v1.Event) bool {
+	return e.Annotations[DeletedAnnotation] == "true"
+}
+
+// countDeltas, when set, makes NewEventData turn the updates only
+// incrementing the count of an event into compact REPEATED records. It is set
+// by ManufactureSink.
+var countDeltas bool
+
+// deliveryKeys, when set, makes NewEventData set the delivery key of the
+// updates, for the consumers and sinks to suppress the duplicates forwarded
+// by replicas running active-active. It is set by ManufactureSink.
+var deliveryKeys bool
+
+// deliveryKey returns the idempotency key of an update of an event, the same
+// for all the replicas forwarding it: its UID and resourceVersion, suffixed
+// for a delete, which keeps the resourceVersion of the last update
+func deliveryKey(e *v1.Event) string {
+	key := string(e.UID) + "-" + e.ResourceVersion
+	if isDeleted(e) {
+		key += "-deleted"
+	}
+	return key
+}
+
+// key returns the delivery key of the update, also without deliveryKeys
+func (e EventData) key() string {
+	if e.DeliveryKey != "" {
+		return e.DeliveryKey
+	}
+	// The tombstones of the deletes don't keep the annotations
+	key := string(e.Event.UID) + "-" + e.Event.ResourceVersion
+	if e.Verb == "DELETED" {
+		key += "-deleted"
+	}
+	return key
 }
 
 // NewEventData constructs an EventData struct from an old and new event,
 // setting the verb accordingly
 func NewEventData(eNew *v1.Event, eOld *v1.Event) EventData {
 	var eData EventData
-	if eOld == nil {
+	if isDeleted(eNew) {
+		// The tombstone identifies the deleted event by its UID, for the
+		// stores downstream to expire or mark their record of it
+		tombstone := compactEvent(eNew)
+		tombstone.ClusterName = eNew.ClusterName
+		eData = EventData{
+			Verb:  "DELETED",
+			Event: tombstone,
+		}
+	} else if eOld == nil {
 		eData = EventData{
 			Verb:  "ADDED",
 			Event: eNew,
 		}
+	} else if countDeltas && eNew.Count > eOld.Count && onlyCountChanged(eNew, eOld) {
+		eData = EventData{
+			Verb:     "REPEATED",
+			Event:    compactEvent(eNew),
+			Repeated: eNew.Count - eOld.Count,
+		}
 	} else {
 		eData = EventData{
 			Verb:     "UPDATED",
@@ -53,10 +125,67 @@ func NewEventData(eNew *v1.Event, eOld *v1.Event) EventData {
 			OldEvent: eOld,
 		}
 	}
+	if deliveryKeys {
+		eData.DeliveryKey = deliveryKey(eNew)
+	}
+	if severities != nil {
+		eData.Severity = eventSeverity(eNew).String()
+	}
 
 	return eData
 }
 
+// inPlace returns the event data for the sinks replacing the document of an
+// event on update: the REPEATED records keep the full event, as they replace
+// it rather than add to it
+func (e EventData) inPlace(eNew *v1.Event) EventData {
+	if e.Verb == "REPEATED" {
+		e.Event = eNew
+	}
+	return e
+}
+
+// onlyCountChanged returns true if the events only differ by their count,
+// timestamps of last occurrence and resource version
+func onlyCountChanged(eNew *v1.Event, eOld *v1.Event) bool {
+	clear := func(e *v1.Event) *v1.Event {
+		e = e.DeepCopy()
+		e.Count = 0
+		e.LastTimestamp = metav1.Time{}
+		e.ResourceVersion = ""
+		if e.Series != nil {
+			e.Series.Count = 0
+			e.Series.LastObservedTime = metav1.MicroTime{}
+		}
+		return e
+	}
+	return equality.Semantic.DeepEqual(clear(eNew), clear(eOld))
+}
+
+// compactEvent returns the identifying fields of an event with its count and
+// last occurrence, for the REPEATED records
+func compactEvent(e *v1.Event) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            e.Name,
+			Namespace:       e.Namespace,
+			UID:             e.UID,
+			ResourceVersion: e.ResourceVersion,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:      e.InvolvedObject.Kind,
+			Namespace: e.InvolvedObject.Namespace,
+			Name:      e.InvolvedObject.Name,
+			UID:       e.InvolvedObject.UID,
+		},
+		Reason:        e.Reason,
+		Type:          e.Type,
+		Count:         e.Count,
+		LastTimestamp: e.LastTimestamp,
+		Series:        e.Series,
+	}
+}
+
 // WriteRFC5424 writes the current event data to the given io.Writer using
 // RFC5424 (syslog over TCP) syntax.
 func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
@@ -74,9 +203,14 @@ func (e *EventData) WriteRFC5424(w io.Writer) (int64, error) {
 	// https://github.com/crewjam/rfc5424/blob/master/marshal.go#L90. There's no
 	// attempt at trying to clean them up here because hostnames and component
 	// names already adhere to this convention in practice.
+	// The severity is only set with a severity mapping, for compatibility
+	priority := rfc5424.Daemon
+	if severities != nil {
+		priority |= rfc5424.Priority(eventSeverity(e.Event).syslog())
+	}
 	msg := rfc5424.Message{
-		Priority:  rfc5424.Daemon,
-		Timestamp: e.Event.LastTimestamp.Time,
+		Priority:  priority,
+		Timestamp: eventTimestamp(e.Event),
 		Hostname:  e.Event.Source.Host,
 		AppName:   e.Event.Source.Component,
 		Message:   eJSONBytes,
@@ -105,3 +239,114 @@ func (e *EventData) WriteFlattenedJSON(w io.Writer) (int64, error) {
 	written, err := w.Write([]byte(result))
 	return int64(written), err
 }
+
+// eventKey returns the value of the named event field, for sinks that derive
+// a partition or routing key from the event. Supported fields are namespace,
+// name, kind and uid of the involved object, and the event reason and type.
+// Unknown fields return an empty key.
+func eventKey(e *v1.Event, field string) string {
+	switch field {
+	case "namespace":
+		return e.InvolvedObject.Namespace
+	case "name":
+		return e.InvolvedObject.Name
+	case "kind":
+		return e.InvolvedObject.Kind
+	case "uid":
+		return string(e.InvolvedObject.UID)
+	case "reason":
+		return e.Reason
+	case "type":
+		return e.Type
+	case "deliveryKey":
+		return deliveryKey(e)
+	}
+	return ""
+}
+
+// involvedObjectKey identifies the involved object of an event: its UID, else
+// its kind, namespace and name
+func involvedObjectKey(e *v1.Event) string {
+	if e.InvolvedObject.UID != "" {
+		return string(e.InvolvedObject.UID)
+	}
+	return e.InvolvedObject.Kind + "/" + e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name
+}
+
+// describeObject returns the kind and namespace/name of the involved object,
+// e.g. "Pod default/web-0", for sinks writing human readable messages
+func describeObject(e *v1.Event) string {
+	if e.InvolvedObject.Namespace == "" {
+		return e.InvolvedObject.Kind + " " + e.InvolvedObject.Name
+	}
+	return e.InvolvedObject.Kind + " " + e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name
+}
+
+// eventKeyFields are the fields that can be referenced in an event template
+var eventKeyFields = []string{"namespace", "name", "kind", "uid", "reason", "type", "deliveryKey"}
+
+// expandEventTemplate replaces the {field} placeholders of tmpl with the
+// matching eventKey values, e.g. "k8s.{namespace}.{reason}".
+func expandEventTemplate(tmpl string, e *v1.Event) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	oldnew := make([]string, 0, 2*len(eventKeyFields))
+	for _, f := range eventKeyFields {
+		oldnew = append(oldnew, "{"+f+"}", eventKey(e, f))
+	}
+	return strings.NewReplacer(oldnew...).Replace(tmpl)
+}
+
+// EventFilter selects events by type, reason, involved object namespace and
+// involved object kind, for sinks that should only see some events, like
+// alerting sinks. An empty list matches any value. The regular expressions,
+// when set, must match (or, for the exclude ones, not match) the reason and
+// the message of the events.
+type EventFilter struct {
+	Types      []string
+	Reasons    []string
+	Namespaces []string
+	Kinds      []string
+
+	ReasonRegexp         *regexp.Regexp
+	ExcludeReasonRegexp  *regexp.Regexp
+	MessageRegexp        *regexp.Regexp
+	ExcludeMessageRegexp *regexp.Regexp
+}
+
+// Matches returns true if the event passes the filter
+func (f EventFilter) Matches(e *v1.Event) bool {
+	return filterMatches(f.Types, e.Type) &&
+		filterMatches(f.Reasons, e.Reason) &&
+		filterMatches(f.Namespaces, e.InvolvedObject.Namespace) &&
+		filterMatches(f.Kinds, e.InvolvedObject.Kind) &&
+		regexpMatches(f.ReasonRegexp, f.ExcludeReasonRegexp, e.Reason) &&
+		regexpMatches(f.MessageRegexp, f.ExcludeMessageRegexp, e.Message)
+}
+
+// matchesAll returns true if the filter lets any event pass
+func (f EventFilter) matchesAll() bool {
+	return len(f.Types) == 0 && len(f.Reasons) == 0 && len(f.Namespaces) == 0 && len(f.Kinds) == 0 &&
+		f.ReasonRegexp == nil && f.ExcludeReasonRegexp == nil &&
+		f.MessageRegexp == nil && f.ExcludeMessageRegexp == nil
+}
+
+func filterMatches(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func regexpMatches(include, exclude *regexp.Regexp, v string) bool {
+	if include != nil && !include.MatchString(v) {
+		return false
+	}
+	return exclude == nil || !exclude.MatchString(v)
+}
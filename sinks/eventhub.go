@@ -2,48 +2,158 @@ package sinks
 
 import (
 	"context"
-	"encoding/json"
 
+	"github.com/Azure/azure-amqp-common-go/v2/aad"
 	eventhub "github.com/Azure/azure-event-hubs-go/v2"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/eapache/channels"
 	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
 )
 
-const maxMessageSize = 1046528
+const (
+	maxMessageSize = 1046528
+
+	// eventHubResourceURI is the AAD resource Event Hubs tokens are issued for
+	eventHubResourceURI = "https://eventhubs.azure.net/"
+)
 
 // EventHubSink sends events to an Azure Event Hub.
 type EventHubSink struct {
+	eventOutput
+
 	hub     *eventhub.Hub
 	eventCh channels.Channel
+
+	// partitionKey is the event field used as partition key, see eventKey.
+	// When empty, Event Hubs distributes events across partitions.
+	partitionKey string
+
+	// retry retries the failed batches
+	retry RetryPolicy
+}
+
+// EventHubAADConfig holds the Azure Active Directory settings used to
+// authenticate to an Event Hub instead of a SAS connection string.
+type EventHubAADConfig struct {
+	// Namespace is the Event Hubs namespace, without the servicebus suffix
+	Namespace string
+	// HubName is the name of the Event Hub within the namespace
+	HubName string
+	// Environment is the Azure cloud name, e.g. AzurePublicCloud
+	Environment string
+	// TenantID, ClientID and ClientSecret identify a service principal. If
+	// ClientSecret is empty a managed identity is used instead, ClientID then
+	// optionally selects a user assigned identity.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
 }
 
-// NewEventHubSink constructs a new EventHubSink given a event hub connection string
-// and buffering options.
+// NewEventHubSink constructs a new EventHubSink given a event hub connection
+// string and buffering options.
 //
 // ```
 // export EVENTHUB_RESOURCE_GROUP=eventrouter
-// export EVENTHUB_NAMESPACE=eventrouter-ns                                                                                                               <<<
+// export EVENTHUB_NAMESPACE=eventrouter-ns
 // export EVENTHUB_NAME=eventrouter
 // export EVENTHUB_REGION=westus2
 // export EVENTHUB_RULE_NAME=eventrouter-send
 //
 // az group create -g ${EVENTHUB_RESOURCE_GROUP} -l ${EVENTHUB_REGION}
-// az eventhubs namespace create -g ${EVENTHUB_RESOURCE_GROUP} -n ${EVENTHUB_NAMESPACE} -l ${EVENTHUB_REGION}
-// az eventhubs eventhub create -g ${EVENTHUB_RESOURCE_GROUP} --namespace-name ${EVENTHUB_NAMESPACE} -n ${EVENTHUB_NAME}
-// az eventhubs eventhub authorization-rule create -g ${EVENTHUB_RESOURCE_GROUP} --namespace-name ${EVENTHUB_NAMESPACE} --eventhub-name ${EVENTHUB_NAME} -n ${EVENTHUB_RULE_NAME} --rights Send
-// export EVENTHUB_CONNECTION_STRING=$(az eventhubs eventhub authorization-rule keys list -g ${EVENTHUB_RESOURCE_GROUP} --namespace-name ${EVENTHUB_NAMESPACE} --eventhub-name ${EVENTHUB_NAME} -n ${EVENTHUB_RULE_NAME} | jq -r '.primaryConnectionString')
+// az eventhubs namespace create -g ${EVENTHUB_RESOURCE_GROUP} \
+//     -n ${EVENTHUB_NAMESPACE} -l ${EVENTHUB_REGION}
+// az eventhubs eventhub create -g ${EVENTHUB_RESOURCE_GROUP} \
+//     --namespace-name ${EVENTHUB_NAMESPACE} -n ${EVENTHUB_NAME}
+// az eventhubs eventhub authorization-rule create \
+//     -g ${EVENTHUB_RESOURCE_GROUP} --namespace-name ${EVENTHUB_NAMESPACE} \
+//     --eventhub-name ${EVENTHUB_NAME} -n ${EVENTHUB_RULE_NAME} --rights Send
+// export EVENTHUB_CONNECTION_STRING=$(
+//     az eventhubs eventhub authorization-rule keys list \
+//     -g ${EVENTHUB_RESOURCE_GROUP} --namespace-name ${EVENTHUB_NAMESPACE} \
+//     --eventhub-name ${EVENTHUB_NAME} -n ${EVENTHUB_RULE_NAME} \
+//     | jq -r '.primaryConnectionString')
 //
 // cat yaml/eventrouter-azure.yaml | envsubst | kubectl apply -f
 // ```
 //
-// connString expects the Azure Event Hub connection string format:
-//		`Endpoint=sb://YOUR_ENDPOINT.servicebus.windows.net/;SharedAccessKeyName=YOUR_ACCESS_KEY_NAME;SharedAccessKey=YOUR_ACCESS_KEY;EntityPath=YOUR_EVENT_HUB_NAME`
-func NewEventHubSink(connString string, overflow bool, bufferSize int) (*EventHubSink, error) {
+// connString expects the Azure Event Hub connection string format, its keys
+// joined by semicolons on one line:
+//
+//	Endpoint=sb://YOUR_ENDPOINT.servicebus.windows.net/;
+//	SharedAccessKeyName=YOUR_ACCESS_KEY_NAME;
+//	SharedAccessKey=YOUR_ACCESS_KEY;
+//	EntityPath=YOUR_EVENT_HUB_NAME
+func NewEventHubSink(connString string, partitionKey string, overflow bool, bufferSize int) (*EventHubSink, error) {
 	hub, err := eventhub.NewHubFromConnectionString(connString)
 	if err != nil {
 		return nil, err
 	}
+	return newEventHubSink(hub, partitionKey, overflow, bufferSize), nil
+}
+
+// NewAADEventHubSink constructs a new EventHubSink that authenticates with an
+// Azure AD service principal or managed identity (e.g. AAD Pod Identity on
+// AKS), so no SAS connection string needs to be stored or rotated.
+func NewAADEventHubSink(cfg EventHubAADConfig, partitionKey string, overflow bool, bufferSize int) (*EventHubSink, error) {
+	env, err := azure.EnvironmentFromName(cfg.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newAADToken(env, cfg.TenantID, cfg.ClientID, cfg.ClientSecret, eventHubResourceURI)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := aad.NewJWTProvider(aad.JWTProviderWithAADToken(token), aad.JWTProviderWithAzureEnvironment(&env))
+	if err != nil {
+		return nil, err
+	}
+
+	hub, err := eventhub.NewHub(cfg.Namespace, cfg.HubName, provider, eventhub.HubWithEnvironment(env))
+	if err != nil {
+		return nil, err
+	}
+	return newEventHubSink(hub, partitionKey, overflow, bufferSize), nil
+}
+
+// newAADToken returns a refreshed AAD token for the given resource. A service
+// principal is used when clientSecret is set, otherwise the managed identity
+// of the node (optionally the user assigned identity clientID).
+func newAADToken(env azure.Environment, tenantID, clientID, clientSecret, resource string) (*adal.ServicePrincipalToken, error) {
+	var token *adal.ServicePrincipalToken
+	if clientSecret != "" {
+		oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		token, err = adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, resource)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		msiEndpoint, err := adal.GetMSIVMEndpoint()
+		if err != nil {
+			return nil, err
+		}
+		if clientID != "" {
+			token, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource, clientID)
+		} else {
+			token, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := token.Refresh(); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func newEventHubSink(hub *eventhub.Hub, partitionKey string, overflow bool, bufferSize int) *EventHubSink {
 	var eventCh channels.Channel
 	if overflow {
 		eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
@@ -51,7 +161,7 @@ func NewEventHubSink(connString string, overflow bool, bufferSize int) (*EventHu
 		eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
 	}
 
-	return &EventHubSink{hub: hub, eventCh: eventCh}, nil
+	return &EventHubSink{hub: hub, eventCh: eventCh, partitionKey: partitionKey, retry: retryPolicy.forSink()}
 }
 
 // UpdateEvents implements the EventSinkInterface. It really just writes the
@@ -96,17 +206,25 @@ loop:
 
 			h.drainEvents(arr)
 		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(h.eventCh); len(arr) > 0 {
+				h.drainEvents(arr)
+			}
 			break loop
 		}
 	}
+	if err := h.hub.Close(context.Background()); err != nil {
+		glog.Warningf("Failed to close the event hub: %v", err)
+	}
 }
 
 // drainEvents takes an array of event data and sends it to the receiving event hub.
 func (h *EventHubSink) drainEvents(events []EventData) {
 	var messageSize int
 	var evts []*eventhub.Event
+	var batch []EventData
 	for _, evt := range events {
-		eJSONBytes, err := json.Marshal(evt)
+		eJSONBytes, err := h.encode(evt)
 		if err != nil {
 			glog.Warningf("Failed to flatten json: %v", err)
 			return
@@ -114,17 +232,30 @@ func (h *EventHubSink) drainEvents(events []EventData) {
 		glog.V(4).Infof("%s", string(eJSONBytes))
 		messageSize += len(eJSONBytes)
 		if messageSize > maxMessageSize {
-			h.sendBatch(evts)
-			evts = nil
+			h.sendBatch(evts, batch)
+			evts, batch = nil, nil
 			messageSize = 0
 		}
-		evts = append(evts, eventhub.NewEvent(eJSONBytes))
+		ehEvent := eventhub.NewEvent(eJSONBytes)
+		if h.partitionKey != "" {
+			if key := eventKey(evt.Event, h.partitionKey); key != "" {
+				ehEvent.PartitionKey = &key
+			}
+		}
+		evts = append(evts, ehEvent)
+		batch = append(batch, evt)
 	}
-	h.sendBatch(evts)
+	h.sendBatch(evts, batch)
 }
 
-func (h *EventHubSink) sendBatch(evts []*eventhub.Event) {
-	if err := h.hub.SendBatch(context.Background(), eventhub.NewEventBatchIterator(evts...)); err != nil {
+// sendBatch sends the messages of the events, dead-lettering the events on
+// failure
+func (h *EventHubSink) sendBatch(evts []*eventhub.Event, events []EventData) {
+	err := h.retry.Do(func() error {
+		return h.hub.SendBatch(context.Background(), eventhub.NewEventBatchIterator(evts...))
+	})
+	if err != nil {
 		glog.Errorf("Failed to send batch of %d: %v", len(evts), err)
+		deadLetterEvents("eventhub", events, err)
 	}
 }
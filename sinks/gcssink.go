@@ -0,0 +1,258 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"google.golang.org/api/option"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/*
+GCSSink archives events in Google Cloud Storage, like the S3 sink does on AWS.
+Events are buffered and uploaded as one object when either:
+1) Time(uploadInterval): the specified time has passed since the last upload
+2) Data size(maxSize): the buffered data grew over maxSize bytes
+
+Objects are named <prefix>/<year>/<month>/<day>/<unix nano>.<ext>, and gzipped
+(with Content-Encoding: gzip) when compress is set.
+
+Without a credentials file the Application Default Credentials are used, which
+includes GKE Workload Identity.
+*/
+type GCSSink struct {
+	eventOutput
+
+	client *storage.Client
+	retry  RetryPolicy
+
+	// bucket is the name of the GCS bucket, prefix the first level directory
+	// in the bucket where the events are stored
+	bucket string
+	prefix string
+
+	// outputFormat is json, flatjson or rfc5424
+	outputFormat string
+	compress     bool
+
+	uploadInterval time.Duration
+	maxSize        int
+
+	lastUpload time.Time
+	bodyBuf    *bytes.Buffer
+	// bufEvents are the events in the buffer, dead-lettered when dropped
+	bufEvents []EventData
+	eventCh   channels.Channel
+}
+
+// NewGCSSink is the factory method constructing a new GCSSink
+func NewGCSSink(credentialsFile, bucket, prefix, outputFormat string, compress bool, uploadInterval time.Duration, maxSize int, overflow bool, bufferSize int) (*GCSSink, error) {
+	switch outputFormat {
+	case "json", "flatjson", "rfc5424":
+	default:
+		return nil, fmt.Errorf("invalid gcs output format %q", outputFormat)
+	}
+
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &GCSSink{
+		client:         client,
+		retry:          retryPolicy.forSink(),
+		bucket:         bucket,
+		prefix:         prefix,
+		outputFormat:   outputFormat,
+		compress:       compress,
+		uploadInterval: uploadInterval,
+		maxSize:        maxSize,
+		lastUpload:     time.Now(),
+		bodyBuf:        bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (s *GCSSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh and
+// adding them to the buffer, which is uploaded when it is large or old
+// enough. The buffer is also checked every few seconds, so the last events
+// are uploaded even when no new events come in.
+func (s *GCSSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			s.drainEvents(arr)
+		case <-ticker.C:
+			if s.bodyBuf.Len() > 0 && time.Since(s.lastUpload) >= s.uploadInterval {
+				s.upload()
+			}
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+	if s.bodyBuf.Len() > 0 {
+		if err := s.upload(); err != nil && len(s.bufEvents) > 0 {
+			// Kept for an attempt that won't come
+			deadLetterEvents("gcs", s.bufEvents, err)
+		}
+	}
+	s.client.Close()
+}
+
+// drainEvents adds the events to the buffer and uploads it if needed
+func (s *GCSSink) drainEvents(events []EventData) {
+	for _, evt := range events {
+		var err error
+		switch s.outputFormat {
+		case "rfc5424":
+			_, err = evt.WriteRFC5424(s.bodyBuf)
+		case "flatjson":
+			_, err = evt.WriteFlattenedJSON(s.bodyBuf)
+		default:
+			var eJSONBytes []byte
+			if eJSONBytes, err = s.encode(evt); err == nil {
+				s.bodyBuf.Write(eJSONBytes)
+			}
+		}
+		if err != nil {
+			glog.Warningf("Failed to serialize event: %v", err)
+			continue
+		}
+		s.bodyBuf.WriteByte('\n')
+		s.bufEvents = append(s.bufEvents, evt)
+	}
+
+	if (s.maxSize > 0 && s.bodyBuf.Len() >= s.maxSize) || time.Since(s.lastUpload) >= s.uploadInterval {
+		s.upload()
+	}
+}
+
+// upload writes the buffer to a new object and clears it, returning the error
+// of a failed upload. On failure, the buffer is kept for the next attempt
+// unless it grew over twice maxSize, its events being dead-lettered.
+func (s *GCSSink) upload() error {
+	now := time.Now().UTC()
+	ext := "json"
+	if s.outputFormat == "rfc5424" {
+		ext = "txt"
+	}
+	name := fmt.Sprintf("%s/%d/%02d/%02d/%d.%s", s.prefix, now.Year(), now.Month(), now.Day(), now.UnixNano(), ext)
+
+	err := s.retry.Do(func() error {
+		return s.write(name)
+	})
+	s.lastUpload = time.Now()
+	if err != nil {
+		glog.Errorf("Error uploading gs://%s/%s: %v", s.bucket, name, err)
+		if s.maxSize <= 0 || s.bodyBuf.Len() < 2*s.maxSize {
+			return err
+		}
+		glog.Errorf("Dropping %d bytes of events after failed uploads, dead-lettering them", s.bodyBuf.Len())
+		deadLetterEvents("gcs", s.bufEvents, err)
+	} else {
+		glog.V(4).Infof("Uploaded gs://%s/%s", s.bucket, name)
+	}
+	s.bodyBuf.Truncate(0)
+	s.bufEvents = nil
+	return err
+}
+
+// write writes the buffer to the object of the name
+func (s *GCSSink) write(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	w := s.client.Bucket(s.bucket).Object(name).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if s.outputFormat == "rfc5424" {
+		w.ContentType = "text/plain"
+	}
+
+	var err error
+	if s.compress {
+		w.ContentEncoding = "gzip"
+		zw := gzip.NewWriter(w)
+		if _, err = zw.Write(s.bodyBuf.Bytes()); err == nil {
+			err = zw.Close()
+		}
+	} else {
+		_, err = w.Write(s.bodyBuf.Bytes())
+	}
+	if err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
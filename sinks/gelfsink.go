@@ -0,0 +1,344 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// gelfChunkHeaderSize is the size of the header of a chunked UDP message:
+	// magic bytes, message ID, sequence number and sequence count
+	gelfChunkHeaderSize = 12
+	// gelfMaxChunks is the maximum number of chunks of one message
+	gelfMaxChunks = 128
+)
+
+// gelfChunkMagic starts every chunk of a chunked UDP message
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// GELFConfig holds the settings of the GELFSink
+type GELFConfig struct {
+	// Network is "udp", "tcp" or "tls"
+	Network string
+	Address string
+
+	// Host is the host field of the messages, the eventrouter hostname by
+	// default
+	Host string
+
+	// ChunkSize is the maximum size of a UDP datagram, larger messages are
+	// chunked. Compress gzips UDP messages; GELF over TCP can't be compressed.
+	ChunkSize int
+	Compress  bool
+
+	// TLS settings, used with the tls network
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// Fields are additional fields added to every message, e.g. cluster=prod;
+	// their names get the leading underscore of GELF additional fields
+	Fields map[string]string
+}
+
+/*
+GELFSink sends events to Graylog (or any GELF input) as GELF 1.1 messages,
+over UDP with chunking, plain TCP or TCP with TLS.
+
+The short_message is the event message and the level its syslog severity:
+by default warning (4) for Warning events and informational (6) for the
+others, see eventSeverity. The event
+and involved object fields are sent as the additional fields _namespace,
+_kind, _name, _reason, _type, _count, _uid, _verb, _source_component and
+_source_host.
+
+Like the socket sink, the TCP connection is opened lazily and re-established
+with the retry policy of the sinks; the events are re-sent after a failed
+write, so Graylog may see duplicates across reconnects, and dead-lettered
+when the retries are exhausted.
+*/
+type GELFSink struct {
+	cfg       GELFConfig
+	tlsConfig *tls.Config
+
+	conn    net.Conn
+	retry   RetryPolicy
+	eventCh channels.Channel
+}
+
+// NewGELFSink constructs a new GELFSink given its config
+func NewGELFSink(cfg GELFConfig, overflow bool, bufferSize int) (*GELFSink, error) {
+	g := &GELFSink{
+		cfg:   cfg,
+		retry: retryPolicy.forSink(),
+	}
+
+	switch cfg.Network {
+	case "udp":
+		if cfg.ChunkSize <= gelfChunkHeaderSize {
+			return nil, fmt.Errorf("invalid gelf chunk size %d", cfg.ChunkSize)
+		}
+	case "tcp":
+	case "tls":
+		tlsConfig, err := tlsClientConfig(cfg.CAFile, "", "", cfg.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		g.tlsConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("invalid gelf network %q, must be udp, tcp or tls", cfg.Network)
+	}
+
+	if g.cfg.Host == "" {
+		g.cfg.Host, _ = os.Hostname()
+	}
+
+	if overflow {
+		g.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		g.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return g, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (g *GELFSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	g.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through g.eventCh, and
+// sending them as GELF messages. If multiple events have happened between
+// loop iterations, they are sent together.
+func (g *GELFSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-g.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := g.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-g.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			g.drainEvents(arr, stopCh)
+		case <-stopCh:
+			// Send the events queued before the stop, retrying them
+			// regardless of the stop
+			if arr := queuedEvents(g.eventCh); len(arr) > 0 {
+				g.drainEvents(arr, nil)
+			}
+			break loop
+		}
+	}
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+// message converts an event to a GELF message
+func (g *GELFSink) message(evt EventData) map[string]interface{} {
+	e := evt.Event
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	level := eventSeverity(e).syslog()
+
+	msg := make(map[string]interface{}, len(g.cfg.Fields)+15)
+	for k, v := range g.cfg.Fields {
+		msg["_"+k] = v
+	}
+	msg["version"] = "1.1"
+	msg["host"] = g.cfg.Host
+	msg["short_message"] = e.Message
+	msg["timestamp"] = float64(ts.UnixNano()/int64(time.Millisecond)) / 1000
+	msg["level"] = level
+	msg["_namespace"] = e.InvolvedObject.Namespace
+	msg["_kind"] = e.InvolvedObject.Kind
+	msg["_name"] = e.InvolvedObject.Name
+	msg["_reason"] = e.Reason
+	msg["_type"] = e.Type
+	msg["_count"] = e.Count
+	msg["_uid"] = string(e.UID)
+	msg["_verb"] = evt.Verb
+	msg["_source_component"] = e.Source.Component
+	msg["_source_host"] = e.Source.Host
+	return msg
+}
+
+// drainEvents sends the events, reconnecting until they could be written,
+// the retries are exhausted or stopCh is closed, nil to keep retrying
+func (g *GELFSink) drainEvents(events []EventData, stopCh <-chan bool) {
+	messages := make([][]byte, 0, len(events))
+	for _, evt := range events {
+		msg, err := json.Marshal(g.message(evt))
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	g.retry.start()
+	for attempt := 1; ; attempt++ {
+		err := g.write(messages)
+		if err == nil {
+			return
+		}
+
+		glog.Errorf("Failed to send %d events to gelf %s://%s: %v", len(messages), g.cfg.Network, g.cfg.Address, err)
+		if g.conn != nil {
+			g.conn.Close()
+			g.conn = nil
+		}
+
+		backoff, ok := g.retry.next(attempt)
+		if !ok {
+			deadLetterEvents("gelf", events, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stopCh:
+			deadLetterEvents("gelf", events, err)
+			return
+		}
+	}
+}
+
+// dial opens the connection to the GELF input
+func (g *GELFSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: socketDialTimeout}
+	switch g.cfg.Network {
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", g.cfg.Address, g.tlsConfig)
+	default:
+		return dialer.Dial(g.cfg.Network, g.cfg.Address)
+	}
+}
+
+// write (re)connects if needed and sends the messages: null byte delimited
+// in one write over TCP, one (possibly chunked) message per datagram over UDP
+func (g *GELFSink) write(messages [][]byte) error {
+	if g.conn == nil {
+		conn, err := g.dial()
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+
+	if g.cfg.Network != "udp" {
+		var buf bytes.Buffer
+		for _, msg := range messages {
+			buf.Write(msg)
+			buf.WriteByte(0)
+		}
+		_, err := g.conn.Write(buf.Bytes())
+		return err
+	}
+
+	for _, msg := range messages {
+		if g.cfg.Compress {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(msg); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			msg = buf.Bytes()
+		}
+		if err := g.writeDatagram(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDatagram sends one message over UDP, chunking it when it doesn't fit
+// in ChunkSize bytes. Messages needing more than 128 chunks are dropped.
+func (g *GELFSink) writeDatagram(msg []byte) error {
+	if len(msg) <= g.cfg.ChunkSize {
+		_, err := g.conn.Write(msg)
+		return err
+	}
+
+	payloadSize := g.cfg.ChunkSize - gelfChunkHeaderSize
+	count := (len(msg) + payloadSize - 1) / payloadSize
+	if count > gelfMaxChunks {
+		glog.Warningf("Dropping gelf message of %d bytes, it needs more than %d chunks", len(msg), gelfMaxChunks)
+		return nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, g.cfg.ChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, msg[i*payloadSize:end]...)
+		if _, err := g.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
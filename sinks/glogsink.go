@@ -17,8 +17,6 @@ limitations under the License.
 package sinks
 
 import (
-	"encoding/json"
-
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
 )
@@ -26,6 +24,8 @@ import (
 // GlogSink is the most basic sink
 // Useful when you already have ELK/EFK Stack
 type GlogSink struct {
+	eventOutput
+
 	// TODO: create a channel and buffer for scaling
 }
 
@@ -38,7 +38,7 @@ func NewGlogSink() EventSinkInterface {
 func (gs *GlogSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	eData := NewEventData(eNew, eOld)
 
-	if eJSONBytes, err := json.Marshal(eData); err == nil {
+	if eJSONBytes, err := gs.encode(eData); err == nil {
 		glog.Info(string(eJSONBytes))
 	} else {
 		glog.Warningf("Failed to json serialize event: %v", err)
@@ -18,11 +18,26 @@ package sinks
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/eapache/channels"
 	"github.com/golang/glog"
-	"github.com/sethgrid/pester"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"k8s.io/api/core/v1"
 )
@@ -44,21 +59,224 @@ can send them, if not, a single HTTP request is made for each event.
 
 But with the payload of the messages being a serialized JSON object
 containing the kubernetes v1.Event.
+
+The requests may carry static headers, a bearer token or basic auth
+credentials, and an HMAC signature of the body so that the receiver can
+authenticate them:
+
+X-Eventrouter-Signature: sha256=<hex encoded HMAC-SHA256 of the body>
+
+With the json format the body is instead a JSON array of the events. Events
+may be held back for up to a flush interval to be sent in batches of up to a
+max batch size, and the bodies may be gzip compressed.
+
+Failed requests, and responses with a retryable status code (429 and 5xx by
+default), are retried with exponential backoff and jitter, waiting as long as
+a Retry-After header asks (up to the max backoff). The action taken for a
+status code or class (e.g. 429 or 4xx) may be configured instead: retry, drop,
+or deadletter to append the events to a dead-letter file, where the events
+also go once the retries are exhausted. Up to a configured number of requests
+may be in flight at once, the events may then arrive out of order.
 */
 
+// HTTPRetryPolicy configures the retries of the HTTPSink requests
+type HTTPRetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+
+	// MinBackoff is the backoff cap of the first retry, doubled on each
+	// retry up to MaxBackoff, as in the RetryPolicy of the sinks
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// StatusCodes are the retryable response status codes
+	StatusCodes []int
+}
+
+// defaultHTTPRetryStatusCodes are retried when the policy has no status codes
+var defaultHTTPRetryStatusCodes = []int{429, 500, 502, 503, 504}
+
+// The actions of the HTTPConfig StatusActions
+const (
+	httpActionRetry      = "retry"
+	httpActionDrop       = "drop"
+	httpActionDeadLetter = "deadletter"
+)
+
+// httpSinkEventsCounterVec counts the events by outcome: sent, retried,
+// dropped or dead_lettered. It is nil unless registerHTTPSinkMetrics was
+// called.
+var httpSinkEventsCounterVec *prometheus.CounterVec
+
+// registerHTTPSinkMetrics creates and registers the HTTP sink metrics
+func registerHTTPSinkMetrics(prefix string) {
+	httpSinkEventsCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_eventrouter_http_sink_events_total", prefix),
+		Help: "Total number of events handled by the http sink, by outcome",
+	}, []string{"outcome"})
+	prometheus.MustRegister(httpSinkEventsCounterVec)
+}
+
+// httpSinkOutcome counts n events with the given outcome
+func httpSinkOutcome(outcome string, n int) {
+	if httpSinkEventsCounterVec != nil {
+		httpSinkEventsCounterVec.WithLabelValues(outcome).Add(float64(n))
+	}
+}
+
+// httpBufferPool holds the buffers of the request bodies
+var httpBufferPool = sync.Pool{
+	New: func() interface{} { return bytes.NewBuffer(make([]byte, 0, 4096)) },
+}
+
+// HTTPConfig holds the settings of the HTTPSink. The zero value of every
+// field but URL keeps the plain behavior described above.
+type HTTPConfig struct {
+	URL string
+
+	// Headers are added to every request
+	Headers map[string]string
+
+	// BearerToken, or else Username and Password, set the Authorization
+	// header
+	BearerToken string
+	Username    string
+	Password    string
+
+	// HMACSecret, when set, signs the body with HMACAlgorithm (sha1, sha256
+	// or sha512, sha256 by default) in the HMACHeader header
+	HMACSecret    string
+	HMACAlgorithm string
+	HMACHeader    string
+
+	// Format is rfc5424 (the default) or json
+	Format string
+
+	// BatchSize bounds the number of events per request, 0 means no limit
+	BatchSize int
+
+	// FlushInterval, when positive, holds events back until BatchSize events
+	// are pending or the oldest pending event has waited that long
+	FlushInterval time.Duration
+
+	// Gzip compresses the request bodies
+	Gzip bool
+
+	// Retry is the retry policy, the backoffs default to 1s and 30s
+	Retry HTTPRetryPolicy
+
+	// TLS settings of https URLs: CAFile replaces the system roots, CertFile
+	// and KeyFile are the client certificate for mutual TLS
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+
+	// StatusActions maps status codes ("400") or classes ("4xx") to retry,
+	// drop or deadletter; an exact code has precedence over its class. The
+	// other codes are retried if they are in Retry.StatusCodes and dropped
+	// otherwise.
+	StatusActions map[string]string
+
+	// DeadLetterFile, when set, is the file the events that couldn't be sent
+	// are appended to as JSON lines
+	DeadLetterFile string
+
+	// Concurrency is the maximum number of requests in flight, 1 by default;
+	// the events of an involved object are still sent in order
+	Concurrency int
+}
+
 // HTTPSink wraps an HTTP endpoint that messages should be sent to.
 type HTTPSink struct {
+	eventOutput
+
 	SinkURL string
 
+	cfg        HTTPConfig
+	hmacHash   func() hash.Hash
+	retryCodes map[int]bool
 	eventCh    channels.Channel
-	httpClient *pester.Client
-	bodyBuf    *bytes.Buffer
+	httpClient *http.Client
+	retry      RetryPolicy
+
+	// workers send the requests when they are sent concurrently, keeping
+	// the events of each involved object in order
+	workers *orderedWorkers
+
+	deadLetterMu sync.Mutex
 }
 
 // NewHTTPSink constructs a new HTTPSink given a sink URL and buffer size
 func NewHTTPSink(sinkURL string, overflow bool, bufferSize int) *HTTPSink {
+	h, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:   sinkURL,
+		Retry: HTTPRetryPolicy{MaxRetries: 10},
+	}, overflow, bufferSize)
+	if err != nil {
+		// The default config is always valid
+		panic(err.Error())
+	}
+	return h
+}
+
+// NewHTTPSinkWithConfig constructs a new HTTPSink given its config and buffer
+// size
+func NewHTTPSinkWithConfig(cfg HTTPConfig, overflow bool, bufferSize int) (*HTTPSink, error) {
 	h := &HTTPSink{
-		SinkURL: sinkURL,
+		SinkURL: cfg.URL,
+		cfg:     cfg,
+	}
+
+	switch cfg.Format {
+	case "", "rfc5424", "json":
+	default:
+		return nil, fmt.Errorf("invalid http sink format %q, must be rfc5424 or json", cfg.Format)
+	}
+
+	if h.cfg.Retry.MinBackoff <= 0 {
+		h.cfg.Retry.MinBackoff = time.Second
+	}
+	if h.cfg.Retry.MaxBackoff <= 0 {
+		h.cfg.Retry.MaxBackoff = 30 * time.Second
+	}
+	codes := cfg.Retry.StatusCodes
+	if len(codes) == 0 {
+		codes = defaultHTTPRetryStatusCodes
+	}
+	h.retryCodes = make(map[int]bool, len(codes))
+	for _, code := range codes {
+		h.retryCodes[code] = true
+	}
+
+	for status, action := range cfg.StatusActions {
+		switch action {
+		case httpActionRetry, httpActionDrop, httpActionDeadLetter:
+		default:
+			return nil, fmt.Errorf("invalid http sink action %q for status %s, must be retry, drop or deadletter", action, status)
+		}
+	}
+	if cfg.Concurrency > 1 {
+		h.workers = newOrderedWorkers(cfg.Concurrency, func(_ int, events []EventData) {
+			h.drainEvents(events)
+		})
+	}
+
+	if cfg.HMACSecret != "" {
+		switch cfg.HMACAlgorithm {
+		case "sha1":
+			h.hmacHash = sha1.New
+		case "", "sha256":
+			h.cfg.HMACAlgorithm = "sha256"
+			h.hmacHash = sha256.New
+		case "sha512":
+			h.hmacHash = sha512.New
+		default:
+			return nil, fmt.Errorf("invalid http sink hmac algorithm %q, must be sha1, sha256 or sha512", cfg.HMACAlgorithm)
+		}
+		if h.cfg.HMACHeader == "" {
+			h.cfg.HMACHeader = "X-Eventrouter-Signature"
+		}
 	}
 
 	if overflow {
@@ -67,14 +285,23 @@ func NewHTTPSink(sinkURL string, overflow bool, bufferSize int) *HTTPSink {
 		h.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
 	}
 
-	h.httpClient = pester.New()
-	h.httpClient.Backoff = pester.ExponentialJitterBackoff
-	h.httpClient.MaxRetries = 10
-	// Let the body buffer be 4096 bytes at the start. It will be grown if
-	// necessary.
-	h.bodyBuf = bytes.NewBuffer(make([]byte, 0, 4096))
+	// Retries are made by post, according to the retry policy and the
+	// status actions, with the budget of the retry policy of the sinks
+	h.retry = retryPolicy.forSink().withRetries(cfg.Retry.MaxRetries)
+	h.retry.MinBackoff, h.retry.MaxBackoff = h.cfg.Retry.MinBackoff, h.cfg.Retry.MaxBackoff
+	h.httpClient = &http.Client{}
+	if cfg.CAFile != "" || cfg.CertFile != "" || cfg.InsecureSkipVerify {
+		tlsConfig, err := tlsClientConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		h.httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
 
-	return h
+	return h, nil
 }
 
 // UpdateEvents implements the EventSinkInterface. It really just writes the
@@ -88,8 +315,12 @@ func (h *HTTPSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 // Run sits in a loop, waiting for data to come in through h.eventCh,
 // and forwarding them to the HTTP sink. If multiple events have happened
 // between loop iterations, it puts all of them in one request instead of
-// making a single request per event.
+// making a single request per event. With a flush interval the events are
+// collected until a batch is full or the interval has passed, pending events
+// are still sent when the sink is stopped.
 func (h *HTTPSink) Run(stopCh <-chan bool) {
+	var pending []EventData
+	var flushCh <-chan time.Time
 loop:
 	for {
 		select {
@@ -102,7 +333,7 @@ loop:
 			}
 
 			// Start with just this event...
-			arr := []EventData{evt}
+			pending = append(pending, evt)
 
 			// Consume all buffered events into an array, in case more have been written
 			// since we last forwarded them
@@ -110,52 +341,250 @@ loop:
 			for i := 0; i < numEvents; i++ {
 				e := <-h.eventCh.Out()
 				if evt, ok = e.(EventData); ok {
-					arr = append(arr, evt)
+					pending = append(pending, evt)
 				} else {
 					glog.Warningf("Invalid type sent through event channel: %T", e)
 				}
 			}
 
-			h.drainEvents(arr)
+			// Send the full batches right away, and the rest too unless they
+			// should wait for the flush interval
+			for h.cfg.BatchSize > 0 && len(pending) >= h.cfg.BatchSize {
+				h.send(pending[:h.cfg.BatchSize])
+				pending = pending[h.cfg.BatchSize:]
+			}
+			if h.cfg.FlushInterval <= 0 {
+				h.flush(pending)
+				pending = nil
+			}
+
+			if len(pending) == 0 {
+				flushCh = nil
+			} else if flushCh == nil {
+				flushCh = time.After(h.cfg.FlushInterval)
+			}
+		case <-flushCh:
+			h.flush(pending)
+			pending = nil
+			flushCh = nil
 		case <-stopCh:
+			// Send the events queued before the stop, flushed below
+			pending = append(pending, queuedEvents(h.eventCh)...)
 			break loop
 		}
 	}
+	h.flush(pending)
+	if h.workers != nil {
+		h.workers.close()
+	}
+}
+
+// flush sends the events in requests of up to BatchSize events
+func (h *HTTPSink) flush(events []EventData) {
+	for len(events) > 0 {
+		n := len(events)
+		if h.cfg.BatchSize > 0 && n > h.cfg.BatchSize {
+			n = h.cfg.BatchSize
+		}
+		h.send(events[:n])
+		events = events[n:]
+	}
+}
+
+// send sends one request with the events, or hands them to the workers when
+// requests are sent concurrently
+func (h *HTTPSink) send(events []EventData) {
+	if h.workers == nil {
+		h.drainEvents(events)
+		return
+	}
+	h.workers.dispatch(events)
 }
 
 // drainEvents takes an array of event data and sends it to the receiving HTTP
-// server. This function is *NOT* re-entrant: it re-uses the same body buffer
-// for each call, truncating it each time to avoid extra memory allocations.
+// server. The body buffers come from a pool, to avoid extra memory
+// allocations.
 func (h *HTTPSink) drainEvents(events []EventData) {
-	// Reuse the body buffer for each request
-	h.bodyBuf.Truncate(0)
+	bodyBuf := httpBufferPool.Get().(*bytes.Buffer)
+	defer httpBufferPool.Put(bodyBuf)
+	bodyBuf.Reset()
 
-	var written int64
-	for _, evt := range events {
-		w, err := evt.WriteRFC5424(h.bodyBuf)
-		written += w
-		if err != nil {
-			glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
+	if h.cfg.Format == "json" {
+		docs := make([]interface{}, len(events))
+		for i, evt := range events {
+			docs[i] = h.document(evt)
+		}
+		if err := json.NewEncoder(bodyBuf).Encode(docs); err != nil {
+			glog.Warningf("Failed to json serialize events: %v", err)
 			return
 		}
+	} else {
+		var written int64
+		for _, evt := range events {
+			w, err := evt.WriteRFC5424(bodyBuf)
+			written += w
+			if err != nil {
+				glog.Warningf("Could not write to event request body (wrote %v) bytes: %v", written, err)
+				return
+			}
 
-		h.bodyBuf.Write([]byte{'\n'})
-		written++
+			bodyBuf.Write([]byte{'\n'})
+			written++
+		}
 	}
 
-	req, err := http.NewRequest("POST", h.SinkURL, h.bodyBuf)
+	body := bodyBuf
+	if h.cfg.Gzip {
+		gzipBuf := httpBufferPool.Get().(*bytes.Buffer)
+		defer httpBufferPool.Put(gzipBuf)
+		gzipBuf.Reset()
+		zw := gzip.NewWriter(gzipBuf)
+		zw.Write(bodyBuf.Bytes())
+		if err := zw.Close(); err != nil {
+			glog.Warningf("Failed to compress events: %v", err)
+			return
+		}
+		body = gzipBuf
+	}
+
+	deadLetter, err := h.post(body.Bytes(), len(events))
+	switch {
+	case err == nil:
+		httpSinkOutcome("sent", len(events))
+	case deadLetter && h.cfg.DeadLetterFile != "":
+		glog.Warningf("Failed to send %d events to %v, writing them to the dead-letter file: %v", len(events), h.SinkURL, err)
+		if err := h.writeDeadLetter(events); err != nil {
+			glog.Errorf("Failed to write %d events to the dead-letter file %s: %v", len(events), h.cfg.DeadLetterFile, err)
+			httpSinkOutcome("dropped", len(events))
+		} else {
+			httpSinkOutcome("dead_lettered", len(events))
+		}
+	case deadLetter && deadLetters != nil:
+		glog.Warningf("Failed to send %d events to %v, handing them to the dead letter: %v", len(events), h.SinkURL, err)
+		deadLetterEvents("http", events, err)
+		httpSinkOutcome("dead_lettered", len(events))
+	default:
+		glog.Warningf("Failed to send %d events to %v: %v", len(events), h.SinkURL, err)
+		httpSinkOutcome("dropped", len(events))
+	}
+}
+
+// statusAction returns the action for a non 2xx status code
+func (h *HTTPSink) statusAction(code int) string {
+	if action, ok := h.cfg.StatusActions[strconv.Itoa(code)]; ok {
+		return action
+	}
+	if action, ok := h.cfg.StatusActions[fmt.Sprintf("%dxx", code/100)]; ok {
+		return action
+	}
+	if h.retryCodes[code] {
+		return httpActionRetry
+	}
+	return httpActionDrop
+}
+
+// post sends the body of a request with n events, retrying according to the
+// retry policy and the status actions. When post fails, it also tells whether
+// the events should go to the dead-letter file.
+func (h *HTTPSink) post(body []byte, n int) (bool, error) {
+	deadLetter := true
+	attempts := 0
+	err := h.retry.Do(func() error {
+		if attempts++; attempts > 1 {
+			httpSinkOutcome("retried", n)
+		}
+		req, err := http.NewRequest("POST", h.SinkURL, bytes.NewReader(body))
+		if err != nil {
+			deadLetter = false
+			return permanent(err)
+		}
+		if h.cfg.Format == "json" && cloudEvents != nil && h.format == nil {
+			req.Header.Set("Content-Type", "application/cloudevents-batch+json")
+		} else if h.cfg.Format == "json" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if h.cfg.Gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		h.authenticate(req, body)
+
+		resp, err := h.httpClient.Do(req)
+		if err != nil {
+			glog.V(2).Infof("Request to %v failed: %v", h.SinkURL, err)
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return nil
+		}
+		err = fmt.Errorf("got HTTP code %v", resp.StatusCode)
+		switch h.statusAction(resp.StatusCode) {
+		case httpActionDrop:
+			deadLetter = false
+			return permanent(err)
+		case httpActionDeadLetter:
+			return permanent(err)
+		}
+		glog.V(2).Infof("Request to %v failed: %v", h.SinkURL, err)
+		return retryAfter(err, httpRetryAfter(resp))
+	})
 	if err != nil {
-		glog.Warningf(err.Error())
-		return
+		return deadLetter, err
 	}
+	return false, nil
+}
+
+// writeDeadLetter appends the events to the dead-letter file, one JSON object
+// per line
+func (h *HTTPSink) writeDeadLetter(events []EventData) error {
+	h.deadLetterMu.Lock()
+	defer h.deadLetterMu.Unlock()
 
-	resp, err := h.httpClient.Do(req)
+	f, err := os.OpenFile(h.cfg.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		glog.Warningf(err.Error())
-		return
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, evt := range events {
+		if err := enc.Encode(evt); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// httpRetryAfter returns the delay asked by the Retry-After header of the
+// response, in seconds or as an HTTP date, or 0
+func httpRetryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
 	}
+	return 0
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		glog.Warningf("Got HTTP code %v from %v", resp.StatusCode, h.SinkURL)
+// authenticate sets the configured headers, credentials and body signature
+// on the request
+func (h *HTTPSink) authenticate(req *http.Request, body []byte) {
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if h.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.cfg.BearerToken)
+	} else if h.cfg.Username != "" {
+		req.SetBasicAuth(h.cfg.Username, h.cfg.Password)
+	}
+	if h.hmacHash != nil {
+		mac := hmac.New(h.hmacHash, []byte(h.cfg.HMACSecret))
+		mac.Write(body)
+		req.Header.Set(h.cfg.HMACHeader, h.cfg.HMACAlgorithm+"="+hex.EncodeToString(mac.Sum(nil)))
 	}
 }
@@ -18,16 +18,26 @@ package sinks
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	ref "k8s.io/client-go/tools/reference"
 
@@ -110,7 +120,7 @@ func TestUpdateEvents(t *testing.T) {
 	<-doneCh
 
 	if got.Len() == 0 {
-		t.Errorf("Sent logs but didn't read any back. HTTP error log: %v", sink.httpClient.ErrLog)
+		t.Errorf("Sent logs but didn't read any back after the retries")
 	}
 	if len(seenRequests) < 2 {
 		t.Errorf("Tried to simulate server errors for retry, more than one request should have been sent")
@@ -151,6 +161,470 @@ func TestUpdateEvents(t *testing.T) {
 	}
 }
 
+func TestBatching(t *testing.T) {
+	stopCh := make(chan bool, 1)
+	doneCh := make(chan bool, 1)
+
+	// The test server records the size of every batch it receives
+	batches := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected a gzip compressed body")
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read the gzip body: %v", err)
+			return
+		}
+		var events []EventData
+		if err := json.NewDecoder(zr).Decode(&events); err != nil {
+			t.Errorf("Failed to decode the events: %v", err)
+		}
+		batches <- len(events)
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:           srv.URL,
+		Format:        "json",
+		BatchSize:     4,
+		FlushInterval: time.Hour,
+		Gzip:          true,
+	}, true, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	evt := makeFakeEvent(&v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz"}, v1.EventTypeNormal, "Created", "Created pod")
+	for i := 0; i < 10; i++ {
+		sink.UpdateEvents(evt, nil)
+	}
+
+	go func() {
+		sink.Run(stopCh)
+		doneCh <- true
+	}()
+
+	// The two full batches are sent right away, the rest when the sink is
+	// stopped since the flush interval doesn't pass
+	for i := 0; i < 2; i++ {
+		if n := <-batches; n != 4 {
+			t.Errorf("Got a batch of %v events, expected 4", n)
+		}
+	}
+	stopCh <- true
+	<-doneCh
+	if n := <-batches; n != 2 {
+		t.Errorf("Got a last batch of %v events, expected 2", n)
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	cloudEvents = &CloudEventsConfig{Source: "/eventrouter", TypePrefix: "io.k8s.event"}
+	defer func() { cloudEvents = nil }()
+
+	var contentType string
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{URL: srv.URL, Format: "json"}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	evt := makeFakeEvent(&v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz"}, v1.EventTypeWarning, "BackOff", "Back-off restarting failed container")
+	evt.UID = "uid"
+	evt.ResourceVersion = "42"
+	evt.Source.Component = "kubelet"
+	sink.drainEvents([]EventData{NewEventData(evt, nil)})
+
+	if contentType != "application/cloudevents-batch+json" {
+		t.Errorf("Got content type %q, expected a CloudEvents batch", contentType)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Got %v CloudEvents, expected 1", len(got))
+	}
+	expected := map[string]string{
+		"specversion": "1.0",
+		"id":          "uid/42",
+		"source":      "/eventrouter/kubelet",
+		"type":        "io.k8s.event.warning",
+		"subject":     "Pod/baz/foo",
+	}
+	for k, v := range expected {
+		if got[0][k] != v {
+			t.Errorf("Got CloudEvents %s %v, expected %v", k, got[0][k], v)
+		}
+	}
+	if _, ok := got[0]["data"].(map[string]interface{}); !ok {
+		t.Errorf("Expected the event data in data")
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	evt := makeFakeEvent(&v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz"}, v1.EventTypeWarning, "BackOff", "Back-off \"restarting\"")
+	formats := map[string]struct {
+		tmpl   string
+		fields []OutputFieldConfig
+	}{
+		"template": {tmpl: `{"reason": "{{.Event.Reason}}", "msg": {{json .Event.Message}}, "source": "k8s"}`},
+		"fields": {fields: []OutputFieldConfig{
+			{Field: "reason", Path: "$.event.reason"},
+			{Field: "msg", Path: "event.message"},
+			{Field: "source", Value: "k8s"},
+			{Field: "missing", Path: "event.nothing"},
+		}},
+	}
+	for name, f := range formats {
+		sink, err := NewHTTPSinkWithConfig(HTTPConfig{URL: srv.URL, Format: "json"}, false, 0)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		format, err := newOutputFormat("http", f.tmpl, f.fields)
+		if err != nil {
+			t.Fatalf("Invalid %s output format: %v", name, err)
+		}
+		sink.setOutputFormat(format)
+		sink.drainEvents([]EventData{NewEventData(evt, nil)})
+
+		expected := map[string]interface{}{"reason": "BackOff", "msg": `Back-off "restarting"`, "source": "k8s"}
+		if len(got) != 1 || len(got[0]) != len(expected) {
+			t.Fatalf("Got %v with the %s output format, expected %v", got, name, expected)
+		}
+		for k, v := range expected {
+			if got[0][k] != v {
+				t.Errorf("Got %s %v with the %s output format, expected %v", k, got[0][k], name, v)
+			}
+		}
+	}
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{URL: srv.URL, Format: "json"}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sink.setOutputFormat(&outputFormat{otel: true})
+	sink.drainEvents([]EventData{NewEventData(evt, nil)})
+	if len(got) != 1 || got[0]["severityNumber"] != float64(otelSeverityWarn) || got[0]["severityText"] != "WARN" {
+		t.Fatalf("Got %v with the otel output encoding, expected a WARN log record", got)
+	}
+	if body, _ := got[0]["body"].(map[string]interface{}); body["stringValue"] != evt.Message {
+		t.Errorf("Got body %v with the otel output encoding, expected the message", got[0]["body"])
+	}
+
+	if _, err := newOutputFormat("http", "{{.Event", nil); err == nil {
+		t.Errorf("Expected an invalid output template to fail")
+	}
+	if _, err := newOutputFormat("http", "{}", []OutputFieldConfig{{Field: "a", Value: 1}}); err == nil {
+		t.Errorf("Expected an output template and output fields to fail")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// The test server answers the first failures requests with status
+	var status, failures, requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL: srv.URL,
+		Retry: HTTPRetryPolicy{
+			MaxRetries: 3,
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 10 * time.Millisecond,
+		},
+	}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	status, failures, requests = http.StatusTooManyRequests, 2, 0
+	if _, err := sink.post([]byte("body"), 1); err != nil {
+		t.Errorf("Expected the request to succeed after retries: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Got %v requests, expected 3", requests)
+	}
+
+	status, failures, requests = http.StatusServiceUnavailable, 10, 0
+	if _, err := sink.post([]byte("body"), 1); err == nil {
+		t.Errorf("Expected the request to fail once the retries are exhausted")
+	}
+	if requests != 4 {
+		t.Errorf("Got %v requests, expected 4", requests)
+	}
+
+	status, failures, requests = http.StatusBadRequest, 10, 0
+	if _, err := sink.post([]byte("body"), 1); err == nil {
+		t.Errorf("Expected the request to fail")
+	}
+	if requests != 1 {
+		t.Errorf("Got %v requests, expected no retry of a 400", requests)
+	}
+}
+
+func TestStatusActions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "httpsink")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	deadLetterFile := filepath.Join(dir, "deadletter.json")
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:            srv.URL,
+		StatusActions:  map[string]string{"4xx": "deadletter", "404": "drop"},
+		DeadLetterFile: deadLetterFile,
+	}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if action := sink.statusAction(http.StatusNotFound); action != "drop" {
+		t.Errorf("Got action %v for 404, expected the exact code to take precedence", action)
+	}
+	if action := sink.statusAction(http.StatusBadGateway); action != "retry" {
+		t.Errorf("Got action %v for 502, expected retry", action)
+	}
+
+	evt := makeFakeEvent(&v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz"}, v1.EventTypeNormal, "Created", "Created pod")
+	sink.drainEvents([]EventData{NewEventData(evt, nil), NewEventData(evt, nil)})
+
+	data, err := ioutil.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatalf("Expected the events in the dead-letter file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Got %v dead-lettered events, expected 2", lines)
+	}
+
+	if _, err := NewHTTPSinkWithConfig(HTTPConfig{StatusActions: map[string]string{"5xx": "ignore"}}, false, 0); err == nil {
+		t.Errorf("Expected an error for an invalid action")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	stopCh := make(chan bool, 1)
+	doneCh := make(chan bool, 1)
+
+	// The test server records the highest number of requests in flight
+	var mu sync.Mutex
+	var inFlight, maxInFlight, requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		requests++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:         srv.URL,
+		BatchSize:   1,
+		Concurrency: 3,
+	}, true, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// The events of an object are sent in order, use distinct objects
+	for i := 0; i < 9; i++ {
+		ref := &v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz", UID: types.UID(fmt.Sprintf("uid-%d", i))}
+		sink.UpdateEvents(makeFakeEvent(ref, v1.EventTypeNormal, "Created", "Created pod"), nil)
+	}
+
+	go func() {
+		sink.Run(stopCh)
+		doneCh <- true
+	}()
+
+	// Wait for the requests to be made, 3 at a time they take 150ms
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		mu.Lock()
+		n := requests
+		mu.Unlock()
+		if n == 9 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopCh <- true
+	<-doneCh
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 9 {
+		t.Errorf("Got %v requests, expected 9", requests)
+	}
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Errorf("Got up to %v requests in flight, expected 2 or 3", maxInFlight)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The test server certificate is valid for 127.0.0.1, and serves as the
+	// client certificate too
+	dir, err := ioutil.TempDir("", "httpsink")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	cert := srv.TLS.Certificates[0]
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{URL: srv.URL}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := sink.post([]byte("body"), 1); err == nil {
+		t.Errorf("Expected the request to fail without the CA and client certificate")
+	}
+
+	sink, err = NewHTTPSinkWithConfig(HTTPConfig{
+		URL:      srv.URL,
+		CAFile:   certFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := sink.post([]byte("body"), 1); err != nil {
+		t.Errorf("Expected the request to succeed with mutual TLS: %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:         "http://localhost",
+		Headers:     map[string]string{"X-Cluster": "prod"},
+		BearerToken: "token",
+		HMACSecret:  "secret",
+	}, false, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	req, _ := http.NewRequest("POST", sink.SinkURL, nil)
+	sink.authenticate(req, []byte("body"))
+
+	if got := req.Header.Get("X-Cluster"); got != "prod" {
+		t.Errorf("Got header X-Cluster %q, expected prod", got)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Got Authorization %q, expected the bearer token", got)
+	}
+	// echo -n body | openssl dgst -sha256 -hmac secret
+	expected := "sha256=dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355"
+	if got := req.Header.Get("X-Eventrouter-Signature"); got != expected {
+		t.Errorf("Got signature %q, expected %q", got, expected)
+	}
+
+	if _, err := NewHTTPSinkWithConfig(HTTPConfig{HMACSecret: "secret", HMACAlgorithm: "md5"}, false, 0); err == nil {
+		t.Errorf("Expected an error for an invalid hmac algorithm")
+	}
+}
+
+func TestConcurrencyOrdering(t *testing.T) {
+	stopCh := make(chan bool, 1)
+	doneCh := make(chan bool, 1)
+
+	// The test server records the messages in the order received, slowing
+	// down the first request
+	var mu sync.Mutex
+	var messages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var docs []EventData
+		json.NewDecoder(r.Body).Decode(&docs)
+		mu.Lock()
+		first := len(messages) == 0
+		mu.Unlock()
+		if first {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		for _, doc := range docs {
+			messages = append(messages, doc.Event.Message)
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSinkWithConfig(HTTPConfig{
+		URL:         srv.URL,
+		Format:      "json",
+		BatchSize:   1,
+		Concurrency: 3,
+	}, true, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ref := &v1.ObjectReference{Kind: "Pod", Name: "foo", Namespace: "baz", UID: "uid"}
+	for i := 0; i < 5; i++ {
+		sink.UpdateEvents(makeFakeEvent(ref, v1.EventTypeNormal, "Created", strconv.Itoa(i)), nil)
+	}
+
+	go func() {
+		sink.Run(stopCh)
+		doneCh <- true
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		mu.Lock()
+		n := len(messages)
+		mu.Unlock()
+		if n == 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopCh <- true
+	<-doneCh
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(messages, ","); got != "0,1,2,3,4" {
+		t.Errorf("Got the messages %v, expected 0,1,2,3,4 in order", got)
+	}
+}
+
 func makeFakeEvent(ref *v1.ObjectReference, eventtype, reason, message string) *v1.Event {
 	tm := metav1.Time{
 		Time: time.Now(),
@@ -17,8 +17,12 @@ limitations under the License.
 package sinks
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
@@ -75,6 +79,11 @@ type InfluxDBSink struct {
 	client *influxdb.Client
 	sync.RWMutex
 	dbExists bool
+	retry    RetryPolicy
+
+	// v2Client and v2WriteURL are only set for the InfluxDB 2.x write API
+	v2Client   *retryClient
+	v2WriteURL string
 }
 
 type InfluxdbConfig struct {
@@ -89,10 +98,29 @@ type InfluxdbConfig struct {
 	ClusterName           string
 	DisableCounterMetrics bool
 	Concurrency           int
+
+	// Version selects the write API: 1 (default) for the legacy /write API
+	// with User and Password, 2 for the InfluxDB 2.x / Cloud /api/v2/write API
+	// with Org, Bucket and Token.
+	Version int
+	Org     string
+	Bucket  string
+	Token   string
+
+	// Precision of the point timestamps: ns (default), us, ms or s
+	Precision string
 }
 
 // Returns a thread-safe implementation of EventSinkInterface for InfluxDB.
 func NewInfuxdbSink(cfg InfluxdbConfig) (EventSinkInterface, error) {
+	if _, ok := influxdbPrecisions[cfg.Precision]; !ok {
+		return nil, fmt.Errorf("invalid influxdb precision %q", cfg.Precision)
+	}
+
+	if cfg.Version == 2 {
+		return newV2Sink(cfg)
+	}
+
 	client, err := newClient(cfg)
 	if err != nil {
 		return nil, err
@@ -102,6 +130,7 @@ func NewInfuxdbSink(cfg InfluxdbConfig) (EventSinkInterface, error) {
 		config:   cfg,
 		client:   client,
 		dbExists: false,
+		retry:    retryPolicy.forSink(),
 	}, nil
 }
 
@@ -134,6 +163,53 @@ func newClient(c InfluxdbConfig) (*influxdb.Client, error) {
 	return client, nil
 }
 
+// influxdbPrecisions maps the configured precision to the one understood by the
+// line protocol encoder of the v1 client, which only knows "u" for microseconds
+var influxdbPrecisions = map[string]string{
+	"":   "",
+	"ns": "",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// newV2Sink returns an InfluxDBSink writing to the InfluxDB 2.x write API.
+// There is no database to create there: the bucket must already exist.
+func newV2Sink(c InfluxdbConfig) (*InfluxDBSink, error) {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   c.Host,
+		Path:   "/api/v2/write",
+	}
+	if c.Secure {
+		u.Scheme = "https"
+	}
+
+	precision := c.Precision
+	if precision == "" {
+		precision = "ns"
+	}
+	params := url.Values{}
+	params.Set("org", c.Org)
+	params.Set("bucket", c.Bucket)
+	params.Set("precision", precision)
+	u.RawQuery = params.Encode()
+
+	client := retryPolicy.forSink().httpClient()
+	client.RetryOnHTTP429 = true
+	client.Timeout = 30 * time.Second
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.InsecureSsl},
+	}
+
+	return &InfluxDBSink{
+		config:     c,
+		v2Client:   client,
+		v2WriteURL: u.String(),
+	}, nil
+}
+
 func (sink *InfluxDBSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	sink.Lock()
 	defer sink.Unlock()
@@ -147,13 +223,15 @@ func (sink *InfluxDBSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	}
 	if err != nil {
 		glog.Warningf("Failed to convert event to point: %v", err)
+		return
 	}
 
 	point.Tags["cluster_name"] = sink.config.ClusterName
+	point.Precision = influxdbPrecisions[sink.config.Precision]
 
 	dataPoints := make([]influxdb.Point, 0, 10)
 	dataPoints = append(dataPoints, *point)
-	sink.sendData(dataPoints)
+	sink.sendData(dataPoints, []EventData{NewEventData(eNew, eOld)})
 }
 
 // Generate point value for event
@@ -168,7 +246,7 @@ func getEventValue(event *v1.Event) (string, error) {
 func eventToPointWithFields(event *v1.Event) (*influxdb.Point, error) {
 	point := influxdb.Point{
 		Measurement: "events",
-		Time:        event.LastTimestamp.Time.UTC(),
+		Time:        eventTimestamp(event),
 		Fields: map[string]interface{}{
 			"message": event.Message,
 		},
@@ -197,7 +275,7 @@ func eventToPoint(event *v1.Event) (*influxdb.Point, error) {
 
 	point := influxdb.Point{
 		Measurement: eventMeasurementName,
-		Time:        event.LastTimestamp.Time.UTC(),
+		Time:        eventTimestamp(event),
 		Fields: map[string]interface{}{
 			valueField: value,
 		},
@@ -213,20 +291,41 @@ func eventToPoint(event *v1.Event) (*influxdb.Point, error) {
 	return &point, nil
 }
 
-func (sink *InfluxDBSink) sendData(dataPoints []influxdb.Point) {
-	if err := sink.createDatabase(); err != nil {
-		glog.Errorf("Failed to create influxdb: %v", err)
+// sendData writes the points with the retry policy, dead-lettering the events
+// they were made of when it fails
+func (sink *InfluxDBSink) sendData(dataPoints []influxdb.Point, events []EventData) {
+	start := time.Now()
+	var err error
+	if sink.v2Client != nil {
+		err = sink.writeV2(dataPoints)
+	} else {
+		err = sink.retry.Do(func() error {
+			return sink.write(dataPoints)
+		})
+	}
+	if err != nil {
+		glog.Errorf("InfluxDB write failed: %v", err)
+		deadLetterEvents("influxdb", events, err)
 		return
 	}
+	glog.V(4).Infof("Exported %d data to influxDB in %s", len(dataPoints), time.Since(start))
+}
+
+// write writes the points with the legacy /write API, resetting the
+// connection when the write failed because of it
+func (sink *InfluxDBSink) write(dataPoints []influxdb.Point) error {
+	if err := sink.createDatabase(); err != nil {
+		return fmt.Errorf("failed to create influxdb: %v", err)
+	}
 	bp := influxdb.BatchPoints{
 		Points:          dataPoints,
 		Database:        sink.config.DbName,
 		RetentionPolicy: "default",
+		Precision:       influxdbPrecisions[sink.config.Precision],
 	}
 
-	start := time.Now()
-	if _, err := sink.client.Write(bp); err != nil {
-		glog.Errorf("InfluxDB write failed: %v", err)
+	_, err := sink.client.Write(bp)
+	if err != nil {
 		if strings.Contains(err.Error(), dbNotFoundError) {
 			sink.resetConnection()
 		} else if _, _, err := sink.client.Ping(); err != nil {
@@ -234,15 +333,40 @@ func (sink *InfluxDBSink) sendData(dataPoints []influxdb.Point) {
 			sink.resetConnection()
 		}
 	}
-	end := time.Now()
-	glog.V(4).Infof("Exported %d data to influxDB in %s", len(dataPoints), end.Sub(start))
+	return err
+}
+
+// writeV2 writes the points in line protocol to the InfluxDB 2.x write API
+func (sink *InfluxDBSink) writeV2(dataPoints []influxdb.Point) error {
+	var b bytes.Buffer
+	for _, p := range dataPoints {
+		b.WriteString(p.MarshalString())
+		b.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", sink.v2WriteURL, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Authorization", "Token "+sink.config.Token)
+
+	resp, err := sink.v2Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
 }
 
 func (sink *InfluxDBSink) resetConnection() {
 	glog.Infof("Influxdb connection reset")
 	sink.dbExists = false
 	sink.client = nil
-	sink.config = InfluxdbConfig{}
 }
 
 func (sink *InfluxDBSink) createDatabase() error {
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInfluxDBFailedWritesAreRetriedAndDeadLettered(t *testing.T) {
+	previous := retryPolicy
+	retryPolicy = RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	defer func() { retryPolicy = previous }()
+
+	var writes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Write([]byte(`{"results":[{}]}`))
+		default:
+			atomic.AddInt32(&writes, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{1, 2} {
+		atomic.StoreInt32(&writes, 0)
+		sink, err := NewInfuxdbSink(InfluxdbConfig{Host: u.Host, DbName: "events", Version: version})
+		if err != nil {
+			t.Fatalf("Failed to create the v%d sink: %v", version, err)
+		}
+
+		deadLetters, restore := captureDeadLetters("file")
+		sink.UpdateEvents(newTestEvent("a"), nil)
+		restore()
+		if n := atomic.LoadInt32(&writes); n != 3 {
+			t.Errorf("Got %d writes with the v%d API, want 3", n, version)
+		}
+		checkNames(t, deadLetters.names(), "a")
+	}
+}
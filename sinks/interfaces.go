@@ -18,8 +18,14 @@ package sinks
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	v1 "k8s.io/api/core/v1"
 )
@@ -29,77 +35,583 @@ type EventSinkInterface interface {
 	UpdateEvents(eNew *v1.Event, eOld *v1.Event)
 }
 
-// ManufactureSink will manufacture a sink according to viper configs
-// TODO: Determine if it should return an array of sinks
-func ManufactureSink() (e EventSinkInterface) {
-	s := viper.GetString("sink")
-	glog.Infof("Sink is [%v]", s)
+// ManufactureSink will manufacture a sink according to viper configs. The
+// sinks list configures several sinks fed simultaneously, each sink type at
+// most once; it defaults to the single sink.
+func ManufactureSink() EventSinkInterface {
+	// With cloudEvents the sinks writing the events as JSON documents or
+	// messages wrap them in a CloudEvents 1.0 envelope (structured mode)
+	viper.SetDefault("cloudEvents", false)
+	viper.SetDefault("cloudEventsSource", "/eventrouter")
+	viper.SetDefault("cloudEventsTypePrefix", "io.k8s.event")
+	if viper.GetBool("cloudEvents") {
+		cloudEvents = &CloudEventsConfig{
+			Source:     viper.GetString("cloudEventsSource"),
+			TypePrefix: viper.GetString("cloudEventsTypePrefix"),
+		}
+	}
+
+	// transforms is the ordered list of operations applied to the events
+	// written as JSON, e.g. [{"op": "drop", "field":
+	// "event.metadata.managedFields"}, {"op": "truncate", "field":
+	// "event.message", "length": 1024}]: drop, rename to a field, add a
+	// value, and truncate to a length
+	viper.SetDefault("transforms", []interface{}{})
+	var transformConfigs []TransformConfig
+	if err := viper.UnmarshalKey("transforms", &transformConfigs); err != nil {
+		panic(fmt.Sprintf("invalid transforms: %v", err))
+	}
+	ops, err := newTransforms(transformConfigs)
+	if err != nil {
+		panic(err.Error())
+	}
+	transforms = ops
+
+	// severityReasons and severityTypes map reasons and types to severity
+	// levels, e.g. {"OOMKilling": "critical", "BackOff": "error"}, the level
+	// of the reason applying first: debug, info, warning, error or critical.
+	// They set the severity of the EventData, the syslog severity of the
+	// rfc5424 records, the alertmanager and pagerduty severities, the GELF
+	// level and the OpenTelemetry severity.
+	viper.SetDefault("severityReasons", map[string]string{})
+	viper.SetDefault("severityTypes", map[string]string{})
+	if reasons, types := viper.GetStringMapString("severityReasons"), viper.GetStringMapString("severityTypes"); len(reasons) > 0 || len(types) > 0 {
+		m, err := newSeverityMapping(SeverityConfig{Reasons: reasons, Types: types})
+		if err != nil {
+			panic(err.Error())
+		}
+		severities = m
+	}
+
+	// timestampField is the field of the primary timestamp of the events
+	// sent to the sinks, e.g. the OpenSearch @timestamp or the InfluxDB time:
+	// lastTimestamp, firstTimestamp or eventTime, falling back to the others
+	// when missing. With normalizeTimestamps the timestamps of the events
+	// are converted to UTC and the missing ones filled in.
+	viper.SetDefault("timestampField", "lastTimestamp")
+	viper.SetDefault("normalizeTimestamps", false)
+	field, err := parseTimestampField(viper.GetString("timestampField"))
+	if err != nil {
+		panic(err.Error())
+	}
+	timestampField = field
+
+	// With countDeltaRecords the updates only incrementing the count of an
+	// event are written as compact REPEATED records, with the increment in
+	// the repeated field, by the sinks writing the EventData
+	viper.SetDefault("countDeltaRecords", false)
+	countDeltas = viper.GetBool("countDeltaRecords")
+
+	// The sinks retry their failed writes up to retryMaxAttempts times in
+	// total, with exponential backoff and jitter from retryMinBackoff to
+	// retryMaxBackoff. The retries of a sink are bounded to retryBudgetRatio
+	// of its writes, 0 for no bound. The retries settings of the sinks, e.g.
+	// httpSinkRetryMax, count the retries after the first attempt instead.
+	viper.SetDefault("retryMaxAttempts", 5)
+	viper.SetDefault("retryMinBackoff", "100ms")
+	viper.SetDefault("retryMaxBackoff", "5s")
+	viper.SetDefault("retryBudgetRatio", 0.2)
+	retryPolicy = RetryPolicy{
+		MaxAttempts: viper.GetInt("retryMaxAttempts"),
+		MinBackoff:  viper.GetDuration("retryMinBackoff"),
+		MaxBackoff:  viper.GetDuration("retryMaxBackoff"),
+	}
+	if ratio := viper.GetFloat64("retryBudgetRatio"); ratio > 0 {
+		retryPolicy.Budget = NewRetryBudget(ratio, retryBudgetMaxTokens)
+	}
+
+	// With deliveryKeys, for replicas forwarding all the events
+	// active-active, the updates carry an idempotency key, their UID and
+	// resourceVersion, as the delivery_key of the EventData, a kafka header,
+	// the opensearch _id and the SQS FIFO deduplication id, so the duplicates
+	// are suppressed
+	viper.SetDefault("deliveryKeys", false)
+	deliveryKeys = viper.GetBool("deliveryKeys")
+
+	// The events a sink fails to deliver are appended to deadLetterFile with
+	// the failure metadata, and/or forwarded to the deadLetterSink sink type
+	// with the metadata as annotations, e.g. s3sink
+	viper.SetDefault("deadLetterFile", "")
+	viper.SetDefault("deadLetterSink", "")
+	if file, name := viper.GetString("deadLetterFile"), viper.GetString("deadLetterSink"); file != "" || name != "" {
+		cfg := DeadLetterConfig{File: file, SinkName: name}
+		if name != "" {
+			glog.Infof("Dead-letter sink is [%v]", name)
+			deadLetterStop = make(chan bool)
+			cfg.Sink = manufactureSink(viper.GetViper(), name, deadLetterStop)
+		}
+		if viper.GetBool("enable-prometheus") {
+			registerDeadLetterMetrics(viper.GetString("metric-prefix"))
+		}
+		deadLetters = NewDeadLetter(cfg)
+	}
+
+	e := manufactureRoutedSinks()
+
+	// diskQueueDir enables the disk queue: the updates are written to
+	// segments of diskQueueSegmentSize bytes in the directory, and forwarded
+	// from them to the sinks, dropping the oldest segments over
+	// diskQueueMaxSize bytes. It sits right in front of the sinks, so that
+	// its cursor only moves past the updates handed to them.
+	viper.SetDefault("diskQueueDir", "")
+	viper.SetDefault("diskQueueSegmentSize", 64<<20)
+	viper.SetDefault("diskQueueMaxSize", 1<<30)
+	if dir := viper.GetString("diskQueueDir"); dir != "" {
+		q, err := NewDiskQueueSink(e, DiskQueueConfig{
+			Dir:         dir,
+			SegmentSize: viper.GetInt64("diskQueueSegmentSize"),
+			MaxSize:     viper.GetInt64("diskQueueMaxSize"),
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		runWrapper(q.Run)
+		e = q
+	}
+
+	// With a positive dedupWindow, the updates of events of the same
+	// involved object, reason and message are held back for the window, and
+	// forwarded once with the aggregated count
+	viper.SetDefault("dedupWindow", "0s")
+	if window := viper.GetDuration("dedupWindow"); window > 0 {
+		d := NewDedupSink(e, window)
+		runWrapper(d.Run)
+		e = d
+	}
+
+	// With a positive seriesRollupInterval, the bumps of the series of the
+	// events.k8s.io events are forwarded once per interval rather than on
+	// each occurrence
+	viper.SetDefault("seriesRollupInterval", "0s")
+	if interval := viper.GetDuration("seriesRollupInterval"); interval > 0 {
+		s := NewSeriesSink(e, interval)
+		runWrapper(s.Run)
+		e = s
+	}
+
+	// samplingReasons and samplingTypes map reasons and types to the rate of
+	// their events forwarded, e.g. {"Pulled": 0.01}, the rate of the reason
+	// applying first. The events are sampled at random, or exactly one in
+	// 1/rate with samplingDeterministic.
+	viper.SetDefault("samplingReasons", map[string]float64{})
+	viper.SetDefault("samplingTypes", map[string]float64{})
+	viper.SetDefault("samplingDeterministic", false)
+	reasons := samplingRatesConfig("samplingReasons")
+	types := samplingRatesConfig("samplingTypes")
+	if len(reasons) > 0 || len(types) > 0 {
+		s, err := NewSamplingSink(e, SamplingConfig{
+			Reasons:       reasons,
+			Types:         types,
+			Deterministic: viper.GetBool("samplingDeterministic"),
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		if viper.GetBool("enable-prometheus") {
+			registerSamplingSinkMetrics(viper.GetString("metric-prefix"))
+		}
+		e = s
+	}
+
+	if viper.GetBool("normalizeTimestamps") {
+		e = NewTimestampSink(e)
+	}
+
+	// redactions is the ordered list of redaction rules applied to the events
+	// before anything else, e.g. [{"pattern": "(?i)bearer [a-z0-9._-]+",
+	// "replacement": "Bearer [REDACTED]"}, {"fields":
+	// ["metadata.annotations.customer-id"]}]: the matches of the pattern, or
+	// the whole values, of the fields, the message by default, are replaced
+	viper.SetDefault("redactions", []interface{}{})
+	var redactionConfigs []RedactionConfig
+	if err := viper.UnmarshalKey("redactions", &redactionConfigs); err != nil {
+		panic(fmt.Sprintf("invalid redactions: %v", err))
+	}
+	if len(redactionConfigs) > 0 {
+		r, err := NewRedactSink(e, redactionConfigs)
+		if err != nil {
+			panic(err.Error())
+		}
+		e = r
+	}
+	return e
+}
+
+// runWrapper runs a sink wrapping routedSinks, until Shutdown stops it
+func runWrapper(run func(stopCh <-chan bool)) {
+	stop := make(chan bool)
+	wrapperStops = append(wrapperStops, stop)
+	runSink(run, stop)
+}
+
+// samplingRatesConfig reads a map of sampling rates
+func samplingRatesConfig(key string) map[string]float64 {
+	rates := make(map[string]float64)
+	for k, v := range viper.GetStringMap(key) {
+		rate, err := cast.ToFloat64E(v)
+		if err != nil {
+			panic("invalid " + key + " rate of " + k + ": " + err.Error())
+		}
+		rates[k] = rate
+	}
+	return rates
+}
+
+// routedSinks is the MultiSink of the sinks. It is set by ManufactureSink.
+var routedSinks *MultiSink
+
+// ForwardDeletes returns true if a sink manufactured by ManufactureSink
+// forwards the deletes of the events, which are only handed to the sinks then
+func ForwardDeletes() bool {
+	return routedSinks != nil && routedSinks.forwardsDeletes()
+}
+
+// manufactureRoutedSinks manufactures the configured sinks, behind a
+// MultiSink queueing and routing the events to them
+func manufactureRoutedSinks() EventSinkInterface {
+	names := viper.GetStringSlice("sinks")
+	if len(names) == 0 {
+		names = []string{viper.GetString("sink")}
+	}
+
+	// The routing rules <sink>RouteTypes, <sink>RouteReasons,
+	// <sink>RouteNamespaces and <sink>RouteKinds (e.g. pagerdutyRouteTypes),
+	// the include/exclude regular expressions on the reason and message (e.g.
+	// slackRouteExcludeReasonRegex) and the CEL expression
+	// <sink>RouteExpression, restrict the events a sink receives, all of them
+	// by default. eventTypes (e.g. ["Warning"] to drop the Normal events) is
+	// the default of <sink>RouteTypes, which an empty list overrides to get
+	// all the events.
+	viper.SetDefault("eventTypes", []string{})
+	eventTypes := viper.GetStringSlice("eventTypes")
+
+	seen := make(map[string]bool, len(names))
+	routes := make([]MultiSinkRoute, 0, len(names))
+	for _, name := range names {
+		if seen[name] {
+			panic("sink " + name + " specified more than once in sinks")
+		}
+		seen[name] = true
+		glog.Infof("Sink is [%v]", name)
+
+		// Stopped with the route, on its removal or by Shutdown
+		stop := make(chan bool)
+		route := manufactureRoute(viper.GetViper(), name, name, eventTypes, stop)
+		route.Stop = stop
+		routes = append(routes, route)
+	}
+
+	// Each sink has its own queue in front of it, so the informer never waits
+	// for the sinks, by default of up to 1500 events, dropping its events if
+	// more than 1500 have come in without getting consumed
+	viper.SetDefault("multiSinkBufferSize", 1500)
+	viper.SetDefault("multiSinkDiscardMessages", true)
+
+	bufferSize := viper.GetInt("multiSinkBufferSize")
+	overflow := viper.GetBool("multiSinkDiscardMessages")
+	if overflow && viper.GetString("diskQueueDir") != "" {
+		// The disk queue holds the updates rather than dropping them
+		glog.Infof("Disk queue enabled, not discarding the sink queue messages")
+		overflow = false
+	}
+
+	m, err := NewMultiSink(routes, overflow, bufferSize)
+	if err != nil {
+		panic(err.Error())
+	}
+	if viper.GetBool("enable-prometheus") {
+		registerMultiSinkMetrics(viper.GetString("metric-prefix"), m)
+	}
+	go m.Run(make(chan bool))
+	routedSinks = m
+	return m
+}
+
+// manufactureRoute manufactures the sink of the sink type s and its route,
+// named name, from the configuration v, the routed sink running until stopCh
+// is closed
+func manufactureRoute(v *viper.Viper, name, s string, eventTypes []string, stopCh <-chan bool) MultiSinkRoute {
+	v.SetDefault(s+"RouteTypes", eventTypes)
+	route := MultiSinkRoute{
+		Name:   name,
+		Sink:   manufactureSink(v, s, stopCh),
+		Filter: eventFilterConfig(v, s+"Route"),
+	}
+	// <sink>RateLimit events per second, with bursts of
+	// <sink>RateLimitBurst events, limit the events a sink receives: the
+	// <sink>RateLimitPolicy drop drops the events over the limit, sample
+	// forwards one in <sink>RateLimitSampleEvery of them, and queue holds
+	// them in the queue of the sink
+	v.SetDefault(s+"RateLimit", 0)
+	v.SetDefault(s+"RateLimitBurst", 10)
+	v.SetDefault(s+"RateLimitPolicy", rateLimitDrop)
+	v.SetDefault(s+"RateLimitSampleEvery", 10)
+	route.RateLimit = RateLimitConfig{
+		EventsPerSecond: v.GetFloat64(s + "RateLimit"),
+		Burst:           v.GetInt(s + "RateLimitBurst"),
+		Policy:          v.GetString(s + "RateLimitPolicy"),
+		SampleEvery:     v.GetInt(s + "RateLimitSampleEvery"),
+	}
+
+	if expression := v.GetString(s + "RouteExpression"); expression != "" {
+		f, err := NewCELFilter(expression)
+		if err != nil {
+			panic(err.Error())
+		}
+		route.Expression = f
+	}
+
+	// <sink>ForwardDeletes forwards the deletes of the events, on their
+	// TTL expiration, as DELETED tombstone records with the event UID
+	v.SetDefault(s+"ForwardDeletes", false)
+	route.ForwardDeletes = v.GetBool(s + "ForwardDeletes")
+	return route
+}
+
+// manufactureSink manufactures a sink of the sink type s from the
+// configuration v, in its output format, running until stopCh is closed
+func manufactureSink(v *viper.Viper, s string, stopCh <-chan bool) EventSinkInterface {
+	e := newSink(v, s, stopCh)
+
+	// <sink>OutputTemplate, a Go template executed on the EventData, or
+	// <sink>OutputFields, a mapping of output fields to the paths of the
+	// EventData JSON or to constants, e.g. [{"field": "msg", "path":
+	// "$.event.message"}, {"field": "source", "value": "k8s"}], set the
+	// exact shape of the events the sink writes
+	v.SetDefault(s+"OutputTemplate", "")
+	v.SetDefault(s+"OutputFields", []interface{}{})
+	var fields []OutputFieldConfig
+	if err := v.UnmarshalKey(s+"OutputFields", &fields); err != nil {
+		panic(fmt.Sprintf("invalid %sOutputFields: %v", s, err))
+	}
+	format, err := newOutputFormat(s, v.GetString(s+"OutputTemplate"), fields)
+	if err != nil {
+		panic(fmt.Sprintf("invalid output format of sink %s: %v", s, err))
+	}
+
+	// <sink>OutputEncoding is json, protobuf for the records of
+	// proto/eventrecord.proto, for the sinks in protobufSinks, or otel for
+	// the OpenTelemetry log records in OTLP/JSON
+	v.SetDefault(s+"OutputEncoding", "json")
+	switch encoding := v.GetString(s + "OutputEncoding"); encoding {
+	case "json":
+	case "protobuf":
+		if !protobufSinks[s] {
+			panic("sink " + s + " does not support the protobuf output encoding")
+		}
+		if format != nil {
+			panic("sink " + s + " has both an output format and the protobuf output encoding")
+		}
+		format = &outputFormat{protobuf: true}
+	case "otel":
+		if format != nil {
+			panic("sink " + s + " has both an output format and the otel output encoding")
+		}
+		format = &outputFormat{otel: true}
+	default:
+		panic("invalid " + s + "OutputEncoding " + encoding + ", must be json, protobuf or otel")
+	}
+	if format != nil {
+		o, ok := e.(outputFormatter)
+		if !ok {
+			panic("sink " + s + " does not support output formats")
+		}
+		o.setOutputFormat(format)
+	}
+	return e
+}
+
+// newSink creates a sink of the sink type s from the configuration v, running
+// until stopCh is closed
+func newSink(v *viper.Viper, s string, stopCh <-chan bool) (e EventSinkInterface) {
+	// In dry-run mode the sinks are not created, their events are logged
+	if v.GetBool("dry-run") {
+		return NewDryRunSink(s)
+	}
+
 	switch s {
 	case "glog":
 		e = NewGlogSink()
 	case "stdout":
-		viper.SetDefault("stdoutJSONNamespace", "")
-		stdoutNamespace := viper.GetString("stdoutJSONNamespace")
-		e = NewStdoutSink(stdoutNamespace)
+		v.SetDefault("stdoutJSONNamespace", "")
+		stdoutNamespace := v.GetString("stdoutJSONNamespace")
+
+		// stdoutFields restricts the output to the given JSON paths (e.g.
+		// event.involvedObject.name), stdoutFlatten writes the nested fields
+		// as top level keys
+		v.SetDefault("stdoutFields", []string{})
+		v.SetDefault("stdoutFlatten", false)
+		e = NewStdoutSinkWithConfig(StdoutConfig{
+			Namespace: stdoutNamespace,
+			Fields:    v.GetStringSlice("stdoutFields"),
+			Flatten:   v.GetBool("stdoutFlatten"),
+		})
 	case "http":
-		url := viper.GetString("httpSinkUrl")
+		url := v.GetString("httpSinkUrl")
 		if url == "" {
 			panic("http sink specified but no httpSinkUrl")
 		}
 
 		// By default we buffer up to 1500 events, and drop messages if more than
 		// 1500 have come in without getting consumed
-		viper.SetDefault("httpSinkBufferSize", 1500)
-		viper.SetDefault("httpSinkDiscardMessages", true)
+		v.SetDefault("httpSinkBufferSize", 1500)
+		v.SetDefault("httpSinkDiscardMessages", true)
+
+		// Requests are not authenticated by default. httpSinkHMACSecret signs
+		// the body in the httpSinkHMACHeader header, as <algorithm>=<hex digest>.
+		v.SetDefault("httpSinkHeaders", map[string]string{})
+		v.SetDefault("httpSinkBearerToken", "")
+		v.SetDefault("httpSinkUsername", "")
+		v.SetDefault("httpSinkPassword", "")
+		v.SetDefault("httpSinkHMACSecret", "")
+		v.SetDefault("httpSinkHMACAlgorithm", "sha256")
+		v.SetDefault("httpSinkHMACHeader", "X-Eventrouter-Signature")
+
+		// Events are sent as RFC5424 lines as soon as they arrive by default.
+		// With httpSinkFormat json the body is a JSON array; a positive
+		// httpSinkFlushInterval holds events back to fill batches of up to
+		// httpSinkBatchSize events (0 for no limit).
+		v.SetDefault("httpSinkFormat", "rfc5424")
+		v.SetDefault("httpSinkBatchSize", 0)
+		v.SetDefault("httpSinkFlushInterval", 0)
+		v.SetDefault("httpSinkGzip", false)
 
-		bufferSize := viper.GetInt("httpSinkBufferSize")
-		overflow := viper.GetBool("httpSinkDiscardMessages")
+		// Failed requests and 429/5xx responses are retried up to
+		// httpSinkRetryMax times, with exponential backoff and jitter
+		v.SetDefault("httpSinkRetryMax", 10)
+		v.SetDefault("httpSinkRetryMinBackoff", "1s")
+		v.SetDefault("httpSinkRetryMaxBackoff", "30s")
+		v.SetDefault("httpSinkRetryStatusCodes", []int{429, 500, 502, 503, 504})
 
-		h := NewHTTPSink(url, overflow, bufferSize)
-		go h.Run(make(chan bool))
+		// The system roots verify https URLs unless httpSinkTLSCAFile is set;
+		// httpSinkTLSCertFile and httpSinkTLSKeyFile enable mutual TLS
+		v.SetDefault("httpSinkTLSCAFile", "")
+		v.SetDefault("httpSinkTLSCertFile", "")
+		v.SetDefault("httpSinkTLSKeyFile", "")
+		v.SetDefault("httpSinkTLSInsecureSkipVerify", false)
+
+		// httpSinkStatusActions maps status codes or classes (e.g. "4xx") to
+		// retry, drop or deadletter; events are dead-lettered once the retries
+		// are exhausted too, when httpSinkDeadLetterFile is set
+		v.SetDefault("httpSinkStatusActions", map[string]string{})
+		v.SetDefault("httpSinkDeadLetterFile", "")
+		v.SetDefault("httpSinkConcurrency", 1)
+
+		bufferSize := v.GetInt("httpSinkBufferSize")
+		overflow := v.GetBool("httpSinkDiscardMessages")
+
+		h, err := NewHTTPSinkWithConfig(HTTPConfig{
+			URL:           url,
+			Headers:       v.GetStringMapString("httpSinkHeaders"),
+			BearerToken:   v.GetString("httpSinkBearerToken"),
+			Username:      v.GetString("httpSinkUsername"),
+			Password:      v.GetString("httpSinkPassword"),
+			HMACSecret:    v.GetString("httpSinkHMACSecret"),
+			HMACAlgorithm: v.GetString("httpSinkHMACAlgorithm"),
+			HMACHeader:    v.GetString("httpSinkHMACHeader"),
+			Format:        v.GetString("httpSinkFormat"),
+			BatchSize:     v.GetInt("httpSinkBatchSize"),
+			FlushInterval: v.GetDuration("httpSinkFlushInterval"),
+			Gzip:          v.GetBool("httpSinkGzip"),
+			Retry: HTTPRetryPolicy{
+				MaxRetries:  v.GetInt("httpSinkRetryMax"),
+				MinBackoff:  v.GetDuration("httpSinkRetryMinBackoff"),
+				MaxBackoff:  v.GetDuration("httpSinkRetryMaxBackoff"),
+				StatusCodes: cast.ToIntSlice(v.Get("httpSinkRetryStatusCodes")),
+			},
+			CAFile:             v.GetString("httpSinkTLSCAFile"),
+			CertFile:           v.GetString("httpSinkTLSCertFile"),
+			KeyFile:            v.GetString("httpSinkTLSKeyFile"),
+			InsecureSkipVerify: v.GetBool("httpSinkTLSInsecureSkipVerify"),
+			StatusActions:      v.GetStringMapString("httpSinkStatusActions"),
+			DeadLetterFile:     v.GetString("httpSinkDeadLetterFile"),
+			Concurrency:        v.GetInt("httpSinkConcurrency"),
+		}, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		if v.GetBool("enable-prometheus") {
+			registerHTTPSinkMetrics(v.GetString("metric-prefix"))
+		}
+		runSink(h.Run, stopCh)
 		return h
 	case "kafka":
-		viper.SetDefault("kafkaBrokers", []string{"kafka:9092"})
-		viper.SetDefault("kafkaTopic", "eventrouter")
-		viper.SetDefault("kafkaAsync", true)
-		viper.SetDefault("kafkaRetryMax", 5)
-		viper.SetDefault("kafkaSaslUser", "")
-		viper.SetDefault("kafkaSaslPwd", "")
+		v.SetDefault("kafkaBrokers", []string{"kafka:9092"})
+		v.SetDefault("kafkaTopic", "eventrouter")
+		v.SetDefault("kafkaTopicAllowlist", []string{})
+		v.SetDefault("kafkaDefaultTopic", "")
+		v.SetDefault("kafkaAsync", true)
+		v.SetDefault("kafkaRetryMax", 5)
+		v.SetDefault("kafkaKey", "{name}")
+		v.SetDefault("kafkaVersion", "")
+		v.SetDefault("kafkaIdempotent", false)
+		v.SetDefault("kafkaCompression", "none")
+		v.SetDefault("kafkaLinger", 0)
+		v.SetDefault("kafkaBatchBytes", 0)
+		v.SetDefault("kafkaBatchMessages", 0)
+		v.SetDefault("kafkaSaslMechanism", "PLAIN")
+		v.SetDefault("kafkaSaslUser", "")
+		v.SetDefault("kafkaSaslPwd", "")
+		v.SetDefault("kafkaMSKRegion", "")
+		v.SetDefault("kafkaTLSEnable", false)
+		v.SetDefault("kafkaTLSCAFile", "")
+		v.SetDefault("kafkaTLSCertFile", "")
+		v.SetDefault("kafkaTLSKeyFile", "")
+		v.SetDefault("kafkaTLSInsecureSkipVerify", false)
 
-		brokers := viper.GetStringSlice("kafkaBrokers")
-		topic := viper.GetString("kafkaTopic")
-		async := viper.GetBool("kakfkaAsync")
-		retryMax := viper.GetInt("kafkaRetryMax")
-		saslUser := viper.GetString("kafkaSaslUser")
-		saslPwd := viper.GetString("kafkaSaslPwd")
+		cfg := KafkaConfig{
+			Brokers:               v.GetStringSlice("kafkaBrokers"),
+			Topic:                 v.GetString("kafkaTopic"),
+			TopicAllowlist:        v.GetStringSlice("kafkaTopicAllowlist"),
+			DefaultTopic:          v.GetString("kafkaDefaultTopic"),
+			Async:                 v.GetBool("kafkaAsync"),
+			RetryMax:              v.GetInt("kafkaRetryMax"),
+			Key:                   v.GetString("kafkaKey"),
+			Version:               v.GetString("kafkaVersion"),
+			Idempotent:            v.GetBool("kafkaIdempotent"),
+			Headers:               v.GetStringMapString("kafkaHeaders"),
+			Compression:           v.GetString("kafkaCompression"),
+			Linger:                v.GetDuration("kafkaLinger"),
+			BatchBytes:            v.GetInt("kafkaBatchBytes"),
+			BatchMessages:         v.GetInt("kafkaBatchMessages"),
+			SASLMechanism:         v.GetString("kafkaSaslMechanism"),
+			SASLUser:              v.GetString("kafkaSaslUser"),
+			SASLPassword:          v.GetString("kafkaSaslPwd"),
+			MSKRegion:             v.GetString("kafkaMSKRegion"),
+			TLS:                   v.GetBool("kafkaTLSEnable"),
+			TLSCAFile:             v.GetString("kafkaTLSCAFile"),
+			TLSCertFile:           v.GetString("kafkaTLSCertFile"),
+			TLSKeyFile:            v.GetString("kafkaTLSKeyFile"),
+			TLSInsecureSkipVerify: v.GetBool("kafkaTLSInsecureSkipVerify"),
+		}
 
-		e, err := NewKafkaSink(brokers, topic, async, retryMax, saslUser, saslPwd)
+		e, err := NewKafkaSink(cfg)
 		if err != nil {
 			panic(err.Error())
 		}
 		return e
 	case "s3sink":
-		accessKeyID := viper.GetString("s3SinkAccessKeyID")
-		if accessKeyID == "" {
-			panic("s3 sink specified but s3SinkAccessKeyID not specified")
-		}
-
-		secretAccessKey := viper.GetString("s3SinkSecretAccessKey")
-		if secretAccessKey == "" {
-			panic("s3 sink specified but s3SinkSecretAccessKey not specified")
+		// Static credentials are optional, the default AWS credential chain is
+		// used when they are not set
+		v.SetDefault("s3SinkAccessKeyID", "")
+		v.SetDefault("s3SinkSecretAccessKey", "")
+		accessKeyID := v.GetString("s3SinkAccessKeyID")
+		secretAccessKey := v.GetString("s3SinkSecretAccessKey")
+		if accessKeyID != "" && secretAccessKey == "" {
+			panic("s3 sink specified with s3SinkAccessKeyID but s3SinkSecretAccessKey not specified")
 		}
 
-		region := viper.GetString("s3SinkRegion")
+		region := v.GetString("s3SinkRegion")
 		if region == "" {
 			panic("s3 sink specified but s3SinkRegion not specified")
 		}
 
-		bucket := viper.GetString("s3SinkBucket")
+		bucket := v.GetString("s3SinkBucket")
 		if bucket == "" {
 			panic("s3 sink specified but s3SinkBucket not specified")
 		}
 
-		bucketDir := viper.GetString("s3SinkBucketDir")
+		bucketDir := v.GetString("s3SinkBucketDir")
 		if bucketDir == "" {
 			panic("s3 sink specified but s3SinkBucketDir not specified")
 		}
@@ -107,63 +619,117 @@ func ManufactureSink() (e EventSinkInterface) {
 		// By default the json is pushed to s3 in not flatenned rfc5424 write format
 		// The option to write to s3 is in the flattened json format which will help in
 		// using the data in redshift with least effort
-		viper.SetDefault("s3SinkOutputFormat", "rfc5424")
-		outputFormat := viper.GetString("s3SinkOutputFormat")
-		if outputFormat != "rfc5424" && outputFormat != "flatjson" {
-			panic("s3 sink specified, but incorrect s3SinkOutputFormat specifed. Supported formats are: rfc5424 (default) and flatjson")
+		v.SetDefault("s3SinkOutputFormat", "rfc5424")
+		outputFormat := v.GetString("s3SinkOutputFormat")
+		// avro writes Avro Object Container Files instead, with the blocks
+		// compressed by s3SinkAvroCodec
+		if outputFormat != "rfc5424" && outputFormat != "flatjson" && outputFormat != "avro" {
+			panic("s3 sink specified, but incorrect s3SinkOutputFormat specifed. Supported formats are: rfc5424 (default), flatjson and avro")
 		}
+		v.SetDefault("s3SinkAvroCodec", "deflate")
 
 		// By default we buffer up to 1500 events, and drop messages if more than
 		// 1500 have come in without getting consumed
-		viper.SetDefault("s3SinkBufferSize", 1500)
-		viper.SetDefault("s3SinkDiscardMessages", true)
+		v.SetDefault("s3SinkBufferSize", 1500)
+		v.SetDefault("s3SinkDiscardMessages", true)
+
+		v.SetDefault("s3SinkUploadInterval", 120)
+		uploadInterval := v.GetInt("s3SinkUploadInterval")
 
-		viper.SetDefault("s3SinkUploadInterval", 120)
-		uploadInterval := viper.GetInt("s3SinkUploadInterval")
+		// Objects are uploaded uncompressed by default. s3SinkMaxSize uploads
+		// as soon as that many bytes (before compression) are buffered, with 0
+		// only the upload interval matters.
+		v.SetDefault("s3SinkCompression", "none")
+		v.SetDefault("s3SinkMaxSize", 0)
 
-		bufferSize := viper.GetInt("s3SinkBufferSize")
-		overflow := viper.GetBool("s3SinkDiscardMessages")
+		// Objects get the bucket default encryption unless
+		// s3SinkServerSideEncryption or s3SinkSSEKMSKeyID is set
+		v.SetDefault("s3SinkServerSideEncryption", "")
+		v.SetDefault("s3SinkSSEKMSKeyID", "")
+		v.SetDefault("s3SinkACL", "")
 
-		s, err := NewS3Sink(accessKeyID, secretAccessKey, region, bucket, bucketDir, uploadInterval, overflow, bufferSize, outputFormat)
+		bufferSize := v.GetInt("s3SinkBufferSize")
+		overflow := v.GetBool("s3SinkDiscardMessages")
+
+		s, err := NewS3Sink(S3Config{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			Region:          region,
+			Bucket:          bucket,
+			BucketDir:       bucketDir,
+			UploadInterval:  uploadInterval,
+			OutputFormat:    outputFormat,
+			AvroCodec:       v.GetString("s3SinkAvroCodec"),
+			Compression:     v.GetString("s3SinkCompression"),
+			MaxSize:         v.GetInt("s3SinkMaxSize"),
+
+			ServerSideEncryption: v.GetString("s3SinkServerSideEncryption"),
+			SSEKMSKeyID:          v.GetString("s3SinkSSEKMSKeyID"),
+			ACL:                  v.GetString("s3SinkACL"),
+		}, overflow, bufferSize)
 		if err != nil {
 			panic(err.Error())
 		}
 
-		go s.Run(make(chan bool))
+		runSink(s.Run, stopCh)
 		return s
 	case "influxdb":
-		host := viper.GetString("influxdbHost")
+		host := v.GetString("influxdbHost")
 		if host == "" {
 			panic("influxdb sink specified but influxdbHost not specified")
 		}
 
-		username := viper.GetString("influxdbUsername")
-		if username == "" {
-			panic("influxdb sink specified but influxdbUsername not specified")
-		}
+		// Version 1 is the legacy write API with username/password, version 2
+		// the InfluxDB 2.x / Cloud API with org, bucket and token
+		v.SetDefault("influxdbVersion", 1)
+		version := v.GetInt("influxdbVersion")
 
-		password := viper.GetString("influxdbPassword")
-		if password == "" {
-			panic("influxdb sink specified but influxdbPassword not specified")
+		username := v.GetString("influxdbUsername")
+		password := v.GetString("influxdbPassword")
+		org := v.GetString("influxdbOrg")
+		bucket := v.GetString("influxdbBucket")
+		token := v.GetString("influxdbToken")
+		switch version {
+		case 1:
+			if username == "" {
+				panic("influxdb sink specified but influxdbUsername not specified")
+			}
+			if password == "" {
+				panic("influxdb sink specified but influxdbPassword not specified")
+			}
+		case 2:
+			if org == "" {
+				panic("influxdb sink specified but influxdbOrg not specified")
+			}
+			if bucket == "" {
+				panic("influxdb sink specified but influxdbBucket not specified")
+			}
+			if token == "" {
+				panic("influxdb sink specified but influxdbToken not specified")
+			}
+		default:
+			panic("influxdbVersion must be 1 or 2")
 		}
 
-		viper.SetDefault("influxdbName", "k8s")
-		viper.SetDefault("influxdbSecure", false)
-		viper.SetDefault("influxdbWithFields", false)
-		viper.SetDefault("influxdbInsecureSsl", false)
-		viper.SetDefault("influxdbRetentionPolicy", "0")
-		viper.SetDefault("influxdbClusterName", "default")
-		viper.SetDefault("influxdbDisableCounterMetrics", false)
-		viper.SetDefault("influxdbConcurrency", 1)
+		v.SetDefault("influxdbName", "k8s")
+		v.SetDefault("influxdbSecure", false)
+		v.SetDefault("influxdbWithFields", false)
+		v.SetDefault("influxdbInsecureSsl", false)
+		v.SetDefault("influxdbRetentionPolicy", "0")
+		v.SetDefault("influxdbClusterName", "default")
+		v.SetDefault("influxdbDisableCounterMetrics", false)
+		v.SetDefault("influxdbConcurrency", 1)
+		v.SetDefault("influxdbPrecision", "ns")
 
-		dbName := viper.GetString("influxdbName")
-		secure := viper.GetBool("influxdbSecure")
-		withFields := viper.GetBool("influxdbWithFields")
-		insecureSsl := viper.GetBool("influxdbInsecureSsl")
-		retentionPolicy := viper.GetString("influxdbRetentionPolicy")
-		cluterName := viper.GetString("influxdbClusterName")
-		disableCounterMetrics := viper.GetBool("influxdbDisableCounterMetrics")
-		concurrency := viper.GetInt("influxdbConcurrency")
+		dbName := v.GetString("influxdbName")
+		secure := v.GetBool("influxdbSecure")
+		withFields := v.GetBool("influxdbWithFields")
+		insecureSsl := v.GetBool("influxdbInsecureSsl")
+		retentionPolicy := v.GetString("influxdbRetentionPolicy")
+		cluterName := v.GetString("influxdbClusterName")
+		disableCounterMetrics := v.GetBool("influxdbDisableCounterMetrics")
+		concurrency := v.GetInt("influxdbConcurrency")
+		precision := v.GetString("influxdbPrecision")
 
 		cfg := InfluxdbConfig{
 			User:                  username,
@@ -177,6 +743,11 @@ func ManufactureSink() (e EventSinkInterface) {
 			ClusterName:           cluterName,
 			DisableCounterMetrics: disableCounterMetrics,
 			Concurrency:           concurrency,
+			Version:               version,
+			Org:                   org,
+			Bucket:                bucket,
+			Token:                 token,
+			Precision:             precision,
 		}
 
 		influx, err := NewInfuxdbSink(cfg)
@@ -185,42 +756,1150 @@ func ManufactureSink() (e EventSinkInterface) {
 		}
 		return influx
 	case "rockset":
-		rocksetAPIKey := viper.GetString("rocksetAPIKey")
+		// The API key is rocksetAPIKey, or the content of rocksetAPIKeyFile
+		// to read it from a mounted secret
+		rocksetAPIKey := v.GetString("rocksetAPIKey")
+		if path := v.GetString("rocksetAPIKeyFile"); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				panic(err.Error())
+			}
+			rocksetAPIKey = strings.TrimSpace(string(b))
+		}
 		if rocksetAPIKey == "" {
-			panic("Rockset sink specified but rocksetAPIKey not specified")
+			panic("Rockset sink specified but neither rocksetAPIKey nor rocksetAPIKeyFile specified")
 		}
 
-		rocksetCollectionName := viper.GetString("rocksetCollectionName")
+		rocksetCollectionName := v.GetString("rocksetCollectionName")
 		if rocksetCollectionName == "" {
 			panic("Rockset sink specified but rocksetCollectionName not specified")
 		}
-		rocksetWorkspaceName := viper.GetString("rocksetWorkspaceName")
-		if rocksetCollectionName == "" {
-			panic("Rockset sink specified but rocksetWorkspaceName not specified")
+
+		v.SetDefault("rocksetAPIServer", "https://api.usw2a1.rockset.com")
+		v.SetDefault("rocksetWorkspaceName", "commons")
+		v.SetDefault("rocksetBatchSize", 500)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("rocksetSinkBufferSize", 1500)
+		v.SetDefault("rocksetSinkDiscardMessages", true)
+
+		cfg := RocksetConfig{
+			APIServer:  v.GetString("rocksetAPIServer"),
+			APIKey:     rocksetAPIKey,
+			Workspace:  v.GetString("rocksetWorkspaceName"),
+			Collection: rocksetCollectionName,
+			BatchSize:  v.GetInt("rocksetBatchSize"),
 		}
-		e = NewRocksetSink(rocksetAPIKey, rocksetCollectionName, rocksetWorkspaceName)
+		bufferSize := v.GetInt("rocksetSinkBufferSize")
+		overflow := v.GetBool("rocksetSinkDiscardMessages")
+
+		rs := NewRocksetSink(cfg, overflow, bufferSize)
+		runSink(rs.Run, stopCh)
+		return rs
 	case "eventhub":
-		connString := viper.GetString("eventHubConnectionString")
-		if connString == "" {
-			panic("eventhub sink specified but eventHubConnectionString not specified")
-		}
 		// By default we buffer up to 1500 events, and drop messages if more than
 		// 1500 have come in without getting consumed
-		viper.SetDefault("eventHubSinkBufferSize", 1500)
-		viper.SetDefault("eventHubSinkDiscardMessages", true)
+		v.SetDefault("eventHubSinkBufferSize", 1500)
+		v.SetDefault("eventHubSinkDiscardMessages", true)
+		v.SetDefault("eventHubAuth", "connectionString")
+		v.SetDefault("eventHubPartitionKey", "")
+
+		bufferSize := v.GetInt("eventHubSinkBufferSize")
+		overflow := v.GetBool("eventHubSinkDiscardMessages")
+		partitionKey := v.GetString("eventHubPartitionKey")
 
-		bufferSize := viper.GetInt("eventHubSinkBufferSize")
-		overflow := viper.GetBool("eventHubSinkDiscardMessages")
-		eh, err := NewEventHubSink(connString, overflow, bufferSize)
+		var eh *EventHubSink
+		var err error
+		switch v.GetString("eventHubAuth") {
+		case "connectionString":
+			connString := v.GetString("eventHubConnectionString")
+			if connString == "" {
+				panic("eventhub sink specified but eventHubConnectionString not specified")
+			}
+			eh, err = NewEventHubSink(connString, partitionKey, overflow, bufferSize)
+		case "aad":
+			v.SetDefault("eventHubEnvironment", "AzurePublicCloud")
+			cfg := EventHubAADConfig{
+				Namespace:    v.GetString("eventHubNamespace"),
+				HubName:      v.GetString("eventHubName"),
+				Environment:  v.GetString("eventHubEnvironment"),
+				TenantID:     v.GetString("eventHubTenantID"),
+				ClientID:     v.GetString("eventHubClientID"),
+				ClientSecret: v.GetString("eventHubClientSecret"),
+			}
+			if cfg.Namespace == "" || cfg.HubName == "" {
+				panic("eventhub sink specified with aad auth but eventHubNamespace or eventHubName not specified")
+			}
+			if cfg.ClientSecret != "" && cfg.TenantID == "" {
+				panic("eventhub sink specified with a service principal but eventHubTenantID not specified")
+			}
+			eh, err = NewAADEventHubSink(cfg, partitionKey, overflow, bufferSize)
+		default:
+			panic("eventhub sink specified, but incorrect eventHubAuth specified. Supported modes are: connectionString (default) and aad")
+		}
 		if err != nil {
 			panic(err.Error())
 		}
-		go eh.Run(make(chan bool))
+		runSink(eh.Run, stopCh)
 		return eh
-	// case "logfile"
+	case "atlas":
+		endpoint := v.GetString("atlasDataAPIUrl")
+		if endpoint == "" {
+			panic("atlas sink specified but atlasDataAPIUrl not specified")
+		}
+
+		apiKey := v.GetString("atlasDataAPIKey")
+		if apiKey == "" {
+			panic("atlas sink specified but atlasDataAPIKey not specified")
+		}
+
+		v.SetDefault("atlasDataSource", "Cluster0")
+		v.SetDefault("atlasDatabase", "k8s")
+		v.SetDefault("atlasCollection", "events")
+		v.SetDefault("atlasBatchSize", 500)
+		v.SetDefault("atlasMaxRetries", 5)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("atlasSinkBufferSize", 1500)
+		v.SetDefault("atlasSinkDiscardMessages", true)
+
+		dataSource := v.GetString("atlasDataSource")
+		database := v.GetString("atlasDatabase")
+		collection := v.GetString("atlasCollection")
+		batchSize := v.GetInt("atlasBatchSize")
+		maxRetries := v.GetInt("atlasMaxRetries")
+		bufferSize := v.GetInt("atlasSinkBufferSize")
+		overflow := v.GetBool("atlasSinkDiscardMessages")
+
+		a := NewAtlasSink(endpoint, apiKey, dataSource, database, collection, batchSize, maxRetries, overflow, bufferSize)
+		runSink(a.Run, stopCh)
+		return a
+	case "pubsub":
+		project := v.GetString("pubsubProject")
+		if project == "" {
+			panic("pubsub sink specified but pubsubProject not specified")
+		}
+
+		v.SetDefault("pubsubTopic", "eventrouter")
+		v.SetDefault("pubsubCredentialsFile", "")
+		v.SetDefault("pubsubOrderingKeys", true)
+
+		topic := v.GetString("pubsubTopic")
+		credentialsFile := v.GetString("pubsubCredentialsFile")
+		ordered := v.GetBool("pubsubOrderingKeys")
+
+		ps, err := NewPubSubSink(project, topic, credentialsFile, ordered)
+		if err != nil {
+			panic(err.Error())
+		}
+		return ps
+	case "kinesis":
+		region := v.GetString("kinesisRegion")
+		if region == "" {
+			panic("kinesis sink specified but kinesisRegion not specified")
+		}
+
+		stream := v.GetString("kinesisStream")
+		if stream == "" {
+			panic("kinesis sink specified but kinesisStream not specified")
+		}
+
+		// Static credentials are optional, the default AWS credential chain is
+		// used when they are not set
+		v.SetDefault("kinesisAccessKeyID", "")
+		v.SetDefault("kinesisSecretAccessKey", "")
+		v.SetDefault("kinesisPartitionKey", "namespace")
+		v.SetDefault("kinesisRetryMax", 5)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("kinesisSinkBufferSize", 1500)
+		v.SetDefault("kinesisSinkDiscardMessages", true)
+
+		accessKeyID := v.GetString("kinesisAccessKeyID")
+		secretAccessKey := v.GetString("kinesisSecretAccessKey")
+		partitionKey := v.GetString("kinesisPartitionKey")
+		if partitionKey != "namespace" && partitionKey != "uid" {
+			panic("kinesis sink specified, but incorrect kinesisPartitionKey specified. Supported keys are: namespace (default) and uid")
+		}
+		retryMax := v.GetInt("kinesisRetryMax")
+		bufferSize := v.GetInt("kinesisSinkBufferSize")
+		overflow := v.GetBool("kinesisSinkDiscardMessages")
+
+		k, err := NewKinesisSink(accessKeyID, secretAccessKey, region, stream, partitionKey, retryMax, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(k.Run, stopCh)
+		return k
+	case "sqs":
+		region := v.GetString("sqsRegion")
+		if region == "" {
+			panic("sqs sink specified but sqsRegion not specified")
+		}
+
+		queueURL := v.GetString("sqsQueueUrl")
+		if queueURL == "" {
+			panic("sqs sink specified but sqsQueueUrl not specified")
+		}
+
+		// Static credentials are optional, the default AWS credential chain is
+		// used when they are not set
+		v.SetDefault("sqsAccessKeyID", "")
+		v.SetDefault("sqsSecretAccessKey", "")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("sqsSinkBufferSize", 1500)
+		v.SetDefault("sqsSinkDiscardMessages", true)
+
+		accessKeyID := v.GetString("sqsAccessKeyID")
+		secretAccessKey := v.GetString("sqsSecretAccessKey")
+		bufferSize := v.GetInt("sqsSinkBufferSize")
+		overflow := v.GetBool("sqsSinkDiscardMessages")
+
+		s, err := NewSQSSink(accessKeyID, secretAccessKey, region, queueURL, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "azuremonitor":
+		v.SetDefault("azureMonitorEnvironment", "AzurePublicCloud")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("azureMonitorSinkBufferSize", 1500)
+		v.SetDefault("azureMonitorSinkDiscardMessages", true)
+
+		cfg := AzureMonitorConfig{
+			Endpoint:     v.GetString("azureMonitorEndpoint"),
+			RuleID:       v.GetString("azureMonitorRuleID"),
+			Stream:       v.GetString("azureMonitorStream"),
+			Environment:  v.GetString("azureMonitorEnvironment"),
+			TenantID:     v.GetString("azureMonitorTenantID"),
+			ClientID:     v.GetString("azureMonitorClientID"),
+			ClientSecret: v.GetString("azureMonitorClientSecret"),
+		}
+		if cfg.Endpoint == "" || cfg.RuleID == "" || cfg.Stream == "" {
+			panic("azuremonitor sink specified but azureMonitorEndpoint, azureMonitorRuleID or azureMonitorStream not specified")
+		}
+		if cfg.ClientSecret != "" && cfg.TenantID == "" {
+			panic("azuremonitor sink specified with a service principal but azureMonitorTenantID not specified")
+		}
+
+		bufferSize := v.GetInt("azureMonitorSinkBufferSize")
+		overflow := v.GetBool("azureMonitorSinkDiscardMessages")
+
+		a, err := NewAzureMonitorSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(a.Run, stopCh)
+		return a
+	case "amqp":
+		url := v.GetString("amqpUrl")
+		if url == "" {
+			panic("amqp sink specified but amqpUrl not specified")
+		}
+
+		v.SetDefault("amqpExchange", "eventrouter")
+		v.SetDefault("amqpRoutingKey", "events.{namespace}.{type}.{reason}")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("amqpSinkBufferSize", 1500)
+		v.SetDefault("amqpSinkDiscardMessages", true)
+
+		exchange := v.GetString("amqpExchange")
+		routingKey := v.GetString("amqpRoutingKey")
+		bufferSize := v.GetInt("amqpSinkBufferSize")
+		overflow := v.GetBool("amqpSinkDiscardMessages")
+
+		a, err := NewAMQPSink(url, exchange, routingKey, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(a.Run, stopCh)
+		return a
+	case "pulsar":
+		url := v.GetString("pulsarUrl")
+		if url == "" {
+			panic("pulsar sink specified but pulsarUrl not specified")
+		}
+
+		v.SetDefault("pulsarTopic", "persistent://public/default/eventrouter")
+		v.SetDefault("pulsarTLSAllowInsecure", false)
+		v.SetDefault("pulsarTLSValidateHostname", false)
+		v.SetDefault("pulsarDisableBatching", false)
+		v.SetDefault("pulsarBatchingMaxMessages", 1000)
+		v.SetDefault("pulsarBatchingMaxPublishDelay", 10*time.Millisecond)
+
+		cfg := PulsarConfig{
+			URL:                     url,
+			Topic:                   v.GetString("pulsarTopic"),
+			Token:                   v.GetString("pulsarToken"),
+			TokenFile:               v.GetString("pulsarTokenFile"),
+			TLSCertFile:             v.GetString("pulsarTLSCertFile"),
+			TLSKeyFile:              v.GetString("pulsarTLSKeyFile"),
+			TLSTrustCertsFile:       v.GetString("pulsarTLSTrustCertsFile"),
+			TLSAllowInsecure:        v.GetBool("pulsarTLSAllowInsecure"),
+			TLSValidateHostname:     v.GetBool("pulsarTLSValidateHostname"),
+			DisableBatching:         v.GetBool("pulsarDisableBatching"),
+			BatchingMaxMessages:     uint(v.GetInt("pulsarBatchingMaxMessages")),
+			BatchingMaxPublishDelay: v.GetDuration("pulsarBatchingMaxPublishDelay"),
+		}
+		if cfg.TLSCertFile != "" && cfg.TLSKeyFile == "" {
+			panic("pulsar sink specified with TLS authentication but pulsarTLSKeyFile not specified")
+		}
+
+		p, err := NewPulsarSink(cfg)
+		if err != nil {
+			panic(err.Error())
+		}
+		return p
+	case "mysql":
+		dsn := v.GetString("mysqlDSN")
+		if dsn == "" {
+			panic("mysql sink specified but mysqlDSN not specified")
+		}
+
+		v.SetDefault("mysqlTable", "events")
+		v.SetDefault("mysqlBatchSize", 500)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("mysqlSinkBufferSize", 1500)
+		v.SetDefault("mysqlSinkDiscardMessages", true)
+
+		table := v.GetString("mysqlTable")
+		batchSize := v.GetInt("mysqlBatchSize")
+		bufferSize := v.GetInt("mysqlSinkBufferSize")
+		overflow := v.GetBool("mysqlSinkDiscardMessages")
+
+		m, err := NewMySQLSink(dsn, table, batchSize, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(m.Run, stopCh)
+		return m
+	case "sqlite":
+		v.SetDefault("sqlitePath", "/var/lib/eventrouter/events.db")
+		v.SetDefault("sqliteMaxAge", 7*24*time.Hour)
+		v.SetDefault("sqliteMaxRows", 1000000)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("sqliteSinkBufferSize", 1500)
+		v.SetDefault("sqliteSinkDiscardMessages", true)
+
+		path := v.GetString("sqlitePath")
+		maxAge := v.GetDuration("sqliteMaxAge")
+		maxRows := v.GetInt("sqliteMaxRows")
+		bufferSize := v.GetInt("sqliteSinkBufferSize")
+		overflow := v.GetBool("sqliteSinkDiscardMessages")
+
+		s, err := NewSQLiteSink(path, maxAge, maxRows, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "clickhouse":
+		endpoint := v.GetString("clickhouseUrl")
+		if endpoint == "" {
+			panic("clickhouse sink specified but clickhouseUrl not specified")
+		}
+
+		v.SetDefault("clickhouseUser", "")
+		v.SetDefault("clickhousePassword", "")
+		v.SetDefault("clickhouseTable", "events")
+		v.SetDefault("clickhouseAsyncInsert", true)
+		v.SetDefault("clickhouseCreateTable", false)
+		v.SetDefault("clickhouseBatchSize", 1000)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("clickhouseSinkBufferSize", 1500)
+		v.SetDefault("clickhouseSinkDiscardMessages", true)
+
+		user := v.GetString("clickhouseUser")
+		password := v.GetString("clickhousePassword")
+		table := v.GetString("clickhouseTable")
+		async := v.GetBool("clickhouseAsyncInsert")
+		createTable := v.GetBool("clickhouseCreateTable")
+		batchSize := v.GetInt("clickhouseBatchSize")
+		bufferSize := v.GetInt("clickhouseSinkBufferSize")
+		overflow := v.GetBool("clickhouseSinkDiscardMessages")
+
+		c, err := NewClickHouseSink(endpoint, user, password, table, async, createTable, batchSize, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(c.Run, stopCh)
+		return c
+	case "opensearch":
+		endpoint := v.GetString("opensearchEndpoint")
+		cloudID := v.GetString("opensearchCloudID")
+		if endpoint == "" && cloudID == "" {
+			panic("opensearch sink specified but neither opensearchEndpoint nor opensearchCloudID specified")
+		}
+
+		v.SetDefault("opensearchIndex", "eventrouter")
+		v.SetDefault("opensearchIndexDateFormat", "2006.01.02")
+		v.SetDefault("opensearchSigV4", false)
+		v.SetDefault("opensearchService", "es")
+		v.SetDefault("opensearchBatchSize", 500)
+		v.SetDefault("opensearchFlushInterval", "1s")
+		v.SetDefault("opensearchWorkers", 2)
+		v.SetDefault("opensearchBootstrap", false)
+		v.SetDefault("opensearchRetentionDays", 30)
+		v.SetDefault("opensearchRolloverAge", "1d")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("opensearchSinkBufferSize", 1500)
+		v.SetDefault("opensearchSinkDiscardMessages", true)
+
+		cfg := OpenSearchConfig{
+			Endpoint:        endpoint,
+			CloudID:         cloudID,
+			Index:           v.GetString("opensearchIndex"),
+			IndexDateFormat: v.GetString("opensearchIndexDateFormat"),
+			DataStream:      v.GetString("opensearchDataStream"),
+			DocumentID:      v.GetString("opensearchDocumentID"),
+			Username:        v.GetString("opensearchUsername"),
+			Password:        v.GetString("opensearchPassword"),
+			APIKey:          v.GetString("opensearchAPIKey"),
+			SigV4:           v.GetBool("opensearchSigV4"),
+			Region:          v.GetString("opensearchRegion"),
+			Service:         v.GetString("opensearchService"),
+			AccessKeyID:     v.GetString("opensearchAccessKeyID"),
+			SecretAccessKey: v.GetString("opensearchSecretAccessKey"),
+			BatchSize:       v.GetInt("opensearchBatchSize"),
+			FlushInterval:   v.GetDuration("opensearchFlushInterval"),
+			Workers:         v.GetInt("opensearchWorkers"),
+			Bootstrap:       v.GetBool("opensearchBootstrap"),
+			RetentionDays:   v.GetInt("opensearchRetentionDays"),
+			RolloverAge:     v.GetString("opensearchRolloverAge"),
+		}
+		if cfg.SigV4 && cfg.Region == "" {
+			panic("opensearch sink specified with opensearchSigV4 but opensearchRegion not specified")
+		}
+		bufferSize := v.GetInt("opensearchSinkBufferSize")
+		overflow := v.GetBool("opensearchSinkDiscardMessages")
+
+		o, err := NewOpenSearchSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(o.Run, stopCh)
+		return o
+	case "socket":
+		address := v.GetString("socketAddress")
+		if address == "" {
+			panic("socket sink specified but socketAddress not specified")
+		}
+
+		v.SetDefault("socketNetwork", "tcp")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("socketSinkBufferSize", 1500)
+		v.SetDefault("socketSinkDiscardMessages", true)
+
+		network := v.GetString("socketNetwork")
+		bufferSize := v.GetInt("socketSinkBufferSize")
+		overflow := v.GetBool("socketSinkDiscardMessages")
+
+		s, err := NewSocketSink(network, address, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "slack":
+		v.SetDefault("slackTypes", []string{v1.EventTypeWarning})
+		v.SetDefault("slackRateLimit", 20)
+		v.SetDefault("slackBurst", 5)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("slackSinkBufferSize", 1500)
+		v.SetDefault("slackSinkDiscardMessages", true)
+
+		cfg := SlackConfig{
+			WebhookURL:        v.GetString("slackWebhookUrl"),
+			Token:             v.GetString("slackToken"),
+			Channel:           v.GetString("slackChannel"),
+			NamespaceChannels: v.GetStringMapString("slackNamespaceChannels"),
+			Filter:            eventFilterConfig(v, "slack"),
+			RateLimit:         v.GetFloat64("slackRateLimit"),
+			Burst:             v.GetInt("slackBurst"),
+		}
+		if cfg.WebhookURL == "" && cfg.Token == "" {
+			panic("slack sink specified but neither slackWebhookUrl nor slackToken specified")
+		}
+		bufferSize := v.GetInt("slackSinkBufferSize")
+		overflow := v.GetBool("slackSinkDiscardMessages")
+
+		s, err := NewSlackSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "telegram":
+		token := v.GetString("telegramToken")
+		if token == "" {
+			panic("telegram sink specified but telegramToken not specified")
+		}
+
+		chatIDs := v.GetStringSlice("telegramChatIDs")
+		if len(chatIDs) == 0 {
+			panic("telegram sink specified but telegramChatIDs not specified")
+		}
+
+		v.SetDefault("telegramTypes", []string{v1.EventTypeWarning})
+		v.SetDefault("telegramTemplate", "")
+		v.SetDefault("telegramParseMode", "")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("telegramSinkBufferSize", 1500)
+		v.SetDefault("telegramSinkDiscardMessages", true)
+
+		tmpl := v.GetString("telegramTemplate")
+		parseMode := v.GetString("telegramParseMode")
+		filter := eventFilterConfig(v, "telegram")
+		bufferSize := v.GetInt("telegramSinkBufferSize")
+		overflow := v.GetBool("telegramSinkDiscardMessages")
+
+		t, err := NewTelegramSink(token, chatIDs, tmpl, parseMode, filter, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(t.Run, stopCh)
+		return t
+	case "pagerduty":
+		routingKey := v.GetString("pagerdutyRoutingKey")
+		if routingKey == "" {
+			panic("pagerduty sink specified but pagerdutyRoutingKey not specified")
+		}
+
+		v.SetDefault("pagerdutyTypes", []string{v1.EventTypeWarning})
+		v.SetDefault("pagerdutySeverity", "warning")
+		v.SetDefault("pagerdutyClusterName", "kubernetes")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("pagerdutySinkBufferSize", 1500)
+		v.SetDefault("pagerdutySinkDiscardMessages", true)
+
+		severity := v.GetString("pagerdutySeverity")
+		cluster := v.GetString("pagerdutyClusterName")
+		filter := eventFilterConfig(v, "pagerduty")
+		bufferSize := v.GetInt("pagerdutySinkBufferSize")
+		overflow := v.GetBool("pagerdutySinkDiscardMessages")
+
+		p, err := NewPagerDutySink(routingKey, severity, cluster, filter, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(p.Run, stopCh)
+		return p
+	case "smtp":
+		host := v.GetString("smtpHost")
+		if host == "" {
+			panic("smtp sink specified but smtpHost not specified")
+		}
+
+		from := v.GetString("smtpFrom")
+		if from == "" {
+			panic("smtp sink specified but smtpFrom not specified")
+		}
+
+		to := v.GetStringSlice("smtpTo")
+		if len(to) == 0 {
+			panic("smtp sink specified but smtpTo not specified")
+		}
+
+		v.SetDefault("smtpPort", 587)
+		v.SetDefault("smtpTLSMode", "starttls")
+		v.SetDefault("smtpInsecureSkipVerify", false)
+		v.SetDefault("smtpSubjectPrefix", "[eventrouter]")
+		v.SetDefault("smtpImmediateTypes", []string{v1.EventTypeWarning})
+		v.SetDefault("smtpDigestInterval", "1h")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("smtpSinkBufferSize", 1500)
+		v.SetDefault("smtpSinkDiscardMessages", true)
+
+		cfg := SMTPConfig{
+			Host:               host,
+			Port:               v.GetInt("smtpPort"),
+			Username:           v.GetString("smtpUsername"),
+			Password:           v.GetString("smtpPassword"),
+			TLSMode:            v.GetString("smtpTLSMode"),
+			InsecureSkipVerify: v.GetBool("smtpInsecureSkipVerify"),
+			From:               from,
+			To:                 to,
+			SubjectPrefix:      v.GetString("smtpSubjectPrefix"),
+			Filter:             eventFilterConfig(v, "smtp"),
+			ImmediateTypes:     v.GetStringSlice("smtpImmediateTypes"),
+			DigestInterval:     v.GetDuration("smtpDigestInterval"),
+		}
+		bufferSize := v.GetInt("smtpSinkBufferSize")
+		overflow := v.GetBool("smtpSinkDiscardMessages")
+
+		s, err := NewSMTPSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "jira":
+		jiraURL := v.GetString("jiraUrl")
+		if jiraURL == "" {
+			panic("jira sink specified but jiraUrl not specified")
+		}
+
+		token := v.GetString("jiraToken")
+		if token == "" {
+			panic("jira sink specified but jiraToken not specified")
+		}
+
+		project := v.GetString("jiraProject")
+		if project == "" {
+			panic("jira sink specified but jiraProject not specified")
+		}
+
+		if len(v.GetStringSlice("jiraReasons")) == 0 {
+			panic("jira sink specified but jiraReasons not specified")
+		}
+
+		v.SetDefault("jiraIssueType", "Task")
+		v.SetDefault("jiraCommentInterval", "1h")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("jiraSinkBufferSize", 1500)
+		v.SetDefault("jiraSinkDiscardMessages", true)
+
+		cfg := JiraConfig{
+			URL:             jiraURL,
+			Username:        v.GetString("jiraUsername"),
+			Token:           token,
+			Project:         project,
+			IssueType:       v.GetString("jiraIssueType"),
+			Labels:          v.GetStringSlice("jiraLabels"),
+			Filter:          eventFilterConfig(v, "jira"),
+			CommentInterval: v.GetDuration("jiraCommentInterval"),
+		}
+		bufferSize := v.GetInt("jiraSinkBufferSize")
+		overflow := v.GetBool("jiraSinkDiscardMessages")
+
+		j, err := NewJiraSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(j.Run, stopCh)
+		return j
+	case "alertmanager":
+		urls := v.GetStringSlice("alertmanagerUrls")
+		if len(urls) == 0 {
+			panic("alertmanager sink specified but alertmanagerUrls not specified")
+		}
+
+		v.SetDefault("alertmanagerTypes", []string{v1.EventTypeWarning})
+		v.SetDefault("alertmanagerSeverity", "warning")
+		v.SetDefault("alertmanagerResolveTimeout", "1h")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("alertmanagerSinkBufferSize", 1500)
+		v.SetDefault("alertmanagerSinkDiscardMessages", true)
+
+		cfg := AlertmanagerConfig{
+			URLs:           urls,
+			Username:       v.GetString("alertmanagerUsername"),
+			Password:       v.GetString("alertmanagerPassword"),
+			Token:          v.GetString("alertmanagerToken"),
+			Labels:         v.GetStringMapString("alertmanagerLabels"),
+			Severity:       v.GetString("alertmanagerSeverity"),
+			ResolveTimeout: v.GetDuration("alertmanagerResolveTimeout"),
+			Filter:         eventFilterConfig(v, "alertmanager"),
+		}
+		bufferSize := v.GetInt("alertmanagerSinkBufferSize")
+		overflow := v.GetBool("alertmanagerSinkDiscardMessages")
+
+		a := NewAlertmanagerSink(cfg, overflow, bufferSize)
+		runSink(a.Run, stopCh)
+		return a
+	case "logfile":
+		v.SetDefault("logfilePath", "/var/log/eventrouter/events.log")
+		v.SetDefault("logfileMaxSize", "100MB")
+		v.SetDefault("logfileMaxAge", "24h")
+		v.SetDefault("logfileMaxBackups", 7)
+		v.SetDefault("logfileCompress", true)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("logfileSinkBufferSize", 1500)
+		v.SetDefault("logfileSinkDiscardMessages", true)
+
+		path := v.GetString("logfilePath")
+		maxSize := int64(v.GetSizeInBytes("logfileMaxSize"))
+		maxAge := v.GetDuration("logfileMaxAge")
+		maxBackups := v.GetInt("logfileMaxBackups")
+		compress := v.GetBool("logfileCompress")
+		bufferSize := v.GetInt("logfileSinkBufferSize")
+		overflow := v.GetBool("logfileSinkDiscardMessages")
+
+		l, err := NewLogFileSink(path, maxSize, maxAge, maxBackups, compress, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(l.Run, stopCh)
+		return l
+	case "gcs":
+		bucket := v.GetString("gcsBucket")
+		if bucket == "" {
+			panic("gcs sink specified but gcsBucket not specified")
+		}
+
+		v.SetDefault("gcsPrefix", "eventrouter")
+		v.SetDefault("gcsCredentialsFile", "")
+		v.SetDefault("gcsOutputFormat", "json")
+		v.SetDefault("gcsCompress", true)
+		v.SetDefault("gcsUploadInterval", "5m")
+		v.SetDefault("gcsMaxSize", "64MB")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("gcsSinkBufferSize", 1500)
+		v.SetDefault("gcsSinkDiscardMessages", true)
+
+		prefix := v.GetString("gcsPrefix")
+		credentialsFile := v.GetString("gcsCredentialsFile")
+		outputFormat := v.GetString("gcsOutputFormat")
+		compress := v.GetBool("gcsCompress")
+		uploadInterval := v.GetDuration("gcsUploadInterval")
+		maxSize := int(v.GetSizeInBytes("gcsMaxSize"))
+		bufferSize := v.GetInt("gcsSinkBufferSize")
+		overflow := v.GetBool("gcsSinkDiscardMessages")
+
+		g, err := NewGCSSink(credentialsFile, bucket, prefix, outputFormat, compress, uploadInterval, maxSize, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(g.Run, stopCh)
+		return g
+	case "bigquery":
+		project := v.GetString("bigqueryProject")
+		if project == "" {
+			panic("bigquery sink specified but bigqueryProject not specified")
+		}
+
+		dataset := v.GetString("bigqueryDataset")
+		if dataset == "" {
+			panic("bigquery sink specified but bigqueryDataset not specified")
+		}
+
+		v.SetDefault("bigqueryTable", "events")
+		v.SetDefault("bigqueryClusterName", "")
+		v.SetDefault("bigqueryCredentialsFile", "")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("bigquerySinkBufferSize", 1500)
+		v.SetDefault("bigquerySinkDiscardMessages", true)
+
+		table := v.GetString("bigqueryTable")
+		cluster := v.GetString("bigqueryClusterName")
+		credentialsFile := v.GetString("bigqueryCredentialsFile")
+		bufferSize := v.GetInt("bigquerySinkBufferSize")
+		overflow := v.GetBool("bigquerySinkDiscardMessages")
+
+		b, err := NewBigQuerySink(project, dataset, table, cluster, credentialsFile, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(b.Run, stopCh)
+		return b
+	case "dynamodb":
+		region := v.GetString("dynamodbRegion")
+		if region == "" {
+			panic("dynamodb sink specified but dynamodbRegion not specified")
+		}
+
+		table := v.GetString("dynamodbTable")
+		if table == "" {
+			panic("dynamodb sink specified but dynamodbTable not specified")
+		}
+
+		// Static credentials are optional, the default AWS credential chain is
+		// used when they are not set
+		v.SetDefault("dynamodbAccessKeyID", "")
+		v.SetDefault("dynamodbSecretAccessKey", "")
+		v.SetDefault("dynamodbPartitionKey", "namespace")
+		v.SetDefault("dynamodbSortKey", "sk")
+		v.SetDefault("dynamodbTTLAttribute", "")
+		v.SetDefault("dynamodbTTL", "720h")
+		v.SetDefault("dynamodbRetryMax", 5)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("dynamodbSinkBufferSize", 1500)
+		v.SetDefault("dynamodbSinkDiscardMessages", true)
+
+		cfg := DynamoDBConfig{
+			Region:          region,
+			Table:           table,
+			AccessKeyID:     v.GetString("dynamodbAccessKeyID"),
+			SecretAccessKey: v.GetString("dynamodbSecretAccessKey"),
+			PartitionKey:    v.GetString("dynamodbPartitionKey"),
+			SortKey:         v.GetString("dynamodbSortKey"),
+			TTLAttribute:    v.GetString("dynamodbTTLAttribute"),
+			TTL:             v.GetDuration("dynamodbTTL"),
+			MaxRetries:      v.GetInt("dynamodbRetryMax"),
+		}
+		bufferSize := v.GetInt("dynamodbSinkBufferSize")
+		overflow := v.GetBool("dynamodbSinkDiscardMessages")
+
+		d, err := NewDynamoDBSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(d.Run, stopCh)
+		return d
+	case "newrelic":
+		licenseKey := v.GetString("newrelicLicenseKey")
+		if licenseKey == "" {
+			panic("newrelic sink specified but newrelicLicenseKey not specified")
+		}
+
+		v.SetDefault("newrelicApi", "log")
+		v.SetDefault("newrelicRegion", "us")
+		v.SetDefault("newrelicEndpoint", "")
+		v.SetDefault("newrelicEventType", "KubernetesEvent")
+		v.SetDefault("newrelicBatchSize", 500)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("newrelicSinkBufferSize", 1500)
+		v.SetDefault("newrelicSinkDiscardMessages", true)
+
+		cfg := NewRelicConfig{
+			API:        v.GetString("newrelicApi"),
+			LicenseKey: licenseKey,
+			AccountID:  v.GetString("newrelicAccountID"),
+			Region:     v.GetString("newrelicRegion"),
+			Endpoint:   v.GetString("newrelicEndpoint"),
+			EventType:  v.GetString("newrelicEventType"),
+			Attributes: v.GetStringMapString("newrelicAttributes"),
+			BatchSize:  v.GetInt("newrelicBatchSize"),
+		}
+		bufferSize := v.GetInt("newrelicSinkBufferSize")
+		overflow := v.GetBool("newrelicSinkDiscardMessages")
+
+		n, err := NewNewRelicSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(n.Run, stopCh)
+		return n
+	case "gelf":
+		address := v.GetString("gelfAddress")
+		if address == "" {
+			panic("gelf sink specified but gelfAddress not specified")
+		}
+
+		v.SetDefault("gelfNetwork", "udp")
+		v.SetDefault("gelfHost", "")
+		v.SetDefault("gelfChunkSize", 1420)
+		v.SetDefault("gelfCompress", true)
+		v.SetDefault("gelfTLSCAFile", "")
+		v.SetDefault("gelfTLSInsecureSkipVerify", false)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("gelfSinkBufferSize", 1500)
+		v.SetDefault("gelfSinkDiscardMessages", true)
+
+		cfg := GELFConfig{
+			Network:            v.GetString("gelfNetwork"),
+			Address:            address,
+			Host:               v.GetString("gelfHost"),
+			ChunkSize:          v.GetInt("gelfChunkSize"),
+			Compress:           v.GetBool("gelfCompress"),
+			CAFile:             v.GetString("gelfTLSCAFile"),
+			InsecureSkipVerify: v.GetBool("gelfTLSInsecureSkipVerify"),
+			Fields:             v.GetStringMapString("gelfFields"),
+		}
+		bufferSize := v.GetInt("gelfSinkBufferSize")
+		overflow := v.GetBool("gelfSinkDiscardMessages")
+
+		g, err := NewGELFSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(g.Run, stopCh)
+		return g
+	case "mqtt":
+		broker := v.GetString("mqttBroker")
+		if broker == "" {
+			panic("mqtt sink specified but mqttBroker not specified")
+		}
+
+		v.SetDefault("mqttProtocolVersion", 4)
+		v.SetDefault("mqttClientID", "eventrouter")
+		v.SetDefault("mqttTopic", "kubernetes/{cluster}/events/{namespace}/{kind}")
+		v.SetDefault("mqttClusterName", "default")
+		v.SetDefault("mqttQoS", 1)
+		v.SetDefault("mqttRetain", false)
+		v.SetDefault("mqttTLSInsecureSkipVerify", false)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("mqttSinkBufferSize", 1500)
+		v.SetDefault("mqttSinkDiscardMessages", true)
+
+		cfg := MQTTConfig{
+			Broker:             broker,
+			ProtocolVersion:    v.GetInt("mqttProtocolVersion"),
+			ClientID:           v.GetString("mqttClientID"),
+			Username:           v.GetString("mqttUsername"),
+			Password:           v.GetString("mqttPassword"),
+			Topic:              v.GetString("mqttTopic"),
+			Cluster:            v.GetString("mqttClusterName"),
+			QoS:                byte(v.GetInt("mqttQoS")),
+			Retain:             v.GetBool("mqttRetain"),
+			CAFile:             v.GetString("mqttTLSCAFile"),
+			CertFile:           v.GetString("mqttTLSCertFile"),
+			KeyFile:            v.GetString("mqttTLSKeyFile"),
+			InsecureSkipVerify: v.GetBool("mqttTLSInsecureSkipVerify"),
+		}
+		bufferSize := v.GetInt("mqttSinkBufferSize")
+		overflow := v.GetBool("mqttSinkDiscardMessages")
+
+		m, err := NewMQTTSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(m.Run, stopCh)
+		return m
+	case "victorialogs":
+		u := v.GetString("victorialogsUrl")
+		if u == "" {
+			panic("victorialogs sink specified but victorialogsUrl not specified")
+		}
+
+		v.SetDefault("victorialogsStreamFields", []string{"namespace", "kind", "reason"})
+		v.SetDefault("victorialogsBatchSize", 1000)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("victorialogsSinkBufferSize", 1500)
+		v.SetDefault("victorialogsSinkDiscardMessages", true)
+
+		cfg := VictoriaLogsConfig{
+			URL:          u,
+			StreamFields: v.GetStringSlice("victorialogsStreamFields"),
+			AccountID:    v.GetString("victorialogsAccountID"),
+			ProjectID:    v.GetString("victorialogsProjectID"),
+			Username:     v.GetString("victorialogsUsername"),
+			Password:     v.GetString("victorialogsPassword"),
+			Fields:       v.GetStringMapString("victorialogsFields"),
+			BatchSize:    v.GetInt("victorialogsBatchSize"),
+		}
+		bufferSize := v.GetInt("victorialogsSinkBufferSize")
+		overflow := v.GetBool("victorialogsSinkDiscardMessages")
+
+		vl := NewVictoriaLogsSink(cfg, overflow, bufferSize)
+		runSink(vl.Run, stopCh)
+		return vl
+	case "quickwit":
+		u := v.GetString("quickwitUrl")
+		if u == "" {
+			panic("quickwit sink specified but quickwitUrl not specified")
+		}
+
+		v.SetDefault("quickwitIndex", "k8s-events")
+		v.SetDefault("quickwitCommit", "auto")
+		v.SetDefault("quickwitToken", "")
+		v.SetDefault("quickwitBatchSize", 1000)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("quickwitSinkBufferSize", 1500)
+		v.SetDefault("quickwitSinkDiscardMessages", true)
+
+		cfg := QuickwitConfig{
+			URL:       u,
+			Index:     v.GetString("quickwitIndex"),
+			Commit:    v.GetString("quickwitCommit"),
+			Token:     v.GetString("quickwitToken"),
+			BatchSize: v.GetInt("quickwitBatchSize"),
+		}
+		bufferSize := v.GetInt("quickwitSinkBufferSize")
+		overflow := v.GetBool("quickwitSinkDiscardMessages")
+
+		q, err := NewQuickwitSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(q.Run, stopCh)
+		return q
+	case "snowflake":
+		account := v.GetString("snowflakeAccount")
+		if account == "" {
+			panic("snowflake sink specified but snowflakeAccount not specified")
+		}
+		user := v.GetString("snowflakeUser")
+		if user == "" {
+			panic("snowflake sink specified but snowflakeUser not specified")
+		}
+		database := v.GetString("snowflakeDatabase")
+		if database == "" {
+			panic("snowflake sink specified but snowflakeDatabase not specified")
+		}
+
+		// The private key is snowflakePrivateKey, or the content of
+		// snowflakePrivateKeyFile to read it from a mounted secret
+		key := []byte(v.GetString("snowflakePrivateKey"))
+		if path := v.GetString("snowflakePrivateKeyFile"); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				panic(err.Error())
+			}
+			key = b
+		}
+		if len(key) == 0 {
+			panic("snowflake sink specified but neither snowflakePrivateKey nor snowflakePrivateKeyFile specified")
+		}
+
+		v.SetDefault("snowflakeUrl", "")
+		v.SetDefault("snowflakeSchema", "PUBLIC")
+		v.SetDefault("snowflakeTable", "K8S_EVENTS")
+		v.SetDefault("snowflakeChannel", "eventrouter")
+		v.SetDefault("snowflakeBatchSize", 1000)
+
+		// The default pipe of the table, unless an explicit one is set
+		v.SetDefault("snowflakePipe", strings.ToUpper(v.GetString("snowflakeTable"))+"-STREAMING")
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("snowflakeSinkBufferSize", 1500)
+		v.SetDefault("snowflakeSinkDiscardMessages", true)
+
+		cfg := SnowflakeConfig{
+			Account:    account,
+			URL:        v.GetString("snowflakeUrl"),
+			User:       user,
+			PrivateKey: key,
+			Database:   database,
+			Schema:     v.GetString("snowflakeSchema"),
+			Pipe:       v.GetString("snowflakePipe"),
+			Channel:    v.GetString("snowflakeChannel"),
+			BatchSize:  v.GetInt("snowflakeBatchSize"),
+		}
+		bufferSize := v.GetInt("snowflakeSinkBufferSize")
+		overflow := v.GetBool("snowflakeSinkDiscardMessages")
+
+		s, err := NewSnowflakeSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(s.Run, stopCh)
+		return s
+	case "webhook":
+		u := v.GetString("webhookUrl")
+		if u == "" {
+			panic("webhook sink specified but webhookUrl not specified")
+		}
+
+		// The body template is webhookBody, or the content of webhookBodyFile
+		// for templates that are easier to keep in a file (e.g. a ConfigMap)
+		body := v.GetString("webhookBody")
+		if path := v.GetString("webhookBodyFile"); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				panic(err.Error())
+			}
+			body = string(b)
+		}
+		if body == "" {
+			panic("webhook sink specified but neither webhookBody nor webhookBodyFile specified")
+		}
+
+		v.SetDefault("webhookMethod", "POST")
+		v.SetDefault("webhookHeaders", map[string]string{})
+		v.SetDefault("webhookContentType", "application/json")
+		v.SetDefault("webhookTimeout", "10s")
+		v.SetDefault("webhookRetryMax", 3)
+
+		// By default we buffer up to 1500 events, and drop messages if more than
+		// 1500 have come in without getting consumed
+		v.SetDefault("webhookSinkBufferSize", 1500)
+		v.SetDefault("webhookSinkDiscardMessages", true)
+
+		cfg := WebhookConfig{
+			URL:         u,
+			Method:      v.GetString("webhookMethod"),
+			Headers:     v.GetStringMapString("webhookHeaders"),
+			Body:        body,
+			ContentType: v.GetString("webhookContentType"),
+			Filter:      eventFilterConfig(v, "webhook"),
+			Timeout:     v.GetDuration("webhookTimeout"),
+			MaxRetries:  v.GetInt("webhookRetryMax"),
+		}
+		bufferSize := v.GetInt("webhookSinkBufferSize")
+		overflow := v.GetBool("webhookSinkDiscardMessages")
+
+		w, err := NewWebhookSink(cfg, overflow, bufferSize)
+		if err != nil {
+			panic(err.Error())
+		}
+		runSink(w.Run, stopCh)
+		return w
 	default:
 		err := errors.New("Invalid Sink Specified")
 		panic(err.Error())
 	}
 	return e
 }
+
+// eventFilterConfig reads the <prefix>Types, <prefix>Reasons,
+// <prefix>Namespaces and <prefix>Kinds lists of an EventFilter, and its
+// <prefix>ReasonRegex, <prefix>ExcludeReasonRegex, <prefix>MessageRegex and
+// <prefix>ExcludeMessageRegex regular expressions
+func eventFilterConfig(v *viper.Viper, prefix string) EventFilter {
+	return EventFilter{
+		Types:      v.GetStringSlice(prefix + "Types"),
+		Reasons:    v.GetStringSlice(prefix + "Reasons"),
+		Namespaces: v.GetStringSlice(prefix + "Namespaces"),
+		Kinds:      v.GetStringSlice(prefix + "Kinds"),
+
+		ReasonRegexp:         regexpConfig(v, prefix+"ReasonRegex"),
+		ExcludeReasonRegexp:  regexpConfig(v, prefix+"ExcludeReasonRegex"),
+		MessageRegexp:        regexpConfig(v, prefix+"MessageRegex"),
+		ExcludeMessageRegexp: regexpConfig(v, prefix+"ExcludeMessageRegex"),
+	}
+}
+
+// regexpConfig compiles the regular expression of the key, nil when unset
+func regexpConfig(v *viper.Viper, key string) *regexp.Regexp {
+	expr := v.GetString(key)
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		panic("invalid " + key + ": " + err.Error())
+	}
+	return re
+}
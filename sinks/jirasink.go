@@ -0,0 +1,327 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// jiraLabelPrefix prefixes the label identifying the involved object of an issue
+	jiraLabelPrefix = "eventrouter-"
+	// jiraForgetAfter is how long an object is remembered after its last event
+	jiraForgetAfter = 24 * time.Hour
+)
+
+// JiraConfig holds the settings of the JiraSink
+type JiraConfig struct {
+	// URL is the base URL of the Jira site, e.g. https://example.atlassian.net
+	URL string
+
+	// Username and Token are the account email and API token on Jira Cloud.
+	// With an empty Username, Token is used as a personal access token
+	// (Jira Server / Data Center).
+	Username string
+	Token    string
+
+	Project   string
+	IssueType string
+	Labels    []string
+
+	Filter EventFilter
+
+	// CommentInterval is the minimum delay between two comments added to the
+	// issue of one object
+	CommentInterval time.Duration
+}
+
+// jiraObject is what the sink remembers about an involved object
+type jiraObject struct {
+	issueKey    string
+	lastComment time.Time
+	lastSeen    time.Time
+}
+
+/*
+JiraSink opens Jira issues for the events matching its filter, typically a
+list of reasons like FailedScheduling or OOMKilling.
+
+There is at most one open issue per involved object: the issue carries an
+eventrouter-<uid> label, and further events about the object are added as
+comments to the open issue (at most one every CommentInterval) instead of
+opening new ones. Once the issue is resolved the next event opens a new one.
+The requests failing with a transport error, a 5xx or a 429 are retried with
+the retry policy of the sinks.
+*/
+type JiraSink struct {
+	cfg        JiraConfig
+	baseURL    string
+	httpClient *http.Client
+	retry      RetryPolicy
+	objects    map[string]*jiraObject
+	eventCh    channels.Channel
+}
+
+// NewJiraSink constructs a new JiraSink given its config
+func NewJiraSink(cfg JiraConfig, overflow bool, bufferSize int) (*JiraSink, error) {
+	if cfg.Project == "" {
+		return nil, fmt.Errorf("jira sink needs a project")
+	}
+
+	j := &JiraSink{
+		cfg:        cfg,
+		baseURL:    strings.TrimSuffix(cfg.URL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retry:      retryPolicy.forSink(),
+		objects:    map[string]*jiraObject{},
+	}
+
+	if overflow {
+		j.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		j.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return j, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (j *JiraSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !j.cfg.Filter.Matches(eNew) {
+		return
+	}
+	j.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through j.eventCh, and
+// opening or commenting issues. Objects without events for a day are
+// forgotten.
+func (j *JiraSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-j.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			j.drainEvent(evt)
+		case <-ticker.C:
+			for uid, obj := range j.objects {
+				if time.Since(obj.lastSeen) > jiraForgetAfter {
+					delete(j.objects, uid)
+				}
+			}
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(j.eventCh) {
+				j.drainEvent(evt)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvent updates jira for the event, dead-lettering it on failure
+func (j *JiraSink) drainEvent(evt EventData) {
+	if err := j.handle(evt.Event); err != nil {
+		glog.Errorf("Failed to update jira for %s: %v", describeObject(evt.Event), err)
+		deadLetterEvents("jira", []EventData{evt}, err)
+	}
+}
+
+// handle comments on the open issue of the involved object, or opens one
+func (j *JiraSink) handle(e *v1.Event) error {
+	uid := string(e.InvolvedObject.UID)
+	obj, ok := j.objects[uid]
+	if !ok {
+		obj = &jiraObject{}
+		j.objects[uid] = obj
+	}
+	obj.lastSeen = time.Now()
+
+	if obj.issueKey != "" && time.Since(obj.lastComment) < j.cfg.CommentInterval {
+		glog.V(4).Infof("Skipping jira comment on %s, last one was %v ago", obj.issueKey, time.Since(obj.lastComment))
+		return nil
+	}
+
+	// The issue may have been resolved, or opened by another replica
+	key, err := j.findOpenIssue(uid)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		if key, err = j.createIssue(e); err != nil {
+			return err
+		}
+		glog.Infof("Opened jira issue %s for %s", key, describeObject(e))
+	} else if err := j.comment(key, e); err != nil {
+		return err
+	}
+	obj.issueKey = key
+	obj.lastComment = time.Now()
+	return nil
+}
+
+// findOpenIssue returns the key of the unresolved issue of the object, or ""
+func (j *JiraSink) findOpenIssue(uid string) (string, error) {
+	jql := fmt.Sprintf(`project = "%s" AND labels = "%s%s" AND statusCategory != Done ORDER BY created DESC`,
+		j.cfg.Project, jiraLabelPrefix, uid)
+	params := url.Values{}
+	params.Set("jql", jql)
+	params.Set("fields", "key")
+	params.Set("maxResults", "1")
+
+	var result struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	if err := j.do("GET", "/rest/api/2/search?"+params.Encode(), nil, &result); err != nil {
+		return "", err
+	}
+	if len(result.Issues) == 0 {
+		return "", nil
+	}
+	return result.Issues[0].Key, nil
+}
+
+// createIssue opens an issue for the event and returns its key
+func (j *JiraSink) createIssue(e *v1.Event) (string, error) {
+	summary := fmt.Sprintf("%s: %s", e.Reason, describeObject(e))
+	if runes := []rune(summary); len(runes) > 250 {
+		summary = string(runes[:250])
+	}
+	labels := append([]string{jiraLabelPrefix + string(e.InvolvedObject.UID)}, j.cfg.Labels...)
+
+	issue := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"project":     map[string]string{"key": j.cfg.Project},
+			"issuetype":   map[string]string{"name": j.cfg.IssueType},
+			"summary":     summary,
+			"description": jiraDescription(e),
+			"labels":      labels,
+		},
+	}
+
+	var result struct {
+		Key string `json:"key"`
+	}
+	if err := j.do("POST", "/rest/api/2/issue", issue, &result); err != nil {
+		return "", err
+	}
+	return result.Key, nil
+}
+
+// comment adds the event to an existing issue
+func (j *JiraSink) comment(key string, e *v1.Event) error {
+	return j.do("POST", "/rest/api/2/issue/"+url.PathEscape(key)+"/comment",
+		map[string]string{"body": jiraDescription(e)}, nil)
+}
+
+// jiraDescription renders the event in Jira wiki markup
+func jiraDescription(e *v1.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s* %s on %s\n\n", e.Type, e.Reason, describeObject(e))
+	fmt.Fprintf(&b, "{noformat}%s{noformat}\n\n", e.Message)
+	fmt.Fprintf(&b, "||Namespace|%s|\n", e.InvolvedObject.Namespace)
+	fmt.Fprintf(&b, "||Kind|%s|\n", e.InvolvedObject.Kind)
+	fmt.Fprintf(&b, "||Name|%s|\n", e.InvolvedObject.Name)
+	fmt.Fprintf(&b, "||Count|%d|\n", e.Count)
+	fmt.Fprintf(&b, "||Source|%s %s|\n", e.Source.Component, e.Source.Host)
+	fmt.Fprintf(&b, "||First seen|%s|\n", e.FirstTimestamp.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "||Last seen|%s|\n", e.LastTimestamp.UTC().Format(time.RFC3339))
+	return b.String()
+}
+
+// do sends a request to the Jira REST API, retrying it with the retry
+// policy, and decodes the response into out
+func (j *JiraSink) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return j.retry.Do(func() error {
+		return j.send(method, path, body, in != nil, out)
+	})
+}
+
+// send sends a request to the Jira REST API once. The rate limited and failed
+// requests return an error to retry, the rejected ones a permanent error.
+func (j *JiraSink) send(method, path string, body []byte, hasBody bool, out interface{}) error {
+	req, err := http.NewRequest(method, j.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if hasBody {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if j.cfg.Username != "" {
+		req.SetBasicAuth(j.cfg.Username, j.cfg.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+j.cfg.Token)
+	}
+
+	resp, err := j.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%s %s got HTTP code %v: %s", method, strings.SplitN(path, "?", 2)[0], resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return retryAfter(err, httpRetryAfter(resp))
+		case resp.StatusCode >= 500:
+			return err
+		}
+		return permanent(err)
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return permanent(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	// kafkaMSKIAMMechanism is the kafkaSaslMechanism value selecting MSK IAM
+	kafkaMSKIAMMechanism = "AWS_MSK_IAM"
+	// kafkaMSKIAMTokenLifetime is the validity of a signed token
+	kafkaMSKIAMTokenLifetime = 15 * time.Minute
+	// kafkaMSKIAMUserAgent identifies the token format to the brokers
+	kafkaMSKIAMUserAgent = "aws-msk-iam-sasl-signer-go/1.0.0"
+)
+
+/*
+kafkaMSKIAMTokenProvider implements sarama.AccessTokenProvider for Amazon MSK
+IAM access control, which MSK accepts over SASL/OAUTHBEARER: the token is a
+SigV4 presigned kafka-cluster:Connect request, base64url encoded, the same
+format as the aws-msk-iam-sasl-signer libraries.
+
+The credentials come from the default AWS chain, so IRSA (web identity), the
+instance role or the environment work without any Kafka user. Tokens are
+reused until they get close to expiry.
+*/
+type kafkaMSKIAMTokenProvider struct {
+	region string
+	sess   *session.Session
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newKafkaMSKIAMTokenProvider creates the token provider, region is the
+// region of the MSK cluster
+func newKafkaMSKIAMTokenProvider(region string) (*kafkaMSKIAMTokenProvider, error) {
+	if region == "" {
+		return nil, fmt.Errorf("kafka sasl mechanism %s needs the region of the msk cluster", kafkaMSKIAMMechanism)
+	}
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(region).WithCredentialsChainVerboseErrors(true))
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaMSKIAMTokenProvider{
+		region: region,
+		sess:   sess,
+	}, nil
+}
+
+// Token implements sarama.AccessTokenProvider
+func (p *kafkaMSKIAMTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Renew once a third of the lifetime is left, tokens are checked at
+	// connection time only
+	if p.token == "" || time.Until(p.expires) < kafkaMSKIAMTokenLifetime/3 {
+		now := time.Now()
+		token, err := p.sign(now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign msk iam token: %v", err)
+		}
+		p.token = token
+		p.expires = now.Add(kafkaMSKIAMTokenLifetime)
+	}
+	return &sarama.AccessToken{Token: p.token}, nil
+}
+
+// sign presigns a kafka-cluster:Connect request and encodes its URL
+func (p *kafkaMSKIAMTokenProvider) sign(now time.Time) (string, error) {
+	u := fmt.Sprintf("https://kafka.%s.amazonaws.com/?Action=kafka-cluster%%3AConnect", p.region)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	signer := v4.NewSigner(p.sess.Config.Credentials)
+	if _, err := signer.Presign(req, nil, "kafka-cluster", p.region, kafkaMSKIAMTokenLifetime, now); err != nil {
+		return "", err
+	}
+
+	query := req.URL.Query()
+	query.Set("User-Agent", kafkaMSKIAMUserAgent)
+	req.URL.RawQuery = query.Encode()
+	return base64.RawURLEncoding.EncodeToString([]byte(req.URL.String())), nil
+}
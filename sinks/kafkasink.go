@@ -17,51 +17,341 @@ limitations under the License.
 package sinks
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/golang/glog"
+	"github.com/xdg/scram"
 	"k8s.io/api/core/v1"
 )
 
+// kafkaDeliveryKeyHeader is the header of the delivery key, with deliveryKeys
+const kafkaDeliveryKeyHeader = "eventrouter-delivery-key"
+
+// KafkaConfig holds the settings of the KafkaSink
+type KafkaConfig struct {
+	Brokers []string
+
+	// Topic is the topic template, the eventKeyFields in braces are replaced
+	// by their value, e.g. "k8s-events-{namespace}" or "k8s-events-{type}".
+	// When TopicAllowlist is set, events whose topic is not in the list go
+	// to DefaultTopic, or are dropped if it is empty.
+	Topic          string
+	TopicAllowlist []string
+	DefaultTopic   string
+
+	// Async selects the async producer, batching the messages, instead of
+	// the sync one sending them one at a time. RetryMax is the number of
+	// retries of the producer, the messages still failing are sent again
+	// with the retry policy of the sinks.
+	Async    bool
+	RetryMax int
+
+	// Key is the message key template: the eventKeyFields in braces are
+	// replaced by their value, e.g. "{uid}" for per object ordering. "none"
+	// (or empty) sends messages without key, spread over the partitions.
+	Key string
+
+	// Version is the Kafka version of the brokers, e.g. "2.1.0", empty for
+	// the sarama default
+	Version string
+
+	// Idempotent enables the idempotent producer, so the retries after a
+	// broker failure don't write duplicates. It needs Kafka 0.11+.
+	Idempotent bool
+
+	// Headers are the record headers, their values are templates like Key,
+	// e.g. cluster=prod, reason={reason}. They need Kafka 0.11+.
+	Headers map[string]string
+
+	// Compression is none, gzip, snappy, lz4 or zstd (Kafka 2.1+)
+	Compression string
+
+	// Linger, BatchBytes and BatchMessages tune the batching of the async
+	// producer: a batch is sent when it is Linger old, or holds BatchBytes
+	// bytes or BatchMessages messages. Zero values keep the sarama defaults.
+	Linger        time.Duration
+	BatchBytes    int
+	BatchMessages int
+
+	// SASLMechanism is PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or AWS_MSK_IAM.
+	// SASL is enabled when SASLUser is set, or with AWS_MSK_IAM which needs
+	// no user but the MSKRegion of the cluster.
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+	MSKRegion     string
+
+	// TLS enables TLS, with an optional CA, client certificate and key
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+}
+
 // KafkaSink implements the EventSinkInterface
 type KafkaSink struct {
-	Topic    string
-	producer interface{}
+	eventOutput
+
+	Topic        string
+	allowlist    map[string]bool
+	defaultTopic string
+	key          string
+	headers      map[string]string
+	producer     interface{}
+
+	// retry sends again the messages still failing after the retries of the
+	// producer, with the retry policy of the sinks
+	retry RetryPolicy
+	// closing stops the retries of the async producer on Close, mu keeping
+	// them from sending to the closed producer
+	closing chan struct{}
+	mu      sync.RWMutex
 }
 
-// NewKafkaSinkSink will create a new KafkaSink with default options, returned as an EventSinkInterface
-func NewKafkaSink(brokers []string, topic string, async bool, retryMax int, saslUser string, saslPwd string) (EventSinkInterface, error) {
+// kafkaMessage is the metadata of the messages of the async producer
+type kafkaMessage struct {
+	evt     EventData
+	attempt int
+}
+
+// NewKafkaSink will create a new KafkaSink given its config, returned as an EventSinkInterface
+func NewKafkaSink(cfg KafkaConfig) (EventSinkInterface, error) {
 
-	p, err := sinkFactory(brokers, async, retryMax, saslUser, saslPwd)
+	p, err := sinkFactory(cfg)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &KafkaSink{
-		Topic:    topic,
-		producer: p,
-	}, err
+	key := cfg.Key
+	if key == "none" {
+		key = ""
+	}
+
+	var allowlist map[string]bool
+	if len(cfg.TopicAllowlist) > 0 {
+		allowlist = make(map[string]bool, len(cfg.TopicAllowlist))
+		for _, t := range cfg.TopicAllowlist {
+			allowlist[t] = true
+		}
+	}
+
+	ks := &KafkaSink{
+		Topic:        cfg.Topic,
+		allowlist:    allowlist,
+		defaultTopic: cfg.DefaultTopic,
+		key:          key,
+		headers:      cfg.Headers,
+		producer:     p,
+		retry:        retryPolicy.forSink(),
+		closing:      make(chan struct{}),
+	}
+	if async, ok := p.(sarama.AsyncProducer); ok {
+		go ks.handleErrors(async)
+	}
+	return ks, err
+}
+
+// handleErrors sends again, or dead-letters, the messages the async producer
+// failed to produce, until it is closed
+func (ks *KafkaSink) handleErrors(p sarama.AsyncProducer) {
+	for err := range p.Errors() {
+		m, ok := err.Msg.Metadata.(kafkaMessage)
+		if !ok {
+			glog.Errorf("Failed to produce message: %v", err)
+			continue
+		}
+		if backoff, ok := ks.retry.next(m.attempt); ok {
+			// A new message, the producer keeps the count of its retries
+			m.attempt++
+			msg := &sarama.ProducerMessage{
+				Topic:    err.Msg.Topic,
+				Key:      err.Msg.Key,
+				Value:    err.Msg.Value,
+				Headers:  err.Msg.Headers,
+				Metadata: m,
+			}
+			time.AfterFunc(backoff, func() { ks.resend(p, msg) })
+			continue
+		}
+		glog.Errorf("Failed to produce message: %v", err)
+		deadLetterEvents("kafka", []EventData{m.evt}, err.Err)
+	}
+}
+
+// resend sends a message of the async producer again, unless the sink is
+// closing
+func (ks *KafkaSink) resend(p sarama.AsyncProducer, msg *sarama.ProducerMessage) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	// The input of the producer is closed once closing is
+	select {
+	case <-ks.closing:
+	default:
+		select {
+		case p.Input() <- msg:
+			return
+		case <-ks.closing:
+		}
+	}
+	deadLetterEvents("kafka", []EventData{msg.Metadata.(kafkaMessage).evt}, errors.New("sink closed"))
 }
 
-func sinkFactory(brokers []string, async bool, retryMax int, saslUser string, saslPwd string) (interface{}, error) {
+func sinkFactory(cfg KafkaConfig) (interface{}, error) {
 	config := sarama.NewConfig()
-	config.Producer.Retry.Max = retryMax
+	config.Producer.Retry.Max = cfg.RetryMax
 	config.Producer.RequiredAcks = sarama.WaitForAll
 
-	if saslUser != "" && saslPwd != "" {
+	if cfg.Version != "" {
+		version, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+
+	switch cfg.Compression {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+		if !config.Version.IsAtLeast(sarama.V0_10_0_0) {
+			config.Version = sarama.V0_10_0_0
+		}
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+		if !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+			config.Version = sarama.V2_1_0_0
+		}
+	default:
+		return nil, fmt.Errorf("invalid kafka compression %q, supported codecs are none, gzip, snappy, lz4 and zstd", cfg.Compression)
+	}
+
+	config.Producer.Flush.Frequency = cfg.Linger
+	config.Producer.Flush.Bytes = cfg.BatchBytes
+	config.Producer.Flush.Messages = cfg.BatchMessages
+
+	// Record headers are part of the record batch format of Kafka 0.11
+	if len(cfg.Headers) > 0 && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		config.Version = sarama.V0_11_0_0
+	}
+
+	if cfg.Idempotent {
+		// The broker dedups by producer ID and sequence number, which only
+		// holds with acks from all replicas and one in flight request
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+		if config.Producer.Retry.Max < 1 {
+			config.Producer.Retry.Max = 1
+		}
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+
+	if cfg.SASLMechanism == kafkaMSKIAMMechanism {
+		provider, err := newKafkaMSKIAMTokenProvider(cfg.MSKRegion)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Handshake = true
+		config.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		config.Net.SASL.TokenProvider = provider
+		config.Net.SASL.Version = sarama.SASLHandshakeV1
+		if !config.Version.IsAtLeast(sarama.V1_0_0_0) {
+			config.Version = sarama.V1_0_0_0
+		}
+		// The IAM listeners of MSK only accept TLS connections
+		cfg.TLS = true
+	} else if cfg.SASLUser != "" {
 		config.Net.SASL.Enable = true
-		config.Net.SASL.User = saslUser
-		config.Net.SASL.Password = saslPwd
+		config.Net.SASL.User = cfg.SASLUser
+		config.Net.SASL.Password = cfg.SASLPassword
+		config.Net.SASL.Handshake = true
+
+		switch cfg.SASLMechanism {
+		case "", sarama.SASLTypePlaintext:
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+			hashFn := kafkaSHA256
+			if cfg.SASLMechanism == sarama.SASLTypeSCRAMSHA512 {
+				hashFn = kafkaSHA512
+			}
+			config.Net.SASL.Mechanism = sarama.SASLMechanism(cfg.SASLMechanism)
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{HashGeneratorFcn: hashFn}
+			}
+			// SCRAM uses the SaslAuthenticate API, which needs Kafka 1.0+
+			config.Net.SASL.Version = sarama.SASLHandshakeV1
+			if !config.Version.IsAtLeast(sarama.V1_0_0_0) {
+				config.Version = sarama.V1_0_0_0
+			}
+		default:
+			return nil, fmt.Errorf("invalid kafka sasl mechanism %q, supported mechanisms are PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 and AWS_MSK_IAM", cfg.SASLMechanism)
+		}
 	}
 
-	if async {
-		return sarama.NewAsyncProducer(brokers, config)
+	if cfg.TLS {
+		tlsConfig, err := tlsClientConfig(cfg.TLSCAFile, cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSInsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if cfg.Async {
+		return sarama.NewAsyncProducer(cfg.Brokers, config)
 	}
 
 	config.Producer.Return.Successes = true
-	return sarama.NewSyncProducer(brokers, config)
+	return sarama.NewSyncProducer(cfg.Brokers, config)
+
+}
+
+var (
+	kafkaSHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	kafkaSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// kafkaSCRAMClient implements sarama.SCRAMClient with the xdg/scram package
+type kafkaSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// Begin implements sarama.SCRAMClient
+func (x *kafkaSCRAMClient) Begin(userName, password, authzID string) (err error) {
+	x.Client, err = x.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	x.ClientConversation = x.Client.NewConversation()
+	return nil
+}
+
+// Step implements sarama.SCRAMClient
+func (x *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	return x.ClientConversation.Step(challenge)
+}
 
+// Done implements sarama.SCRAMClient
+func (x *kafkaSCRAMClient) Done() bool {
+	return x.ClientConversation.Done()
 }
 
 // UpdateEvents implements EventSinkInterface.UpdateEvents
@@ -69,34 +359,89 @@ func (ks *KafkaSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 
 	eData := NewEventData(eNew, eOld)
 
-	eJSONBytes, err := json.Marshal(eData)
+	eJSONBytes, err := ks.encode(eData)
 	if err != nil {
 		glog.Errorf("Failed to json serialize event: %v", err)
 		return
 	}
+	topic := ks.topic(eNew)
+	if topic == "" {
+		glog.V(4).Infof("Dropping event %s/%s, no allowed kafka topic", eNew.Namespace, eNew.Name)
+		return
+	}
 	msg := &sarama.ProducerMessage{
-		Topic: ks.Topic,
-		Key:   sarama.StringEncoder(eNew.InvolvedObject.Name),
-		Value: sarama.ByteEncoder(eJSONBytes),
+		Topic:    topic,
+		Value:    sarama.ByteEncoder(eJSONBytes),
+		Metadata: kafkaMessage{evt: eData, attempt: 1},
+	}
+	for k, v := range ks.headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(k),
+			Value: []byte(expandEventTemplate(v, eNew)),
+		})
+	}
+	if deliveryKeys {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(kafkaDeliveryKeyHeader),
+			Value: []byte(eData.DeliveryKey),
+		})
+	}
+	// Messages without key are spread over the partitions by the partitioner
+	if ks.key != "" {
+		msg.Key = sarama.StringEncoder(expandEventTemplate(ks.key, eNew))
 	}
 
 	switch p := ks.producer.(type) {
 	case sarama.SyncProducer:
-		partition, offset, err := p.SendMessage(msg)
+		var partition int32
+		var offset int64
+		ks.retry.start()
+		for attempt := 1; ; attempt++ {
+			partition, offset, err = p.SendMessage(msg)
+			if err == nil {
+				break
+			}
+			backoff, ok := ks.retry.next(attempt)
+			if !ok {
+				break
+			}
+			time.Sleep(backoff)
+		}
 		if err != nil {
 			glog.Errorf("Failed to send to: topic(%s)/partition(%d)/offset(%d)\n",
-				ks.Topic, partition, offset)
+				topic, partition, offset)
+			deadLetterEvents("kafka", []EventData{eData}, err)
 		}
 
 	case sarama.AsyncProducer:
-		select {
-		case p.Input() <- msg:
-		case err := <-p.Errors():
-			glog.Errorf("Failed to produce message: %v", err)
-		}
+		// The errors are retried or dead-lettered by handleErrors
+		p.Input() <- msg
 
 	default:
 		glog.Errorf("Unhandled producer type: %s", p)
 	}
 
 }
+
+// Close implements io.Closer, closing the producer and its connections
+func (ks *KafkaSink) Close() error {
+	switch p := ks.producer.(type) {
+	case sarama.SyncProducer:
+		return p.Close()
+	case sarama.AsyncProducer:
+		close(ks.closing)
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		return p.Close()
+	}
+	return nil
+}
+
+// topic returns the topic of the event, or "" when the event should be dropped
+func (ks *KafkaSink) topic(e *v1.Event) string {
+	topic := expandEventTemplate(ks.Topic, e)
+	if ks.allowlist != nil && !ks.allowlist[topic] {
+		return ks.defaultTopic
+	}
+	return topic
+}
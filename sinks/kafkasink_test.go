@@ -0,0 +1,55 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+)
+
+func TestKafkaAsyncSelectsTheProducer(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	for name, test := range map[string]struct {
+		async interface{}
+		want  bool
+	}{
+		"default": {async: nil, want: true},
+		"async":   {async: true, want: true},
+		"sync":    {async: false, want: false},
+	} {
+		v := viper.New()
+		v.Set("kafkaBrokers", []string{broker.Addr()})
+		if test.async != nil {
+			v.Set("kafkaAsync", test.async)
+		}
+
+		sink := newSink(v, "kafka", make(chan bool)).(*KafkaSink)
+		_, async := sink.producer.(sarama.AsyncProducer)
+		if async != test.want {
+			t.Errorf("Got the async producer %v with the %s setting, want %v", async, name, test.want)
+		}
+		sink.Close()
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// kinesisMaxRecords is the maximum number of records in one PutRecords call
+	kinesisMaxRecords = 500
+	// kinesisMaxRequestSize is the maximum payload of one PutRecords call
+	kinesisMaxRequestSize = 5 * 1024 * 1024
+)
+
+/*
+KinesisSink writes events to an AWS Kinesis Data Stream. Events are buffered
+and sent with PutRecords, up to 500 records (or 5MiB) per call.
+
+Kinesis reports throttling per record: records rejected with
+ProvisionedThroughputExceededException (or an internal failure) are retried
+with the retry policy of the sinks, up to maxRetries times, while the records
+that were accepted are not sent again.
+*/
+type KinesisSink struct {
+	eventOutput
+
+	client *kinesis.Kinesis
+
+	// stream is the name of the Kinesis data stream
+	stream string
+
+	// partitionKey selects which event field is used as partition key, either
+	// "namespace" or "uid" (the involved object UID)
+	partitionKey string
+
+	// retry retries the failed records, maxRetries times
+	retry RetryPolicy
+
+	eventCh channels.Channel
+}
+
+// NewKinesisSink constructs a new KinesisSink. If accessKeyID is empty the
+// default AWS credential chain (env, shared config, IRSA, instance role) is
+// used.
+func NewKinesisSink(accessKeyID, secretAccessKey, region, stream, partitionKey string, maxRetries int, overflow bool, bufferSize int) (*KinesisSink, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+	}
+	if accessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
+	}
+
+	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KinesisSink{
+		client:       kinesis.New(sess),
+		stream:       stream,
+		partitionKey: partitionKey,
+		retry:        retryPolicy.forSink().withRetries(maxRetries),
+	}
+
+	if overflow {
+		k.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		k.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return k, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (k *KinesisSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	k.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through k.eventCh, and
+// forwarding them to Kinesis. If multiple events have happened between loop
+// iterations, they are sent in as few PutRecords calls as possible.
+func (k *KinesisSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-k.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := k.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-k.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			k.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(k.eventCh); len(arr) > 0 {
+				k.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvents converts the events to records and sends them in batches that
+// respect the PutRecords limits.
+func (k *KinesisSink) drainEvents(events []EventData) {
+	var batch []*kinesis.PutRecordsRequestEntry
+	var batchEvents []EventData
+	var batchSize int
+	for _, evt := range events {
+		eJSONBytes, err := k.encode(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		entry := &kinesis.PutRecordsRequestEntry{
+			Data:         eJSONBytes,
+			PartitionKey: aws.String(k.recordKey(evt.Event)),
+		}
+		size := len(eJSONBytes) + len(*entry.PartitionKey)
+		if len(batch) == kinesisMaxRecords || batchSize+size > kinesisMaxRequestSize {
+			k.putRecords(batch, batchEvents)
+			batch, batchEvents = nil, nil
+			batchSize = 0
+		}
+		batch = append(batch, entry)
+		batchEvents = append(batchEvents, evt)
+		batchSize += size
+	}
+
+	if len(batch) > 0 {
+		k.putRecords(batch, batchEvents)
+	}
+}
+
+// recordKey returns the partition key for the event. Kinesis rejects empty
+// partition keys, so cluster scoped objects fall back to the event name.
+func (k *KinesisSink) recordKey(e *v1.Event) string {
+	var key string
+	switch k.partitionKey {
+	case "uid":
+		key = string(e.InvolvedObject.UID)
+	default:
+		key = e.InvolvedObject.Namespace
+	}
+	if key == "" {
+		key = e.Name
+	}
+	return key
+}
+
+// putRecords sends the records of the events, retrying the ones that Kinesis
+// rejected.
+func (k *KinesisSink) putRecords(records []*kinesis.PutRecordsRequestEntry, events []EventData) {
+	err := k.retry.Do(func() error {
+		out, err := k.client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(k.stream),
+			Records:    records,
+		})
+		if err != nil {
+			return err
+		}
+		if aws.Int64Value(out.FailedRecordCount) == 0 {
+			return nil
+		}
+
+		// Only the failed records are sent again; results are returned in
+		// the same order as the request entries
+		var failed []*kinesis.PutRecordsRequestEntry
+		var failedEvents []EventData
+		for i, r := range out.Records {
+			if r.ErrorCode != nil {
+				failed = append(failed, records[i])
+				failedEvents = append(failedEvents, events[i])
+			}
+		}
+		records, events = failed, failedEvents
+		return fmt.Errorf("%d records rejected", len(records))
+	})
+	if err != nil {
+		glog.Errorf("Failed to put %d records to stream(%s): %v", len(records), k.stream, err)
+		deadLetterEvents("kinesis", events, err)
+	}
+}
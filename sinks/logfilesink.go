@@ -0,0 +1,296 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// logFileBackupTimeFormat is the timestamp appended to rotated file names
+const logFileBackupTimeFormat = "20060102T150405.000"
+
+/*
+LogFileSink writes newline delimited JSON events to a local file, rotating it
+when it grows over maxSize bytes or gets older than maxAge, whichever comes
+first (a zero value disables the limit). With the protobuf output encoding,
+the file is a sequence of size delimited records instead.
+
+Rotated files are renamed <path>.<timestamp>, and gzipped to
+<path>.<timestamp>.gz when compress is set. Only the maxBackups most recent
+rotated files are kept, zero keeps them all.
+*/
+type LogFileSink struct {
+	eventOutput
+
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	bodyBuf  *bytes.Buffer
+	eventCh  channels.Channel
+}
+
+// NewLogFileSink constructs a new LogFileSink and opens the file, appending
+// to it if it already exists.
+func NewLogFileSink(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool, overflow bool, bufferSize int) (*LogFileSink, error) {
+	l := &LogFileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+		bodyBuf:    bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	if overflow {
+		l.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		l.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return l, nil
+}
+
+// open opens the log file for appending
+func (l *LogFileSink) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	l.openedAt = time.Now()
+	return nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (l *LogFileSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	l.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through l.eventCh, and
+// writing them to the file. If multiple events have happened between loop
+// iterations, they are written together.
+func (l *LogFileSink) Run(stopCh <-chan bool) {
+	var tickerC <-chan time.Time
+	if l.maxAge > 0 {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		tickerC = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case e := <-l.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := l.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-l.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			l.drainEvents(arr)
+		case <-tickerC:
+			if l.size > 0 && time.Since(l.openedAt) >= l.maxAge {
+				l.rotate()
+			}
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(l.eventCh); len(arr) > 0 {
+				l.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// drainEvents appends the events to the file, rotating it first if this
+// write would take it over maxSize. This function is *NOT* re-entrant: it
+// re-uses the same body buffer for each call.
+func (l *LogFileSink) drainEvents(events []EventData) {
+	l.bodyBuf.Truncate(0)
+	for _, evt := range events {
+		eJSONBytes, err := l.encode(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		if l.format != nil && l.format.protobuf {
+			// The protobuf records are delimited by their size
+			var size [binary.MaxVarintLen64]byte
+			l.bodyBuf.Write(size[:binary.PutUvarint(size[:], uint64(len(eJSONBytes)))])
+			l.bodyBuf.Write(eJSONBytes)
+			continue
+		}
+		l.bodyBuf.Write(eJSONBytes)
+		l.bodyBuf.WriteByte('\n')
+	}
+	if l.bodyBuf.Len() == 0 {
+		return
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(l.bodyBuf.Len()) > l.maxSize {
+		l.rotate()
+	}
+	if l.file == nil {
+		// a previous rotation failed to reopen the file
+		if err := l.open(); err != nil {
+			glog.Errorf("Failed to open %s: %v", l.path, err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(l.bodyBuf.Bytes())
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("Failed to write %d events to %s: %v", len(events), l.path, err)
+		deadLetterEvents("logfile", events, err)
+	}
+}
+
+// rotate renames the current file, opens a new one, then compresses and
+// prunes the backups
+func (l *LogFileSink) rotate() {
+	l.file.Close()
+	l.file = nil
+
+	backup := l.path + "." + time.Now().UTC().Format(logFileBackupTimeFormat)
+	if err := os.Rename(l.path, backup); err != nil {
+		glog.Errorf("Failed to rotate %s: %v", l.path, err)
+		backup = ""
+	}
+	if err := l.open(); err != nil {
+		glog.Errorf("Failed to open %s: %v", l.path, err)
+	}
+
+	if backup != "" && l.compress {
+		if err := gzipFile(backup); err != nil {
+			glog.Errorf("Failed to compress %s: %v", backup, err)
+		}
+	}
+	l.pruneBackups()
+}
+
+// pruneBackups removes the oldest rotated files over maxBackups
+func (l *LogFileSink) pruneBackups() {
+	if l.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		glog.Errorf("Failed to list backups of %s: %v", l.path, err)
+		return
+	}
+	// The timestamps sort lexically, leaving aside a .tmp compression file
+	var rotated []string
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".tmp") {
+			rotated = append(rotated, b)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > l.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			glog.Errorf("Failed to remove backup %s: %v", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// gzipFile compresses path to path.gz and removes path
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// mqttTimeout bounds connecting to the broker and waiting for a publish
+// acknowledgement
+const mqttTimeout = 30 * time.Second
+
+// MQTTConfig holds the settings of the MQTTSink
+type MQTTConfig struct {
+	// Broker is the URL of the broker: tcp://host:1883, or ssl://host:8883
+	// (tls:// and mqtts:// are accepted too) for TLS
+	Broker string
+
+	// ProtocolVersion is 4 for MQTT v3.1.1 or 5 for MQTT v5
+	ProtocolVersion int
+
+	ClientID string
+	Username string
+	Password string
+
+	// Topic is the topic template, {cluster} and the eventKeyFields in braces
+	// are replaced by their value, e.g. "k8s/{cluster}/{namespace}/{kind}"
+	Topic   string
+	Cluster string
+
+	QoS    byte
+	Retain bool
+
+	// TLS settings, used with ssl:// brokers
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// mqttPublisher publishes messages to a broker with one of the MQTT clients
+type mqttPublisher interface {
+	publish(topic string, payload []byte, contentType string) error
+	close()
+}
+
+/*
+MQTTSink publishes events as JSON messages to an MQTT broker, over MQTT v3.1.1
+or v5, with a topic derived from the event so subscribers can pick the events
+of a cluster, namespace or kind with topic wildcards.
+
+With QoS 1 or 2 each publish waits for the broker acknowledgement. Failed
+publishes are retried with the retry policy of the sinks, re-establishing the
+connection, and dead-lettered when the retries are exhausted.
+*/
+type MQTTSink struct {
+	eventOutput
+
+	cfg       MQTTConfig
+	topic     string
+	publisher mqttPublisher
+	retry     RetryPolicy
+	eventCh   channels.Channel
+}
+
+// NewMQTTSink constructs a new MQTTSink given its config. The connection is
+// opened lazily, so the broker doesn't need to be up at startup.
+func NewMQTTSink(cfg MQTTConfig, overflow bool, bufferSize int) (*MQTTSink, error) {
+	if cfg.QoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %d", cfg.QoS)
+	}
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt broker url: %v", err)
+	}
+
+	var tlsConfig *tls.Config
+	switch u.Scheme {
+	case "tcp":
+	case "ssl", "tls", "mqtts":
+		if tlsConfig, err = tlsClientConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkipVerify); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid mqtt broker scheme %q, must be tcp or ssl", u.Scheme)
+	}
+
+	m := &MQTTSink{
+		cfg:   cfg,
+		topic: strings.Replace(cfg.Topic, "{cluster}", cfg.Cluster, -1),
+		retry: retryPolicy.forSink(),
+	}
+
+	switch cfg.ProtocolVersion {
+	case 4:
+		// The v3.1.1 client doesn't know the mqtts scheme
+		broker := *u
+		if broker.Scheme == "mqtts" {
+			broker.Scheme = "ssl"
+		}
+		opts := mqtt.NewClientOptions().
+			AddBroker(broker.String()).
+			SetClientID(cfg.ClientID).
+			SetUsername(cfg.Username).
+			SetPassword(cfg.Password).
+			SetProtocolVersion(4).
+			SetAutoReconnect(true).
+			SetConnectTimeout(mqttTimeout)
+		if tlsConfig != nil {
+			opts.SetTLSConfig(tlsConfig)
+		}
+		m.publisher = &mqtt311Publisher{
+			client: mqtt.NewClient(opts),
+			qos:    cfg.QoS,
+			retain: cfg.Retain,
+		}
+	case 5:
+		m.publisher = &mqtt5Publisher{
+			cfg:       cfg,
+			address:   u.Host,
+			tlsConfig: tlsConfig,
+		}
+	default:
+		return nil, fmt.Errorf("invalid mqtt protocol version %d, must be 4 (v3.1.1) or 5", cfg.ProtocolVersion)
+	}
+
+	if overflow {
+		m.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		m.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return m, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (m *MQTTSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	m.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through m.eventCh, and
+// publishing them to the broker, one message per event.
+func (m *MQTTSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-m.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			m.drainEvent(evt)
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(m.eventCh) {
+				m.drainEvent(evt)
+			}
+			break loop
+		}
+	}
+	m.publisher.close()
+}
+
+// drainEvent publishes the event, dead-lettering it on failure
+func (m *MQTTSink) drainEvent(evt EventData) {
+	eJSONBytes, err := m.encode(evt)
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return
+	}
+
+	topic := expandEventTemplate(m.topic, evt.Event)
+	err = m.retry.Do(func() error {
+		return m.publisher.publish(topic, eJSONBytes, m.contentType())
+	})
+	if err != nil {
+		glog.Errorf("Failed to publish event to mqtt topic %s: %v", topic, err)
+		deadLetterEvents("mqtt", []EventData{evt}, err)
+	}
+}
+
+// mqtt311Publisher publishes with the paho MQTT v3.1.1 client, which
+// reconnects on its own once connected
+type mqtt311Publisher struct {
+	client mqtt.Client
+	qos    byte
+	retain bool
+}
+
+func (p *mqtt311Publisher) publish(topic string, payload []byte, contentType string) error {
+	if !p.client.IsConnected() {
+		token := p.client.Connect()
+		if !token.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("timed out connecting to the broker")
+		}
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+
+	token := p.client.Publish(topic, p.qos, p.retain, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out waiting for the broker acknowledgement")
+	}
+	return token.Error()
+}
+
+func (p *mqtt311Publisher) close() {
+	p.client.Disconnect(250)
+}
+
+// mqtt5Publisher publishes with the paho MQTT v5 client, reconnecting after
+// any error
+type mqtt5Publisher struct {
+	cfg       MQTTConfig
+	address   string
+	tlsConfig *tls.Config
+
+	client *paho.Client
+}
+
+// connect dials the broker and sends the CONNECT packet
+func (p *mqtt5Publisher) connect() error {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.address, p.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", p.address)
+	}
+	if err != nil {
+		return err
+	}
+
+	client := paho.NewClient()
+	client.Conn = conn
+	cp := &paho.Connect{
+		ClientID:   p.cfg.ClientID,
+		KeepAlive:  30,
+		CleanStart: true,
+	}
+	if p.cfg.Username != "" {
+		cp.Username = p.cfg.Username
+		cp.UsernameFlag = true
+		cp.Password = []byte(p.cfg.Password)
+		cp.PasswordFlag = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if ca.ReasonCode != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused the connection with reason code %d", ca.ReasonCode)
+	}
+	p.client = client
+	return nil
+}
+
+func (p *mqtt5Publisher) publish(topic string, payload []byte, contentType string) error {
+	if p.client == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	resp, err := p.client.Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        p.cfg.QoS,
+		Retain:     p.cfg.Retain,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{ContentType: contentType},
+	})
+	if err != nil {
+		// Error closes the connection, the next publish reconnects
+		p.client.Error(err)
+		p.client = nil
+		return err
+	}
+	// Reason codes of 0x80 and above are failures
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return fmt.Errorf("broker rejected the message with reason code %d", resp.ReasonCode)
+	}
+	return nil
+}
+
+func (p *mqtt5Publisher) close() {
+	if p.client != nil {
+		p.client.Disconnect(&paho.Disconnect{})
+	}
+}
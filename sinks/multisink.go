@@ -0,0 +1,519 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// multiSinkUpdate is an update queued for one of the sinks of a MultiSink
+type multiSinkUpdate struct {
+	eNew *v1.Event
+	eOld *v1.Event
+
+	// flushed, when set, marks a Flush rather than an update: it is closed
+	// once the updates queued before it were handed to the sink
+	flushed chan struct{}
+}
+
+// MultiSinkRoute is a sink of a MultiSink, with the filter selecting the
+// events it receives
+type MultiSinkRoute struct {
+	// Name is the sink type the sink was manufactured from
+	Name   string
+	Sink   EventSinkInterface
+	Filter EventFilter
+
+	// Expression, when set, further restricts the events to those it
+	// matches
+	Expression *CELFilter
+
+	RateLimit RateLimitConfig
+
+	// ForwardDeletes forwards the deleted events to the sink, as DELETED
+	// tombstone records
+	ForwardDeletes bool
+
+	// Stop, when set, is closed when the sink is removed from the
+	// MultiSink, to stop the sink
+	Stop chan bool
+}
+
+const (
+	// rateLimitDrop drops the events over the rate limit
+	rateLimitDrop = "drop"
+	// rateLimitSample forwards one in SampleEvery events over the rate limit
+	rateLimitSample = "sample"
+	// rateLimitQueue holds the events over the rate limit in the queue of the
+	// sink, until it overflows
+	rateLimitQueue = "queue"
+)
+
+// RateLimitConfig is the token bucket rate limit of a sink of a MultiSink.
+// EventsPerSecond 0 disables it.
+type RateLimitConfig struct {
+	EventsPerSecond float64
+	Burst           int
+
+	// Policy is drop, sample or queue, SampleEvery the sampling of the
+	// sample policy
+	Policy      string
+	SampleEvery int
+}
+
+// multiSinkDroppedCounterVec counts the events dropped before reaching a sink,
+// by sink and reason: queue_full or rate_limited. It is nil unless
+// registerMultiSinkMetrics was called.
+var multiSinkDroppedCounterVec *prometheus.CounterVec
+
+// registerMultiSinkMetrics creates and registers the metrics of the sink
+// queues: the dropped events, and the length of the queue of each sink,
+// including the sinks added later
+func registerMultiSinkMetrics(prefix string, m *MultiSink) {
+	multiSinkDroppedCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_eventrouter_sink_dropped_events_total", prefix),
+		Help: "Total number of events dropped before reaching a sink, by sink and reason",
+	}, []string{"sink", "reason"})
+	prometheus.MustRegister(multiSinkDroppedCounterVec)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metricPrefix = prefix
+	for _, w := range m.workers {
+		m.registerQueueLength(w)
+	}
+}
+
+// registerQueueLength registers the queue length metric of the worker, if
+// the metrics are enabled
+func (m *MultiSink) registerQueueLength(w *multiSinkWorker) {
+	if m.metricPrefix == "" {
+		return
+	}
+	eventCh := w.eventCh
+	w.queueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        fmt.Sprintf("%s_eventrouter_sink_queue_length", m.metricPrefix),
+		Help:        "Number of events in the queue of a sink",
+		ConstLabels: prometheus.Labels{"sink": w.Name},
+	}, func() float64 { return float64(len(eventCh)) })
+	prometheus.MustRegister(w.queueLength)
+}
+
+// multiSinkDropped counts an event dropped before reaching the sink
+func multiSinkDropped(sink, reason string) {
+	if multiSinkDroppedCounterVec != nil {
+		multiSinkDroppedCounterVec.WithLabelValues(sink, reason).Inc()
+	}
+}
+
+// multiSinkWorker feeds one sink of a MultiSink from its own queue
+type multiSinkWorker struct {
+	MultiSinkRoute
+	eventCh chan multiSinkUpdate
+
+	limiter *rate.Limiter
+	// excess counts the events over the rate limit for the sample policy
+	excess int
+
+	// done is closed when the sink is removed, stopping the worker, and the
+	// sink with the Stop of the route
+	done        chan bool
+	queueLength prometheus.Collector
+	// stopped is closed when the worker returns
+	stopped chan struct{}
+}
+
+/*
+MultiSink fans the events out to several sinks, e.g. Kafka for the data lake
+and Slack for the warnings. Each sink only receives the events matching the
+filter of its route, e.g. the warnings for PagerDuty and all the events for S3.
+
+Each sink gets its own bounded queue and goroutine, so a slow or blocking sink
+never holds the others back, nor the informer: when its queue is full, its
+updates are dropped and counted (or, when discarding is disabled, the updates
+wait for room in the queue). A sink panicking on an update is logged and
+keeps getting the next ones, the other sinks are not affected.
+
+The sinks can be added and removed while running, e.g. from the EventSink
+resources: a removed sink stops getting updates, the queued ones are dropped,
+and the sink is closed if it is an io.Closer, e.g. holding a producer. The
+rules of the EventRoute resources targeting a sink replace the filter and
+expression of its route: it receives the events matching any of them.
+*/
+type MultiSink struct {
+	overflow   bool
+	bufferSize int
+
+	mu           sync.RWMutex
+	workers      []*multiSinkWorker
+	stopCh       <-chan bool
+	metricPrefix string
+
+	// eventRules are the rules of the EventRoutes by name, and rules the
+	// same by sink, replaced rather than updated
+	eventRules map[string]eventRule
+	rules      map[string][]EventRule
+}
+
+// EventRule selects the events routed to the sinks by an EventRoute.
+// Expression, when set, further restricts the events to those it matches.
+type EventRule struct {
+	Filter     EventFilter
+	Expression *CELFilter
+}
+
+// Matches returns true if the update passes the rule
+func (r EventRule) Matches(eNew *v1.Event, eOld *v1.Event) bool {
+	return r.Filter.Matches(eNew) && (r.Expression == nil || r.Expression.Matches(eNew, eOld))
+}
+
+// eventRule is an EventRule and the names of the sinks it targets
+type eventRule struct {
+	EventRule
+	sinks []string
+}
+
+// NewMultiSink creates a MultiSink over the routes, failing on an invalid
+// rate limit policy
+func NewMultiSink(routes []MultiSinkRoute, overflow bool, bufferSize int) (*MultiSink, error) {
+	m := &MultiSink{overflow: overflow, bufferSize: bufferSize}
+	for _, route := range routes {
+		w, err := m.newWorker(route)
+		if err != nil {
+			return nil, err
+		}
+		m.workers = append(m.workers, w)
+	}
+	return m, nil
+}
+
+// newWorker creates the worker of a route, failing on an invalid rate limit
+// policy
+func (m *MultiSink) newWorker(route MultiSinkRoute) (*multiSinkWorker, error) {
+	w := &multiSinkWorker{MultiSinkRoute: route, done: route.Stop, stopped: make(chan struct{})}
+	if w.done == nil {
+		w.done = make(chan bool)
+	}
+	if r := route.RateLimit; r.EventsPerSecond > 0 {
+		switch r.Policy {
+		case rateLimitDrop, rateLimitQueue:
+		case rateLimitSample:
+			if r.SampleEvery < 1 {
+				return nil, fmt.Errorf("sink %s: invalid rate limit sampling %d", route.Name, r.SampleEvery)
+			}
+		default:
+			return nil, fmt.Errorf("sink %s: invalid rate limit policy %q, expected %s, %s or %s",
+				route.Name, r.Policy, rateLimitDrop, rateLimitSample, rateLimitQueue)
+		}
+		burst := r.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		w.limiter = rate.NewLimiter(rate.Limit(r.EventsPerSecond), burst)
+	}
+	w.eventCh = make(chan multiSinkUpdate, m.bufferSize)
+	return w, nil
+}
+
+// AddRoute adds a sink to the MultiSink, replacing the sink of the same
+// name, failing on an invalid rate limit policy
+func (m *MultiSink) AddRoute(route MultiSinkRoute) error {
+	w, err := m.newWorker(route)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeWorker(route.Name)
+	m.registerQueueLength(w)
+	m.workers = append(m.workers, w)
+	if m.stopCh != nil {
+		go w.run(m.stopCh)
+	}
+	return nil
+}
+
+// RemoveRoute removes the sink of the name from the MultiSink, returning
+// false if there is none
+func (m *MultiSink) RemoveRoute(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeWorker(name)
+}
+
+// removeWorker stops and removes the worker of the name, with m.mu held
+func (m *MultiSink) removeWorker(name string) bool {
+	for i, w := range m.workers {
+		if w.Name != name {
+			continue
+		}
+		close(w.done)
+		if m.stopCh == nil {
+			// The worker never ran to close the sink
+			w.closeSink()
+		}
+		if w.queueLength != nil {
+			prometheus.Unregister(w.queueLength)
+		}
+		m.workers = append(m.workers[:i:i], m.workers[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// SetRule sets the rule named name, routing the events it matches to the
+// sinks named, including the sinks added later
+func (m *MultiSink) SetRule(name string, sinks []string, rule EventRule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.eventRules == nil {
+		m.eventRules = make(map[string]eventRule)
+	}
+	m.eventRules[name] = eventRule{EventRule: rule, sinks: sinks}
+	m.indexRules()
+}
+
+// RemoveRule removes the rule named name, returning false if there is none
+func (m *MultiSink) RemoveRule(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.eventRules[name]; !ok {
+		return false
+	}
+	delete(m.eventRules, name)
+	m.indexRules()
+	return true
+}
+
+// indexRules replaces the rules by sink, with m.mu held
+func (m *MultiSink) indexRules() {
+	rules := make(map[string][]EventRule)
+	for _, r := range m.eventRules {
+		for _, sink := range r.sinks {
+			rules[sink] = append(rules[sink], r.EventRule)
+		}
+	}
+	m.rules = rules
+}
+
+// matches returns true if the update is routed to the sink of the worker, by
+// its rules if any, else by its route
+func (w *multiSinkWorker) matches(rules []EventRule, eNew *v1.Event, eOld *v1.Event) bool {
+	if len(rules) > 0 {
+		for _, r := range rules {
+			if r.Matches(eNew, eOld) {
+				return true
+			}
+		}
+		return false
+	}
+	if !w.Filter.Matches(eNew) {
+		return false
+	}
+	return w.Expression == nil || w.Expression.Matches(eNew, eOld)
+}
+
+// forwardsDeletes returns true if a sink forwards the deleted events
+func (m *MultiSink) forwardsDeletes() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, w := range m.workers {
+		if w.ForwardDeletes {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateEvents implements the EventSinkInterface. It queues the update for
+// each of the sinks whose route matches the event.
+func (m *MultiSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	m.mu.RLock()
+	workers, rules := m.workers, m.rules
+	m.mu.RUnlock()
+
+	deleted := isDeleted(eNew)
+	for _, w := range workers {
+		if deleted && !w.ForwardDeletes {
+			continue
+		}
+		if !w.matches(rules[w.Name], eNew, eOld) {
+			continue
+		}
+		u := multiSinkUpdate{eNew: eNew, eOld: eOld}
+		if !m.overflow {
+			select {
+			case w.eventCh <- u:
+			case <-w.done:
+			}
+			continue
+		}
+		select {
+		case w.eventCh <- u:
+		case <-w.done:
+		default:
+			multiSinkDropped(w.Name, "queue_full")
+		}
+	}
+}
+
+// Flush waits until the sinks were handed the updates queued before it, or
+// removed. It returns at once if the MultiSink is not running.
+func (m *MultiSink) Flush() {
+	m.mu.RLock()
+	workers, stopCh := m.workers, m.stopCh
+	m.mu.RUnlock()
+	if stopCh == nil {
+		return
+	}
+
+	for _, w := range workers {
+		u := multiSinkUpdate{flushed: make(chan struct{})}
+		select {
+		case w.eventCh <- u:
+		case <-w.done:
+			continue
+		case <-stopCh:
+			return
+		}
+		select {
+		case <-u.flushed:
+		case <-w.done:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Close implements io.Closer, removing the sinks once they were handed the
+// queued updates, and waiting for them to stop and get closed
+func (m *MultiSink) Close() error {
+	m.Flush()
+
+	m.mu.Lock()
+	workers, started := m.workers, m.stopCh != nil
+	for _, w := range workers {
+		m.removeWorker(w.Name)
+	}
+	m.mu.Unlock()
+
+	for _, w := range workers {
+		if started {
+			<-w.stopped
+		}
+		waitSinks(w.done)
+	}
+	return nil
+}
+
+// Run starts forwarding the queued updates to the sinks, until stopCh is
+// closed
+func (m *MultiSink) Run(stopCh <-chan bool) {
+	m.mu.Lock()
+	m.stopCh = stopCh
+	for _, w := range m.workers {
+		go w.run(stopCh)
+	}
+	m.mu.Unlock()
+	<-stopCh
+}
+
+// run forwards the queued updates to the sink of the worker
+func (w *multiSinkWorker) run(stopCh <-chan bool) {
+	defer close(w.stopped)
+	for {
+		select {
+		case u := <-w.eventCh:
+			if u.flushed != nil {
+				close(u.flushed)
+			} else if w.allow(stopCh) {
+				w.update(u)
+			}
+		case <-stopCh:
+			return
+		case <-w.done:
+			w.closeSink()
+			return
+		}
+	}
+}
+
+// closeSink closes the sink of a removed worker, if it is an io.Closer
+func (w *multiSinkWorker) closeSink() {
+	if c, ok := w.Sink.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			glog.Warningf("Failed to close sink %s: %v", w.Name, err)
+		}
+	}
+}
+
+// allow applies the rate limit to the next update, returning true if it is
+// forwarded. With the queue policy, it waits for the rate limit, stopCh or
+// the removal of the worker.
+func (w *multiSinkWorker) allow(stopCh <-chan bool) bool {
+	if w.limiter == nil {
+		return true
+	}
+	switch w.RateLimit.Policy {
+	case rateLimitQueue:
+		r := w.limiter.Reserve()
+		select {
+		case <-time.After(r.Delay()):
+			return true
+		case <-stopCh:
+			r.Cancel()
+			return false
+		case <-w.done:
+			r.Cancel()
+			return false
+		}
+	case rateLimitSample:
+		if w.limiter.Allow() {
+			return true
+		}
+		w.excess++
+		if w.excess%w.RateLimit.SampleEvery == 0 {
+			return true
+		}
+	default:
+		if w.limiter.Allow() {
+			return true
+		}
+	}
+	multiSinkDropped(w.Name, "rate_limited")
+	return false
+}
+
+// update hands an update to the sink, recovering from its panics
+func (w *multiSinkWorker) update(u multiSinkUpdate) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Sink %s failed to handle event %s/%s: %v", w.Name, u.eNew.Namespace, u.eNew.Name, r)
+		}
+	}()
+	w.Sink.UpdateEvents(u.eNew, u.eOld)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func newRoutedTestEvent(namespace, eventType string) *v1.Event {
+	e := newTestEvent("test")
+	e.Type = eventType
+	e.InvolvedObject = v1.ObjectReference{Kind: "Pod", Namespace: namespace, Name: "web-0"}
+	return e
+}
+
+// queued returns the number of updates queued for the sink named name
+func queued(t *testing.T, m *MultiSink, name string) int {
+	t.Helper()
+	for _, w := range m.workers {
+		if w.Name == name {
+			n := len(w.eventCh)
+			for len(w.eventCh) > 0 {
+				<-w.eventCh
+			}
+			return n
+		}
+	}
+	t.Fatalf("No sink %s", name)
+	return 0
+}
+
+func TestMultiSinkRulesReplaceTheFilter(t *testing.T) {
+	m, err := NewMultiSink([]MultiSinkRoute{
+		{Name: "warnings", Sink: &recordingSink{}, Filter: EventFilter{Types: []string{"Warning"}}},
+		{Name: "all", Sink: &recordingSink{}},
+	}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normal := newRoutedTestEvent("team-a", "Normal")
+	warning := newRoutedTestEvent("team-b", "Warning")
+	send := func() {
+		m.UpdateEvents(normal, nil)
+		m.UpdateEvents(warning, nil)
+	}
+
+	// The routes filter the events without rules
+	send()
+	if n := queued(t, m, "warnings"); n != 1 {
+		t.Errorf("Got %d updates for the filtered sink, want 1", n)
+	}
+	if n := queued(t, m, "all"); n != 2 {
+		t.Errorf("Got %d updates for the unfiltered sink, want 2", n)
+	}
+
+	// The rules targeting a sink replace its filter, the sink receiving the
+	// events matching any of them
+	m.SetRule("team-a", []string{"warnings"}, EventRule{Filter: EventFilter{Namespaces: []string{"team-a"}}})
+	send()
+	if n := queued(t, m, "warnings"); n != 1 {
+		t.Errorf("Got %d updates for the sink of the rule, want the Normal event of team-a only", n)
+	}
+	if n := queued(t, m, "all"); n != 2 {
+		t.Errorf("Got %d updates for the sink without rules, want 2", n)
+	}
+	m.SetRule("team-b", []string{"warnings"}, EventRule{Filter: EventFilter{Namespaces: []string{"team-b"}}})
+	send()
+	if n := queued(t, m, "warnings"); n != 2 {
+		t.Errorf("Got %d updates for the sink of the rules, want 2", n)
+	}
+	if n := queued(t, m, "all"); n != 2 {
+		t.Errorf("Got %d updates for the sink without rules, want 2", n)
+	}
+
+	// A rule set again is replaced
+	m.SetRule("team-a", []string{"warnings"}, EventRule{Filter: EventFilter{Namespaces: []string{"team-c"}}})
+	send()
+	if n := queued(t, m, "warnings"); n != 1 {
+		t.Errorf("Got %d updates after replacing the rule, want the event of team-b only", n)
+	}
+
+	// The filter applies again once the rules are removed
+	if !m.RemoveRule("team-a") || !m.RemoveRule("team-b") {
+		t.Fatalf("Failed to remove the rules")
+	}
+	if m.RemoveRule("team-a") {
+		t.Errorf("Removed a rule twice")
+	}
+	send()
+	if n := queued(t, m, "warnings"); n != 1 {
+		t.Errorf("Got %d updates after removing the rules, want the Warning event only", n)
+	}
+}
+
+func TestMultiSinkRulesApplyToTheSinksAddedLater(t *testing.T) {
+	m, err := NewMultiSink(nil, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetRule("team-a", []string{"team-a/sink"}, EventRule{Filter: EventFilter{Namespaces: []string{"team-a"}}})
+	if err := m.AddRoute(MultiSinkRoute{Name: "team-a/sink", Sink: &recordingSink{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.UpdateEvents(newRoutedTestEvent("team-a", "Normal"), nil)
+	m.UpdateEvents(newRoutedTestEvent("team-b", "Normal"), nil)
+	if n := queued(t, m, "team-a/sink"); n != 1 {
+		t.Errorf("Got %d updates for the sink added after its rule, want 1", n)
+	}
+}
+
+func TestMultiSinkRateLimitPolicies(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		limit RateLimitConfig
+		want  []bool
+	}{
+		{
+			name:  "drop",
+			limit: RateLimitConfig{EventsPerSecond: 0.001, Burst: 2, Policy: "drop"},
+			want:  []bool{true, true, false, false, false, false},
+		},
+		{
+			name:  "sample",
+			limit: RateLimitConfig{EventsPerSecond: 0.001, Burst: 2, Policy: "sample", SampleEvery: 3},
+			want:  []bool{true, true, false, false, true, false, false, true},
+		},
+		{
+			name:  "burst of 1 by default",
+			limit: RateLimitConfig{EventsPerSecond: 0.001, Policy: "drop"},
+			want:  []bool{true, false},
+		},
+		{
+			name:  "queue",
+			limit: RateLimitConfig{EventsPerSecond: 1000, Burst: 1, Policy: "queue"},
+			want:  []bool{true, true, true, true},
+		},
+	} {
+		m, err := NewMultiSink([]MultiSinkRoute{{Name: "test", Sink: &recordingSink{}, RateLimit: test.limit}}, true, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := m.workers[0]
+		for i, want := range test.want {
+			if got := w.allow(make(chan bool)); got != want {
+				t.Errorf("Got %v for update %d with the %s policy, want %v", got, i, test.name, want)
+			}
+		}
+	}
+}
+
+func TestMultiSinkRateLimitQueueWaits(t *testing.T) {
+	m, err := NewMultiSink([]MultiSinkRoute{{
+		Name:      "test",
+		Sink:      &recordingSink{},
+		RateLimit: RateLimitConfig{EventsPerSecond: 0.001, Policy: "queue"},
+	}}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := m.workers[0]
+	if !w.allow(nil) {
+		t.Fatalf("Got the first update over the rate limit")
+	}
+
+	// The update over the rate limit waits, until stopped
+	stopCh := make(chan bool)
+	allowed := make(chan bool)
+	go func() { allowed <- w.allow(stopCh) }()
+	select {
+	case <-allowed:
+		t.Fatalf("Got the update over the rate limit without waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stopCh)
+	if <-allowed {
+		t.Errorf("Got the update waiting for the rate limit forwarded on stop")
+	}
+
+	// or until the sink is removed
+	go func() { allowed <- w.allow(nil) }()
+	m.RemoveRoute("test")
+	select {
+	case got := <-allowed:
+		if got {
+			t.Errorf("Got the update waiting for the rate limit forwarded once the sink is removed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Got the update still waiting for the rate limit once the sink is removed")
+	}
+}
+
+func TestMultiSinkRateLimitErrors(t *testing.T) {
+	for name, limit := range map[string]RateLimitConfig{
+		"unknown policy": {EventsPerSecond: 1, Policy: "block"},
+		"no policy":      {EventsPerSecond: 1},
+		"no sampling":    {EventsPerSecond: 1, Policy: "sample"},
+	} {
+		_, err := NewMultiSink([]MultiSinkRoute{{Name: "test", Sink: &recordingSink{}, RateLimit: limit}}, true, 10)
+		if err == nil {
+			t.Errorf("Got no error for a rate limit with %s", name)
+		}
+	}
+
+	// The policy doesn't matter without a rate limit
+	if _, err := NewMultiSink([]MultiSinkRoute{{Name: "test", Sink: &recordingSink{}, RateLimit: RateLimitConfig{Policy: "block"}}}, true, 10); err != nil {
+		t.Errorf("Failed to create a sink without rate limit: %v", err)
+	}
+}
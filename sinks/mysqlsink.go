@@ -0,0 +1,219 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	_ "github.com/go-sql-driver/mysql" // registers the mysql database/sql driver
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// mysqlTableNameRe restricts table names, they can't be passed as query parameters
+var mysqlTableNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// mysqlColumns are the columns written for every event, in insert order
+var mysqlColumns = []string{
+	"uid", "resource_version", "verb", "type", "reason", "message", "count",
+	"namespace", "kind", "name", "source_component", "source_host",
+	"first_timestamp", "last_timestamp", "data",
+}
+
+/*
+MySQLSink writes events to a MySQL (5.7+) or MariaDB (10.2+) table. The table is
+created at startup when it does not exist, with the main event fields in their
+own (indexed) columns and the full event JSON in the data column.
+
+Events buffered between two loop iterations are written with multi-row INSERT
+statements of up to batchSize rows each.
+*/
+type MySQLSink struct {
+	db        *sql.DB
+	table     string
+	batchSize int
+	retry     RetryPolicy
+	eventCh   channels.Channel
+}
+
+// NewMySQLSink connects to the database described by dsn (see
+// github.com/go-sql-driver/mysql for the format) and creates the events table
+// if needed.
+func NewMySQLSink(dsn, table string, batchSize int, overflow bool, bufferSize int) (*MySQLSink, error) {
+	if !mysqlTableNameRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid mysql table name %q", table)
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping mysql server: %v", err)
+	}
+
+	m := &MySQLSink{
+		db:        db,
+		table:     table,
+		batchSize: batchSize,
+		retry:     retryPolicy.forSink(),
+	}
+	if err := m.createTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if overflow {
+		m.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		m.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return m, nil
+}
+
+// createTable creates the events table if it doesn't exist yet
+func (m *MySQLSink) createTable() error {
+	_, err := m.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid VARCHAR(64) NOT NULL,
+	resource_version VARCHAR(64) NOT NULL,
+	verb VARCHAR(16) NOT NULL,
+	type VARCHAR(32) NOT NULL,
+	reason VARCHAR(128) NOT NULL,
+	message TEXT NOT NULL,
+	count INT NOT NULL,
+	namespace VARCHAR(253) NOT NULL,
+	kind VARCHAR(64) NOT NULL,
+	name VARCHAR(253) NOT NULL,
+	source_component VARCHAR(253) NOT NULL,
+	source_host VARCHAR(253) NOT NULL,
+	first_timestamp DATETIME NULL,
+	last_timestamp DATETIME NULL,
+	data JSON NOT NULL,
+	INDEX idx_uid (uid),
+	INDEX idx_namespace_last_timestamp (namespace, last_timestamp),
+	INDEX idx_reason (reason)
+) DEFAULT CHARSET=utf8mb4`, m.table))
+	if err != nil {
+		return fmt.Errorf("failed to create mysql table %s: %v", m.table, err)
+	}
+	return nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (m *MySQLSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	m.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through m.eventCh, and
+// writing them to the database. If multiple events have happened between loop
+// iterations, they are inserted together.
+func (m *MySQLSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-m.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := m.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-m.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, m.batchSize, m.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(m.eventCh), m.batchSize, m.drainEvents)
+			break loop
+		}
+	}
+	m.db.Close()
+}
+
+// drainEvents writes the events with a single multi-row INSERT
+func (m *MySQLSink) drainEvents(events []EventData) {
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(mysqlColumns)), ",") + ")"
+	rows := make([]string, 0, len(events))
+	args := make([]interface{}, 0, len(events)*len(mysqlColumns))
+	for _, evt := range events {
+		eJSONBytes, err := json.Marshal(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		e := evt.Event
+		rows = append(rows, placeholder)
+		args = append(args,
+			string(e.UID), e.ResourceVersion, evt.Verb, e.Type, e.Reason, e.Message, e.Count,
+			e.InvolvedObject.Namespace, e.InvolvedObject.Kind, e.InvolvedObject.Name,
+			e.Source.Component, e.Source.Host,
+			mysqlTime(e.FirstTimestamp.Time), mysqlTime(e.LastTimestamp.Time),
+			string(eJSONBytes),
+		)
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", m.table, strings.Join(mysqlColumns, ", "), strings.Join(rows, ", "))
+	err := m.retry.Do(func() error {
+		_, err := m.db.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		glog.Errorf("Failed to insert %d events into mysql table %s: %v", len(rows), m.table, err)
+		deadLetterEvents("mysql", events, err)
+	}
+}
+
+// mysqlTime converts unset timestamps to NULL and others to UTC, DATETIME
+// columns don't carry a time zone
+func mysqlTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// newRelicMaxAttributeLength is the longest string attribute the Event API keeps
+const newRelicMaxAttributeLength = 4096
+
+// newRelicEndpoints are the ingest URLs per API and region; %s is the account ID
+var newRelicEndpoints = map[string]map[string]string{
+	"log": {
+		"us": "https://log-api.newrelic.com/log/v1",
+		"eu": "https://log-api.eu.newrelic.com/log/v1",
+	},
+	"event": {
+		"us": "https://insights-collector.newrelic.com/v1/accounts/%s/events",
+		"eu": "https://insights-collector.eu01.nr-data.net/v1/accounts/%s/events",
+	},
+}
+
+// NewRelicConfig holds the settings of the NewRelicSink
+type NewRelicConfig struct {
+	// API is either "log" (Log API) or "event" (Event API)
+	API string
+
+	LicenseKey string
+
+	// AccountID is required by the Event API
+	AccountID string
+
+	// Region is "us" or "eu". Endpoint, when set, overrides the URL derived
+	// from API and Region.
+	Region   string
+	Endpoint string
+
+	// EventType is the eventType of the custom events sent to the Event API
+	EventType string
+
+	// Attributes are added to every log or event, e.g. clusterName=prod
+	Attributes map[string]string
+
+	BatchSize int
+}
+
+/*
+NewRelicSink sends events to New Relic, authenticating with a license key,
+either as logs through the Log API or as custom events through the Event API.
+
+The involved object, reason, type, count and source of an event are mapped to
+attributes, so they can be faceted in NRQL without parsing the message. Events
+buffered between two loop iterations are sent in gzipped requests of up to
+BatchSize items.
+*/
+type NewRelicSink struct {
+	cfg        NewRelicConfig
+	url        string
+	httpClient *retryClient
+	eventCh    channels.Channel
+}
+
+// NewNewRelicSink constructs a new NewRelicSink given its config
+func NewNewRelicSink(cfg NewRelicConfig, overflow bool, bufferSize int) (*NewRelicSink, error) {
+	endpoints, ok := newRelicEndpoints[cfg.API]
+	if !ok {
+		return nil, fmt.Errorf("invalid newrelic api %q, supported apis are log and event", cfg.API)
+	}
+	if cfg.API == "event" && cfg.AccountID == "" {
+		return nil, fmt.Errorf("newrelic event api needs an account id")
+	}
+
+	u := cfg.Endpoint
+	if u == "" {
+		if u, ok = endpoints[cfg.Region]; !ok {
+			return nil, fmt.Errorf("invalid newrelic region %q, supported regions are us and eu", cfg.Region)
+		}
+		if cfg.API == "event" {
+			u = fmt.Sprintf(u, cfg.AccountID)
+		}
+	}
+
+	n := &NewRelicSink{
+		cfg: cfg,
+		url: u,
+	}
+
+	n.httpClient = retryPolicy.forSink().httpClient()
+
+	if overflow {
+		n.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		n.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return n, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (n *NewRelicSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	n.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through n.eventCh, and
+// sending them to New Relic. If multiple events have happened between loop
+// iterations, they are sent BatchSize items at a time.
+func (n *NewRelicSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-n.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := n.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-n.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, n.cfg.BatchSize, n.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(n.eventCh), n.cfg.BatchSize, n.drainEvents)
+			break loop
+		}
+	}
+}
+
+// attributes maps the fields of an event to New Relic attributes
+func (n *NewRelicSink) attributes(evt EventData) map[string]interface{} {
+	e := evt.Event
+	attrs := make(map[string]interface{}, len(n.cfg.Attributes)+14)
+	for k, v := range n.cfg.Attributes {
+		attrs[k] = v
+	}
+	attrs["verb"] = evt.Verb
+	attrs["event.uid"] = string(e.UID)
+	attrs["event.type"] = e.Type
+	attrs["event.reason"] = e.Reason
+	attrs["event.count"] = e.Count
+	attrs["event.source.component"] = e.Source.Component
+	attrs["event.source.host"] = e.Source.Host
+	attrs["involvedObject.kind"] = e.InvolvedObject.Kind
+	attrs["involvedObject.namespace"] = e.InvolvedObject.Namespace
+	attrs["involvedObject.name"] = e.InvolvedObject.Name
+	attrs["involvedObject.uid"] = string(e.InvolvedObject.UID)
+	if !e.FirstTimestamp.IsZero() {
+		attrs["event.firstTimestamp"] = e.FirstTimestamp.UTC().Format(time.RFC3339)
+	}
+	if !e.LastTimestamp.IsZero() {
+		attrs["event.lastTimestamp"] = e.LastTimestamp.UTC().Format(time.RFC3339)
+	}
+	return attrs
+}
+
+// newRelicTimestamp returns the time of the last occurrence of the event in
+// milliseconds since the epoch
+func newRelicTimestamp(e *v1.Event) int64 {
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return ts.UnixNano() / int64(time.Millisecond)
+}
+
+// payload builds the request body of the configured API
+func (n *NewRelicSink) payload(events []EventData) interface{} {
+	if n.cfg.API == "event" {
+		items := make([]map[string]interface{}, 0, len(events))
+		for _, evt := range events {
+			item := n.attributes(evt)
+			message := evt.Event.Message
+			if len(message) > newRelicMaxAttributeLength {
+				message = message[:newRelicMaxAttributeLength]
+			}
+			item["eventType"] = n.cfg.EventType
+			item["timestamp"] = newRelicTimestamp(evt.Event)
+			item["message"] = message
+			items = append(items, item)
+		}
+		return items
+	}
+
+	type logEntry struct {
+		Timestamp  int64                  `json:"timestamp"`
+		Message    string                 `json:"message"`
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	logs := make([]logEntry, 0, len(events))
+	for _, evt := range events {
+		logs = append(logs, logEntry{
+			Timestamp:  newRelicTimestamp(evt.Event),
+			Message:    evt.Event.Message,
+			Attributes: n.attributes(evt),
+		})
+	}
+	return []map[string]interface{}{{
+		"common": map[string]interface{}{
+			"attributes": map[string]string{"logtype": "kubernetes-event"},
+		},
+		"logs": logs,
+	}}
+}
+
+// drainEvents sends the events with one gzipped request
+func (n *NewRelicSink) drainEvents(events []EventData) {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if err := json.NewEncoder(zw).Encode(n.payload(events)); err != nil {
+		glog.Warningf("Failed to json serialize events: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		glog.Warningf("Failed to compress events: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", n.url, &body)
+	if err != nil {
+		glog.Warningf(err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-License-Key", n.cfg.LicenseKey)
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		glog.Errorf("Failed to send %d events to newrelic: %v", len(events), err)
+		deadLetterEvents("newrelic", events, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		glog.Errorf("Failed to send %d events to newrelic, %v", len(events), err)
+		deadLetterEvents("newrelic", events, err)
+	}
+}
@@ -0,0 +1,663 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// openSearchServiceManaged is the SigV4 service name of Amazon OpenSearch Service domains
+	openSearchServiceManaged = "es"
+	// openSearchServiceServerless is the SigV4 service name of OpenSearch Serverless collections
+	openSearchServiceServerless = "aoss"
+
+	// openSearchIDUID uses the event UID as document _id
+	openSearchIDUID = "uid"
+	// openSearchIDUIDResourceVersion uses the event UID and resourceVersion as document _id
+	openSearchIDUIDResourceVersion = "uid+resourceVersion"
+)
+
+// openSearchPlaceholderRe matches the placeholders of a data stream name
+var openSearchPlaceholderRe = regexp.MustCompile(`\{[a-z]+\}`)
+
+// OpenSearchConfig holds the settings of the OpenSearchSink
+type OpenSearchConfig struct {
+	// Endpoint is the base URL of the cluster, domain or collection.
+	// Alternatively CloudID is the Cloud ID of an Elastic Cloud deployment,
+	// the sink writing to the cluster of the deployment.
+	Endpoint string
+	CloudID  string
+
+	// Index is the name of the index events are written to. When
+	// IndexDateFormat is set, the event date is appended to it, e.g.
+	// eventrouter-2020.05.17.
+	Index           string
+	IndexDateFormat string
+
+	// DataStream, when set, is the name of the data stream events are
+	// written to instead of Index. It can contain {namespace}, {name}, {kind},
+	// {uid}, {reason} and {type} placeholders, e.g. logs-k8s-{namespace}. The
+	// data stream needs a matching index template with data_stream enabled.
+	DataStream string
+
+	// DocumentID selects the document _id: empty lets OpenSearch generate
+	// one, "uid" makes updates of an event overwrite its document, and
+	// "uid+resourceVersion" only deduplicates redeliveries of the same
+	// revision. With an ID, dated indices use the event first timestamp so
+	// all the updates of an event land in the same index. Data streams are
+	// append only, there a known _id is skipped rather than overwritten.
+	DocumentID string
+
+	// Username and Password enable basic authentication
+	Username string
+	Password string
+
+	// APIKey enables API key authentication, with the Authorization: ApiKey
+	// header Elastic clusters accept. It is the base64 encoded credential of
+	// the key, or its id and key as id:key.
+	APIKey string
+
+	// SigV4 enables AWS request signing, for Service "es" (Amazon
+	// OpenSearch Service) or "aoss" (OpenSearch Serverless). If AccessKeyID is
+	// empty the default AWS credential chain is used.
+	SigV4           bool
+	Region          string
+	Service         string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// BatchSize is the maximum number of documents of one bulk request, a
+	// partial batch is sent after FlushInterval. Workers bulk requests are
+	// sent concurrently, the events of an involved object in order.
+	BatchSize     int
+	FlushInterval time.Duration
+	Workers       int
+
+	// Bootstrap installs an index template and an ISM policy at startup,
+	// deleting indices RetentionDays after their creation. Data stream
+	// backing indices are rolled over every RolloverAge first. An existing
+	// policy is left untouched.
+	Bootstrap     bool
+	RetentionDays int
+	RolloverAge   string
+}
+
+/*
+OpenSearchSink writes events to OpenSearch with the bulk API. Events are
+collected in batches of up to BatchSize documents, a batch being sent when it
+is full or when FlushInterval has passed, whichever comes first. Batches are
+indexed by Workers goroutines, so at most Workers requests are in flight and a
+slow cluster applies backpressure to the event buffer instead of opening more
+connections.
+
+When a data stream is configured, documents are sent with the create op and
+carry the @timestamp field data streams require.
+
+Requests can be signed with AWS SigV4, which is what Amazon OpenSearch Service
+domains with IAM access policies and OpenSearch Serverless collections require.
+The bulk API being the same, the sink writes to Elasticsearch clusters too,
+e.g. Elastic Cloud deployments by their Cloud ID, with an API key rather than
+a native user.
+*/
+type OpenSearchSink struct {
+	cfg        OpenSearchConfig
+	baseURL    string
+	signer     *v4.Signer
+	httpClient *retryClient
+	retry      RetryPolicy
+	eventCh    channels.Channel
+}
+
+// openSearchDoc is a document of a bulk request: the lines of its action and
+// source, in the body buffer
+type openSearchDoc struct {
+	evt        EventData
+	start, end int
+}
+
+// openSearchBulkResponse is the part of the _bulk response we look at
+type openSearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// NewOpenSearchSink constructs a new OpenSearchSink given its config
+func NewOpenSearchSink(cfg OpenSearchConfig, overflow bool, bufferSize int) (*OpenSearchSink, error) {
+	switch cfg.DocumentID {
+	case "", openSearchIDUID, openSearchIDUIDResourceVersion:
+	default:
+		return nil, fmt.Errorf("invalid opensearch document id %q, must be %q or %q",
+			cfg.DocumentID, openSearchIDUID, openSearchIDUIDResourceVersion)
+	}
+	// The replicas running active-active write the same documents
+	if cfg.DocumentID == "" && deliveryKeys {
+		cfg.DocumentID = openSearchIDUIDResourceVersion
+	}
+
+	if cfg.CloudID != "" {
+		if cfg.Endpoint != "" {
+			return nil, fmt.Errorf("opensearch sink needs an endpoint or a cloud ID, not both")
+		}
+		endpoint, err := openSearchCloudEndpoint(cfg.CloudID)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Endpoint = endpoint
+	}
+	if cfg.APIKey != "" {
+		if cfg.Username != "" || cfg.SigV4 {
+			return nil, fmt.Errorf("opensearch sink needs one of an API key, basic authentication or SigV4")
+		}
+		// The id and key of the API key are sent base64 encoded
+		if strings.Contains(cfg.APIKey, ":") {
+			cfg.APIKey = base64.StdEncoding.EncodeToString([]byte(cfg.APIKey))
+		}
+	}
+
+	o := &OpenSearchSink{
+		cfg:     cfg,
+		baseURL: strings.TrimSuffix(cfg.Endpoint, "/"),
+	}
+	if o.cfg.BatchSize <= 0 {
+		o.cfg.BatchSize = 1
+	}
+	if o.cfg.Workers <= 0 {
+		o.cfg.Workers = 1
+	}
+	if o.cfg.FlushInterval <= 0 {
+		o.cfg.FlushInterval = time.Second
+	}
+
+	if cfg.SigV4 {
+		if cfg.Service != openSearchServiceManaged && cfg.Service != openSearchServiceServerless {
+			return nil, fmt.Errorf("invalid opensearch SigV4 service %q, must be %q or %q",
+				cfg.Service, openSearchServiceManaged, openSearchServiceServerless)
+		}
+
+		awsConfig := &aws.Config{
+			Region: aws.String(cfg.Region),
+		}
+		if cfg.AccessKeyID != "" {
+			awsConfig.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+		}
+
+		awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
+		sess, err := session.NewSession(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		o.signer = v4.NewSigner(sess.Config.Credentials)
+	}
+
+	o.retry = retryPolicy.forSink()
+	o.httpClient = o.retry.httpClient()
+
+	if cfg.Bootstrap {
+		if err := o.bootstrap(); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap opensearch: %v", err)
+		}
+	}
+
+	if overflow {
+		o.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		o.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return o, nil
+}
+
+// openSearchCloudEndpoint returns the endpoint of the cluster of an Elastic
+// Cloud deployment from its Cloud ID: the deployment name and, base64
+// encoded, the host, the UUID of the cluster and the UUID of Kibana, e.g.
+// name:dXMtZWFzdC0xLmF3cy5mb3VuZC5pbyRjZWM2ZjI2MWE3NGJmMjRjZTMzYmI4ODExYjg0Mjk0ZiRjNmMyY2E2ZDA0MjI0OWFmMGNjN2Q3YTllOTYyNTc0Mw==
+func openSearchCloudEndpoint(cloudID string) (string, error) {
+	encoded := cloudID[strings.LastIndex(cloudID, ":")+1:]
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid opensearch cloud ID: %v", err)
+	}
+	parts := strings.Split(string(decoded), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid opensearch cloud ID: no host or cluster UUID")
+	}
+
+	// The host may carry the port, placed after the cluster subdomain
+	host, port := parts[0], ""
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port = host[:i], host[i:]
+	}
+	return "https://" + parts[1] + "." + host + port, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (o *OpenSearchSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	evt := NewEventData(eNew, eOld)
+	if o.cfg.DocumentID == openSearchIDUID {
+		// The documents of the events are updated in place
+		evt = evt.inPlace(eNew)
+	}
+	o.eventCh.In() <- evt
+}
+
+// Run sits in a loop, waiting for data to come in through o.eventCh, and
+// handing full batches, or partial batches every FlushInterval, to the bulk
+// workers.
+func (o *OpenSearchSink) Run(stopCh <-chan bool) {
+	bufs := make([]*bytes.Buffer, o.cfg.Workers)
+	for i := range bufs {
+		bufs[i] = bytes.NewBuffer(make([]byte, 0, 4096))
+	}
+	workers := newOrderedWorkers(o.cfg.Workers, func(worker int, batch []EventData) {
+		o.drainEvents(bufs[worker], batch)
+	})
+
+	ticker := time.NewTicker(o.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]EventData, 0, o.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			workers.dispatch(batch)
+			batch = make([]EventData, 0, o.cfg.BatchSize)
+		}
+	}
+
+loop:
+	for {
+		select {
+		case e := <-o.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			batch = append(batch, evt)
+			if len(batch) >= o.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(o.eventCh) {
+				batch = append(batch, evt)
+				if len(batch) >= o.cfg.BatchSize {
+					flush()
+				}
+			}
+			break loop
+		}
+	}
+
+	flush()
+	workers.close()
+}
+
+// openSearchTimestamp returns the time the event is indexed under
+func openSearchTimestamp(e *v1.Event) time.Time {
+	t := eventTimestamp(e)
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC()
+}
+
+// indexName returns the index or data stream the event is written to
+func (o *OpenSearchSink) indexName(e *v1.Event) string {
+	if o.cfg.DataStream != "" {
+		// data stream names must be lowercase
+		return strings.ToLower(expandEventTemplate(o.cfg.DataStream, e))
+	}
+	if o.cfg.IndexDateFormat == "" {
+		return o.cfg.Index
+	}
+	t := openSearchTimestamp(e)
+	if o.cfg.DocumentID != "" && !e.FirstTimestamp.IsZero() {
+		t = e.FirstTimestamp.UTC()
+	}
+	return o.cfg.Index + "-" + t.Format(o.cfg.IndexDateFormat)
+}
+
+// documentID returns the _id of the event document, or "" to let OpenSearch
+// generate one
+func (o *OpenSearchSink) documentID(e *v1.Event) string {
+	switch o.cfg.DocumentID {
+	case openSearchIDUID:
+		return string(e.UID)
+	case openSearchIDUIDResourceVersion:
+		return string(e.UID) + "-" + e.ResourceVersion
+	}
+	return ""
+}
+
+// drainEvents sends the events in one _bulk request, building the body in buf
+func (o *OpenSearchSink) drainEvents(buf *bytes.Buffer, events []EventData) {
+	buf.Truncate(0)
+	enc := json.NewEncoder(buf)
+
+	var docs []openSearchDoc
+	for _, evt := range events {
+		eJSONBytes, err := json.Marshal(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		op := "index"
+		if o.cfg.DataStream != "" {
+			op = "create"
+		}
+		meta := map[string]string{"_index": o.indexName(evt.Event)}
+		if id := o.documentID(evt.Event); id != "" {
+			meta["_id"] = id
+		}
+		action := map[string]map[string]string{op: meta}
+		start := buf.Len()
+		if err := enc.Encode(action); err != nil {
+			glog.Warningf("Failed to json serialize bulk action: %v", err)
+			continue
+		}
+		if o.cfg.DataStream != "" {
+			// Prepend @timestamp to the event object rather than decoding and
+			// re-encoding it
+			buf.WriteString(`{"@timestamp":"`)
+			buf.WriteString(openSearchTimestamp(evt.Event).Format(time.RFC3339Nano))
+			buf.WriteString(`",`)
+			eJSONBytes = eJSONBytes[1:]
+		}
+		buf.Write(eJSONBytes)
+		buf.WriteByte('\n')
+		docs = append(docs, openSearchDoc{evt: evt, start: start, end: buf.Len()})
+	}
+	if len(docs) == 0 {
+		return
+	}
+
+	docs, err := o.bulk(buf.Bytes(), docs)
+	if err != nil {
+		glog.Errorf("Failed to index %d events into opensearch: %v", len(docs), err)
+		deadLetterDocs(docs, err)
+	}
+}
+
+// deadLetterDocs hands the events of the documents to the dead letter
+func deadLetterDocs(docs []openSearchDoc, err error) {
+	events := make([]EventData, len(docs))
+	for i, doc := range docs {
+		events[i] = doc.evt
+	}
+	deadLetterEvents("opensearch", events, err)
+}
+
+// request sends a request, signed when SigV4 is enabled, and returns the
+// response status and body
+func (o *OpenSearchSink) request(method, path, contentType string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, o.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if o.signer != nil {
+		// OpenSearch Serverless requires the payload hash header, which the
+		// signer then includes in the signature
+		if o.cfg.Service == openSearchServiceServerless {
+			sum := sha256.Sum256(body)
+			req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		}
+		if _, err := o.signer.Sign(req, bytes.NewReader(body), o.cfg.Service, o.cfg.Region, time.Now()); err != nil {
+			return 0, nil, fmt.Errorf("failed to sign request: %v", err)
+		}
+	} else if o.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+o.cfg.APIKey)
+	} else if o.cfg.Username != "" {
+		req.SetBasicAuth(o.cfg.Username, o.cfg.Password)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// putJSON sends a PUT request with a JSON body. A 409 conflict is only an
+// error when allowConflict is false.
+func (o *OpenSearchSink) putJSON(path string, v interface{}, allowConflict bool) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	status, respBody, err := o.request("PUT", path, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict && allowConflict {
+		return nil
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("PUT %s got HTTP code %v: %s", path, status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// indexPattern returns the pattern matching all the indices or data streams
+// written by the sink
+func (o *OpenSearchSink) indexPattern() string {
+	if o.cfg.DataStream != "" {
+		return strings.ToLower(openSearchPlaceholderRe.ReplaceAllString(o.cfg.DataStream, "*"))
+	}
+	return o.cfg.Index + "-*"
+}
+
+// bootstrap installs the ISM policy and the index template. The template name
+// and policy id are the index (or data stream) name, without placeholders.
+func (o *OpenSearchSink) bootstrap() error {
+	if o.cfg.Service == openSearchServiceServerless && o.signer != nil {
+		return fmt.Errorf("OpenSearch Serverless doesn't support ISM, use a data lifecycle policy instead")
+	}
+	if o.cfg.DataStream == "" && o.cfg.IndexDateFormat == "" {
+		return fmt.Errorf("retention needs dated indices or a data stream")
+	}
+	if o.cfg.RetentionDays <= 0 {
+		return fmt.Errorf("invalid retention of %d days", o.cfg.RetentionDays)
+	}
+
+	pattern := o.indexPattern()
+	name := strings.Trim(strings.Replace(pattern, "*", "", -1), "-_.")
+	if name == "" {
+		name = "eventrouter"
+	}
+
+	hotActions := []interface{}{}
+	if o.cfg.DataStream != "" && o.cfg.RolloverAge != "" {
+		hotActions = append(hotActions, map[string]interface{}{
+			"rollover": map[string]string{"min_index_age": o.cfg.RolloverAge},
+		})
+	}
+	policy := map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "eventrouter retention of " + pattern,
+			"default_state": "hot",
+			"states": []interface{}{
+				map[string]interface{}{
+					"name":    "hot",
+					"actions": hotActions,
+					"transitions": []interface{}{
+						map[string]interface{}{
+							"state_name": "delete",
+							"conditions": map[string]string{
+								"min_index_age": fmt.Sprintf("%dd", o.cfg.RetentionDays),
+							},
+						},
+					},
+				},
+				map[string]interface{}{
+					"name":        "delete",
+					"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+					"transitions": []interface{}{},
+				},
+			},
+			// attaches the policy to the indices created from now on
+			"ism_template": []interface{}{
+				map[string]interface{}{
+					"index_patterns": []string{pattern},
+					"priority":       100,
+				},
+			},
+		},
+	}
+	if err := o.putJSON("/_plugins/_ism/policies/"+name, policy, true); err != nil {
+		return err
+	}
+
+	properties := map[string]interface{}{
+		"event": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"message":        map[string]string{"type": "text"},
+				"firstTimestamp": map[string]string{"type": "date"},
+				"lastTimestamp":  map[string]string{"type": "date"},
+			},
+		},
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       100,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{"properties": properties},
+		},
+	}
+	if o.cfg.DataStream != "" {
+		properties["@timestamp"] = map[string]string{"type": "date"}
+		template["data_stream"] = map[string]interface{}{}
+	}
+	if err := o.putJSON("/_index_template/"+name, template, false); err != nil {
+		return err
+	}
+
+	glog.Infof("Installed opensearch index template and ISM policy %q for %s", name, pattern)
+	return nil
+}
+
+// bulk sends the documents of the body in _bulk requests, retrying the ones
+// OpenSearch rejected with a 429 or a 5xx, the failed requests being retried
+// by the http client. It returns the documents that failed, with the error,
+// after dead-lettering the ones rejected for good.
+func (o *OpenSearchSink) bulk(body []byte, docs []openSearchDoc) ([]openSearchDoc, error) {
+	err := o.retry.Do(func() error {
+		req := body
+		if len(docs) > 0 && (docs[0].start != 0 || docs[len(docs)-1].end != len(body)) {
+			req = make([]byte, 0, len(body))
+			for _, doc := range docs {
+				req = append(req, body[doc.start:doc.end]...)
+			}
+		}
+		status, respBody, err := o.request("POST", "/_bulk", "application/x-ndjson", req)
+		if err != nil {
+			return permanent(err)
+		}
+		if status < 200 || status > 299 {
+			return permanent(fmt.Errorf("got HTTP code %v: %s", status, strings.TrimSpace(string(respBody))))
+		}
+
+		var bulkResp openSearchBulkResponse
+		if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+			return permanent(fmt.Errorf("failed to parse bulk response: %v", err))
+		}
+		if !bulkResp.Errors {
+			docs = nil
+			return nil
+		}
+		if len(bulkResp.Items) != len(docs) {
+			return permanent(fmt.Errorf("got %d bulk items for %d documents", len(bulkResp.Items), len(docs)))
+		}
+
+		// The items are in the order of the documents
+		var retry, rejected []openSearchDoc
+		var retryErr, rejectedErr string
+		for i, item := range bulkResp.Items {
+			for op, result := range item {
+				// A conflict on create means the document was already
+				// indexed, e.g. a redelivery of the same event revision
+				if op == "create" && result.Status == http.StatusConflict {
+					continue
+				}
+				if result.Status <= 299 {
+					continue
+				}
+				reason := result.Error.Type + ": " + result.Error.Reason
+				if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+					if len(retry) == 0 {
+						retryErr = reason
+					}
+					retry = append(retry, docs[i])
+				} else {
+					if len(rejected) == 0 {
+						rejectedErr = reason
+					}
+					rejected = append(rejected, docs[i])
+				}
+			}
+		}
+		if len(rejected) > 0 {
+			err := fmt.Errorf("%d of %d documents rejected, first error: %s", len(rejected), len(docs), rejectedErr)
+			glog.Errorf("Failed to index %d events into opensearch: %v", len(rejected), err)
+			deadLetterDocs(rejected, err)
+		}
+		docs = retry
+		if len(retry) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%d documents failed, first error: %s", len(retry), retryErr)
+	})
+	return docs, err
+}
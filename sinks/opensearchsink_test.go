@@ -0,0 +1,126 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenSearchCloudEndpoint(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	for _, test := range []struct {
+		name    string
+		cloudID string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "without port",
+			cloudID: encode("us-east-1.aws.found.io$cec6f261a74bf24ce33bb8811b84294f$c6c2ca6d042249af0cc7d7a9e9625743"),
+			want:    "https://cec6f261a74bf24ce33bb8811b84294f.us-east-1.aws.found.io",
+		},
+		{
+			name:    "with port",
+			cloudID: encode("us-east-1.aws.found.io:9243$abc$def"),
+			want:    "https://abc.us-east-1.aws.found.io:9243",
+		},
+		{
+			name:    "name prefix",
+			cloudID: "my-deployment:" + encode("europe-west1.gcp.cloud.es.io$abc$def"),
+			want:    "https://abc.europe-west1.gcp.cloud.es.io",
+		},
+		{
+			name:    "without the Kibana UUID",
+			cloudID: "my-deployment:" + encode("europe-west1.gcp.cloud.es.io$abc"),
+			want:    "https://abc.europe-west1.gcp.cloud.es.io",
+		},
+		{
+			name:    "invalid base64",
+			cloudID: "my-deployment:not base64!",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			cloudID: "",
+			wantErr: true,
+		},
+		{
+			name:    "without cluster UUID",
+			cloudID: "my-deployment:" + encode("europe-west1.gcp.cloud.es.io"),
+			wantErr: true,
+		},
+		{
+			name:    "empty cluster UUID",
+			cloudID: "my-deployment:" + encode("europe-west1.gcp.cloud.es.io$$def"),
+			wantErr: true,
+		},
+		{
+			name:    "empty host",
+			cloudID: "my-deployment:" + encode("$abc$def"),
+			wantErr: true,
+		},
+	} {
+		got, err := openSearchCloudEndpoint(test.cloudID)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Got endpoint %q for a Cloud ID %s, want an error", got, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to decode the Cloud ID %s: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("Got endpoint %q for the Cloud ID %s, want %q", got, test.name, test.want)
+		}
+	}
+}
+
+func TestOpenSearchAPIKeyHeader(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw"))
+	for name, key := range map[string]string{
+		"id:key":  "VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw",
+		"encoded": encoded,
+	} {
+		o, err := NewOpenSearchSink(OpenSearchConfig{Endpoint: srv.URL, APIKey: key}, true, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := o.request("GET", "/", "application/json", nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := "ApiKey " + encoded; auth != want {
+			t.Errorf("Got Authorization %q with the %s API key, want %q", auth, name, want)
+		}
+	}
+
+	// The API key replaces the other authentications
+	if _, err := NewOpenSearchSink(OpenSearchConfig{Endpoint: srv.URL, APIKey: encoded, Username: "eventrouter"}, true, 10); err == nil {
+		t.Errorf("Got no error for an API key with basic authentication")
+	}
+}
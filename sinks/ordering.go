@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+/*
+orderedWorkers delivers batches of events concurrently while keeping the
+events of each involved object in order: the events are assigned to the
+workers by the hash of their involved object, each worker delivering its
+batches one at a time, so the updates of an object never overtake its
+creation. A batch mixing objects is split by worker.
+
+dispatch blocks while the worker of an event is busy, so at most one batch
+per worker is in flight.
+*/
+type orderedWorkers struct {
+	queues []chan []EventData
+	wg     sync.WaitGroup
+}
+
+// newOrderedWorkers starts n workers calling deliver with their index and
+// their batches
+func newOrderedWorkers(n int, deliver func(worker int, events []EventData)) *orderedWorkers {
+	if n < 1 {
+		n = 1
+	}
+	w := &orderedWorkers{queues: make([]chan []EventData, n)}
+	for i := range w.queues {
+		q := make(chan []EventData)
+		w.queues[i] = q
+		w.wg.Add(1)
+		go func(worker int) {
+			defer w.wg.Done()
+			for events := range q {
+				deliver(worker, events)
+			}
+		}(i)
+	}
+	return w
+}
+
+// dispatch hands the events to their workers, in order
+func (w *orderedWorkers) dispatch(events []EventData) {
+	if len(w.queues) == 1 {
+		w.queues[0] <- events
+		return
+	}
+	parts := make([][]EventData, len(w.queues))
+	for _, evt := range events {
+		h := fnv.New32a()
+		h.Write([]byte(involvedObjectKey(evt.Event)))
+		i := h.Sum32() % uint32(len(w.queues))
+		parts[i] = append(parts[i], evt)
+	}
+	for i, part := range parts {
+		if len(part) > 0 {
+			w.queues[i] <- part
+		}
+	}
+}
+
+// close waits for the workers to deliver the dispatched batches, and stops
+// them
+func (w *orderedWorkers) close() {
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+}
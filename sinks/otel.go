@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The OpenTelemetry severity numbers of the severity levels
+const (
+	otelSeverityDebug = 5
+	otelSeverityInfo  = 9
+	otelSeverityWarn  = 13
+	otelSeverityError = 17
+	otelSeverityFatal = 21
+)
+
+// otelAnyValue is an OTLP AnyValue, in the OTLP/JSON encoding where the
+// 64 bit integers are strings
+type otelAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+// otelKeyValue is an OTLP attribute
+type otelKeyValue struct {
+	Key   string       `json:"key"`
+	Value otelAnyValue `json:"value"`
+}
+
+// otelLogRecord is an OTLP LogRecord, in the OTLP/JSON encoding
+type otelLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 otelAnyValue   `json:"body"`
+	Attributes           []otelKeyValue `json:"attributes"`
+}
+
+// otelAttributes builds the attributes of a log record, leaving out the
+// empty values
+type otelAttributes []otelKeyValue
+
+// string adds a string attribute
+func (a *otelAttributes) string(key, value string) {
+	if value == "" {
+		return
+	}
+	*a = append(*a, otelKeyValue{Key: key, Value: otelAnyValue{StringValue: &value}})
+}
+
+// int adds an integer attribute
+func (a *otelAttributes) int(key string, value int64) {
+	if value == 0 {
+		return
+	}
+	s := strconv.FormatInt(value, 10)
+	*a = append(*a, otelKeyValue{Key: key, Value: otelAnyValue{IntValue: &s}})
+}
+
+// otelUnixNano returns a timestamp of the OTLP/JSON encoding, "" for a zero
+// time
+func otelUnixNano(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otelSeverity returns the severity number and text of an event, from its
+// severity level
+func otelSeverity(e *v1.Event) (int, string) {
+	switch eventSeverity(e) {
+	case severityDebug:
+		return otelSeverityDebug, "DEBUG"
+	case severityWarning:
+		return otelSeverityWarn, "WARN"
+	case severityError:
+		return otelSeverityError, "ERROR"
+	case severityCritical:
+		return otelSeverityFatal, "FATAL"
+	default:
+		return otelSeverityInfo, "INFO"
+	}
+}
+
+// newOtelLogRecord maps the event data onto the OpenTelemetry log data model:
+// the time is the primary timestamp of the event, the severity comes from its
+// severity level, the body is its message, and the involved object and the event are
+// described by the attributes of the k8s.* semantic conventions, as the
+// collector's k8s events receiver does.
+func newOtelLogRecord(evt EventData) otelLogRecord {
+	e := evt.Event
+	ts := eventTimestamp(e)
+	severity, severityText := otelSeverity(e)
+	message := e.Message
+
+	var attrs otelAttributes
+	attrs.string("eventrouter.verb", evt.Verb)
+	attrs.string("eventrouter.delivery_key", evt.DeliveryKey)
+	attrs.int("eventrouter.repeated", int64(evt.Repeated))
+	attrs.string("k8s.cluster.name", e.ClusterName)
+	attrs.string("k8s.namespace.name", e.InvolvedObject.Namespace)
+	attrs.string("k8s.object.kind", e.InvolvedObject.Kind)
+	attrs.string("k8s.object.name", e.InvolvedObject.Name)
+	attrs.string("k8s.object.uid", string(e.InvolvedObject.UID))
+	attrs.string("k8s.object.api_version", e.InvolvedObject.APIVersion)
+	attrs.string("k8s.object.resource_version", e.InvolvedObject.ResourceVersion)
+	attrs.string("k8s.object.fieldpath", e.InvolvedObject.FieldPath)
+	attrs.string("k8s.event.name", e.Name)
+	attrs.string("k8s.event.uid", string(e.UID))
+	attrs.string("k8s.event.reason", e.Reason)
+	attrs.string("k8s.event.action", e.Action)
+	if !e.FirstTimestamp.IsZero() {
+		attrs.string("k8s.event.start_time", e.FirstTimestamp.UTC().Format(time.RFC3339))
+	}
+	attrs.int("k8s.event.count", int64(e.Count))
+	attrs.string("k8s.event.source.component", e.Source.Component)
+	attrs.string("k8s.event.source.host", e.Source.Host)
+	attrs.string("k8s.event.reporting_controller", e.ReportingController)
+	attrs.string("k8s.event.reporting_instance", e.ReportingInstance)
+
+	return otelLogRecord{
+		TimeUnixNano:         otelUnixNano(ts),
+		ObservedTimeUnixNano: otelUnixNano(time.Now()),
+		SeverityNumber:       severity,
+		SeverityText:         severityText,
+		Body:                 otelAnyValue{StringValue: &message},
+		Attributes:           attrs,
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+// OutputFieldConfig is a field of an output mapping: the value at Path, a
+// dotted path in the EventData JSON such as $.event.involvedObject.name, or
+// the constant Value. Field is the dotted path of the output field.
+type OutputFieldConfig struct {
+	Field string      `mapstructure:"field"`
+	Path  string      `mapstructure:"path"`
+	Value interface{} `mapstructure:"value"`
+}
+
+// outputField is a parsed OutputFieldConfig
+type outputField struct {
+	field []string
+	path  []string
+	value interface{}
+}
+
+// outputTemplateFuncs are the functions of the output templates
+var outputTemplateFuncs = template.FuncMap{
+	// json writes a value as JSON, e.g. {{json .Event.Message}} for a
+	// quoted and escaped string
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+/*
+outputFormat is the serialized shape of the events of a sink, for receivers
+with a fixed schema: either a Go template executed on the EventData, its
+output written as is, or a mapping of output fields to the paths of the
+EventData JSON. The transforms apply before the mapping; the CloudEvents
+envelope doesn't apply.
+
+With protobuf, the events are encoded as the EventRecords of
+proto/eventrecord.proto instead, and with otel as OTLP/JSON log records, see
+newOtelLogRecord, both without transforms.
+*/
+type outputFormat struct {
+	tmpl     *template.Template
+	fields   []outputField
+	protobuf bool
+	otel     bool
+}
+
+// newOutputFormat creates the output format of a template or a field
+// mapping, nil with neither
+func newOutputFormat(name, tmpl string, fields []OutputFieldConfig) (*outputFormat, error) {
+	if tmpl != "" && len(fields) > 0 {
+		return nil, errors.New("output template and output fields are exclusive")
+	}
+	if tmpl != "" {
+		t, err := template.New(name).Funcs(outputTemplateFuncs).Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output template: %v", err)
+		}
+		return &outputFormat{tmpl: t}, nil
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	f := &outputFormat{}
+	for i, cfg := range fields {
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("output field %d has no field", i)
+		}
+		if (cfg.Path == "") == (cfg.Value == nil) {
+			return nil, fmt.Errorf("output field %s must have one of path and value", cfg.Field)
+		}
+		field := outputField{field: strings.Split(cfg.Field, "."), value: cfg.Value}
+		if cfg.Path != "" {
+			field.path = strings.Split(strings.TrimPrefix(strings.TrimPrefix(cfg.Path, "$"), "."), ".")
+		}
+		f.fields = append(f.fields, field)
+	}
+	return f, nil
+}
+
+// execute returns the template output of the event data
+func (f *outputFormat) execute(evt EventData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, evt); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mapFields returns the document of the output fields of the event data.
+// The fields whose path isn't found are left out.
+func (f *outputFormat) mapFields(evt EventData) (map[string]interface{}, error) {
+	b, err := json.Marshal(transformEventData(evt))
+	if err != nil {
+		return nil, err
+	}
+	// UseNumber keeps the numbers as they were written
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]interface{}, len(f.fields))
+	for _, field := range f.fields {
+		v := field.value
+		if field.path != nil {
+			var ok bool
+			if v, ok = lookupPath(doc, field.path); !ok {
+				continue
+			}
+		}
+		if parent := transformParent(out, field.field, true); parent != nil {
+			parent[field.field[len(field.field)-1]] = v
+		}
+	}
+	return out, nil
+}
+
+// lookupPath returns the value at the path of the document
+func lookupPath(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// outputFormatter is implemented by the sinks supporting output formats
+type outputFormatter interface {
+	setOutputFormat(format *outputFormat)
+}
+
+/*
+eventOutput serializes the event data of a sink, in its output format when
+set, else as marshalEventData does. The sinks writing the EventData embed it.
+*/
+type eventOutput struct {
+	format *outputFormat
+}
+
+// setOutputFormat implements the outputFormatter
+func (o *eventOutput) setOutputFormat(format *outputFormat) {
+	o.format = format
+}
+
+// encode serializes the event data
+func (o *eventOutput) encode(evt EventData) ([]byte, error) {
+	switch {
+	case o.format == nil:
+		return marshalEventData(evt)
+	case o.format.protobuf:
+		return marshalEventProto(evt), nil
+	case o.format.otel:
+		return json.Marshal(newOtelLogRecord(evt))
+	case o.format.tmpl != nil:
+		return o.format.execute(evt)
+	default:
+		doc, err := o.format.mapFields(evt)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(doc)
+	}
+}
+
+// document returns the value to serialize for the event data, for the sinks
+// writing several events per document. The template outputs that aren't
+// JSON are strings. These sinks don't support protobuf.
+func (o *eventOutput) document(evt EventData) interface{} {
+	switch {
+	case o.format == nil:
+		return eventDataJSON(evt)
+	case o.format.otel:
+		return newOtelLogRecord(evt)
+	case o.format.tmpl != nil:
+		b, err := o.format.execute(evt)
+		if err != nil {
+			glog.Warningf("Failed to execute the output template: %v", err)
+			return nil
+		}
+		if json.Valid(b) {
+			return json.RawMessage(b)
+		}
+		return string(b)
+	default:
+		doc, err := o.format.mapFields(evt)
+		if err != nil {
+			glog.Warningf("Failed to map the output fields: %v", err)
+			return nil
+		}
+		return doc
+	}
+}
+
+// contentType returns the content type of the encoded event data
+func (o *eventOutput) contentType() string {
+	switch {
+	case o.format == nil:
+		return eventDataContentType()
+	case o.format.protobuf:
+		return "application/x-protobuf"
+	default:
+		return "application/json"
+	}
+}
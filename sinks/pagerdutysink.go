@@ -0,0 +1,225 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// pagerDutyEventsURL is the Events API v2 endpoint
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	// pagerDutyMaxSummaryLen is the maximum length of the summary field
+	pagerDutyMaxSummaryLen = 1024
+)
+
+/*
+PagerDutySink triggers PagerDuty incidents through the Events API v2 for the
+events matching its filter.
+
+The dedup key is the involved object UID and the event reason, so repeated
+warnings about one object update a single open incident instead of paging
+again for every occurrence. The throttled and failed triggers are retried
+with the retry policy of the sinks.
+*/
+type PagerDutySink struct {
+	routingKey string
+	severity   string
+	cluster    string
+	filter     EventFilter
+	httpClient *http.Client
+	retry      RetryPolicy
+	eventCh    channels.Channel
+}
+
+// pagerDutyEvent is the body of an Events API v2 trigger
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     string            `json:"timestamp,omitempty"`
+	Component     string            `json:"component,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+// NewPagerDutySink constructs a new PagerDutySink. severity is one of
+// critical, error, warning or info, cluster is reported as the event source.
+func NewPagerDutySink(routingKey, severity, cluster string, filter EventFilter, overflow bool, bufferSize int) (*PagerDutySink, error) {
+	switch severity {
+	case "critical", "error", "warning", "info":
+	default:
+		return nil, fmt.Errorf("invalid pagerduty severity %q", severity)
+	}
+
+	p := &PagerDutySink{
+		routingKey: routingKey,
+		severity:   severity,
+		cluster:    cluster,
+		filter:     filter,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retry:      retryPolicy.forSink(),
+	}
+
+	if overflow {
+		p.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		p.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return p, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (p *PagerDutySink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !p.filter.Matches(eNew) {
+		return
+	}
+	p.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through p.eventCh, and
+// triggering an incident for each of them.
+func (p *PagerDutySink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-p.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			p.drainEvent(evt)
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(p.eventCh) {
+				p.drainEvent(evt)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvent triggers the incident of the event, dead-lettering it on
+// failure
+func (p *PagerDutySink) drainEvent(evt EventData) {
+	if err := p.trigger(evt.Event); err != nil {
+		glog.Errorf("Failed to trigger pagerduty incident for %s/%s: %v", evt.Event.Namespace, evt.Event.Name, err)
+		deadLetterEvents("pagerduty", []EventData{evt}, err)
+	}
+}
+
+// trigger sends the trigger event, retrying throttled and failed requests
+func (p *PagerDutySink) trigger(e *v1.Event) error {
+	obj := e.InvolvedObject
+	summary := fmt.Sprintf("%s %s/%s: %s: %s", obj.Kind, obj.Namespace, obj.Name, e.Reason, e.Message)
+	if runes := []rune(summary); len(runes) > pagerDutyMaxSummaryLen {
+		summary = string(runes[:pagerDutyMaxSummaryLen])
+	}
+
+	source := p.cluster
+	if e.Source.Host != "" {
+		source = e.Source.Host
+	}
+
+	pdEvent := pagerDutyEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "trigger",
+		DedupKey:    string(obj.UID) + "/" + e.Reason,
+		Payload: pagerDutyPayload{
+			Summary:   summary,
+			Source:    source,
+			Severity:  p.eventSeverity(e),
+			Component: obj.Kind + "/" + obj.Name,
+			Group:     obj.Namespace,
+			Class:     e.Reason,
+			CustomDetails: map[string]string{
+				"cluster":   p.cluster,
+				"namespace": obj.Namespace,
+				"kind":      obj.Kind,
+				"name":      obj.Name,
+				"reason":    e.Reason,
+				"type":      e.Type,
+				"message":   e.Message,
+				"count":     fmt.Sprintf("%d", e.Count),
+				"component": e.Source.Component,
+			},
+		},
+	}
+	if !e.LastTimestamp.IsZero() {
+		pdEvent.Payload.Timestamp = e.LastTimestamp.UTC().Format(time.RFC3339)
+	}
+
+	body, err := json.Marshal(pdEvent)
+	if err != nil {
+		return err
+	}
+
+	return p.retry.Do(func() error {
+		resp, err := p.httpClient.Post(pagerDutyEventsURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return retryAfter(err, httpRetryAfter(resp))
+		case resp.StatusCode >= 500:
+			return err
+		default:
+			// 400 means the event is invalid, sending it again won't help
+			return permanent(err)
+		}
+	})
+}
+
+// eventSeverity returns the PagerDuty severity of the event: the configured
+// severity, unless the severity mapping sets it, debug being info
+func (p *PagerDutySink) eventSeverity(e *v1.Event) string {
+	if severities == nil {
+		return p.severity
+	}
+	if s := eventSeverity(e); s > severityDebug {
+		return s.String()
+	}
+	return severityInfo.String()
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The protobuf wire types
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// protobufSinks are the sinks supporting the protobuf output encoding, the
+// ones writing each event as a binary message or record
+var protobufSinks = map[string]bool{
+	"kafka":   true,
+	"logfile": true,
+}
+
+// protoBuffer encodes protobuf messages. The fields with default values are
+// left out, as proto3 does.
+type protoBuffer struct {
+	b []byte
+}
+
+// varint appends a varint
+func (p *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	p.b = append(p.b, buf[:n]...)
+}
+
+// tag appends the key of a field
+func (p *protoBuffer) tag(field int, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// string appends a string field
+func (p *protoBuffer) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	p.tag(field, protoBytes)
+	p.varint(uint64(len(s)))
+	p.b = append(p.b, s...)
+}
+
+// int64 appends an int64 or int32 field, the negative values sign extended
+func (p *protoBuffer) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, protoVarint)
+	p.varint(uint64(v))
+}
+
+// message appends an embedded message field, left out when empty
+func (p *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	if len(m.b) == 0 {
+		return
+	}
+	p.tag(field, protoBytes)
+	p.varint(uint64(len(m.b)))
+	p.b = append(p.b, m.b...)
+}
+
+// timestamp appends a google.protobuf.Timestamp field
+func (p *protoBuffer) timestamp(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	p.message(field, func(m *protoBuffer) {
+		m.int64(1, t.Unix())
+		m.int64(2, int64(t.Nanosecond()))
+	})
+}
+
+// stringMap appends a map<string, string> field, sorted by key so the
+// encoding is deterministic
+func (p *protoBuffer) stringMap(field int, kv map[string]string) {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.tag(field, protoBytes)
+		var entry protoBuffer
+		entry.string(1, k)
+		entry.string(2, kv[k])
+		p.varint(uint64(len(entry.b)))
+		p.b = append(p.b, entry.b...)
+	}
+}
+
+// marshalEventProto serializes the event data as an EventRecord of
+// proto/eventrecord.proto
+func marshalEventProto(evt EventData) []byte {
+	var p protoBuffer
+	p.string(1, evt.Verb)
+	if evt.Event != nil {
+		p.message(2, func(m *protoBuffer) { encodeEventProto(m, evt.Event) })
+	}
+	if evt.OldEvent != nil {
+		p.message(3, func(m *protoBuffer) { encodeEventProto(m, evt.OldEvent) })
+	}
+	p.int64(4, int64(evt.Repeated))
+	p.string(5, evt.DeliveryKey)
+	p.string(6, evt.Severity)
+	return p.b
+}
+
+// encodeEventProto encodes an Event of proto/eventrecord.proto
+func encodeEventProto(p *protoBuffer, e *v1.Event) {
+	p.string(1, e.Name)
+	p.string(2, e.Namespace)
+	p.string(3, string(e.UID))
+	p.string(4, e.ResourceVersion)
+	p.string(5, e.ClusterName)
+	p.stringMap(6, e.Labels)
+	p.stringMap(7, e.Annotations)
+	p.message(8, func(m *protoBuffer) { encodeObjectReferenceProto(m, &e.InvolvedObject) })
+	p.string(9, e.Reason)
+	p.string(10, e.Message)
+	p.string(11, e.Type)
+	p.int64(12, int64(e.Count))
+	p.string(13, e.Source.Component)
+	p.string(14, e.Source.Host)
+	p.timestamp(15, e.FirstTimestamp.Time)
+	p.timestamp(16, e.LastTimestamp.Time)
+	p.timestamp(17, e.EventTime.Time)
+	p.string(18, e.Action)
+	p.string(19, e.ReportingController)
+	p.string(20, e.ReportingInstance)
+	if e.Related != nil {
+		p.message(21, func(m *protoBuffer) { encodeObjectReferenceProto(m, e.Related) })
+	}
+	if e.Series != nil {
+		p.int64(22, int64(e.Series.Count))
+		p.timestamp(23, e.Series.LastObservedTime.Time)
+	}
+}
+
+// encodeObjectReferenceProto encodes an ObjectReference of
+// proto/eventrecord.proto
+func encodeObjectReferenceProto(p *protoBuffer, ref *v1.ObjectReference) {
+	p.string(1, ref.Kind)
+	p.string(2, ref.Namespace)
+	p.string(3, ref.Name)
+	p.string(4, string(ref.UID))
+	p.string(5, ref.APIVersion)
+	p.string(6, ref.ResourceVersion)
+	p.string(7, ref.FieldPath)
+}
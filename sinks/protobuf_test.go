@@ -0,0 +1,287 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// protoFieldRe matches the field declarations of proto/eventrecord.proto
+var protoFieldRe = regexp.MustCompile(`^(map<(\w+), (\w+)>|[\w.]+) (\w+) = (\d+);$`)
+
+// protoScalarTypes are the scalar types of the fields of the schema
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// eventRecordSchema parses proto/eventrecord.proto, for the tests to decode
+// the records with the schema the consumers use rather than with the encoder
+func eventRecordSchema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	b, err := ioutil.ReadFile("../proto/eventrecord.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("eventrecord.proto"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+	}
+	typeName := func(name string) string {
+		if strings.Contains(name, ".") {
+			return "." + name
+		}
+		return "." + file.GetPackage() + "." + name
+	}
+	field := func(name, typ string, number int32) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if scalar, ok := protoScalarTypes[typ]; ok {
+			f.Type = scalar.Enum()
+		} else {
+			f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+			f.TypeName = proto.String(typeName(typ))
+		}
+		return f
+	}
+
+	var msg *descriptorpb.DescriptorProto
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "syntax ") ||
+			strings.HasPrefix(line, "import ") || strings.HasPrefix(line, "option "):
+		case strings.HasPrefix(line, "package "):
+			file.Package = proto.String(strings.TrimSuffix(strings.TrimPrefix(line, "package "), ";"))
+		case strings.HasPrefix(line, "message ") && strings.HasSuffix(line, " {"):
+			msg = &descriptorpb.DescriptorProto{
+				Name: proto.String(strings.TrimSuffix(strings.TrimPrefix(line, "message "), " {")),
+			}
+			file.MessageType = append(file.MessageType, msg)
+		case line == "}":
+			msg = nil
+		case msg != nil && protoFieldRe.MatchString(line):
+			m := protoFieldRe.FindStringSubmatch(line)
+			number, _ := strconv.Atoi(m[5])
+			if m[2] == "" {
+				msg.Field = append(msg.Field, field(m[4], m[1], int32(number)))
+				break
+			}
+
+			// A map is a repeated field of an entry message of its own
+			entry := &descriptorpb.DescriptorProto{
+				Name:    proto.String(strings.Title(m[4]) + "Entry"),
+				Field:   []*descriptorpb.FieldDescriptorProto{field("key", m[2], 1), field("value", m[3], 2)},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}
+			msg.NestedType = append(msg.NestedType, entry)
+			f := field(m[4], msg.GetName()+"."+entry.GetName(), int32(number))
+			f.TypeName = proto.String(typeName(msg.GetName()) + "." + entry.GetName())
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			msg.Field = append(msg.Field, f)
+		default:
+			t.Fatalf("Unsupported line of the schema: %q", line)
+		}
+	}
+
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("Failed to build the schema: %v", err)
+	}
+	return fd
+}
+
+// decodeEventRecord decodes an EventRecord with the schema, returned as its
+// JSON mapping with the field names of the schema
+func decodeEventRecord(t *testing.T, schema protoreflect.FileDescriptor, b []byte) map[string]interface{} {
+	t.Helper()
+	record := dynamicpb.NewMessage(schema.Messages().ByName("EventRecord"))
+	if err := proto.Unmarshal(b, record); err != nil {
+		t.Fatalf("Failed to decode the EventRecord: %v", err)
+	}
+	if unknown := record.GetUnknown(); len(unknown) > 0 {
+		t.Errorf("Got %d bytes of fields unknown to the schema", len(unknown))
+	}
+
+	j, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(j, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestEventProtoRoundTrip(t *testing.T) {
+	schema := eventRecordSchema(t)
+
+	first := time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC)
+	last := first.Add(90*time.Second + 500*time.Millisecond)
+	old := newTestEvent("web-0.1")
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-0.1",
+			Namespace:       "default",
+			UID:             "uid-1",
+			ResourceVersion: "42",
+			ClusterName:     "prod",
+			Labels:          map[string]string{"app": "web", "tier": "frontend"},
+			Annotations:     map[string]string{"note": "test"},
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			Namespace:       "default",
+			Name:            "web-0",
+			UID:             "pod-uid",
+			APIVersion:      "v1",
+			ResourceVersion: "7",
+			FieldPath:       "spec.containers{web}",
+		},
+		Reason:              "BackOff",
+		Message:             "Back-off restarting failed container",
+		Type:                "Warning",
+		Count:               -1,
+		Source:              v1.EventSource{Component: "kubelet", Host: "node-1"},
+		FirstTimestamp:      metav1.NewTime(first),
+		LastTimestamp:       metav1.NewTime(last),
+		EventTime:           metav1.NewMicroTime(last),
+		Action:              "Restarting",
+		ReportingController: "kubelet",
+		ReportingInstance:   "node-1",
+		Related:             &v1.ObjectReference{Kind: "Node", Name: "node-1"},
+		Series:              &v1.EventSeries{Count: 3, LastObservedTime: metav1.NewMicroTime(last)},
+	}
+
+	got := decodeEventRecord(t, schema, marshalEventProto(EventData{
+		Verb:        "UPDATED",
+		Event:       event,
+		OldEvent:    old,
+		Repeated:    2,
+		DeliveryKey: "uid-1-42",
+	}))
+	want := map[string]interface{}{
+		"verb": "UPDATED",
+		"event": map[string]interface{}{
+			"name":             "web-0.1",
+			"namespace":        "default",
+			"uid":              "uid-1",
+			"resource_version": "42",
+			"cluster_name":     "prod",
+			"labels":           map[string]interface{}{"app": "web", "tier": "frontend"},
+			"annotations":      map[string]interface{}{"note": "test"},
+			"involved_object": map[string]interface{}{
+				"kind":             "Pod",
+				"namespace":        "default",
+				"name":             "web-0",
+				"uid":              "pod-uid",
+				"api_version":      "v1",
+				"resource_version": "7",
+				"field_path":       "spec.containers{web}",
+			},
+			"reason":                    "BackOff",
+			"message":                   "Back-off restarting failed container",
+			"type":                      "Warning",
+			"count":                     float64(-1),
+			"source_component":          "kubelet",
+			"source_host":               "node-1",
+			"first_timestamp":           "2020-05-17T10:00:00Z",
+			"last_timestamp":            "2020-05-17T10:01:30.500Z",
+			"event_time":                "2020-05-17T10:01:30.500Z",
+			"action":                    "Restarting",
+			"reporting_controller":      "kubelet",
+			"reporting_instance":        "node-1",
+			"related":                   map[string]interface{}{"kind": "Node", "name": "node-1"},
+			"series_count":              float64(3),
+			"series_last_observed_time": "2020-05-17T10:01:30.500Z",
+		},
+		"old_event": map[string]interface{}{
+			"name":      "web-0.1",
+			"namespace": "default",
+			"reason":    "Test",
+			"message":   "test event web-0.1",
+		},
+		"repeated":     float64(2),
+		"delivery_key": "uid-1-42",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got record %v, want %v", got, want)
+	}
+
+	// The fields with default values are left out
+	got = decodeEventRecord(t, schema, marshalEventProto(EventData{Verb: "DELETED", Event: &v1.Event{}}))
+	if want := map[string]interface{}{"verb": "DELETED"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got record %v for an empty event, want %v", got, want)
+	}
+}
+
+func TestEventProtoSeverity(t *testing.T) {
+	schema := eventRecordSchema(t)
+	previous := severities
+	defer func() { severities = previous }()
+
+	var err error
+	severities, err = newSeverityMapping(SeverityConfig{Reasons: map[string]string{"BackOff": "error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for reason, want := range map[string]string{"BackOff": "error", "Test": "info"} {
+		e := newTestEvent("test")
+		e.Reason = reason
+		got := decodeEventRecord(t, schema, marshalEventProto(NewEventData(e, nil)))
+		if got["severity"] != want {
+			t.Errorf("Got severity %v for reason %s, want %s", got["severity"], reason, want)
+		}
+	}
+
+	// Without severities the records have no severity
+	severities = nil
+	got := decodeEventRecord(t, schema, marshalEventProto(NewEventData(newTestEvent("test"), nil)))
+	if s, ok := got["severity"]; ok {
+		t.Errorf("Got severity %v without severities", s)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/golang/glog"
+	"google.golang.org/api/option"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// PubSubSink publishes JSON encoded events to a Google Cloud Pub/Sub topic.
+// Batching is left to the Pub/Sub client, which coalesces messages published
+// in quick succession into a single request.
+type PubSubSink struct {
+	eventOutput
+
+	client *pubsub.Client
+	topic  *pubsub.Topic
+	retry  RetryPolicy
+
+	// ordered tells whether messages carry an ordering key derived from the
+	// involved object UID, so that events for one object are delivered in order
+	ordered bool
+}
+
+// NewPubSubSink will create a new PubSubSink publishing to the given topic of
+// the given project. If credentialsFile is empty, Application Default
+// Credentials (e.g. Workload Identity) are used.
+func NewPubSubSink(project, topicID, credentialsFile string, ordered bool) (*PubSubSink, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	client, err := pubsub.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := client.Topic(topicID)
+	topic.EnableMessageOrdering = ordered
+
+	return &PubSubSink{
+		client:  client,
+		topic:   topic,
+		retry:   retryPolicy.forSink(),
+		ordered: ordered,
+	}, nil
+}
+
+// Close implements io.Closer, publishing the pending messages and closing
+// the client
+func (ps *PubSubSink) Close() error {
+	ps.topic.Stop()
+	return ps.client.Close()
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (ps *PubSubSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eData := NewEventData(eNew, eOld)
+
+	eJSONBytes, err := ps.encode(eData)
+	if err != nil {
+		glog.Errorf("Failed to json serialize event: %v", err)
+		return
+	}
+
+	attributes := map[string]string{
+		"namespace": eNew.InvolvedObject.Namespace,
+		"reason":    eNew.Reason,
+		"type":      eNew.Type,
+		"verb":      eData.Verb,
+	}
+	var orderingKey string
+	if ps.ordered {
+		orderingKey = string(eNew.InvolvedObject.UID)
+	}
+
+	go func() {
+		err := ps.retry.Do(func() error {
+			// A message is only published once, each attempt gets its own
+			res := ps.topic.Publish(context.Background(), &pubsub.Message{
+				Data:        eJSONBytes,
+				Attributes:  attributes,
+				OrderingKey: orderingKey,
+			})
+			_, err := res.Get(context.Background())
+			if err != nil && orderingKey != "" {
+				// Publishing for a key is paused after a failure so that
+				// ordering is not violated, resume it so the retries and
+				// later events still go through
+				ps.topic.ResumePublish(orderingKey)
+			}
+			return err
+		})
+		if err != nil {
+			glog.Errorf("Failed to publish event to topic(%s): %v", ps.topic.ID(), err)
+			deadLetterEvents("pubsub", []EventData{eData}, err)
+		}
+	}()
+}
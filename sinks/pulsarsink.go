@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"context"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// PulsarConfig holds the settings of the PulsarSink
+type PulsarConfig struct {
+	// URL is the Pulsar service URL, e.g. pulsar+ssl://broker:6651
+	URL   string
+	Topic string
+
+	// Token or TokenFile enable token authentication
+	Token     string
+	TokenFile string
+
+	// TLSCertFile and TLSKeyFile enable TLS client certificate authentication
+	TLSCertFile string
+	TLSKeyFile  string
+
+	TLSTrustCertsFile   string
+	TLSAllowInsecure    bool
+	TLSValidateHostname bool
+
+	// Batching settings of the producer
+	DisableBatching         bool
+	BatchingMaxMessages     uint
+	BatchingMaxPublishDelay time.Duration
+}
+
+// PulsarSink publishes JSON encoded events to an Apache Pulsar topic. The
+// message key is the involved object UID, so key based subscriptions and
+// compacted topics see the events of one object together.
+type PulsarSink struct {
+	eventOutput
+
+	topic    string
+	client   pulsar.Client
+	producer pulsar.Producer
+	retry    RetryPolicy
+}
+
+// NewPulsarSink will create a new PulsarSink given its config
+func NewPulsarSink(cfg PulsarConfig) (*PulsarSink, error) {
+	opts := pulsar.ClientOptions{
+		URL:                        cfg.URL,
+		TLSTrustCertsFilePath:      cfg.TLSTrustCertsFile,
+		TLSAllowInsecureConnection: cfg.TLSAllowInsecure,
+		TLSValidateHostname:        cfg.TLSValidateHostname,
+	}
+	switch {
+	case cfg.Token != "":
+		opts.Authentication = pulsar.NewAuthenticationToken(cfg.Token)
+	case cfg.TokenFile != "":
+		opts.Authentication = pulsar.NewAuthenticationTokenFromFile(cfg.TokenFile)
+	case cfg.TLSCertFile != "":
+		opts.Authentication = pulsar.NewAuthenticationTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+
+	client, err := pulsar.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := client.CreateProducer(pulsar.ProducerOptions{
+		Topic:                   cfg.Topic,
+		DisableBatching:         cfg.DisableBatching,
+		BatchingMaxMessages:     cfg.BatchingMaxMessages,
+		BatchingMaxPublishDelay: cfg.BatchingMaxPublishDelay,
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &PulsarSink{
+		topic:    cfg.Topic,
+		client:   client,
+		producer: producer,
+		retry:    retryPolicy.forSink(),
+	}, nil
+}
+
+// Close implements io.Closer, flushing and closing the producer and the
+// client
+func (ps *PulsarSink) Close() error {
+	err := ps.producer.Flush()
+	ps.producer.Close()
+	ps.client.Close()
+	return err
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (ps *PulsarSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eData := NewEventData(eNew, eOld)
+
+	eJSONBytes, err := ps.encode(eData)
+	if err != nil {
+		glog.Errorf("Failed to json serialize event: %v", err)
+		return
+	}
+
+	msg := &pulsar.ProducerMessage{
+		Payload:   eJSONBytes,
+		Key:       string(eNew.InvolvedObject.UID),
+		EventTime: eventTimestamp(eNew),
+		Properties: map[string]string{
+			"namespace": eNew.InvolvedObject.Namespace,
+			"reason":    eNew.Reason,
+			"type":      eNew.Type,
+		},
+	}
+
+	ps.retry.start()
+	ps.send(msg, eData, 1)
+}
+
+// send sends the message of the event, sending it again with the retry
+// policy on failure, the attempt counting from 1
+func (ps *PulsarSink) send(msg *pulsar.ProducerMessage, eData EventData, attempt int) {
+	ps.producer.SendAsync(context.Background(), msg, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		if err == nil {
+			return
+		}
+		if backoff, ok := ps.retry.next(attempt); ok {
+			time.AfterFunc(backoff, func() { ps.send(msg, eData, attempt+1) })
+			return
+		}
+		glog.Errorf("Failed to send event to topic(%s): %v", ps.topic, err)
+		deadLetterEvents("pulsar", []EventData{eData}, err)
+	})
+}
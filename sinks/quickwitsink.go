@@ -0,0 +1,236 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// QuickwitConfig holds the settings of the QuickwitSink
+type QuickwitConfig struct {
+	// URL is the base URL of a Quickwit node, e.g. http://quickwit:7280
+	URL string
+
+	// Index is the index ID, the eventKeyFields in braces are replaced by
+	// their value, e.g. "k8s-events-{namespace}"
+	Index string
+
+	// Commit is the commit behavior of the ingest requests: auto, wait_for
+	// or force
+	Commit string
+
+	// Token, when set, is sent as bearer token, for Quickwit behind an
+	// authenticating proxy
+	Token string
+
+	BatchSize int
+}
+
+// quickwitDocument is the document indexed for an event
+type quickwitDocument struct {
+	Timestamp       string    `json:"timestamp"`
+	Verb            string    `json:"verb"`
+	Type            string    `json:"type"`
+	Reason          string    `json:"reason"`
+	Message         string    `json:"message"`
+	Count           int32     `json:"count"`
+	Namespace       string    `json:"namespace"`
+	Kind            string    `json:"kind"`
+	Name            string    `json:"name"`
+	UID             string    `json:"uid"`
+	SourceComponent string    `json:"source_component"`
+	SourceHost      string    `json:"source_host"`
+	Event           *v1.Event `json:"event"`
+}
+
+/*
+QuickwitSink indexes events in Quickwit with the ingest API:
+
+POST <url>/api/v1/<index>/ingest?commit=auto
+
+The documents carry the key event fields at the top level, with the time of
+the last occurrence in timestamp (to be used as the timestamp_field of the
+index), and the whole event under event. The index ID may be templated on
+the event, the events of one batch are then sent with one request per index.
+Events buffered between two loop iterations are sent in batches of up to
+BatchSize documents.
+*/
+type QuickwitSink struct {
+	cfg        QuickwitConfig
+	baseURL    string
+	httpClient *retryClient
+	eventCh    channels.Channel
+}
+
+// NewQuickwitSink constructs a new QuickwitSink given its config
+func NewQuickwitSink(cfg QuickwitConfig, overflow bool, bufferSize int) (*QuickwitSink, error) {
+	switch cfg.Commit {
+	case "auto", "wait_for", "force":
+	default:
+		return nil, fmt.Errorf("invalid quickwit commit %q, must be auto, wait_for or force", cfg.Commit)
+	}
+
+	q := &QuickwitSink{
+		cfg:     cfg,
+		baseURL: strings.TrimSuffix(cfg.URL, "/"),
+	}
+
+	q.httpClient = retryPolicy.forSink().httpClient()
+
+	if overflow {
+		q.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		q.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return q, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (q *QuickwitSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	q.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through q.eventCh, and
+// ingesting them into Quickwit. If multiple events have happened between loop
+// iterations, they are sent BatchSize documents at a time.
+func (q *QuickwitSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-q.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := q.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-q.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, q.cfg.BatchSize, q.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(q.eventCh), q.cfg.BatchSize, q.drainEvents)
+			break loop
+		}
+	}
+}
+
+// quickwitDoc converts an event to a Quickwit document
+func quickwitDoc(evt EventData) quickwitDocument {
+	e := evt.Event
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return quickwitDocument{
+		Timestamp:       ts.UTC().Format(time.RFC3339Nano),
+		Verb:            evt.Verb,
+		Type:            e.Type,
+		Reason:          e.Reason,
+		Message:         e.Message,
+		Count:           e.Count,
+		Namespace:       e.InvolvedObject.Namespace,
+		Kind:            e.InvolvedObject.Kind,
+		Name:            e.InvolvedObject.Name,
+		UID:             string(e.UID),
+		SourceComponent: e.Source.Component,
+		SourceHost:      e.Source.Host,
+		Event:           e,
+	}
+}
+
+// drainEvents groups the events by index and ingests each group with one
+// NDJSON request
+func (q *QuickwitSink) drainEvents(events []EventData) {
+	bodies := map[string]*bytes.Buffer{}
+	groups := map[string][]EventData{}
+	for _, evt := range events {
+		index := expandEventTemplate(q.cfg.Index, evt.Event)
+		body, ok := bodies[index]
+		if !ok {
+			body = &bytes.Buffer{}
+			bodies[index] = body
+		}
+		// Encode writes one JSON object per line, as the ingest API expects
+		if err := json.NewEncoder(body).Encode(quickwitDoc(evt)); err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		groups[index] = append(groups[index], evt)
+	}
+
+	for index, body := range bodies {
+		if err := q.ingest(index, body); err != nil {
+			glog.Errorf("Failed to ingest %d events into quickwit index %s: %v", len(groups[index]), index, err)
+			deadLetterEvents("quickwit", groups[index], err)
+		}
+	}
+}
+
+// ingest sends the documents to the ingest API of the index
+func (q *QuickwitSink) ingest(index string, body *bytes.Buffer) error {
+	u := fmt.Sprintf("%s/api/v1/%s/ingest?commit=%s", q.baseURL, url.PathEscape(index), q.cfg.Commit)
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if q.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+q.cfg.Token)
+	}
+
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
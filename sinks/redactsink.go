@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// redactDefaultReplacement replaces the redacted values by default
+const redactDefaultReplacement = "[REDACTED]"
+
+// RedactionConfig is a redaction rule. Fields are paths in the event JSON,
+// e.g. message, $.metadata.annotations or involvedObject.name, with * for
+// any key or element; the strings under a field that is an object or an
+// array are all redacted.
+type RedactionConfig struct {
+	// Pattern is the regular expression of the values redacted, the whole
+	// values by default
+	Pattern string `mapstructure:"pattern"`
+	// Replacement replaces the matches, with $1 for the submatches,
+	// [REDACTED] by default
+	Replacement string   `mapstructure:"replacement"`
+	Fields      []string `mapstructure:"fields"`
+}
+
+// redactRule is a parsed RedactionConfig
+type redactRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	fields      [][]string
+}
+
+/*
+RedactSink masks the secrets and identifiers the controllers leak into the
+events, e.g. bearer tokens, connection strings or customer ids in the
+messages, before they are handed to the sinks. The rules apply in order to
+the new and old events, on copies; all the fields but message are redacted on
+the JSON of the event, which is decoded back.
+*/
+type RedactSink struct {
+	sink  EventSinkInterface
+	rules []redactRule
+
+	// messageOnly is true when the rules only redact the message
+	messageOnly bool
+}
+
+// NewRedactSink creates a RedactSink in front of sink, failing on invalid
+// rules
+func NewRedactSink(sink EventSinkInterface, cfgs []RedactionConfig) (*RedactSink, error) {
+	r := &RedactSink{sink: sink, messageOnly: true}
+	for i, cfg := range cfgs {
+		rule := redactRule{replacement: cfg.Replacement}
+		if rule.replacement == "" {
+			rule.replacement = redactDefaultReplacement
+		}
+		if cfg.Pattern != "" {
+			re, err := regexp.Compile(cfg.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern of redaction %d: %v", i, err)
+			}
+			rule.pattern = re
+		}
+		fields := cfg.Fields
+		if len(fields) == 0 {
+			fields = []string{"message"}
+		}
+		for _, f := range fields {
+			path := strings.Split(strings.TrimPrefix(strings.TrimPrefix(f, "$"), "."), ".")
+			for _, k := range path {
+				if k == "" {
+					return nil, fmt.Errorf("invalid field %q of redaction %d", f, i)
+				}
+			}
+			if len(path) != 1 || path[0] != "message" {
+				r.messageOnly = false
+			}
+			rule.fields = append(rule.fields, path)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (r *RedactSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eNew = r.redact(eNew)
+	if eOld != nil {
+		eOld = r.redact(eOld)
+	}
+	r.sink.UpdateEvents(eNew, eOld)
+}
+
+// redact returns a copy of the event with the rules applied
+func (r *RedactSink) redact(e *v1.Event) *v1.Event {
+	if r.messageOnly {
+		e = e.DeepCopy()
+		for _, rule := range r.rules {
+			e.Message = rule.apply(e.Message)
+		}
+		return e
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return e
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		glog.Warningf("Failed to json deserialize event: %v", err)
+		return e
+	}
+	for _, rule := range r.rules {
+		for _, path := range rule.fields {
+			doc = rule.redactPath(doc, path)
+		}
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return e
+	}
+	redacted := &v1.Event{}
+	if err := json.Unmarshal(b, redacted); err != nil {
+		// A rule replaced a value that must be parsed, e.g. a timestamp
+		glog.Warningf("Failed to decode the redacted event %s/%s, dropping its fields: %v", e.Namespace, e.Name, err)
+		return &v1.Event{ObjectMeta: *e.ObjectMeta.DeepCopy(), InvolvedObject: e.InvolvedObject, Reason: e.Reason, Type: e.Type}
+	}
+	return redacted
+}
+
+// redactPath redacts the strings under the path of the value
+func (rule redactRule) redactPath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return rule.redactAll(v)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			for k, child := range v {
+				v[k] = rule.redactPath(child, path[1:])
+			}
+		} else if child, ok := v[path[0]]; ok {
+			v[path[0]] = rule.redactPath(child, path[1:])
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for i, child := range v {
+				v[i] = rule.redactPath(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// redactAll redacts the strings of the value
+func (rule redactRule) redactAll(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return rule.apply(v)
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = rule.redactAll(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rule.redactAll(child)
+		}
+	}
+	return v
+}
+
+// apply redacts the string
+func (rule redactRule) apply(s string) string {
+	if rule.pattern == nil {
+		if s == "" {
+			return s
+		}
+		return rule.replacement
+	}
+	return rule.pattern.ReplaceAllString(s, rule.replacement)
+}
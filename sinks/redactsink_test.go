@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// redactTestEvent returns an event leaking secrets in its message, labels,
+// annotations and owner references
+func redactTestEvent() *v1.Event {
+	e := newTestEvent("web-0.1")
+	e.Message = "Failed to pull: Bearer abc123 token=s3cr3t"
+	e.Labels = map[string]string{"customer": "acme", "app": "web"}
+	e.Annotations = map[string]string{"dsn": "postgres://user:pw@db", "url": "https://example.com"}
+	e.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "acme-web"}}
+	e.InvolvedObject = v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "acme-web-0"}
+	return e
+}
+
+// redactSink creates a RedactSink in front of a recordingSink
+func redactSink(t *testing.T, cfgs ...RedactionConfig) (*RedactSink, *recordingSink) {
+	t.Helper()
+	sink := &recordingSink{}
+	r, err := NewRedactSink(sink, cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, sink
+}
+
+func TestRedactSinkPatterns(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		rules []RedactionConfig
+		want  string
+	}{
+		{
+			name:  "whole message",
+			rules: []RedactionConfig{{}},
+			want:  "[REDACTED]",
+		},
+		{
+			name:  "pattern",
+			rules: []RedactionConfig{{Pattern: `Bearer \S+`}},
+			want:  "Failed to pull: [REDACTED] token=s3cr3t",
+		},
+		{
+			name:  "replacement with submatches",
+			rules: []RedactionConfig{{Pattern: `(token|Bearer)[= ]\S+`, Replacement: "$1=***"}},
+			want:  "Failed to pull: Bearer=*** token=***",
+		},
+		{
+			name: "rules in order",
+			rules: []RedactionConfig{
+				{Pattern: `s3cr3t`, Replacement: "abc123"},
+				{Pattern: `abc123`, Replacement: "***"},
+			},
+			want: "Failed to pull: Bearer *** token=***",
+		},
+		{
+			name:  "no match",
+			rules: []RedactionConfig{{Pattern: `password=\S+`}},
+			want:  "Failed to pull: Bearer abc123 token=s3cr3t",
+		},
+	} {
+		r, sink := redactSink(t, test.rules...)
+		r.UpdateEvents(redactTestEvent(), nil)
+		if got := sink.updates[0].Message; got != test.want {
+			t.Errorf("Got message %q with the %s, want %q", got, test.name, test.want)
+		}
+	}
+
+	// The empty messages stay empty
+	r, sink := redactSink(t, RedactionConfig{})
+	r.UpdateEvents(newTestEvent("a"), nil)
+	e := newTestEvent("b")
+	e.Message = ""
+	r.UpdateEvents(e, nil)
+	if got := sink.updates[1].Message; got != "" {
+		t.Errorf("Got message %q for an empty message, want it empty", got)
+	}
+}
+
+func TestRedactSinkNestedFields(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		fields []string
+		check  func(e *v1.Event) bool
+	}{
+		{
+			name:   "object",
+			fields: []string{"metadata.annotations"},
+			check: func(e *v1.Event) bool {
+				return reflect.DeepEqual(e.Annotations, map[string]string{"dsn": "[REDACTED]", "url": "[REDACTED]"})
+			},
+		},
+		{
+			name:   "key of an object",
+			fields: []string{"$.metadata.labels.customer"},
+			check: func(e *v1.Event) bool {
+				return reflect.DeepEqual(e.Labels, map[string]string{"customer": "[REDACTED]", "app": "web"})
+			},
+		},
+		{
+			name:   "any key",
+			fields: []string{"metadata.labels.*"},
+			check: func(e *v1.Event) bool {
+				return reflect.DeepEqual(e.Labels, map[string]string{"customer": "[REDACTED]", "app": "[REDACTED]"})
+			},
+		},
+		{
+			name:   "any element",
+			fields: []string{"metadata.ownerReferences.*.name"},
+			check: func(e *v1.Event) bool {
+				return e.OwnerReferences[0].Name == "[REDACTED]" && e.OwnerReferences[0].Kind == "ReplicaSet"
+			},
+		},
+		{
+			name:   "nested string",
+			fields: []string{".involvedObject.name"},
+			check: func(e *v1.Event) bool {
+				return e.InvolvedObject.Name == "[REDACTED]" && e.InvolvedObject.Kind == "Pod"
+			},
+		},
+		{
+			name:   "missing field",
+			fields: []string{"metadata.annotations.missing", "related.name"},
+			check: func(e *v1.Event) bool {
+				return reflect.DeepEqual(e, redactTestEvent())
+			},
+		},
+	} {
+		r, sink := redactSink(t, RedactionConfig{Fields: test.fields})
+		r.UpdateEvents(redactTestEvent(), nil)
+		e := sink.updates[0]
+		if !test.check(e) {
+			t.Errorf("Got event %+v redacting the %s, want it redacted", e, test.name)
+		}
+		if e.Message != redactTestEvent().Message {
+			t.Errorf("Got message %q redacting the %s, want it unchanged", e.Message, test.name)
+		}
+	}
+
+	// A pattern applies to the strings under the field
+	r, sink := redactSink(t, RedactionConfig{Pattern: `acme`, Replacement: "customer", Fields: []string{"metadata", "involvedObject"}})
+	r.UpdateEvents(redactTestEvent(), nil)
+	e := sink.updates[0]
+	if e.Labels["customer"] != "customer" || e.OwnerReferences[0].Name != "customer-web" || e.InvolvedObject.Name != "customer-web-0" {
+		t.Errorf("Got event %+v, want acme replaced under metadata and involvedObject", e)
+	}
+
+	for _, field := range []string{"", "metadata..name", "$."} {
+		if _, err := NewRedactSink(&recordingSink{}, []RedactionConfig{{Fields: []string{field}}}); err == nil {
+			t.Errorf("Got no error for the field %q", field)
+		}
+	}
+	if _, err := NewRedactSink(&recordingSink{}, []RedactionConfig{{Pattern: "("}}); err == nil {
+		t.Errorf("Got no error for an invalid pattern")
+	}
+}
+
+func TestRedactSinkDoesNotMutateTheInput(t *testing.T) {
+	for name, rules := range map[string][]RedactionConfig{
+		"message": {{Pattern: `Bearer \S+`}},
+		"fields":  {{Fields: []string{"message", "metadata.labels", "metadata.ownerReferences.*.name"}}},
+	} {
+		r, sink := redactSink(t, rules...)
+		eNew, eOld := redactTestEvent(), redactTestEvent()
+		eOld.Message = "Pulling: Bearer abc123"
+		want := eOld.DeepCopy()
+		r.UpdateEvents(eNew, eOld)
+
+		if !reflect.DeepEqual(eNew, redactTestEvent()) {
+			t.Errorf("Got the new event mutated redacting the %s: %+v", name, eNew)
+		}
+		if !reflect.DeepEqual(eOld, want) {
+			t.Errorf("Got the old event mutated redacting the %s: %+v", name, eOld)
+		}
+		if sink.updates[0] == eNew || sink.olds[0] == eOld {
+			t.Errorf("Got the input events handed to the sink redacting the %s", name)
+		}
+		if got := sink.olds[0].Message; got == eOld.Message {
+			t.Errorf("Got old message %q redacting the %s, want it redacted", got, name)
+		}
+	}
+}
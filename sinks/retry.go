@@ -0,0 +1,285 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryBudgetMaxTokens is the number of retries a budget starts with and
+// saves up to, allowing bursts of failures
+const retryBudgetMaxTokens = 100
+
+// RetryPolicy retries the failed operations of the sinks with exponential
+// backoff and full jitter. The zero value doesn't retry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, the first one included
+	MaxAttempts int
+
+	// MinBackoff is the backoff cap of the first retry, doubled on each
+	// retry up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Budget, when set, bounds the retries to a share of the operations, so a
+	// failing backend doesn't get a multiple of the load
+	Budget *RetryBudget
+}
+
+// retryPolicy is the retry policy of the sinks without one of their own. It
+// is set by ManufactureSink.
+var retryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+}
+
+// permanentError is an error not worth retrying
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent marks an error as not worth retrying, e.g. a rejected request
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// retryAfterError is an error to retry after a delay, e.g. asked by the
+// backend
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// retryAfter marks an error to be retried after at least delay, capped to
+// the MaxBackoff of the policy, e.g. from a Retry-After header
+func retryAfter(err error, delay time.Duration) error {
+	if delay <= 0 {
+		return err
+	}
+	return retryAfterError{err: err, delay: delay}
+}
+
+// forSink returns the policy for a sink, with a budget of its own
+func (p RetryPolicy) forSink() RetryPolicy {
+	if p.Budget != nil {
+		p.Budget = NewRetryBudget(p.Budget.ratio, p.Budget.maxTokens)
+	}
+	return p
+}
+
+// withRetries returns the policy with the given number of retries after the
+// first attempt, for the sinks configuring their retries
+func (p RetryPolicy) withRetries(retries int) RetryPolicy {
+	if retries < 0 {
+		retries = 0
+	}
+	p.MaxAttempts = retries + 1
+	return p
+}
+
+// Backoff returns the delay before the given retry, from 0: a random delay up
+// to MinBackoff << retry, capped to MaxBackoff
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := p.MinBackoff << uint(retry)
+	if backoff > p.MaxBackoff || backoff <= 0 {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// httpClient returns an http client retrying with the policy
+func (p RetryPolicy) httpClient() *retryClient {
+	return &retryClient{Client: &http.Client{}, policy: p}
+}
+
+// retryClient is an http.Client retrying the requests failing with a
+// transport error or a 5xx, and with a 429 when RetryOnHTTP429 is set, with
+// its retry policy
+type retryClient struct {
+	*http.Client
+	RetryOnHTTP429 bool
+
+	policy RetryPolicy
+}
+
+// Do sends the request, retrying it with the policy, and returns the last
+// response if any
+func (c *retryClient) Do(req *http.Request) (*http.Response, error) {
+	// The body is sent again on each attempt
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	var resp *http.Response
+	err := c.policy.Do(func() error {
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			resp = nil
+		}
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		r, err := c.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp = r
+		if r.StatusCode >= 500 || (c.RetryOnHTTP429 && r.StatusCode == http.StatusTooManyRequests) {
+			return fmt.Errorf("got HTTP code %v", r.StatusCode)
+		}
+		return nil
+	})
+	if resp != nil {
+		// The caller handles the status of the last response
+		return resp, nil
+	}
+	return nil, err
+}
+
+// Post sends a POST request, retrying it with the policy
+func (c *retryClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do calls fn until it succeeds, returns a permanent error, the attempts are
+// exhausted or the budget is spent, and returns its last error
+func (p RetryPolicy) Do(fn func() error) error {
+	p.start()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if perm, ok := err.(permanentError); ok {
+			return perm.err
+		}
+		if attempt >= p.MaxAttempts {
+			if attempt > 1 {
+				return fmt.Errorf("%v (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+		if p.Budget != nil && !p.Budget.withdraw() {
+			return fmt.Errorf("%v (retry budget exhausted)", err)
+		}
+		delay := p.Backoff(attempt - 1)
+		if ra, ok := err.(retryAfterError); ok && ra.delay > delay {
+			delay = ra.delay
+			if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+				delay = p.MaxBackoff
+			}
+		}
+		time.Sleep(delay)
+	}
+}
+
+// start counts an operation in the budget, for the operations retried with
+// next
+func (p RetryPolicy) start() {
+	if p.Budget != nil {
+		p.Budget.deposit()
+	}
+}
+
+// next returns the backoff before retrying an operation after its failed
+// attempt, from 1, or false when the attempts are exhausted or the budget is
+// spent. It is for the operations that can't wait in Do, e.g. retried from a
+// completion callback.
+func (p RetryPolicy) next(attempt int) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if p.Budget != nil && !p.Budget.withdraw() {
+		return 0, false
+	}
+	return p.Backoff(attempt - 1), true
+}
+
+/*
+RetryBudget bounds the retries to a ratio of the operations: each operation
+earns Ratio retry tokens, up to MaxTokens, and each retry spends one. When a
+backend fails all the requests, it only gets Ratio more of them than when
+healthy, instead of MaxAttempts times as many.
+*/
+type RetryBudget struct {
+	ratio     float64
+	maxTokens float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget creates a full RetryBudget
+func NewRetryBudget(ratio float64, maxTokens float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:     ratio,
+		maxTokens: maxTokens,
+		tokens:    maxTokens,
+	}
+}
+
+// deposit earns the tokens of an operation
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+// withdraw spends the token of a retry, returning false when there is none
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -17,54 +17,204 @@ limitations under the License.
 package sinks
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
 
-	apiclient "github.com/rockset/rockset-go-client"
-	models "github.com/rockset/rockset-go-client/lib/go"
 	v1 "k8s.io/api/core/v1"
 )
 
+// RocksetConfig holds the settings of the RocksetSink
+type RocksetConfig struct {
+	// APIServer is the regional API server, e.g. https://api.usw2a1.rockset.com
+	APIServer string
+	APIKey    string
+
+	Workspace  string
+	Collection string
+
+	BatchSize int
+}
+
 /*
 RocksetSink is a sink that uploads the kubernetes events as json object
 and converts them to documents inside of a Rockset collection.
 
 Rockset can later be used with
 many different connectors such as Tableau or Redash to use this data.
+
+The documents are added with the document ingestion endpoint:
+
+POST <api server>/v1/orgs/self/ws/<workspace>/collections/<collection>/docs
+
+The _id of a document is the event UID, so the updates of an event replace
+its document instead of adding one per update, and _event_time is the time of
+its last occurrence. Events buffered between two loop iterations are written
+in batches of up to BatchSize documents.
 */
 type RocksetSink struct {
-	client                *apiclient.RockClient
-	rocksetCollectionName string
-	rocksetWorkspaceName  string
+	cfg        RocksetConfig
+	url        string
+	httpClient *retryClient
+	eventCh    channels.Channel
 }
 
-// NewRocksetSink will create a new RocksetSink with default options, returned as
-// an EventSinkInterface
-func NewRocksetSink(rocksetAPIKey string, rocksetCollectionName string, rocksetWorkspaceName string) EventSinkInterface {
-	client := apiclient.Client(rocksetAPIKey, "https://api.rs2.usw2.rockset.com")
-	return &RocksetSink{
-		client:                client,
-		rocksetCollectionName: rocksetCollectionName,
-		rocksetWorkspaceName:  rocksetWorkspaceName,
+// NewRocksetSink will create a new RocksetSink given its config
+func NewRocksetSink(cfg RocksetConfig, overflow bool, bufferSize int) *RocksetSink {
+	rs := &RocksetSink{
+		cfg: cfg,
+		url: fmt.Sprintf("%s/v1/orgs/self/ws/%s/collections/%s/docs",
+			strings.TrimSuffix(cfg.APIServer, "/"), url.PathEscape(cfg.Workspace), url.PathEscape(cfg.Collection)),
 	}
+
+	rs.httpClient = retryPolicy.forSink().httpClient()
+	rs.httpClient.RetryOnHTTP429 = true
+
+	if overflow {
+		rs.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		rs.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return rs
 }
 
-// UpdateEvents implements the EventSinkInterface
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
 func (rs *RocksetSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
-	eData := NewEventData(eNew, eOld)
+	// The documents of the events are updated in place
+	rs.eventCh.In() <- NewEventData(eNew, eOld).inPlace(eNew)
+}
+
+// Run sits in a loop, waiting for data to come in through rs.eventCh, and
+// adding them to the collection. If multiple events have happened between
+// loop iterations, they are written BatchSize documents at a time.
+func (rs *RocksetSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-rs.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := rs.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-rs.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, rs.cfg.BatchSize, rs.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(rs.eventCh), rs.cfg.BatchSize, rs.drainEvents)
+			break loop
+		}
+	}
+}
 
-	if eJSONBytes, err := json.Marshal(eData); err == nil {
-		var m map[string]interface{}
-		json.Unmarshal(eJSONBytes, &m)
-		docs := []interface{}{
-			m,
+// rocksetDocument converts an event to a Rockset document: the event data
+// fields with the _id and _event_time fields added
+func rocksetDocument(evt EventData) (map[string]interface{}, error) {
+	eJSONBytes, err := json.Marshal(evt)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(eJSONBytes, &doc); err != nil {
+		return nil, err
+	}
+
+	e := evt.Event
+	if e.UID != "" {
+		doc["_id"] = string(e.UID)
+	}
+	ts := eventTimestamp(e)
+	if !ts.IsZero() {
+		// _event_time may be given in microseconds since the epoch
+		doc["_event_time"] = ts.UnixNano() / 1000
+	}
+	return doc, nil
+}
+
+// drainEvents adds a batch of events to the collection, dead-lettering them
+// on failure
+func (rs *RocksetSink) drainEvents(events []EventData) {
+	if err := rs.addDocuments(events); err != nil {
+		glog.Errorf("Failed to add %d events to rockset collection %s.%s: %v", len(events), rs.cfg.Workspace, rs.cfg.Collection, err)
+		deadLetterEvents("rockset", events, err)
+	}
+}
+
+// addDocuments adds the events to the collection with one request
+func (rs *RocksetSink) addDocuments(events []EventData) error {
+	docs := make([]interface{}, 0, len(events))
+	for _, evt := range events {
+		doc, err := rocksetDocument(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
 		}
-		dinfo := models.AddDocumentsRequest{
-			Data: docs,
+		docs = append(docs, doc)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"data": docs})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", rs.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "ApiKey "+rs.cfg.APIKey)
+
+	resp, err := rs.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	// Documents may be rejected one by one in a 200 response
+	var result struct {
+		Data []struct {
+			Status string `json:"status"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &result); err == nil {
+		for _, status := range result.Data {
+			if status.Status == "ERROR" && status.Error != nil {
+				glog.Warningf("Rockset rejected a document: %s", status.Error.Message)
+			}
 		}
-		rs.client.Documents.Add(rs.rocksetWorkspaceName, rs.rocksetCollectionName, dinfo)
-	} else {
-		fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+// AddSink adds the sink named name, of the sink type s, to the sinks
+// manufactured by ManufactureSink, replacing the sink of the same name. The
+// settings are configuration keys of the sink, e.g. {"httpSinkUrl":
+// "https://..."} for an http sink, the keys missing falling back to the
+// configuration.
+func AddSink(name, s string, settings map[string]interface{}) error {
+	return addSink(name, s, runtimeConfig(settings, ""))
+}
+
+// AddTenantSink adds a sink like AddSink, but the keys of its sink type
+// missing from the settings take their defaults rather than the
+// configuration, so the sink of a tenant doesn't get the credentials of the
+// configured sink of its type, e.g. httpSinkBearerToken.
+func AddTenantSink(name, s string, settings map[string]interface{}) error {
+	return addSink(name, s, runtimeConfig(settings, s))
+}
+
+// addSink adds the sink named name, of the sink type s, from the
+// configuration v
+func addSink(name, s string, v *viper.Viper) (err error) {
+	if routedSinks == nil {
+		return errors.New("no sinks manufactured")
+	}
+
+	// The sinks panic on their invalid configuration
+	stop := make(chan bool)
+	defer func() {
+		if r := recover(); r != nil {
+			close(stop)
+			err = fmt.Errorf("invalid sink %s of type %s: %v", name, s, r)
+		}
+	}()
+
+	v.SetDefault("eventTypes", []string{})
+	route := manufactureRoute(v, name, s, v.GetStringSlice("eventTypes"), stop)
+	route.Stop = stop
+	if err := routedSinks.AddRoute(route); err != nil {
+		close(stop)
+		return err
+	}
+	glog.Infof("Sink %s is [%v]", name, s)
+	return nil
+}
+
+// runtimeConfig returns a private configuration of the settings over the
+// configuration, for the sinks added while running: the configuration is
+// only read, as the handlers read it concurrently. The keys of the
+// configuration starting with isolated, a sink type, are left out.
+func runtimeConfig(settings map[string]interface{}, isolated string) *viper.Viper {
+	v := viper.New()
+	// The keys of viper are lower case
+	prefix := strings.ToLower(isolated)
+	for _, k := range viper.AllKeys() {
+		if prefix != "" && strings.HasPrefix(k, prefix) {
+			continue
+		}
+		// Set rather than defaulted, the defaults of the sink would
+		// override the configuration
+		v.Set(k, viper.Get(k))
+	}
+	for k, value := range settings {
+		v.Set(k, value)
+	}
+	return v
+}
+
+// RemoveSink removes the sink named name, added by AddSink, stopping it. It
+// returns false if there is no such sink.
+func RemoveSink(name string) bool {
+	if routedSinks == nil {
+		return false
+	}
+	if !routedSinks.RemoveRoute(name) {
+		return false
+	}
+	glog.Infof("Sink %s removed", name)
+	return true
+}
+
+// SetEventRoute sets the rule named name, routing the events it matches to
+// the sinks named, e.g. added by AddSink, in place of the routing rules of
+// their configuration. The sinks added later are routed by the rule too.
+func SetEventRoute(name string, sinks []string, rule EventRule) error {
+	if routedSinks == nil {
+		return errors.New("no sinks manufactured")
+	}
+	routedSinks.SetRule(name, sinks, rule)
+	glog.Infof("Event route %s to sinks %v", name, sinks)
+	return nil
+}
+
+// RemoveEventRoute removes the rule named name, set by SetEventRoute. It
+// returns false if there is no such rule.
+func RemoveEventRoute(name string) bool {
+	if routedSinks == nil {
+		return false
+	}
+	if !routedSinks.RemoveRule(name) {
+		return false
+	}
+	glog.Infof("Event route %s removed", name)
+	return true
+}
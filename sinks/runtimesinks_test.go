@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// runtimeSink returns the sink named name of the routed sinks
+func runtimeSink(t *testing.T, name string) EventSinkInterface {
+	t.Helper()
+	routedSinks.mu.RLock()
+	defer routedSinks.mu.RUnlock()
+	for _, w := range routedSinks.workers {
+		if w.Name == name {
+			return w.Sink
+		}
+	}
+	t.Fatalf("No sink %s", name)
+	return nil
+}
+
+func TestTenantSinkDoesNotInheritTheConfiguration(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("httpSinkUrl", "https://admin.example.com")
+	viper.Set("httpSinkBearerToken", "admin-token")
+	viper.Set("httpSinkPassword", "admin-password")
+	viper.Set("httpSinkHMACSecret", "admin-secret")
+
+	m, err := NewMultiSink(nil, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := routedSinks
+	routedSinks = m
+	defer func() { routedSinks = saved }()
+
+	settings := map[string]interface{}{"httpSinkUrl": "https://tenant.example.com"}
+	for _, tc := range []struct {
+		name  string
+		add   func(name, s string, settings map[string]interface{}) error
+		token string
+	}{
+		{"kube-system/audit", AddSink, "admin-token"},
+		{"team-a/audit", AddTenantSink, ""},
+	} {
+		if err := tc.add(tc.name, "http", settings); err != nil {
+			t.Fatalf("Failed to add sink %s: %v", tc.name, err)
+		}
+		h, ok := runtimeSink(t, tc.name).(*HTTPSink)
+		if !ok {
+			t.Fatalf("Got sink %s of type %T, want an HTTPSink", tc.name, runtimeSink(t, tc.name))
+		}
+		if h.cfg.URL != "https://tenant.example.com" {
+			t.Errorf("Got URL %q for sink %s, want the URL of its settings", h.cfg.URL, tc.name)
+		}
+		if h.cfg.BearerToken != tc.token {
+			t.Errorf("Got bearer token %q for sink %s, want %q", h.cfg.BearerToken, tc.name, tc.token)
+		}
+		if tc.token == "" && (h.cfg.Password != "" || h.cfg.HMACSecret != "") {
+			t.Errorf("Got the configured credentials for the tenant sink %s", tc.name)
+		}
+		RemoveSink(tc.name)
+	}
+}
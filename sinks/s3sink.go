@@ -2,8 +2,10 @@ package sinks
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"k8s.io/api/core/v1"
@@ -11,16 +13,65 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/eapache/channels"
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkedin/goavro/v2"
 )
 
+// S3Config holds the settings of the S3Sink
+type S3Config struct {
+	// Static credentials are optional, the default AWS credential chain (env,
+	// shared config, IRSA, instance role) is used when AccessKeyID is empty
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	Bucket          string
+	BucketDir       string
+
+	// UploadInterval is the number of seconds between two uploads
+	UploadInterval int
+
+	// OutputFormat is rfc5424, flatjson or avro
+	OutputFormat string
+
+	// AvroCodec is the block compression of avro objects: null, deflate or
+	// snappy
+	AvroCodec string
+
+	// Compression is none, gzip or zstd
+	Compression string
+
+	// MaxSize, when positive, uploads as soon as the buffered (uncompressed)
+	// data reaches MaxSize bytes, without waiting for the upload interval
+	MaxSize int
+
+	// ServerSideEncryption is empty (the bucket default), AES256 or aws:kms;
+	// SSEKMSKeyID selects the KMS key and implies aws:kms
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+
+	// ACL is the canned ACL of the objects, e.g. bucket-owner-full-control
+	// when writing to a bucket of another account
+	ACL string
+}
+
 /*
 S3Sink is the sink that uploads the kubernetes events as json object stored in a file.
 The sinker uploads it to s3 if any of the below criteria gets fullfilled
 1) Time(uploadInterval): If the specfied time has passed since the last upload it uploads
-2) [TODO] Data size: If the total data getting uploaded becomes greater than N bytes
+2) Data size(maxSize): If the buffered data, before compression, reaches maxSize bytes
+
+The objects can be compressed with gzip or zstd, the key then gets the .gz or
+.zst extension. With the avro output format every object is an Avro Object
+Container File with the schema embedded, compressed by its own block codec,
+and gets the .avro extension.
+
+Without static access keys the default AWS credential chain is used, which
+covers IAM Roles for Service Accounts. The objects may be encrypted with a KMS
+key and given a canned ACL such as bucket-owner-full-control.
 
 S3 is cheap and the sink can be used to store events data. S3 can later then be used with
 Redshift and other visualization tools to use this data.
@@ -39,6 +90,22 @@ type S3Sink struct {
 	// outPutFormat is the format in which the data is stored in the s3 file
 	outputFormat string
 
+	// compression is the compression applied to the objects: none, gzip or zstd
+	compression string
+
+	// avroCodec is the block codec of avro objects, and ocf the writer of the
+	// object being buffered, created with its header on the first append
+	avroCodec string
+	ocf       *goavro.OCFWriter
+
+	// maxSize is the size of the buffered data that triggers an upload, 0 disables it
+	maxSize int
+
+	// sse, sseKMSKeyID and acl are set on every uploaded object when not empty
+	sse         string
+	sseKMSKeyID string
+	acl         string
+
 	// lastUploadTimestamp stores the timestamp when the last upload to s3 happened
 	lastUploadTimestamp int64
 
@@ -51,13 +118,51 @@ type S3Sink struct {
 
 	// bodyBuf stores all the event captured data in a buffer before upload
 	bodyBuf *bytes.Buffer
+
+	// bufEvents are the events in bodyBuf, dead-lettered if the upload fails
+	bufEvents []EventData
+
+	// retry retries the failed uploads
+	retry RetryPolicy
 }
 
 // NewS3Sink is the factory method constructing a new S3Sink
-func NewS3Sink(awsAccessKeyID string, s3SinkSecretAccessKey string, s3SinkRegion string, s3SinkBucket string, s3SinkBucketDir string, s3SinkUploadInterval int, overflow bool, bufferSize int, outputFormat string) (*S3Sink, error) {
+func NewS3Sink(cfg S3Config, overflow bool, bufferSize int) (*S3Sink, error) {
+	switch cfg.Compression {
+	case "none", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("invalid s3 compression %q, must be none, gzip or zstd", cfg.Compression)
+	}
+	if cfg.OutputFormat == "avro" {
+		switch cfg.AvroCodec {
+		case goavro.CompressionNullLabel, goavro.CompressionDeflateLabel, goavro.CompressionSnappyLabel:
+		default:
+			return nil, fmt.Errorf("invalid s3 avro codec %q, must be null, deflate or snappy", cfg.AvroCodec)
+		}
+		if cfg.Compression != "none" {
+			return nil, fmt.Errorf("s3 compression %s can't be used with the avro output format, set the avro codec instead", cfg.Compression)
+		}
+	}
+
+	sse := cfg.ServerSideEncryption
+	if sse == "" && cfg.SSEKMSKeyID != "" {
+		sse = s3.ServerSideEncryptionAwsKms
+	}
+	switch sse {
+	case "", s3.ServerSideEncryptionAes256:
+		if cfg.SSEKMSKeyID != "" {
+			return nil, fmt.Errorf("s3 kms key specified with server side encryption %s", sse)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, fmt.Errorf("invalid s3 server side encryption %q, must be AES256 or aws:kms", sse)
+	}
+
 	awsConfig := &aws.Config{
-		Region:      aws.String(s3SinkRegion),
-		Credentials: credentials.NewStaticCredentials(awsAccessKeyID, s3SinkSecretAccessKey, ""),
+		Region: aws.String(cfg.Region),
+	}
+	if cfg.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, "")
 	}
 
 	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
@@ -70,11 +175,18 @@ func NewS3Sink(awsAccessKeyID string, s3SinkSecretAccessKey string, s3SinkRegion
 
 	s := &S3Sink{
 		uploader:       uploader,
-		bucket:         s3SinkBucket,
-		bucketDir:      s3SinkBucketDir,
-		uploadInterval: time.Second * time.Duration(s3SinkUploadInterval),
-		outputFormat:   outputFormat,
+		bucket:         cfg.Bucket,
+		bucketDir:      cfg.BucketDir,
+		uploadInterval: time.Second * time.Duration(cfg.UploadInterval),
+		outputFormat:   cfg.OutputFormat,
+		compression:    cfg.Compression,
+		avroCodec:      cfg.AvroCodec,
+		maxSize:        cfg.MaxSize,
+		sse:            sse,
+		sseKMSKeyID:    cfg.SSEKMSKeyID,
+		acl:            cfg.ACL,
 		bodyBuf:        bytes.NewBuffer(make([]byte, 0, 4096)),
+		retry:          retryPolicy.forSink(),
 	}
 
 	if overflow {
@@ -127,13 +239,40 @@ loop:
 
 			s.drainEvents(arr)
 		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr)
+			}
 			break loop
 		}
 	}
+	// Upload what was buffered since the last upload
+	if len(s.bufEvents) > 0 {
+		s.upload()
+	}
 }
 
 // drainEvents takes an array of event data and sends it to s3
 func (s *S3Sink) drainEvents(events []EventData) {
+	if s.outputFormat == "avro" {
+		if err := s.appendAvro(events); err != nil {
+			glog.Warningf("Could not write events to the avro object: %v", err)
+			return
+		}
+	} else {
+		s.writeLines(events)
+	}
+	s.bufEvents = append(s.bufEvents, events...)
+
+	if s.canUpload() == false {
+		return
+	}
+
+	s.upload()
+}
+
+// writeLines writes the events to the buffer, one per line
+func (s *S3Sink) writeLines(events []EventData) {
 	var written int64
 	for _, evt := range events {
 		switch s.outputFormat {
@@ -158,16 +297,39 @@ func (s *S3Sink) drainEvents(events []EventData) {
 		s.bodyBuf.Write([]byte{'\n'})
 		written++
 	}
+}
 
-	if s.canUpload() == false {
-		return
+// appendAvro appends the events to the buffered avro object as one block
+func (s *S3Sink) appendAvro(events []EventData) error {
+	records := make([]interface{}, 0, len(events))
+	for _, evt := range events {
+		record, err := eventAvroRecord(evt)
+		if err != nil {
+			glog.Warningf("Failed to convert event to avro: %v", err)
+			continue
+		}
+		records = append(records, record)
 	}
 
-	s.upload()
+	if s.ocf == nil {
+		ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{
+			W:               s.bodyBuf,
+			Schema:          eventAvroSchema,
+			CompressionName: s.avroCodec,
+		})
+		if err != nil {
+			return err
+		}
+		s.ocf = ocf
+	}
+	return s.ocf.Append(records)
 }
 
 // canUpload verifies the conditions suitable for a new file upload and upload the data
 func (s *S3Sink) canUpload() bool {
+	if s.maxSize > 0 && s.bodyBuf.Len() >= s.maxSize {
+		return true
+	}
 	now := time.Now().UnixNano()
 	if (s.lastUploadTimestamp + s.uploadInterval.Nanoseconds()) < now {
 		return true
@@ -177,7 +339,51 @@ func (s *S3Sink) canUpload() bool {
 
 // getNewKey gets the key name based on time
 func (s *S3Sink) getNewKey(t time.Time) string {
-	return fmt.Sprintf("%s/%d/%d/%d/%d.txt", s.bucketDir, t.Year(), t.Month(), t.Day(), t.UnixNano())
+	ext := "txt"
+	if s.outputFormat == "avro" {
+		ext = "avro"
+	}
+	key := fmt.Sprintf("%s/%d/%d/%d/%d.%s", s.bucketDir, t.Year(), t.Month(), t.Day(), t.UnixNano(), ext)
+	switch s.compression {
+	case "gzip":
+		key += ".gz"
+	case "zstd":
+		key += ".zst"
+	}
+	return key
+}
+
+// compress returns the buffered data compressed with the configured
+// compression, along with its content type
+func (s *S3Sink) compress() (*bytes.Buffer, string, error) {
+	var zw io.WriteCloser
+	var contentType string
+	var buf bytes.Buffer
+	switch s.compression {
+	case "gzip":
+		zw = gzip.NewWriter(&buf)
+		contentType = "application/gzip"
+	case "zstd":
+		enc, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, "", err
+		}
+		zw = enc
+		contentType = "application/zstd"
+	default:
+		if s.outputFormat == "avro" {
+			return s.bodyBuf, "avro/binary", nil
+		}
+		return s.bodyBuf, "text/plain", nil
+	}
+
+	if _, err := zw.Write(s.bodyBuf.Bytes()); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, contentType, nil
 }
 
 // upload uploads the events stored in buffer to s3 in the specified key
@@ -185,17 +391,43 @@ func (s *S3Sink) getNewKey(t time.Time) string {
 func (s *S3Sink) upload() {
 	now := time.Now()
 	key := s.getNewKey(now)
+	size := s.bodyBuf.Len()
 
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-		Body:   s.bodyBuf,
-	})
+	body, contentType, err := s.compress()
 	if err != nil {
-		glog.Errorf("Error uploading %s to s3, %v", key, err)
+		glog.Errorf("Error compressing %s, %v", key, err)
+		deadLetterEvents("s3", s.bufEvents, err)
+	} else {
+		input := &s3manager.UploadInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+		}
+		if s.sse != "" {
+			input.ServerSideEncryption = aws.String(s.sse)
+		}
+		if s.sseKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.sseKMSKeyID)
+		}
+		if s.acl != "" {
+			input.ACL = aws.String(s.acl)
+		}
+		err = s.retry.Do(func() error {
+			// The body is read again on each attempt
+			input.Body = bytes.NewReader(body.Bytes())
+			_, err := s.uploader.Upload(input)
+			return err
+		})
+		if err != nil {
+			glog.Errorf("Error uploading %s to s3, %v", key, err)
+			deadLetterEvents("s3", s.bufEvents, err)
+		} else {
+			glog.Infof("Uploaded at %s (%d bytes uncompressed)", key, size)
+		}
 	}
-	glog.Infof("Uploaded at %s", key)
 	s.lastUploadTimestamp = now.UnixNano()
 
 	s.bodyBuf.Truncate(0)
+	s.bufEvents = nil
+	s.ocf = nil
 }
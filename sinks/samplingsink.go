@@ -0,0 +1,126 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// samplingSinkSampledCounterVec counts the events sampled away, by type and
+// reason. It is nil unless registerSamplingSinkMetrics was called.
+var samplingSinkSampledCounterVec *prometheus.CounterVec
+
+// registerSamplingSinkMetrics creates and registers the sampling metrics
+func registerSamplingSinkMetrics(prefix string) {
+	samplingSinkSampledCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_eventrouter_sampled_events_total", prefix),
+		Help: "Total number of events dropped by sampling, by type and reason",
+	}, []string{"type", "reason"})
+	prometheus.MustRegister(samplingSinkSampledCounterVec)
+}
+
+// SamplingConfig holds the sampling rates, from 0 to 1, of the events by
+// reason and by type. The reasons and types are case insensitive.
+type SamplingConfig struct {
+	Reasons map[string]float64
+	Types   map[string]float64
+
+	// Deterministic forwards exactly one in 1/rate events instead of each
+	// event with the probability rate
+	Deterministic bool
+}
+
+/*
+SamplingSink forwards a sample of the high volume events, e.g. 1% of the
+Pulled and Scheduled events, and all the others. The rate of the reason of an
+event, else of its type, applies; events without a rate are all forwarded.
+*/
+type SamplingSink struct {
+	sink  EventSinkInterface
+	rates map[string]float64
+
+	deterministic bool
+	mu            sync.Mutex
+	counts        map[string]uint64
+}
+
+// NewSamplingSink creates a SamplingSink in front of sink, failing on a rate
+// out of [0, 1]
+func NewSamplingSink(sink EventSinkInterface, cfg SamplingConfig) (*SamplingSink, error) {
+	s := &SamplingSink{
+		sink:          sink,
+		rates:         make(map[string]float64, len(cfg.Reasons)+len(cfg.Types)),
+		deterministic: cfg.Deterministic,
+		counts:        make(map[string]uint64),
+	}
+	for kind, rates := range map[string]map[string]float64{"reason": cfg.Reasons, "type": cfg.Types} {
+		for k, rate := range rates {
+			if rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sampling rate %v of %s %s, expected a rate from 0 to 1", rate, kind, k)
+			}
+			s.rates[kind+"/"+strings.ToLower(k)] = rate
+		}
+	}
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events sampled away are
+// counted and dropped.
+func (s *SamplingSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !s.sample(eNew) {
+		if samplingSinkSampledCounterVec != nil {
+			samplingSinkSampledCounterVec.WithLabelValues(eNew.Type, eNew.Reason).Inc()
+		}
+		return
+	}
+	s.sink.UpdateEvents(eNew, eOld)
+}
+
+// sample returns true if the event is part of the sample
+func (s *SamplingSink) sample(e *v1.Event) bool {
+	key := "reason/" + strings.ToLower(e.Reason)
+	rate, ok := s.rates[key]
+	if !ok {
+		key = "type/" + strings.ToLower(e.Type)
+		if rate, ok = s.rates[key]; !ok {
+			return true
+		}
+	}
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	if !s.deterministic {
+		return rand.Float64() < rate
+	}
+
+	every := uint64(math.Round(1 / rate))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.counts[key]
+	s.counts[key] = n + 1
+	return n%every == 0
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSamplingSinkDeterministic(t *testing.T) {
+	cfg := SamplingConfig{
+		Reasons:       map[string]float64{"Pulled": 0.1, "scheduled": 0.5, "Killing": 0, "BackOff": 1},
+		Types:         map[string]float64{"Normal": 0.25},
+		Deterministic: true,
+	}
+	for _, test := range []struct {
+		reason, eventType string
+		want              int
+	}{
+		{reason: "Pulled", eventType: "Normal", want: 10},
+		// The reasons are case insensitive
+		{reason: "Scheduled", eventType: "Normal", want: 50},
+		{reason: "Killing", eventType: "Normal", want: 0},
+		// The rate of the reason applies before the one of the type
+		{reason: "BackOff", eventType: "Normal", want: 100},
+		{reason: "Started", eventType: "Normal", want: 25},
+		// The events without a rate are all forwarded
+		{reason: "Failed", eventType: "Warning", want: 100},
+	} {
+		sink := &recordingSink{}
+		s, err := NewSamplingSink(sink, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			e := newRoutedTestEvent("default", test.eventType)
+			e.Reason = test.reason
+			s.UpdateEvents(e, nil)
+		}
+		if n := len(sink.updates); n != test.want {
+			t.Errorf("Got %d of 100 %s %s events, want %d", n, test.eventType, test.reason, test.want)
+		}
+	}
+}
+
+func TestSamplingSinkProbabilistic(t *testing.T) {
+	sink := &recordingSink{}
+	s, err := NewSamplingSink(sink, SamplingConfig{Reasons: map[string]float64{"Pulled": 0.1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		e := newTestEvent("test")
+		e.Reason = "Pulled"
+		s.UpdateEvents(e, nil)
+	}
+	if n := len(sink.updates); n < 800 || n > 1200 {
+		t.Errorf("Got %d of 10000 events, want about 1000", n)
+	}
+}
+
+func TestSamplingSinkCountsTheSampledEvents(t *testing.T) {
+	samplingSinkSampledCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_eventrouter_sampled_events_total",
+	}, []string{"type", "reason"})
+	defer func() { samplingSinkSampledCounterVec = nil }()
+
+	s, err := NewSamplingSink(&recordingSink{}, SamplingConfig{Reasons: map[string]float64{"Pulled": 0.25}, Deterministic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		e := newRoutedTestEvent("default", "Normal")
+		e.Reason = "Pulled"
+		s.UpdateEvents(e, nil)
+	}
+	if n := testutil.ToFloat64(samplingSinkSampledCounterVec.WithLabelValues("Normal", "Pulled")); n != 6 {
+		t.Errorf("Got %v sampled events, want 6", n)
+	}
+}
+
+func TestNewSamplingSinkErrors(t *testing.T) {
+	for name, cfg := range map[string]SamplingConfig{
+		"negative reason rate": {Reasons: map[string]float64{"Pulled": -0.1}},
+		"type rate over 1":     {Types: map[string]float64{"Normal": 1.5}},
+	} {
+		if _, err := NewSamplingSink(&recordingSink{}, cfg); err == nil {
+			t.Errorf("Got no error for a %s", name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// seriesEntry holds the pending bumps of a series
+type seriesEntry struct {
+	eNew *v1.Event
+	eOld *v1.Event
+}
+
+/*
+SeriesSink rolls up the series of the events.k8s.io events: the first
+occurrence of an event is forwarded as is, and the bumps of its series (the
+updates of its count and last observed time) are held back and forwarded as
+one update per interval, with the state of the last bump and the old event of
+the last update forwarded. A finished series is forwarded at once.
+
+With countDeltaRecords, a rollup is written as a REPEATED record of the
+occurrences since the previous one.
+*/
+type SeriesSink struct {
+	sink     EventSinkInterface
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[types.UID]*seriesEntry
+}
+
+// NewSeriesSink creates a SeriesSink in front of sink
+func NewSeriesSink(sink EventSinkInterface, interval time.Duration) *SeriesSink {
+	return &SeriesSink{
+		sink:     sink,
+		interval: interval,
+		pending:  make(map[types.UID]*seriesEntry),
+	}
+}
+
+// UpdateEvents implements the EventSinkInterface. The series bumps are held
+// back until the next rollup, the other updates forwarded.
+func (s *SeriesSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if eOld == nil || eNew.Series == nil {
+		s.sink.UpdateEvents(eNew, eOld)
+		return
+	}
+	finished := eNew.Series.State == v1.EventSeriesStateFinished
+
+	s.mu.Lock()
+	entry, ok := s.pending[eNew.UID]
+	if !ok {
+		entry = &seriesEntry{eOld: eOld}
+		s.pending[eNew.UID] = entry
+	}
+	entry.eNew = eNew
+	if finished {
+		delete(s.pending, eNew.UID)
+	}
+	s.mu.Unlock()
+
+	if finished {
+		s.sink.UpdateEvents(entry.eNew, entry.eOld)
+	}
+}
+
+// Run sits in a loop, forwarding the rollups every interval, until stopCh is
+// closed. The pending bumps are forwarded on stop.
+func (s *SeriesSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-stopCh:
+			break loop
+		}
+	}
+	s.flush()
+}
+
+// flush forwards the pending bumps
+func (s *SeriesSink) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[types.UID]*seriesEntry, len(pending))
+	s.mu.Unlock()
+
+	for _, entry := range pending {
+		s.sink.UpdateEvents(entry.eNew, entry.eOld)
+	}
+}
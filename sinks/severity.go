@@ -0,0 +1,111 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// severity is the severity level of an event, from debug to critical
+type severity int
+
+// The severity levels
+const (
+	severityDebug severity = iota
+	severityInfo
+	severityWarning
+	severityError
+	severityCritical
+)
+
+// severityNames are the names of the severity levels
+var severityNames = []string{"debug", "info", "warning", "error", "critical"}
+
+// String returns the name of the severity level
+func (s severity) String() string {
+	return severityNames[s]
+}
+
+// syslog returns the syslog severity of the level
+func (s severity) syslog() int {
+	return []int{7, 6, 4, 3, 2}[s]
+}
+
+// parseSeverity parses the name of a severity level, warn for warning too
+func parseSeverity(name string) (severity, error) {
+	name = strings.ToLower(name)
+	if name == "warn" {
+		return severityWarning, nil
+	}
+	for i, n := range severityNames {
+		if n == name {
+			return severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid severity %q, must be one of %s", name, strings.Join(severityNames, ", "))
+}
+
+// SeverityConfig maps the reasons and types of the events to severity
+// levels: debug, info, warning, error or critical. The reasons and types are
+// case insensitive.
+type SeverityConfig struct {
+	Reasons map[string]string
+	Types   map[string]string
+}
+
+// severityMapping is a parsed SeverityConfig, keyed by reason/<reason> and
+// type/<type>
+type severityMapping map[string]severity
+
+// severities, when set, maps the events to severity levels for the sinks
+// having levels, and sets the severity of the EventData. It is set by
+// ManufactureSink.
+var severities severityMapping
+
+// newSeverityMapping parses the severity mapping, failing on invalid levels
+func newSeverityMapping(cfg SeverityConfig) (severityMapping, error) {
+	m := make(severityMapping, len(cfg.Reasons)+len(cfg.Types))
+	for kind, levels := range map[string]map[string]string{"reason": cfg.Reasons, "type": cfg.Types} {
+		for k, name := range levels {
+			s, err := parseSeverity(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid severity of %s %s: %v", kind, k, err)
+			}
+			m[kind+"/"+strings.ToLower(k)] = s
+		}
+	}
+	return m, nil
+}
+
+// eventSeverity returns the severity level of the event: the level of its
+// reason, else of its type, in severities. By default the Warning events are
+// warnings and the others info.
+func eventSeverity(e *v1.Event) severity {
+	if s, ok := severities["reason/"+strings.ToLower(e.Reason)]; ok {
+		return s
+	}
+	if s, ok := severities["type/"+strings.ToLower(e.Type)]; ok {
+		return s
+	}
+	if e.Type == v1.EventTypeWarning {
+		return severityWarning
+	}
+	return severityInfo
+}
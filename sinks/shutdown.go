@@ -0,0 +1,151 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+)
+
+// wrapperStops are the stop channels of the sinks wrapping routedSinks, e.g.
+// the dedup window, from the innermost. deadLetterStop is the one of the
+// dead-letter sink. They are set by ManufactureSink.
+var (
+	wrapperStops   []chan bool
+	deadLetterStop chan bool
+)
+
+// running are the sinks running, by the channel stopping them
+var (
+	runningMu sync.Mutex
+	running   = make(map[<-chan bool]*runningSinks)
+)
+
+// runningSinks counts the sinks running until a channel is closed
+type runningSinks struct {
+	wg sync.WaitGroup
+	n  int
+}
+
+// runSink runs a sink until stopCh is closed, waitSinks waiting for it to
+// return
+func runSink(run func(stopCh <-chan bool), stopCh <-chan bool) {
+	runningMu.Lock()
+	r := running[stopCh]
+	if r == nil {
+		r = &runningSinks{}
+		running[stopCh] = r
+	}
+	r.n++
+	r.wg.Add(1)
+	runningMu.Unlock()
+
+	go func() {
+		defer r.wg.Done()
+		run(stopCh)
+
+		runningMu.Lock()
+		if r.n--; r.n == 0 {
+			delete(running, stopCh)
+		}
+		runningMu.Unlock()
+	}()
+}
+
+// waitSinks waits for the sinks run until stopCh is closed to return
+func waitSinks(stopCh <-chan bool) {
+	runningMu.Lock()
+	r := running[stopCh]
+	runningMu.Unlock()
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+// stopSinks stops the sinks run until stop is closed, and waits for them
+func stopSinks(stop chan bool) {
+	close(stop)
+	waitSinks(stop)
+}
+
+/*
+Shutdown stops the sinks manufactured by ManufactureSink once they sent the
+updates they hold, so that the checkpoint saved afterwards doesn't skip them
+on the restart: the sinks wrapping the routed sinks forward their pending
+updates from the outermost, e.g. those of the dedup window, the MultiSink
+hands its queued updates to the sinks, which send their queues and batches
+on stop and get closed, and the dead-letter sink stops last, getting the
+updates the others failed to send.
+
+It returns false if the sinks didn't stop within timeout, the updates they
+still hold being lost. The updates handed to the sinks afterwards are
+dropped.
+*/
+func Shutdown(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := len(wrapperStops) - 1; i >= 0; i-- {
+			stopSinks(wrapperStops[i])
+		}
+		if routedSinks != nil {
+			routedSinks.Close()
+		}
+		if deadLetterStop != nil {
+			stopSinks(deadLetterStop)
+		}
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		glog.Warningf("Timed out after %v waiting for the sinks to send the events they hold", timeout)
+		return false
+	}
+}
+
+// queuedEvents returns the events left in the channel of a sink, for the sink
+// to send them on stop
+func queuedEvents(eventCh channels.Channel) []EventData {
+	var events []EventData
+	for n := eventCh.Len(); n > 0; n-- {
+		e := <-eventCh.Out()
+		if evt, ok := e.(EventData); ok {
+			events = append(events, evt)
+		} else {
+			glog.Warningf("Invalid type sent through event channel: %T", e)
+		}
+	}
+	return events
+}
+
+// inBatches calls send with the events in batches of up to size events, all
+// of them at once if size is not positive
+func inBatches(events []EventData, size int, send func([]EventData)) {
+	for len(events) > 0 {
+		n := len(events)
+		if size > 0 && n > size {
+			n = size
+		}
+		send(events[:n])
+		events = events[n:]
+	}
+}
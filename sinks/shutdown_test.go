@@ -0,0 +1,124 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownSendsTheHeldEvents(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []EventData
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("Failed to decode the events: %v", err)
+		}
+		mu.Lock()
+		for _, evt := range events {
+			got = append(got, evt.Event.Message)
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// The events are held by the dedup window, the queue of the MultiSink
+	// and the batch of the sink, none of them passing
+	h, err := NewHTTPSinkWithConfig(HTTPConfig{URL: srv.URL, Format: "json", FlushInterval: time.Hour}, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool)
+	runSink(h.Run, stop)
+	m, err := NewMultiSink([]MultiSinkRoute{{Name: "http", Sink: h, Stop: stop}}, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Run(make(chan bool))
+	for started := false; !started; time.Sleep(time.Millisecond) {
+		m.mu.RLock()
+		started = m.stopCh != nil
+		m.mu.RUnlock()
+	}
+	d := NewDedupSink(m, time.Hour)
+
+	defer func(r *MultiSink, w []chan bool) { routedSinks, wrapperStops = r, w }(routedSinks, wrapperStops)
+	routedSinks, wrapperStops = m, nil
+	runWrapper(d.Run)
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		e := newTestEvent(fmt.Sprintf("event-%d", i))
+		e.Message = e.Name
+		d.UpdateEvents(e, nil)
+		want = append(want, e.Message)
+	}
+	if !Shutdown(10 * time.Second) {
+		t.Fatalf("Timed out shutting down the sinks")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("Got events %v sent on shutdown, want %v", got, want)
+	}
+	sent := make(map[string]bool, len(got))
+	for _, message := range got {
+		sent[message] = true
+	}
+	for _, message := range want {
+		if !sent[message] {
+			t.Errorf("Got event %s not sent on shutdown", message)
+		}
+	}
+	if len(m.workers) != 0 {
+		t.Errorf("Got %d sinks left after the shutdown, want none", len(m.workers))
+	}
+}
+
+func TestInBatches(t *testing.T) {
+	events := make([]EventData, 5)
+	for _, tc := range []struct {
+		size int
+		want []int
+	}{
+		{0, []int{5}},
+		{-1, []int{5}},
+		{2, []int{2, 2, 1}},
+		{5, []int{5}},
+		{10, []int{5}},
+	} {
+		var got []int
+		inBatches(events, tc.size, func(batch []EventData) {
+			got = append(got, len(batch))
+		})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Got batches of %v events with size %d, want %v", got, tc.size, tc.want)
+		}
+	}
+
+	inBatches(nil, 2, func(batch []EventData) {
+		t.Errorf("Got a batch of %d events without events", len(batch))
+	})
+}
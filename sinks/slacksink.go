@@ -0,0 +1,301 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// slackPostMessageURL is the Web API method used with a bot token
+	slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+	// slackMaxTextLen caps the event message, Block Kit sections take 3000
+	// characters at most
+	slackMaxTextLen = 2900
+)
+
+// SlackConfig holds the settings of the SlackSink
+type SlackConfig struct {
+	// WebhookURL is an incoming webhook URL. Alternatively Token is a bot
+	// token, used with chat.postMessage and Channel.
+	WebhookURL string
+	Token      string
+	Channel    string
+
+	// NamespaceChannels routes the events of a namespace to a channel (bot
+	// token) or to a webhook URL (incoming webhooks are bound to a channel).
+	// Other namespaces go to Channel or WebhookURL.
+	NamespaceChannels map[string]string
+
+	Filter EventFilter
+
+	// RateLimit is the number of messages per minute allowed per channel,
+	// with bursts of up to Burst messages. Events over the limit are dropped
+	// and counted in the next message sent to the channel.
+	RateLimit float64
+	Burst     int
+}
+
+// slackEscaper escapes the control characters of mrkdwn text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackDestination is a channel or webhook and its rate limiter
+type slackDestination struct {
+	limiter    *rate.Limiter
+	suppressed int
+}
+
+/*
+SlackSink posts Block Kit formatted messages to Slack for the events matching
+its filter, by default warnings only. Events are posted one message at a time
+from a buffered channel, so a slow Slack API never blocks the informer. The
+messages failing with a transport error, a 5xx or a 429 are retried with the
+retry policy of the sinks, waiting as long as Slack asks when rate limited.
+*/
+type SlackSink struct {
+	cfg          SlackConfig
+	httpClient   *http.Client
+	retry        RetryPolicy
+	destinations map[string]*slackDestination
+	eventCh      channels.Channel
+}
+
+// NewSlackSink constructs a new SlackSink given its config
+func NewSlackSink(cfg SlackConfig, overflow bool, bufferSize int) (*SlackSink, error) {
+	if cfg.WebhookURL == "" && cfg.Token == "" {
+		return nil, fmt.Errorf("slack sink needs a webhook URL or a bot token")
+	}
+	if cfg.Token != "" && cfg.Channel == "" {
+		return nil, fmt.Errorf("slack sink with a bot token needs a channel")
+	}
+
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+
+	s := &SlackSink{
+		cfg:          cfg,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		retry:        retryPolicy.forSink(),
+		destinations: map[string]*slackDestination{},
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (s *SlackSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !s.cfg.Filter.Matches(eNew) {
+		return
+	}
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// posting them to Slack.
+func (s *SlackSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			s.post(evt)
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(s.eventCh) {
+				s.post(evt)
+			}
+			break loop
+		}
+	}
+}
+
+// destination returns the channel (or webhook URL) of the event
+func (s *SlackSink) destination(e *v1.Event) string {
+	if d, ok := s.cfg.NamespaceChannels[e.InvolvedObject.Namespace]; ok {
+		return d
+	}
+	if s.cfg.Token != "" {
+		return s.cfg.Channel
+	}
+	return s.cfg.WebhookURL
+}
+
+// post sends the event to its destination, unless that destination is over
+// its rate limit
+func (s *SlackSink) post(evt EventData) {
+	dest := s.destination(evt.Event)
+	d, ok := s.destinations[dest]
+	if !ok {
+		d = &slackDestination{}
+		if s.cfg.RateLimit > 0 {
+			d.limiter = rate.NewLimiter(rate.Limit(s.cfg.RateLimit/60), s.cfg.Burst)
+		}
+		s.destinations[dest] = d
+	}
+	if d.limiter != nil && !d.limiter.Allow() {
+		d.suppressed++
+		glog.V(4).Infof("Slack rate limit reached, dropping event %s/%s", evt.Event.Namespace, evt.Event.Name)
+		return
+	}
+
+	msg := slackMessage(evt, d.suppressed)
+	url := dest
+	if s.cfg.Token != "" {
+		msg["channel"] = dest
+		url = slackPostMessageURL
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		glog.Warningf("Failed to json serialize slack message: %v", err)
+		return
+	}
+
+	if err := s.retry.Do(func() error { return s.send(url, body) }); err != nil {
+		glog.Errorf("Failed to post event to slack: %v", err)
+		deadLetterEvents("slack", []EventData{evt}, err)
+		return
+	}
+	d.suppressed = 0
+}
+
+// send posts the message once. The rate limited and failed posts return an
+// error to retry, after the delay Slack asks for if any, the rejected ones a
+// permanent error.
+func (s *SlackSink) send(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return retryAfter(err, httpRetryAfter(resp))
+		case resp.StatusCode >= 500:
+			return err
+		}
+		return permanent(err)
+	}
+
+	// The Web API reports errors in the body of 200 responses
+	if s.cfg.Token != "" {
+		var apiResp struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(respBody, &apiResp); err == nil && !apiResp.OK {
+			return permanent(fmt.Errorf("slack API error: %s", apiResp.Error))
+		}
+	}
+	return nil
+}
+
+// slackMessage builds the Block Kit message of an event. text is the
+// fallback used in notifications.
+func slackMessage(evt EventData, suppressed int) map[string]interface{} {
+	e := evt.Event
+	icon := ":information_source:"
+	if e.Type == v1.EventTypeWarning {
+		icon = ":warning:"
+	}
+
+	object := e.InvolvedObject.Kind + " " + e.InvolvedObject.Name
+	if e.InvolvedObject.Namespace != "" {
+		object = e.InvolvedObject.Kind + " " + e.InvolvedObject.Namespace + "/" + e.InvolvedObject.Name
+	}
+	title := fmt.Sprintf("%s *%s* on %s", icon, slackEscaper.Replace(e.Reason), slackEscaper.Replace(object))
+
+	// plain_text must not be empty
+	message := e.Message
+	if message == "" {
+		message = "(no message)"
+	}
+	if runes := []rune(message); len(runes) > slackMaxTextLen {
+		message = string(runes[:slackMaxTextLen]) + "…"
+	}
+
+	context := []string{fmt.Sprintf("%s event", e.Type)}
+	if e.Count > 1 {
+		context = append(context, fmt.Sprintf("seen %d times", e.Count))
+	}
+	if e.Source.Component != "" {
+		context = append(context, "from "+slackEscaper.Replace(e.Source.Component))
+	}
+	if !e.LastTimestamp.IsZero() {
+		context = append(context, fmt.Sprintf("<!date^%d^{date_short_pretty} {time_secs}|%s>",
+			e.LastTimestamp.Unix(), e.LastTimestamp.UTC().Format(time.RFC3339)))
+	}
+	if suppressed > 0 {
+		context = append(context, fmt.Sprintf("%d events suppressed by rate limit", suppressed))
+	}
+
+	return map[string]interface{}{
+		"text": fmt.Sprintf("%s on %s: %s", e.Reason, object, e.Message),
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": title},
+			},
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "plain_text", "text": message},
+			},
+			map[string]interface{}{
+				"type": "context",
+				"elements": []interface{}{
+					map[string]string{"type": "mrkdwn", "text": strings.Join(context, " | ")},
+				},
+			},
+		},
+	}
+}
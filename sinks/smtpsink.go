@@ -0,0 +1,310 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// smtpMaxDigestEvents caps the number of events listed in one digest, the
+// following ones are only counted
+const smtpMaxDigestEvents = 1000
+
+// SMTPConfig holds the settings of the SMTPSink
+type SMTPConfig struct {
+	Host string
+	Port int
+
+	// Username and Password enable PLAIN authentication, which net/smtp
+	// only allows over TLS (or to localhost)
+	Username string
+	Password string
+
+	// TLSMode is "starttls" (upgrade a plain connection, usually port 587),
+	// "tls" (implicit TLS, usually port 465) or "none"
+	TLSMode            string
+	InsecureSkipVerify bool
+
+	From          string
+	To            []string
+	SubjectPrefix string
+
+	Filter EventFilter
+
+	// Events of the ImmediateTypes are mailed right away, the other matching
+	// events are collected in a digest mailed every DigestInterval. An empty
+	// list mails every event right away.
+	ImmediateTypes []string
+	DigestInterval time.Duration
+}
+
+/*
+SMTPSink emails the events matching its filter. Events of the immediate types
+(Warning by default) are mailed as soon as they come in, the events buffered
+between two loop iterations being sent in one email. The other events are
+collected and mailed as one digest every DigestInterval (hourly by default).
+The emails failing with a connection error or a transient (4xx) reply are
+retried with the retry policy of the sinks.
+*/
+type SMTPSink struct {
+	cfg     SMTPConfig
+	retry   RetryPolicy
+	digest  []EventData
+	dropped int
+	eventCh channels.Channel
+}
+
+// NewSMTPSink constructs a new SMTPSink given its config
+func NewSMTPSink(cfg SMTPConfig, overflow bool, bufferSize int) (*SMTPSink, error) {
+	switch cfg.TLSMode {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("invalid smtp TLS mode %q, must be starttls, tls or none", cfg.TLSMode)
+	}
+	if cfg.DigestInterval <= 0 {
+		return nil, fmt.Errorf("invalid smtp digest interval %v", cfg.DigestInterval)
+	}
+
+	s := &SMTPSink{
+		cfg:   cfg,
+		retry: retryPolicy.forSink(),
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (s *SMTPSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !s.cfg.Filter.Matches(eNew) {
+		return
+	}
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh. Immediate
+// events are mailed together, the others are added to the digest, which is
+// mailed by the ticker.
+func (s *SMTPSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(s.cfg.DigestInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			s.drainEvents(arr)
+		case <-ticker.C:
+			s.sendDigest()
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+	s.sendDigest()
+}
+
+// drainEvents mails the immediate events and adds the others to the digest
+func (s *SMTPSink) drainEvents(events []EventData) {
+	var immediate []EventData
+	for _, evt := range events {
+		if filterMatches(s.cfg.ImmediateTypes, evt.Event.Type) {
+			immediate = append(immediate, evt)
+		} else if len(s.digest) < smtpMaxDigestEvents {
+			s.digest = append(s.digest, evt)
+		} else {
+			s.dropped++
+		}
+	}
+	if len(immediate) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("%s %s on %s", immediate[0].Event.Type, immediate[0].Event.Reason, describeObject(immediate[0].Event))
+	if len(immediate) > 1 {
+		subject = fmt.Sprintf("%d events, first: %s", len(immediate), subject)
+	}
+	if err := s.deliver(subject, smtpBody(immediate, 0)); err != nil {
+		glog.Errorf("Failed to mail %d events: %v", len(immediate), err)
+		deadLetterEvents("smtp", immediate, err)
+	}
+}
+
+// sendDigest mails the collected digest events, if any
+func (s *SMTPSink) sendDigest() {
+	if len(s.digest) == 0 {
+		return
+	}
+
+	total := len(s.digest) + s.dropped
+	subject := fmt.Sprintf("Digest of %d events", total)
+	if err := s.deliver(subject, smtpBody(s.digest, s.dropped)); err != nil {
+		glog.Errorf("Failed to mail digest of %d events: %v", total, err)
+		deadLetterEvents("smtp", s.digest, err)
+	}
+	s.digest = nil
+	s.dropped = 0
+}
+
+// smtpBody renders the plain text body listing the events
+func smtpBody(events []EventData, dropped int) []byte {
+	var b bytes.Buffer
+	for _, evt := range events {
+		e := evt.Event
+		fmt.Fprintf(&b, "%s  %s  %s  %s\n", e.LastTimestamp.UTC().Format(time.RFC3339), e.Type, e.Reason, describeObject(e))
+		fmt.Fprintf(&b, "    %s\n", e.Message)
+		if e.Count > 1 {
+			fmt.Fprintf(&b, "    (seen %d times, source %s)\n", e.Count, e.Source.Component)
+		}
+		b.WriteByte('\n')
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&b, "%d more events are not listed.\n", dropped)
+	}
+	return b.Bytes()
+}
+
+// deliver sends the email, retrying it with the retry policy unless the
+// server rejects it with a permanent (5xx) reply
+func (s *SMTPSink) deliver(subject string, body []byte) error {
+	return s.retry.Do(func() error {
+		err := s.send(subject, body)
+		if perr, ok := err.(*textproto.Error); ok && perr.Code >= 500 {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// send delivers one email to all recipients
+func (s *SMTPSink) send(subject string, body []byte) error {
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsConfig := &tls.Config{
+		ServerName:         s.cfg.Host,
+		InsecureSkipVerify: s.cfg.InsecureSkipVerify,
+	}
+
+	var c *smtp.Client
+	var err error
+	if s.cfg.TLSMode == "tls" {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, s.cfg.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, s.cfg.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if s.cfg.TLSMode == "starttls" {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	}
+	defer c.Close()
+
+	if s.cfg.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range s.cfg.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	subject = strings.TrimSpace(s.cfg.SubjectPrefix + " " + subject)
+	fmt.Fprintf(w, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	if _, err = w.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,505 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// snowflakeJWTLifetime is the lifetime of the key-pair JWTs, Snowflake
+	// rejects the ones valid for more than an hour
+	snowflakeJWTLifetime = 59 * time.Minute
+
+	// snowflakeTokenRenewal is the age at which the scoped token of the
+	// ingest host is renewed, well before it expires
+	snowflakeTokenRenewal = 30 * time.Minute
+)
+
+// SnowflakeConfig holds the settings of the SnowflakeSink
+type SnowflakeConfig struct {
+	// Account is the account identifier, e.g. myorg-myaccount or the account
+	// locator xy12345.us-east-2.aws, and URL the account URL,
+	// https://<account>.snowflakecomputing.com by default
+	Account string
+	URL     string
+
+	// User is the user of the key-pair authentication, and PrivateKey its
+	// unencrypted PEM encoded RSA private key, PKCS#8 or PKCS#1
+	User       string
+	PrivateKey []byte
+
+	// Database, Schema and Pipe name the pipe of the table, e.g. its default
+	// pipe <TABLE>-STREAMING
+	Database string
+	Schema   string
+	Pipe     string
+
+	// Channel is the name of the channel of the sink, distinct for each
+	// replica streaming to the pipe: opening a channel invalidates its other
+	// clients
+	Channel string
+
+	BatchSize int
+}
+
+// snowflakeRow is the row streamed for an event
+type snowflakeRow struct {
+	EventTime       string    `json:"event_time"`
+	UID             string    `json:"uid"`
+	ResourceVersion string    `json:"resource_version"`
+	Verb            string    `json:"verb"`
+	Type            string    `json:"type"`
+	Reason          string    `json:"reason"`
+	Message         string    `json:"message"`
+	Count           int32     `json:"count"`
+	Namespace       string    `json:"namespace"`
+	Kind            string    `json:"kind"`
+	Name            string    `json:"name"`
+	SourceComponent string    `json:"source_component"`
+	SourceHost      string    `json:"source_host"`
+	Data            EventData `json:"data"`
+}
+
+// snowflakeStatusError is an error response of the Snowflake API
+type snowflakeStatusError struct {
+	code int
+	body string
+}
+
+func (e snowflakeStatusError) Error() string {
+	return fmt.Sprintf("got HTTP code %v: %s", e.code, e.body)
+}
+
+/*
+SnowflakeSink streams events into a Snowflake table with the REST API of
+Snowpipe Streaming, e.g. a table created with:
+
+	CREATE TABLE K8S_EVENTS (
+		EVENT_TIME TIMESTAMP_TZ, UID STRING, RESOURCE_VERSION STRING,
+		VERB STRING, TYPE STRING, REASON STRING, MESSAGE STRING, COUNT INT,
+		NAMESPACE STRING, KIND STRING, NAME STRING,
+		SOURCE_COMPONENT STRING, SOURCE_HOST STRING, DATA VARIANT
+	)
+
+The rows carry the key event fields, with the time of the last occurrence in
+event_time, and the whole event data in data. The sink authenticates with a
+key-pair JWT of the user, exchanged for a token scoped to the ingest host of
+the account, opens its channel on the pipe and appends the events buffered
+between two loop iterations in batches of up to BatchSize rows.
+
+Each batch is appended with the next offset token of the channel, from the
+last one Snowflake committed when the channel was opened. When an append is
+rejected, e.g. as the channel was opened by another client, the channel is
+opened again and the batch is sent again unless its offset was committed.
+*/
+type SnowflakeSink struct {
+	cfg         SnowflakeConfig
+	accountURL  string
+	channelPath string
+	key         *rsa.PrivateKey
+	httpClient  *retryClient
+	retry       RetryPolicy
+	eventCh     channels.Channel
+
+	// issuer and subject are the claims of the JWTs: the account and the
+	// user, with the fingerprint of the public key for the issuer
+	issuer, subject string
+
+	// ingestURL is the URL of the ingest host of the account, and token its
+	// scoped token, renewed at tokenRenewal
+	ingestURL    string
+	token        string
+	tokenRenewal time.Time
+
+	// continuation is the continuation token of the open channel, empty when
+	// it is to be opened again, and offset the offset token of the last rows
+	continuation string
+	offset       int64
+}
+
+// NewSnowflakeSink constructs a new SnowflakeSink given its config
+func NewSnowflakeSink(cfg SnowflakeConfig, overflow bool, bufferSize int) (*SnowflakeSink, error) {
+	key, err := parseSnowflakeKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snowflake private key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(pub)
+
+	// The JWTs name the account without the region of an account locator
+	account := strings.ToUpper(strings.SplitN(cfg.Account, ".", 2)[0])
+	subject := account + "." + strings.ToUpper(cfg.User)
+
+	accountURL := strings.TrimSuffix(cfg.URL, "/")
+	if accountURL == "" {
+		accountURL = "https://" + strings.ToLower(cfg.Account) + ".snowflakecomputing.com"
+	}
+
+	s := &SnowflakeSink{
+		cfg:        cfg,
+		accountURL: accountURL,
+		channelPath: fmt.Sprintf("/databases/%s/schemas/%s/pipes/%s/channels/%s",
+			url.PathEscape(cfg.Database), url.PathEscape(cfg.Schema),
+			url.PathEscape(cfg.Pipe), url.PathEscape(cfg.Channel)),
+		key:     key,
+		issuer:  subject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		subject: subject,
+	}
+
+	s.retry = retryPolicy.forSink()
+	s.httpClient = s.retry.httpClient()
+	s.httpClient.RetryOnHTTP429 = true
+	s.httpClient.Timeout = 30 * time.Second
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// parseSnowflakeKey parses a PEM encoded RSA private key, PKCS#8 or PKCS#1
+func parseSnowflakeKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("encrypted keys are not supported")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("got a %T, want an RSA key", key)
+	}
+	return rsaKey, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (s *SnowflakeSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// streaming them into Snowflake. If multiple events have happened between loop
+// iterations, they are appended BatchSize rows at a time.
+func (s *SnowflakeSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, s.cfg.BatchSize, s.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(s.eventCh), s.cfg.BatchSize, s.drainEvents)
+			break loop
+		}
+	}
+}
+
+// snowflakeRowOf converts an event to a Snowflake row
+func snowflakeRowOf(evt EventData) snowflakeRow {
+	e := evt.Event
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return snowflakeRow{
+		EventTime:       ts.UTC().Format(time.RFC3339Nano),
+		UID:             string(e.UID),
+		ResourceVersion: e.ResourceVersion,
+		Verb:            evt.Verb,
+		Type:            e.Type,
+		Reason:          e.Reason,
+		Message:         e.Message,
+		Count:           e.Count,
+		Namespace:       e.InvolvedObject.Namespace,
+		Kind:            e.InvolvedObject.Kind,
+		Name:            e.InvolvedObject.Name,
+		SourceComponent: e.Source.Component,
+		SourceHost:      e.Source.Host,
+		Data:            evt,
+	}
+}
+
+// drainEvents appends the events to the channel as one batch of NDJSON rows
+// with the next offset token
+func (s *SnowflakeSink) drainEvents(events []EventData) {
+	body := &bytes.Buffer{}
+	var sent []EventData
+	for _, evt := range events {
+		// Encode writes one JSON object per line, as the append API expects
+		if err := json.NewEncoder(body).Encode(snowflakeRowOf(evt)); err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		sent = append(sent, evt)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	// The offset is set once the channel is open, and kept on the retries
+	var offset int64
+	err := s.retry.Do(func() error {
+		if err := s.authorize(); err != nil {
+			// The requests were already retried by the http client
+			return permanent(err)
+		}
+		if s.continuation == "" {
+			committed, err := s.openChannel()
+			if err != nil {
+				return permanent(err)
+			}
+			if committed > s.offset {
+				s.offset = committed
+			}
+			if offset > 0 && committed >= offset {
+				// The rows were committed before the append was rejected
+				return nil
+			}
+		}
+		if offset == 0 {
+			offset = s.offset + 1
+		}
+
+		err := s.appendRows(body.Bytes(), offset)
+		if err == nil {
+			s.offset = offset
+			return nil
+		}
+		status, ok := err.(snowflakeStatusError)
+		switch {
+		case ok && status.code == http.StatusUnauthorized:
+			// The scoped token expired early or was revoked
+			s.token = ""
+			return err
+		case ok && status.code >= 400 && status.code < 500 && status.code != http.StatusTooManyRequests:
+			// e.g. the continuation token is stale as the channel was opened by
+			// another client
+			s.continuation = ""
+			return err
+		}
+		return permanent(err)
+	})
+	if err != nil {
+		glog.Errorf("Failed to append %d events to snowflake channel %s: %v", len(sent), s.cfg.Channel, err)
+		deadLetterEvents("snowflake", sent, err)
+	}
+}
+
+// authorize gets the ingest host of the account, on the first call, and a
+// token scoped to it when the current one is due for renewal
+func (s *SnowflakeSink) authorize() error {
+	now := time.Now()
+	if s.token != "" && now.Before(s.tokenRenewal) {
+		return nil
+	}
+	jwt, err := s.jwt(now)
+	if err != nil {
+		return err
+	}
+
+	if s.ingestURL == "" {
+		req, err := http.NewRequest("GET", s.accountURL+"/v2/streaming/hostname", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+		host, err := s.send(req)
+		if err != nil {
+			return fmt.Errorf("failed to get the ingest host: %v", err)
+		}
+		s.ingestURL = "https://" + strings.TrimSpace(string(host))
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("scope", strings.TrimPrefix(s.ingestURL, "https://"))
+	form.Set("assertion", jwt)
+	req, err := http.NewRequest("POST", s.accountURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token, err := s.send(req)
+	if err != nil {
+		return fmt.Errorf("failed to get a scoped token: %v", err)
+	}
+	s.token = strings.TrimSpace(string(token))
+	s.tokenRenewal = now.Add(snowflakeTokenRenewal)
+	return nil
+}
+
+// jwt returns a key-pair JWT of the user, signed with RS256
+func (s *SnowflakeSink) jwt(now time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": s.issuer,
+		"sub": s.subject,
+		"iat": now.Unix(),
+		"exp": now.Add(snowflakeJWTLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// openChannel opens the channel, or opens it again, and returns the offset
+// token of the last rows Snowflake committed to it
+func (s *SnowflakeSink) openChannel() (int64, error) {
+	b, err := s.ingest("PUT", "/v2/streaming"+s.channelPath, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the channel: %v", err)
+	}
+	var resp struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+		ChannelStatus         struct {
+			LastCommittedOffsetToken string `json:"last_committed_offset_token"`
+		} `json:"channel_status"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil || resp.NextContinuationToken == "" {
+		return 0, fmt.Errorf("invalid open channel response: %s", b)
+	}
+
+	var committed int64
+	if token := resp.ChannelStatus.LastCommittedOffsetToken; token != "" {
+		if committed, err = strconv.ParseInt(token, 10, 64); err != nil {
+			glog.Warningf("Ignoring the offset token %q of snowflake channel %s, not set by eventrouter", token, s.cfg.Channel)
+			committed = 0
+		}
+	}
+	s.continuation = resp.NextContinuationToken
+	glog.Infof("Opened snowflake channel %s at offset %d", s.cfg.Channel, committed)
+	return committed, nil
+}
+
+// appendRows appends the NDJSON rows to the channel with the offset token
+func (s *SnowflakeSink) appendRows(body []byte, offset int64) error {
+	params := url.Values{}
+	params.Set("continuationToken", s.continuation)
+	params.Set("offsetToken", strconv.FormatInt(offset, 10))
+	path := "/v2/streaming/data" + s.channelPath + "/rows?" + params.Encode()
+	b, err := s.ingest("POST", path, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil || resp.NextContinuationToken == "" {
+		s.continuation = ""
+		return fmt.Errorf("invalid append rows response: %s", b)
+	}
+	s.continuation = resp.NextContinuationToken
+	return nil
+}
+
+// ingest sends a request to the ingest host with the scoped token
+func (s *SnowflakeSink) ingest(method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, s.ingestURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	return s.send(req)
+}
+
+// send sends the request and returns the body of its response
+func (s *SnowflakeSink) send(req *http.Request) ([]byte, error) {
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, snowflakeStatusError{code: resp.StatusCode, body: strings.TrimSpace(string(b))}
+	}
+	return b, nil
+}
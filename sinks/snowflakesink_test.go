@@ -0,0 +1,298 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snowflakeTestKey is the RSA key of the tests, generated once
+var snowflakeTestKey struct {
+	sync.Once
+	key *rsa.PrivateKey
+}
+
+func snowflakeKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	snowflakeTestKey.Do(func() {
+		snowflakeTestKey.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if snowflakeTestKey.key == nil {
+		t.Fatal("Failed to generate an RSA key")
+	}
+	return snowflakeTestKey.key
+}
+
+// fakeSnowpipe is a Snowpipe Streaming API recording the appended rows
+type fakeSnowpipe struct {
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// committed is the offset token returned when the channel is opened,
+	// continuation the valid continuation token
+	committed    string
+	continuation int
+	// reject is the number of appends to reject with a 400
+	reject  int
+	opens   int
+	offsets []string
+	rows    []map[string]interface{}
+}
+
+func (f *fakeSnowpipe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channel := "/databases/DB/schemas/PUBLIC/pipes/K8S_EVENTS-STREAMING/channels/eventrouter-0"
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/streaming/hostname":
+		if r.Header.Get("X-Snowflake-Authorization-Token-Type") != "KEYPAIR_JWT" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.checkJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		fmt.Fprint(w, r.Host)
+	case r.Method == "POST" && r.URL.Path == "/oauth/token":
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.Form.Get("scope") != r.Host {
+			f.t.Errorf("Got token request %v, want a jwt-bearer grant for %s", r.Form, r.Host)
+		}
+		f.checkJWT(r.Form.Get("assertion"))
+		fmt.Fprint(w, "scoped-token")
+	case r.Header.Get("Authorization") != "Bearer scoped-token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.Method == "PUT" && r.URL.Path == "/v2/streaming"+channel:
+		f.opens++
+		f.continuation++
+		fmt.Fprintf(w, `{"next_continuation_token":"c%d","channel_status":{"last_committed_offset_token":%q}}`, f.continuation, f.committed)
+	case r.Method == "POST" && r.URL.Path == "/v2/streaming/data"+channel+"/rows":
+		if f.reject > 0 || r.URL.Query().Get("continuationToken") != fmt.Sprintf("c%d", f.continuation) {
+			if f.reject > 0 {
+				f.reject--
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":"STALE_CONTINUATION_TOKEN_SEQUENCER"}`)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			f.t.Errorf("Got content type %s, want application/x-ndjson", ct)
+		}
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var row map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				f.t.Errorf("Got invalid row %q: %v", scanner.Text(), err)
+			}
+			f.rows = append(f.rows, row)
+		}
+		f.offsets = append(f.offsets, r.URL.Query().Get("offsetToken"))
+		f.continuation++
+		fmt.Fprintf(w, `{"next_continuation_token":"c%d"}`, f.continuation)
+	default:
+		f.t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// checkJWT checks the claims and the signature of a key-pair JWT
+func (f *fakeSnowpipe) checkJWT(jwt string) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		f.t.Errorf("Got JWT %q, want 3 parts", jwt)
+		return
+	}
+	enc := base64.RawURLEncoding
+	header, _ := enc.DecodeString(parts[0])
+	if string(header) != `{"alg":"RS256","typ":"JWT"}` {
+		f.t.Errorf("Got JWT header %s", header)
+	}
+	sig, _ := enc.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		f.t.Errorf("Got an invalid JWT signature: %v", err)
+	}
+
+	b, _ := enc.DecodeString(parts[1])
+	var claims struct {
+		Iss, Sub string
+		Iat, Exp int64
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		f.t.Errorf("Got invalid JWT claims %s: %v", b, err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	fingerprint := sha256.Sum256(pub)
+	if want := "MYORG-MYACCOUNT.EVENTROUTER.SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]); claims.Iss != want {
+		f.t.Errorf("Got issuer %s, want %s", claims.Iss, want)
+	}
+	if claims.Sub != "MYORG-MYACCOUNT.EVENTROUTER" {
+		f.t.Errorf("Got subject %s, want MYORG-MYACCOUNT.EVENTROUTER", claims.Sub)
+	}
+	if d := time.Duration(claims.Exp-claims.Iat) * time.Second; d <= 0 || d > time.Hour {
+		f.t.Errorf("Got a JWT valid for %v, want at most an hour", d)
+	}
+}
+
+// newFakeSnowpipe starts a fake Snowpipe Streaming API and a sink streaming
+// to it
+func newFakeSnowpipe(t *testing.T) (*fakeSnowpipe, *SnowflakeSink, func()) {
+	t.Helper()
+	key := snowflakeKey(t)
+	f := &fakeSnowpipe{t: t, key: key}
+	srv := httptest.NewTLSServer(f)
+
+	s, err := NewSnowflakeSink(SnowflakeConfig{
+		Account:    "myorg-myaccount",
+		URL:        srv.URL,
+		User:       "eventrouter",
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		Database:   "DB",
+		Schema:     "PUBLIC",
+		Pipe:       "K8S_EVENTS-STREAMING",
+		Channel:    "eventrouter-0",
+		BatchSize:  10,
+	}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.httpClient.Client = srv.Client()
+	s.retry = RetryPolicy{MaxAttempts: 3}
+	s.httpClient.policy = RetryPolicy{}
+	return f, s, srv.Close
+}
+
+func TestSnowflakeSinkAppendsRows(t *testing.T) {
+	f, s, stop := newFakeSnowpipe(t)
+	defer stop()
+
+	// The offsets continue from the one committed before a restart
+	f.committed = "41"
+	e := newTestEvent("web-0.1")
+	e.Reason = "BackOff"
+	e.Count = 3
+	s.drainEvents([]EventData{NewEventData(e, nil), NewEventData(newTestEvent("b"), nil)})
+	s.drainEvents([]EventData{NewEventData(newTestEvent("c"), nil)})
+
+	if got, want := strings.Join(f.offsets, ","), "42,43"; got != want {
+		t.Errorf("Got offset tokens %s, want %s", got, want)
+	}
+	if f.opens != 1 {
+		t.Errorf("Got the channel opened %d times, want once", f.opens)
+	}
+	if len(f.rows) != 3 {
+		t.Fatalf("Got %d rows, want 3", len(f.rows))
+	}
+	row := f.rows[0]
+	if row["reason"] != "BackOff" || row["count"] != float64(3) || row["verb"] != "ADDED" {
+		t.Errorf("Got row %v, want the fields of the event", row)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(row["event_time"])); err != nil {
+		t.Errorf("Got event_time %v: %v", row["event_time"], err)
+	}
+	data, _ := row["data"].(map[string]interface{})
+	if event, _ := data["event"].(map[string]interface{}); event["reason"] != "BackOff" {
+		t.Errorf("Got data %v, want the event data", row["data"])
+	}
+}
+
+func TestSnowflakeSinkReopensTheChannel(t *testing.T) {
+	f, s, stop := newFakeSnowpipe(t)
+	defer stop()
+
+	s.drainEvents([]EventData{NewEventData(newTestEvent("a"), nil)})
+
+	// Another client opened the channel: the batch is sent again with the
+	// same offset once the channel is opened again
+	f.continuation += 10
+	s.drainEvents([]EventData{NewEventData(newTestEvent("b"), nil)})
+	if got, want := strings.Join(f.offsets, ","), "1,2"; got != want {
+		t.Errorf("Got offset tokens %s, want %s", got, want)
+	}
+	if f.opens != 2 {
+		t.Errorf("Got the channel opened %d times, want twice", f.opens)
+	}
+
+	// The batch committed before the rejection isn't sent again
+	f.reject = 1
+	f.committed = "3"
+	s.drainEvents([]EventData{NewEventData(newTestEvent("c"), nil)})
+	s.drainEvents([]EventData{NewEventData(newTestEvent("d"), nil)})
+	if got, want := strings.Join(f.offsets, ","), "1,2,4"; got != want {
+		t.Errorf("Got offset tokens %s, want %s", got, want)
+	}
+}
+
+func TestSnowflakeSinkDeadLetters(t *testing.T) {
+	f, s, stop := newFakeSnowpipe(t)
+	defer stop()
+
+	sink, restore := captureDeadLetters("file")
+	defer restore()
+	f.reject = 10
+	s.drainEvents([]EventData{NewEventData(newTestEvent("a"), nil), NewEventData(newTestEvent("b"), nil)})
+	checkNames(t, sink.names(), "a", "b")
+	if f.opens != 3 {
+		t.Errorf("Got the channel opened %d times, want once per attempt", f.opens)
+	}
+}
+
+func TestParseSnowflakeKey(t *testing.T) {
+	key := snowflakeKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{
+		"PKCS#1": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"PKCS#8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	} {
+		got, err := parseSnowflakeKey(b)
+		if err != nil {
+			t.Errorf("Failed to parse the %s key: %v", name, err)
+		} else if got.N.Cmp(key.N) != 0 {
+			t.Errorf("Got another key parsing the %s key", name)
+		}
+	}
+
+	for name, b := range map[string][]byte{
+		"not PEM":   []byte("not a key"),
+		"encrypted": pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: pkcs8}),
+		"garbage":   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bytes.Repeat([]byte{1}, 16)}),
+	} {
+		if _, err := parseSnowflakeKey(b); err == nil {
+			t.Errorf("Got no error for a %s key", name)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// socketDialTimeout bounds one connection attempt
+	socketDialTimeout = 10 * time.Second
+	// socketWriteTimeout bounds one write, so a stuck peer triggers a reconnect
+	socketWriteTimeout = 30 * time.Second
+)
+
+/*
+SocketSink writes newline delimited JSON events to a raw TCP or UDP socket, e.g.
+a homegrown collector or `nc -lk 5170`.
+
+Over TCP the events buffered between two loop iterations are written with one
+write call. When the connection fails the sink reconnects with the retry
+policy of the sinks and writes the same events again, so the peer may see
+duplicates across reconnects, and dead-letters the events when the retries
+are exhausted. Over UDP each event is sent in its own datagram; events
+larger than a datagram are dropped by the network.
+*/
+type SocketSink struct {
+	eventOutput
+
+	network string
+	address string
+
+	conn    net.Conn
+	retry   RetryPolicy
+	bodyBuf *bytes.Buffer
+	eventCh channels.Channel
+}
+
+// NewSocketSink constructs a new SocketSink, network is "tcp" or "udp". The
+// connection is opened lazily, so the peer doesn't need to be up at startup.
+func NewSocketSink(network, address string, overflow bool, bufferSize int) (*SocketSink, error) {
+	switch network {
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("invalid socket network %q, must be tcp or udp", network)
+	}
+
+	s := &SocketSink{
+		network: network,
+		address: address,
+		retry:   retryPolicy.forSink(),
+		bodyBuf: bytes.NewBuffer(make([]byte, 0, 4096)),
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (s *SocketSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// writing them to the socket. If multiple events have happened between loop
+// iterations, they are written together.
+func (s *SocketSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			s.drainEvents(arr, stopCh)
+		case <-stopCh:
+			// Send the events queued before the stop, retrying them
+			// regardless of the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr, nil)
+			}
+			break loop
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// drainEvents writes the events, reconnecting until they could be written,
+// the retries are exhausted or stopCh is closed, nil to keep retrying. This function is *NOT* re-entrant: it re-uses the same
+// body buffer for each call.
+func (s *SocketSink) drainEvents(events []EventData, stopCh <-chan bool) {
+	s.bodyBuf.Truncate(0)
+	// ends holds the offset of the end of each line in the body buffer
+	ends := make([]int, 0, len(events))
+	for _, evt := range events {
+		eJSONBytes, err := s.encode(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+		s.bodyBuf.Write(eJSONBytes)
+		s.bodyBuf.WriteByte('\n')
+		ends = append(ends, s.bodyBuf.Len())
+	}
+	if len(ends) == 0 {
+		return
+	}
+
+	s.retry.start()
+	for attempt := 1; ; attempt++ {
+		err := s.write(ends)
+		if err == nil {
+			return
+		}
+
+		glog.Errorf("Failed to write %d events to %s://%s: %v", len(ends), s.network, s.address, err)
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+
+		backoff, ok := s.retry.next(attempt)
+		if !ok {
+			deadLetterEvents("socket", events, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stopCh:
+			deadLetterEvents("socket", events, err)
+			return
+		}
+	}
+}
+
+// write (re)connects if needed and writes the body buffer, in one write over
+// TCP and one datagram per line over UDP
+func (s *SocketSink) write(ends []int) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, socketDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if s.network == "tcp" {
+		_, err := s.conn.Write(s.bodyBuf.Bytes())
+		return err
+	}
+	body := s.bodyBuf.Bytes()
+	start := 0
+	for _, end := range ends {
+		if _, err := s.conn.Write(body[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
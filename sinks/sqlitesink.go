@@ -0,0 +1,228 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 database/sql driver
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// sqlitePruneInterval is how often the retention limits are enforced
+const sqlitePruneInterval = time.Minute
+
+/*
+SQLiteSink archives events in a local SQLite database file, typically on a
+PersistentVolume, which gives air-gapped or edge clusters a queryable record of
+their events without any remote dependency.
+
+Old events are pruned every minute: events whose last timestamp is older than
+maxAge are deleted, then only the newest maxRows rows are kept. A zero value
+disables the corresponding limit.
+
+NOTE: the sqlite3 driver uses cgo, the binary must be built with
+CGO_ENABLED=1 for this sink to work.
+*/
+type SQLiteSink struct {
+	db      *sql.DB
+	maxAge  time.Duration
+	maxRows int
+	eventCh channels.Channel
+}
+
+// NewSQLiteSink opens (or creates) the database at path and creates the
+// events table if needed.
+func NewSQLiteSink(path string, maxAge time.Duration, maxRows int, overflow bool, bufferSize int) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid TEXT NOT NULL,
+	resource_version TEXT NOT NULL,
+	verb TEXT NOT NULL,
+	type TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	message TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	namespace TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	name TEXT NOT NULL,
+	source_component TEXT NOT NULL,
+	source_host TEXT NOT NULL,
+	last_timestamp INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_events_uid ON events (uid);
+CREATE INDEX IF NOT EXISTS idx_events_namespace ON events (namespace, last_timestamp);
+CREATE INDEX IF NOT EXISTS idx_events_last_timestamp ON events (last_timestamp);`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite events table in %s: %v", path, err)
+	}
+
+	s := &SQLiteSink{
+		db:      db,
+		maxAge:  maxAge,
+		maxRows: maxRows,
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (s *SQLiteSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// writing them to the database. If multiple events have happened between loop
+// iterations, they are inserted in one transaction. Retention limits are
+// enforced from the same loop, so there is only ever one writer.
+func (s *SQLiteSink) Run(stopCh <-chan bool) {
+	ticker := time.NewTicker(sqlitePruneInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			s.drainEvents(arr)
+		case <-ticker.C:
+			s.prune()
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+	s.db.Close()
+}
+
+// drainEvents inserts the events in a single transaction, dead-lettering them
+// when it fails
+func (s *SQLiteSink) drainEvents(events []EventData) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		glog.Errorf("Failed to start sqlite transaction: %v", err)
+		deadLetterEvents("sqlite", events, err)
+		return
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO events (uid, resource_version, verb, type, reason, message, count,
+	namespace, kind, name, source_component, source_host, last_timestamp, data)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		glog.Errorf("Failed to prepare sqlite insert: %v", err)
+		tx.Rollback()
+		deadLetterEvents("sqlite", events, err)
+		return
+	}
+	defer stmt.Close()
+
+	for _, evt := range events {
+		eJSONBytes, err := json.Marshal(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		e := evt.Event
+		lastTimestamp := e.LastTimestamp.Time
+		if lastTimestamp.IsZero() {
+			lastTimestamp = time.Now()
+		}
+		_, err = stmt.Exec(string(e.UID), e.ResourceVersion, evt.Verb, e.Type, e.Reason, e.Message, e.Count,
+			e.InvolvedObject.Namespace, e.InvolvedObject.Kind, e.InvolvedObject.Name,
+			e.Source.Component, e.Source.Host, lastTimestamp.Unix(), string(eJSONBytes))
+		if err != nil {
+			glog.Errorf("Failed to insert event into sqlite: %v", err)
+			tx.Rollback()
+			deadLetterEvents("sqlite", events, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		glog.Errorf("Failed to commit %d events to sqlite: %v", len(events), err)
+		deadLetterEvents("sqlite", events, err)
+	}
+}
+
+// prune deletes the events that fall outside of the retention limits
+func (s *SQLiteSink) prune() {
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge).Unix()
+		if res, err := s.db.Exec(`DELETE FROM events WHERE last_timestamp < ?`, cutoff); err != nil {
+			glog.Errorf("Failed to prune sqlite events by age: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			glog.V(4).Infof("Pruned %d sqlite events older than %v", n, s.maxAge)
+		}
+	}
+
+	if s.maxRows > 0 {
+		res, err := s.db.Exec(`DELETE FROM events WHERE id <= (SELECT MAX(id) FROM events) - ?`, s.maxRows)
+		if err != nil {
+			glog.Errorf("Failed to prune sqlite events by row count: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			glog.V(4).Infof("Pruned %d sqlite events above %d rows", n, s.maxRows)
+		}
+	}
+}
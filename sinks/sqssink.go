@@ -0,0 +1,245 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// sqsMaxBatchEntries is the maximum number of messages in one SendMessageBatch
+	sqsMaxBatchEntries = 10
+	// sqsMaxBatchSize is the maximum total payload of one SendMessageBatch
+	sqsMaxBatchSize = 256 * 1024
+)
+
+/*
+SQSSink sends events to an AWS SQS queue, using SendMessageBatch for events
+buffered between two loop iterations.
+
+FIFO queues (whose URL ends in ".fifo") are supported: the message group ID is
+the namespace of the involved object, so events are ordered per namespace, and
+the deduplication ID is the event UID and resourceVersion, so an event that is
+sent twice within the deduplication interval is only delivered once.
+*/
+type SQSSink struct {
+	eventOutput
+
+	client   *sqs.SQS
+	queueURL string
+	fifo     bool
+	retry    RetryPolicy
+	eventCh  channels.Channel
+}
+
+// NewSQSSink constructs a new SQSSink. If accessKeyID is empty the default AWS
+// credential chain (env, shared config, IRSA, instance role) is used.
+func NewSQSSink(accessKeyID, secretAccessKey, region, queueURL string, overflow bool, bufferSize int) (*SQSSink, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+	}
+	if accessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
+	}
+
+	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQSSink{
+		client:   sqs.New(sess),
+		queueURL: queueURL,
+		fifo:     strings.HasSuffix(queueURL, ".fifo"),
+		retry:    retryPolicy.forSink(),
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (s *SQSSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// forwarding them to SQS. If multiple events have happened between loop
+// iterations, they are sent in batches of up to 10 messages.
+func (s *SQSSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := s.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-s.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			s.drainEvents(arr)
+		case <-stopCh:
+			// Send the events queued before the stop
+			if arr := queuedEvents(s.eventCh); len(arr) > 0 {
+				s.drainEvents(arr)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvents converts the events to messages and sends them in batches that
+// respect the SendMessageBatch limits.
+func (s *SQSSink) drainEvents(events []EventData) {
+	var batch []*sqs.SendMessageBatchRequestEntry
+	var batchEvents []EventData
+	var batchSize int
+	for _, evt := range events {
+		eJSONBytes, err := s.encode(evt)
+		if err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+			continue
+		}
+
+		if len(batch) == sqsMaxBatchEntries || batchSize+len(eJSONBytes) > sqsMaxBatchSize {
+			s.sendBatch(batch, batchEvents)
+			batch, batchEvents = nil, nil
+			batchSize = 0
+		}
+
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(len(batch))),
+			MessageBody: aws.String(string(eJSONBytes)),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"namespace": sqsStringAttribute(evt.Event.InvolvedObject.Namespace),
+				"reason":    sqsStringAttribute(evt.Event.Reason),
+				"type":      sqsStringAttribute(evt.Event.Type),
+			},
+		}
+		if s.fifo {
+			group := evt.Event.InvolvedObject.Namespace
+			if group == "" {
+				group = "default"
+			}
+			entry.MessageGroupId = aws.String(group)
+			entry.MessageDeduplicationId = aws.String(evt.key())
+		}
+
+		batch = append(batch, entry)
+		batchEvents = append(batchEvents, evt)
+		batchSize += len(eJSONBytes)
+	}
+
+	if len(batch) > 0 {
+		s.sendBatch(batch, batchEvents)
+	}
+}
+
+// sendBatch sends one SendMessageBatch request of the events, retrying the
+// entries that failed on the side of SQS, and logs and dead-letters the
+// entries that couldn't be sent.
+func (s *SQSSink) sendBatch(batch []*sqs.SendMessageBatchRequestEntry, events []EventData) {
+	err := s.retry.Do(func() error {
+		out, err := s.client.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(s.queueURL),
+			Entries:  batch,
+		})
+		if err != nil {
+			return err
+		}
+
+		// The entry ids are the indices of the entries in the batch
+		var failed []*sqs.SendMessageBatchRequestEntry
+		var failedEvents []EventData
+		var failedErr error
+		for _, f := range out.Failed {
+			i, err := strconv.Atoi(aws.StringValue(f.Id))
+			if err != nil || i < 0 || i >= len(events) {
+				continue
+			}
+			err = fmt.Errorf("%s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+			if aws.BoolValue(f.SenderFault) {
+				// The message itself is rejected, e.g. too large
+				glog.Errorf("Failed to send message to %s: %v", s.queueURL, err)
+				deadLetterEvents("sqs", events[i:i+1], err)
+				continue
+			}
+			failed = append(failed, batch[i])
+			failedEvents = append(failedEvents, events[i])
+			failedErr = err
+		}
+		for i, entry := range failed {
+			entry.Id = aws.String(strconv.Itoa(i))
+		}
+		batch, events = failed, failedEvents
+		if len(batch) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%d messages failed, last error: %v", len(batch), failedErr)
+	})
+	if err != nil {
+		glog.Errorf("Failed to send batch of %d to %s: %v", len(batch), s.queueURL, err)
+		deadLetterEvents("sqs", events, err)
+	}
+}
+
+// sqsStringAttribute builds a String message attribute. SQS rejects empty
+// attribute values, so empty strings are sent as "none".
+func sqsStringAttribute(value string) *sqs.MessageAttributeValue {
+	if value == "" {
+		value = "none"
+	}
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
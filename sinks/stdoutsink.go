@@ -17,9 +17,12 @@ limitations under the License.
 package sinks
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"k8s.io/api/core/v1"
 )
@@ -28,36 +31,159 @@ import (
 // By default, Fluentd/ElasticSearch won't index glog formatted lines
 // By logging raw JSON to stdout, we will get automated indexing which
 // can be queried in Kibana.
+//
+// Every event is written as one JSON object on a single line (NDJSON), so log
+// shippers like Fluent Bit can parse it without multiline handling. The
+// fields may be restricted to an allowlist of paths, and the nested objects
+// flattened into top level keys joined by underscores.
 type StdoutSink struct {
+	eventOutput
+
 	// TODO: create a channel and buffer for scaling
 	namespace string
+
+	// fields are the allowed field paths, split on dots
+	fields  [][]string
+	flatten bool
 }
 
+// StdoutConfig holds the settings of the StdoutSink
+type StdoutConfig struct {
+	// Namespace, when set, nests the event data under that key
+	Namespace string
+
+	// Fields are the JSON paths of the fields to keep, e.g. "verb",
+	// "event.reason" or "event.involvedObject.name"; all of them when empty
+	Fields []string
+
+	// Flatten writes nested fields as top level keys such as
+	// event_involvedObject_name
+	Flatten bool
+}
 
 // NewStdoutSink will create a new StdoutSink with default options, returned as
 // an EventSinkInterface
 func NewStdoutSink(namespace string) EventSinkInterface {
-	return &StdoutSink{
-		namespace: namespace}
+	return NewStdoutSinkWithConfig(StdoutConfig{Namespace: namespace})
+}
+
+// NewStdoutSinkWithConfig will create a new StdoutSink given its config,
+// returned as an EventSinkInterface
+func NewStdoutSinkWithConfig(cfg StdoutConfig) EventSinkInterface {
+	gs := &StdoutSink{
+		namespace: cfg.Namespace,
+		flatten:   cfg.Flatten,
+	}
+	for _, f := range cfg.Fields {
+		if f != "" {
+			gs.fields = append(gs.fields, strings.Split(f, "."))
+		}
+	}
+	return gs
 }
 
 // UpdateEvents implements the EventSinkInterface
 func (gs *StdoutSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
 	eData := NewEventData(eNew, eOld)
-	
+
+	line, err := gs.line(eData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v\n", err)
+		return
+	}
+	// One write per line, so that lines are never interleaved
+	os.Stdout.Write(append(line, '\n'))
+}
+
+// line returns the JSON line of the event data
+func (gs *StdoutSink) line(eData EventData) ([]byte, error) {
+	var doc interface{} = gs.document(eData)
+
+	if len(gs.fields) > 0 || gs.flatten {
+		// Work on the generic JSON representation of the event data
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		// UseNumber keeps the numbers as they were written
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		if len(gs.fields) > 0 {
+			m = selectFields(m, gs.fields)
+		}
+		if gs.flatten {
+			flat := make(map[string]interface{}, len(m))
+			flattenFields("", m, flat)
+			m = flat
+		}
+		doc = m
+	}
+
 	if len(gs.namespace) > 0 {
-		namespacedData := map[string]interface{}{}
-		namespacedData[gs.namespace] = eData
-		if eJSONBytes, err := json.Marshal(namespacedData); err == nil {
-			fmt.Println(string(eJSONBytes))
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
-		}
-	} else {
-		if eJSONBytes, err := json.Marshal(eData); err == nil {
-			fmt.Println(string(eJSONBytes))
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to json serialize event: %v", err)
+		doc = map[string]interface{}{gs.namespace: doc}
+	}
+	return json.Marshal(doc)
+}
+
+// selectFields returns the fields of doc found at the given paths, keeping
+// their nesting
+func selectFields(doc map[string]interface{}, paths [][]string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, path := range paths {
+		var v interface{} = doc
+		found := true
+		for _, key := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			if v, ok = m[key]; !ok {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		dst := out
+		for _, key := range path[:len(path)-1] {
+			next, ok := dst[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				dst[key] = next
+			}
+			dst = next
+		}
+		dst[path[len(path)-1]] = v
+	}
+	return out
+}
+
+// flattenFields adds the leaves of v to out, keyed by their path joined by
+// underscores; array elements are keyed by their index
+func flattenFields(prefix string, v interface{}, out map[string]interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "_" + key
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			flattenFields(join(k), child, out)
+		}
+	case []interface{}:
+		for i, child := range t {
+			flattenFields(join(strconv.Itoa(i)), child, out)
 		}
+	default:
+		out[prefix] = v
 	}
 }
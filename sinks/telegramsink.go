@@ -0,0 +1,201 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// telegramAPIURL is the base URL of the Bot API
+	telegramAPIURL = "https://api.telegram.org/bot"
+	// telegramMaxTextLen is the maximum length of a message
+	telegramMaxTextLen = 4096
+)
+
+// TelegramDefaultTemplate is the message template used when none is configured
+const TelegramDefaultTemplate = `{{.Event.Type}}: {{.Event.Reason}} on {{.Event.InvolvedObject.Kind}} ` +
+	`{{with .Event.InvolvedObject.Namespace}}{{.}}/{{end}}{{.Event.InvolvedObject.Name}}
+{{.Event.Message}}`
+
+/*
+TelegramSink sends the events matching its filter as Telegram messages from a
+bot to one or more chats (user, group or @channel IDs).
+
+Messages are rendered with a text/template evaluated against the EventData,
+e.g. {{.Event.Reason}}. With parseMode HTML, use {{html .Event.Message}} to
+escape event fields. The messages failing with a transport error, a 5xx or a
+429 are retried with the retry policy of the sinks, waiting as long as
+Telegram asks when rate limited.
+*/
+type TelegramSink struct {
+	sendURL    string
+	chatIDs    []string
+	parseMode  string
+	tmpl       *template.Template
+	filter     EventFilter
+	httpClient *http.Client
+	retry      RetryPolicy
+	eventCh    channels.Channel
+}
+
+// telegramResponse is the envelope of Bot API responses
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// NewTelegramSink constructs a new TelegramSink. An empty tmpl uses
+// TelegramDefaultTemplate, parseMode is "", "HTML" or "MarkdownV2".
+func NewTelegramSink(token string, chatIDs []string, tmpl, parseMode string, filter EventFilter, overflow bool, bufferSize int) (*TelegramSink, error) {
+	if tmpl == "" {
+		tmpl = TelegramDefaultTemplate
+	}
+	t, err := template.New("telegram").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telegram message template: %v", err)
+	}
+
+	s := &TelegramSink{
+		sendURL:    telegramAPIURL + token + "/sendMessage",
+		chatIDs:    chatIDs,
+		parseMode:  parseMode,
+		tmpl:       t,
+		filter:     filter,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retry:      retryPolicy.forSink(),
+	}
+
+	if overflow {
+		s.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		s.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return s, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (s *TelegramSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !s.filter.Matches(eNew) {
+		return
+	}
+	s.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through s.eventCh, and
+// sending them to every chat.
+func (s *TelegramSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-s.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			s.drainEvent(evt)
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(s.eventCh) {
+				s.drainEvent(evt)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvent renders the event and sends it to every chat
+func (s *TelegramSink) drainEvent(evt EventData) {
+	var text bytes.Buffer
+	if err := s.tmpl.Execute(&text, evt); err != nil {
+		glog.Warningf("Failed to render telegram message: %v", err)
+		return
+	}
+	msg := text.String()
+	if runes := []rune(msg); len(runes) > telegramMaxTextLen {
+		msg = string(runes[:telegramMaxTextLen])
+	}
+
+	var failed error
+	for _, chatID := range s.chatIDs {
+		if err := s.send(chatID, msg); err != nil {
+			glog.Errorf("Failed to send event to telegram chat %s: %v", chatID, err)
+			failed = err
+		}
+	}
+	if failed != nil {
+		deadLetterEvents("telegram", []EventData{evt}, failed)
+	}
+}
+
+// send sends one message, retrying it with the retry policy
+func (s *TelegramSink) send(chatID, text string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               s.parseMode,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.retry.Do(func() error {
+		resp, err := s.httpClient.Post(s.sendURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			// Don't log the URL, it contains the bot token
+			if uerr, ok := err.(*url.Error); ok {
+				err = uerr.Err
+			}
+			return err
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var apiResp telegramResponse
+		json.Unmarshal(respBody, &apiResp)
+		if resp.StatusCode != http.StatusOK || !apiResp.OK {
+			err := fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, apiResp.Description)
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests:
+				return retryAfter(err, time.Duration(apiResp.Parameters.RetryAfter)*time.Second)
+			case resp.StatusCode >= 500:
+				return err
+			}
+			return permanent(err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The timestamp fields of the events
+const (
+	timestampLast  = "lasttimestamp"
+	timestampFirst = "firsttimestamp"
+	timestampEvent = "eventtime"
+)
+
+// timestampField is the field of the primary timestamp of the events, the
+// @timestamp of OpenSearch, the time of InfluxDB points and the like. It is
+// set by ManufactureSink.
+var timestampField = timestampLast
+
+// parseTimestampField parses the name of a timestamp field, case insensitive
+func parseTimestampField(name string) (string, error) {
+	switch field := strings.ToLower(name); field {
+	case timestampLast, timestampFirst, timestampEvent:
+		return field, nil
+	default:
+		return "", fmt.Errorf("invalid timestampField %q, must be lastTimestamp, firstTimestamp or eventTime", name)
+	}
+}
+
+// eventTimestamp returns the primary timestamp of the event, in UTC: its
+// timestampField, else the first set of lastTimestamp, eventTime and
+// firstTimestamp, or the zero time
+func eventTimestamp(e *v1.Event) time.Time {
+	var ts time.Time
+	switch timestampField {
+	case timestampFirst:
+		ts = e.FirstTimestamp.Time
+	case timestampEvent:
+		ts = e.EventTime.Time
+	}
+	for _, t := range []time.Time{ts, e.LastTimestamp.Time, e.EventTime.Time, e.FirstTimestamp.Time} {
+		if !t.IsZero() {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+/*
+TimestampSink normalizes the timestamps of the events before the sinks: they
+are all converted to UTC, and the missing ones are filled in, so the
+core/v1 events, which only set firstTimestamp and lastTimestamp, and the
+events.k8s.io events, which only set eventTime, carry the three of them.
+eventTime is filled in with lastTimestamp, else firstTimestamp; firstTimestamp
+and lastTimestamp with each other, else eventTime.
+*/
+type TimestampSink struct {
+	sink EventSinkInterface
+}
+
+// NewTimestampSink creates a TimestampSink in front of sink
+func NewTimestampSink(sink EventSinkInterface) *TimestampSink {
+	return &TimestampSink{sink: sink}
+}
+
+// UpdateEvents implements the EventSinkInterface
+func (t *TimestampSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	eNew = normalizeTimestamps(eNew)
+	if eOld != nil {
+		eOld = normalizeTimestamps(eOld)
+	}
+	t.sink.UpdateEvents(eNew, eOld)
+}
+
+// normalizeTimestamps returns a copy of the event with normalized timestamps
+func normalizeTimestamps(e *v1.Event) *v1.Event {
+	e = e.DeepCopy()
+	first, last, event := e.FirstTimestamp.Time, e.LastTimestamp.Time, e.EventTime.Time
+	if first.IsZero() {
+		first = last
+	}
+	if last.IsZero() {
+		last = first
+	}
+	if event.IsZero() {
+		event = last
+	}
+	if first.IsZero() {
+		first, last = event, event
+	}
+
+	if !first.IsZero() {
+		e.FirstTimestamp = metav1.NewTime(first.UTC())
+		e.LastTimestamp = metav1.NewTime(last.UTC())
+		e.EventTime = metav1.NewMicroTime(event.UTC())
+	}
+	if e.Series != nil && !e.Series.LastObservedTime.IsZero() {
+		e.Series.LastObservedTime = metav1.NewMicroTime(e.Series.LastObservedTime.UTC())
+	}
+	return e
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// The transform operations
+	transformDrop     = "drop"
+	transformRename   = "rename"
+	transformAdd      = "add"
+	transformTruncate = "truncate"
+)
+
+// TransformConfig is an operation of the transform pipeline. Field and To are
+// dotted paths in the EventData JSON, e.g. event.metadata.managedFields.
+type TransformConfig struct {
+	// Op is drop, rename (to To), add (Value) or truncate (to Length bytes)
+	Op    string      `mapstructure:"op"`
+	Field string      `mapstructure:"field"`
+	To    string      `mapstructure:"to"`
+	Value interface{} `mapstructure:"value"`
+	// Length is the length strings are truncated to, cut on a rune boundary
+	Length int `mapstructure:"length"`
+}
+
+// transformOp is a parsed TransformConfig
+type transformOp struct {
+	TransformConfig
+	field []string
+	to    []string
+}
+
+// transforms, when set, is applied to the EventData by the sinks writing it as
+// JSON, before the CloudEvents envelope. It is set by ManufactureSink.
+var transforms []transformOp
+
+// newTransforms parses the transform pipeline, failing on invalid operations
+func newTransforms(cfgs []TransformConfig) ([]transformOp, error) {
+	ops := make([]transformOp, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("transform %d has no field", i)
+		}
+		op := transformOp{TransformConfig: cfg, field: strings.Split(cfg.Field, ".")}
+		switch cfg.Op {
+		case transformDrop, transformAdd:
+		case transformRename:
+			if cfg.To == "" {
+				return nil, fmt.Errorf("transform %d renames %s to no field", i, cfg.Field)
+			}
+			op.to = strings.Split(cfg.To, ".")
+		case transformTruncate:
+			if cfg.Length <= 0 {
+				return nil, fmt.Errorf("transform %d truncates %s to invalid length %d", i, cfg.Field, cfg.Length)
+			}
+		default:
+			return nil, fmt.Errorf("invalid transform op %q, must be drop, rename, add or truncate", cfg.Op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// transformEventData returns the event data with the transforms applied, as
+// a JSON document, or the event data itself without transforms
+func transformEventData(evt EventData) interface{} {
+	if len(transforms) == 0 {
+		return evt
+	}
+	b, err := json.Marshal(evt)
+	if err != nil {
+		glog.Warningf("Failed to json serialize event: %v", err)
+		return evt
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		glog.Warningf("Failed to json deserialize event: %v", err)
+		return evt
+	}
+
+	for _, op := range transforms {
+		switch op.Op {
+		case transformDrop:
+			if parent := transformParent(doc, op.field, false); parent != nil {
+				delete(parent, op.field[len(op.field)-1])
+			}
+		case transformRename:
+			parent := transformParent(doc, op.field, false)
+			if parent == nil {
+				continue
+			}
+			v, ok := parent[op.field[len(op.field)-1]]
+			if !ok {
+				continue
+			}
+			delete(parent, op.field[len(op.field)-1])
+			if to := transformParent(doc, op.to, true); to != nil {
+				to[op.to[len(op.to)-1]] = v
+			}
+		case transformAdd:
+			if parent := transformParent(doc, op.field, true); parent != nil {
+				parent[op.field[len(op.field)-1]] = op.Value
+			}
+		case transformTruncate:
+			parent := transformParent(doc, op.field, false)
+			if parent == nil {
+				continue
+			}
+			key := op.field[len(op.field)-1]
+			if s, ok := parent[key].(string); ok && len(s) > op.Length {
+				n := op.Length
+				for n > 0 && !utf8.RuneStart(s[n]) {
+					n--
+				}
+				parent[key] = s[:n]
+			}
+		}
+	}
+	return doc
+}
+
+// transformParent returns the object holding the last element of the path,
+// creating the missing objects with create, or nil
+func transformParent(doc map[string]interface{}, path []string, create bool) map[string]interface{} {
+	for _, k := range path[:len(path)-1] {
+		next, ok := doc[k].(map[string]interface{})
+		if !ok {
+			if !create || doc[k] != nil {
+				return nil
+			}
+			next = make(map[string]interface{})
+			doc[k] = next
+		}
+		doc = next
+	}
+	return doc
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"reflect"
+	"testing"
+)
+
+// transformTestEvent returns the JSON document of the event data of a test
+// event with the transforms applied
+func transformTestEvent(t *testing.T, cfgs ...TransformConfig) map[string]interface{} {
+	t.Helper()
+	ops, err := newTransforms(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := transforms
+	transforms = ops
+	defer func() { transforms = previous }()
+
+	e := newTestEvent("web-0.1")
+	e.Message = "Back-off pulling image, retrying in 5m0s"
+	e.Annotations = map[string]string{"note": "test"}
+	doc, ok := transformEventData(NewEventData(e, nil)).(map[string]interface{})
+	if !ok {
+		t.Fatalf("Got no JSON document with the transforms %v", cfgs)
+	}
+	return doc
+}
+
+// transformField returns the value of the dotted path of the document
+func transformField(doc map[string]interface{}, path ...string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func TestTransformEventData(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		ops   []TransformConfig
+		path  []string
+		want  interface{}
+		other []string
+	}{
+		{
+			name: "drop",
+			ops:  []TransformConfig{{Op: "drop", Field: "event.metadata.annotations"}},
+			path: []string{"event", "metadata", "annotations"},
+			want: nil,
+		},
+		{
+			name:  "rename",
+			ops:   []TransformConfig{{Op: "rename", Field: "event.message", To: "msg"}},
+			path:  []string{"msg"},
+			want:  "Back-off pulling image, retrying in 5m0s",
+			other: []string{"event", "message"},
+		},
+		{
+			name:  "rename to a new object",
+			ops:   []TransformConfig{{Op: "rename", Field: "event.reason", To: "k8s.reason"}},
+			path:  []string{"k8s", "reason"},
+			want:  "Test",
+			other: []string{"event", "reason"},
+		},
+		{
+			name: "add",
+			ops:  []TransformConfig{{Op: "add", Field: "cluster", Value: "prod"}},
+			path: []string{"cluster"},
+			want: "prod",
+		},
+		{
+			name: "add to a new object",
+			ops:  []TransformConfig{{Op: "add", Field: "labels.env", Value: "prod"}},
+			path: []string{"labels", "env"},
+			want: "prod",
+		},
+		{
+			name: "add under a string",
+			ops:  []TransformConfig{{Op: "add", Field: "verb.env", Value: "prod"}},
+			path: []string{"verb"},
+			want: "ADDED",
+		},
+		{
+			name: "truncate",
+			ops:  []TransformConfig{{Op: "truncate", Field: "event.message", Length: 8}},
+			path: []string{"event", "message"},
+			want: "Back-off",
+		},
+		{
+			name: "truncate a shorter string",
+			ops:  []TransformConfig{{Op: "truncate", Field: "event.reason", Length: 8}},
+			path: []string{"event", "reason"},
+			want: "Test",
+		},
+		{
+			name: "in order",
+			ops: []TransformConfig{
+				{Op: "rename", Field: "event.message", To: "msg"},
+				{Op: "truncate", Field: "msg", Length: 4},
+				{Op: "drop", Field: "event"},
+			},
+			path:  []string{"msg"},
+			want:  "Back",
+			other: []string{"event"},
+		},
+		{
+			name: "missing fields",
+			ops: []TransformConfig{
+				{Op: "drop", Field: "event.missing.field"},
+				{Op: "rename", Field: "event.missing", To: "msg"},
+				{Op: "truncate", Field: "event.missing", Length: 1},
+			},
+			path:  []string{"event", "message"},
+			want:  "Back-off pulling image, retrying in 5m0s",
+			other: []string{"msg"},
+		},
+	} {
+		doc := transformTestEvent(t, test.ops...)
+		got, ok := transformField(doc, test.path...)
+		if test.want == nil {
+			if ok {
+				t.Errorf("Got %v with the %s transform, want it dropped", got, test.name)
+			}
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Got %v with the %s transform, want %v", got, test.name, test.want)
+		}
+		if got, ok := transformField(doc, test.other...); test.other != nil && ok {
+			t.Errorf("Got %v at %v with the %s transform, want nothing", got, test.other, test.name)
+		}
+	}
+}
+
+func TestTransformTruncatesOnARuneBoundary(t *testing.T) {
+	ops, err := newTransforms([]TransformConfig{{Op: "truncate", Field: "event.message", Length: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := transforms
+	transforms = ops
+	defer func() { transforms = previous }()
+
+	// é is 2 bytes, cut at the start of the third one
+	e := newTestEvent("a")
+	e.Message = "ééé"
+	doc := transformEventData(NewEventData(e, nil)).(map[string]interface{})
+	if got, _ := transformField(doc, "event", "message"); got != "éé" {
+		t.Errorf("Got message %q, want %q", got, "éé")
+	}
+}
+
+func TestNewTransformsErrors(t *testing.T) {
+	for name, cfg := range map[string]TransformConfig{
+		"no field":           {Op: "drop"},
+		"unknown op":         {Op: "replace", Field: "event.message"},
+		"rename to no field": {Op: "rename", Field: "event.message"},
+		"truncate to zero":   {Op: "truncate", Field: "event.message"},
+	} {
+		if _, err := newTransforms([]TransformConfig{cfg}); err == nil {
+			t.Errorf("Got no error for a transform with %s", name)
+		}
+	}
+
+	// Without transforms the event data is written as is
+	evt := NewEventData(newTestEvent("a"), nil)
+	if _, ok := transformEventData(evt).(EventData); !ok {
+		t.Errorf("Got the event data transformed without transforms")
+	}
+}
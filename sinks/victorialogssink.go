@@ -0,0 +1,226 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// VictoriaLogsConfig holds the settings of the VictoriaLogsSink
+type VictoriaLogsConfig struct {
+	// URL is the base URL of VictoriaLogs, e.g. http://victorialogs:9428
+	URL string
+
+	// StreamFields are the fields identifying a log stream
+	StreamFields []string
+
+	// AccountID and ProjectID select the tenant, empty for the default one
+	AccountID string
+	ProjectID string
+
+	Username string
+	Password string
+
+	// Fields are added to every entry, e.g. cluster=prod
+	Fields map[string]string
+
+	BatchSize int
+}
+
+/*
+VictoriaLogsSink writes events to VictoriaLogs through the JSON lines
+ingestion endpoint:
+
+POST <url>/insert/jsonline?_stream_fields=namespace,kind,reason
+
+Each event is one entry, with the message in _msg, the time of its last
+occurrence in _time and the key event fields (namespace, kind, name, reason,
+type, count, uid, source) as top level fields. The stream fields default to
+namespace, kind and reason, which keeps the number of streams low while the
+other fields stay searchable. Events buffered between two loop iterations are
+sent in gzipped requests of up to BatchSize entries.
+*/
+type VictoriaLogsSink struct {
+	cfg        VictoriaLogsConfig
+	url        string
+	httpClient *retryClient
+	eventCh    channels.Channel
+}
+
+// NewVictoriaLogsSink constructs a new VictoriaLogsSink given its config
+func NewVictoriaLogsSink(cfg VictoriaLogsConfig, overflow bool, bufferSize int) *VictoriaLogsSink {
+	params := url.Values{}
+	if len(cfg.StreamFields) > 0 {
+		params.Set("_stream_fields", strings.Join(cfg.StreamFields, ","))
+	}
+
+	v := &VictoriaLogsSink{
+		cfg: cfg,
+		url: strings.TrimSuffix(cfg.URL, "/") + "/insert/jsonline?" + params.Encode(),
+	}
+
+	v.httpClient = retryPolicy.forSink().httpClient()
+
+	if overflow {
+		v.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		v.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return v
+}
+
+// UpdateEvents implements the EventSinkInterface. It really just writes the
+// event data to the event channel, which should never block when the sink is
+// configured to discard messages.
+func (v *VictoriaLogsSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	v.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through v.eventCh, and
+// sending them to VictoriaLogs. If multiple events have happened between loop
+// iterations, they are sent BatchSize entries at a time.
+func (v *VictoriaLogsSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-v.eventCh.Out():
+			var evt EventData
+			var ok bool
+			if evt, ok = e.(EventData); !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+
+			// Start with just this event...
+			arr := []EventData{evt}
+
+			// Consume all buffered events into an array, in case more have been written
+			// since we last forwarded them
+			numEvents := v.eventCh.Len()
+			for i := 0; i < numEvents; i++ {
+				e := <-v.eventCh.Out()
+				if evt, ok = e.(EventData); ok {
+					arr = append(arr, evt)
+				} else {
+					glog.Warningf("Invalid type sent through event channel: %T", e)
+				}
+			}
+
+			inBatches(arr, v.cfg.BatchSize, v.drainEvents)
+		case <-stopCh:
+			// Send the events queued before the stop
+			inBatches(queuedEvents(v.eventCh), v.cfg.BatchSize, v.drainEvents)
+			break loop
+		}
+	}
+}
+
+// entry converts an event to a VictoriaLogs entry
+func (v *VictoriaLogsSink) entry(evt EventData) map[string]interface{} {
+	e := evt.Event
+	ts := eventTimestamp(e)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	entry := make(map[string]interface{}, len(v.cfg.Fields)+13)
+	for k, val := range v.cfg.Fields {
+		entry[k] = val
+	}
+	entry["_msg"] = e.Message
+	entry["_time"] = ts.UTC().Format(time.RFC3339Nano)
+	entry["verb"] = evt.Verb
+	entry["namespace"] = e.InvolvedObject.Namespace
+	entry["kind"] = e.InvolvedObject.Kind
+	entry["name"] = e.InvolvedObject.Name
+	entry["reason"] = e.Reason
+	entry["type"] = e.Type
+	entry["count"] = e.Count
+	entry["uid"] = string(e.UID)
+	entry["object_uid"] = string(e.InvolvedObject.UID)
+	entry["source_component"] = e.Source.Component
+	entry["source_host"] = e.Source.Host
+	return entry
+}
+
+// drainEvents sends the events with one gzipped request
+func (v *VictoriaLogsSink) drainEvents(events []EventData) {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	enc := json.NewEncoder(zw)
+	for _, evt := range events {
+		// Encode writes one JSON object per line, as the endpoint expects
+		if err := enc.Encode(v.entry(evt)); err != nil {
+			glog.Warningf("Failed to json serialize event: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		glog.Warningf("Failed to compress events: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", v.url, &body)
+	if err != nil {
+		glog.Warningf(err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/stream+json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if v.cfg.AccountID != "" {
+		req.Header.Set("AccountID", v.cfg.AccountID)
+	}
+	if v.cfg.ProjectID != "" {
+		req.Header.Set("ProjectID", v.cfg.ProjectID)
+	}
+	if v.cfg.Username != "" {
+		req.SetBasicAuth(v.cfg.Username, v.cfg.Password)
+	}
+
+	if err := v.send(req); err != nil {
+		glog.Errorf("Failed to send %d events to victorialogs: %v", len(events), err)
+		deadLetterEvents("victorialogs", events, err)
+	}
+}
+
+// send sends the request and turns non 2xx responses into errors
+func (v *VictoriaLogsSink) send(req *http.Request) error {
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/golang/glog"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WebhookConfig holds the settings of the WebhookSink
+type WebhookConfig struct {
+	// URL, Headers values and Body are Go templates executed on the
+	// EventData, e.g. {{.Event.InvolvedObject.Namespace}}
+	URL     string
+	Method  string
+	Headers map[string]string
+	Body    string
+
+	ContentType string
+
+	Filter EventFilter
+
+	// Timeout bounds each request, MaxRetries is the number of retries of
+	// failed requests and 5xx responses
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+// webhookTemplateFuncs are the functions available to the webhook templates,
+// on top of the text/template builtins
+var webhookTemplateFuncs = template.FuncMap{
+	// json encodes a value as JSON, to embed strings safely in JSON bodies
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"replace": strings.Replace,
+	// trunc shortens s to n bytes at most, for APIs limiting field sizes
+	"trunc": func(n int, s string) string {
+		if len(s) > n {
+			return s[:n]
+		}
+		return s
+	},
+	// default returns def when v is empty
+	"default": func(def, v string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	},
+	// rfc3339 formats the event timestamps, e.g. .Event.LastTimestamp
+	"rfc3339": func(v interface{}) (string, error) {
+		var t time.Time
+		switch ts := v.(type) {
+		case time.Time:
+			t = ts
+		case metav1.Time:
+			t = ts.Time
+		case metav1.MicroTime:
+			t = ts.Time
+		default:
+			return "", fmt.Errorf("rfc3339 of %T", v)
+		}
+		return t.UTC().Format(time.RFC3339), nil
+	},
+}
+
+/*
+WebhookSink sends one HTTP request per event to any API, with the URL, the
+headers and the body rendered from Go templates over the event, so chat
+tools, ticketing systems or custom services can be targeted from the config
+alone. For instance, a chat webhook could get the body:
+
+	{"text": {{json (printf "%s %s/%s: %s" .Event.Reason .Event.InvolvedObject.Namespace .Event.InvolvedObject.Name .Event.Message)}}}
+
+The templates see the EventData: .Verb, .Event and .OldEvent (nil for added
+events). On top of the text/template builtins, they may use json, upper,
+lower, replace, trunc, default and rfc3339. Only the events matching the
+filter are sent.
+*/
+type WebhookSink struct {
+	cfg        WebhookConfig
+	url        *template.Template
+	headers    map[string]*template.Template
+	body       *template.Template
+	httpClient *retryClient
+	eventCh    channels.Channel
+}
+
+// NewWebhookSink constructs a new WebhookSink given its config, failing when
+// a template doesn't parse
+func NewWebhookSink(cfg WebhookConfig, overflow bool, bufferSize int) (*WebhookSink, error) {
+	w := &WebhookSink{
+		cfg:     cfg,
+		headers: make(map[string]*template.Template, len(cfg.Headers)),
+	}
+
+	var err error
+	if w.url, err = template.New("url").Funcs(webhookTemplateFuncs).Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid webhook url template: %v", err)
+	}
+	if w.body, err = template.New("body").Funcs(webhookTemplateFuncs).Parse(cfg.Body); err != nil {
+		return nil, fmt.Errorf("invalid webhook body template: %v", err)
+	}
+	for name, value := range cfg.Headers {
+		if w.headers[name], err = template.New(name).Funcs(webhookTemplateFuncs).Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid webhook header %s template: %v", name, err)
+		}
+	}
+
+	w.httpClient = retryPolicy.forSink().withRetries(cfg.MaxRetries).httpClient()
+	w.httpClient.Timeout = cfg.Timeout
+	w.httpClient.RetryOnHTTP429 = true
+
+	if overflow {
+		w.eventCh = channels.NewOverflowingChannel(channels.BufferCap(bufferSize))
+	} else {
+		w.eventCh = channels.NewNativeChannel(channels.BufferCap(bufferSize))
+	}
+
+	return w, nil
+}
+
+// UpdateEvents implements the EventSinkInterface. Events not matching the
+// filter are dropped right away.
+func (w *WebhookSink) UpdateEvents(eNew *v1.Event, eOld *v1.Event) {
+	if !w.cfg.Filter.Matches(eNew) {
+		return
+	}
+	w.eventCh.In() <- NewEventData(eNew, eOld)
+}
+
+// Run sits in a loop, waiting for data to come in through w.eventCh, and
+// sending one request per event.
+func (w *WebhookSink) Run(stopCh <-chan bool) {
+loop:
+	for {
+		select {
+		case e := <-w.eventCh.Out():
+			evt, ok := e.(EventData)
+			if !ok {
+				glog.Warningf("Invalid type sent through event channel: %T", e)
+				continue loop
+			}
+			w.drainEvent(evt)
+		case <-stopCh:
+			// Send the events queued before the stop
+			for _, evt := range queuedEvents(w.eventCh) {
+				w.drainEvent(evt)
+			}
+			break loop
+		}
+	}
+}
+
+// drainEvent sends the event to the webhook, dead-lettering it on failure
+func (w *WebhookSink) drainEvent(evt EventData) {
+	if err := w.send(evt); err != nil {
+		glog.Errorf("Failed to send event %s/%s to the webhook: %v", evt.Event.Namespace, evt.Event.Name, err)
+		deadLetterEvents("webhook", []EventData{evt}, err)
+	}
+}
+
+// renderWebhookTemplate executes a template on the event
+func renderWebhookTemplate(tmpl *template.Template, evt EventData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, evt); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// send renders the request of the event and sends it
+func (w *WebhookSink) send(evt EventData) error {
+	u, err := renderWebhookTemplate(w.url, evt)
+	if err != nil {
+		return err
+	}
+	body, err := renderWebhookTemplate(w.body, evt)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(w.cfg.Method, strings.TrimSpace(u), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if w.cfg.ContentType != "" {
+		req.Header.Set("Content-Type", w.cfg.ContentType)
+	}
+	for name, tmpl := range w.headers {
+		value, err := renderWebhookTemplate(tmpl, evt)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got HTTP code %v: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
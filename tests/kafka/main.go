@@ -43,7 +43,15 @@ func main() {
 		log.Fatal(err)
 	}
 
-	kSink, err := sinks.NewKafkaSink(k.Brokers, k.Topic, k.Async, k.RetryMax, "user", "password")
+	kSink, err := sinks.NewKafkaSink(sinks.KafkaConfig{
+		Brokers:      k.Brokers,
+		Topic:        k.Topic,
+		Async:        k.Async,
+		RetryMax:     k.RetryMax,
+		Key:          "{name}",
+		SASLUser:     "user",
+		SASLPassword: "password",
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
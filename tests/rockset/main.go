@@ -15,9 +15,12 @@ package main
 
 import (
 	"fmt"
-	"github.com/heptiolabs/eventrouter/sinks"
+	"log"
 	"time"
 
+	"github.com/heptiolabs/eventrouter/sinks"
+	"github.com/kelseyhightower/envconfig"
+
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -25,7 +28,20 @@ import (
 	ref "k8s.io/client-go/tools/reference"
 )
 
+type RocksetEnv struct {
+	APIServer  string `default:"https://api.usw2a1.rockset.com"`
+	APIKey     string `required:"true"`
+	Workspace  string `default:"commons"`
+	Collection string `required:"true"`
+}
+
 func main() {
+	var r RocksetEnv
+	err := envconfig.Process("rockset", &r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	testPod := &v1.Pod{
 		TypeMeta: metav1.TypeMeta{
 			Kind: "Pod",
@@ -45,9 +61,22 @@ func main() {
 
 	evt := makeFakeEvent(podRef, v1.EventTypeWarning, "CreateInCluster", "Fake pod creation event")
 
-	sink := sinks.NewRocksetSink("key", "collection", "commons")
+	sink := sinks.NewRocksetSink(sinks.RocksetConfig{
+		APIServer:  r.APIServer,
+		APIKey:     r.APIKey,
+		Workspace:  r.Workspace,
+		Collection: r.Collection,
+		BatchSize:  500,
+	}, false, 10)
+
+	stopCh := make(chan bool)
+	go sink.Run(stopCh)
 
 	sink.UpdateEvents(evt, nil)
+
+	// Leave the sink the time to write the document
+	time.Sleep(5 * time.Second)
+	close(stopCh)
 }
 
 func makeFakeEvent(ref *v1.ObjectReference, eventtype, reason, message string) *v1.Event {